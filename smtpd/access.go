@@ -0,0 +1,55 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// permitted returns true if a client at addr may connect, according to the listener's allow and
+// deny lists. Deny takes precedence over allow, and an empty allow list allows everyone. Clients
+// without an IP address (e.g. on a unix socket) are always permitted
+func (l *Listener) permitted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, n := range l.deny {
+		if n.Contains(tcpAddr.IP) {
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, n := range l.allow {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuse closes a connection from a client which is not permitted, first sending a 554 greeting
+// if configured to. No InboundConnection is created, so this is cheap
+func (l *Listener) refuse(conn net.Conn) {
+	if l.denyBanner {
+		// RFC5321 3.1
+		conn.SetWriteDeadline(time.Now().Add(l.params.WriteTimeout))
+		fmt.Fprintf(conn, "554 %s %s\r\n", l.params.GreetingHostname, l.params.Messages["denied"])
+	}
+	conn.Close()
+}
+
+// parseCIDRs parses a list of CIDRs from the configuration, describing them as kind in any error
+func parseCIDRs(kind string, cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if _, n, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("Bad %s: '%s'", kind, cidr)
+		} else {
+			networks = append(networks, n)
+		}
+	}
+	return networks, nil
+}
@@ -0,0 +1,108 @@
+package smtpd
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessLists(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:   "tcp",
+		Address:    "127.0.0.1:30025",
+		AllowCIDRs: []string{"192.0.2.0/24", "2001:db8::/32"},
+		DenyCIDRs:  []string{"192.0.2.128/25", "2001:db8:bad::/48"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	for _, test := range []struct {
+		ip        string
+		permitted bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.129", false},
+		{"198.51.100.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8:bad::1", false},
+		{"2001:db9::1", false},
+		{"::ffff:192.0.2.1", true},
+	} {
+		if permitted := l.permitted(&net.TCPAddr{IP: net.ParseIP(test.ip), Port: 1234}); permitted != test.permitted {
+			t.Fatalf("Address %s permitted %v, expected %v", test.ip, permitted, test.permitted)
+		}
+	}
+	if !l.permitted(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Fatalf("Unix socket client not permitted")
+	}
+
+	// with no allow list, everything not denied is allowed
+	l, err = NewListener(newTestLogger(t), ServerConfig{
+		Protocol:  "tcp",
+		Address:   "127.0.0.1:30025",
+		DenyCIDRs: []string{"10.0.0.0/8", "fe80::/10"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	for _, test := range []struct {
+		ip        string
+		permitted bool
+	}{
+		{"10.1.2.3", false},
+		{"192.0.2.1", true},
+		{"fe80::1", false},
+		{"2001:db8::1", true},
+	} {
+		if permitted := l.permitted(&net.TCPAddr{IP: net.ParseIP(test.ip), Port: 1234}); permitted != test.permitted {
+			t.Fatalf("Address %s permitted %v, expected %v", test.ip, permitted, test.permitted)
+		}
+	}
+
+	for _, s := range []ServerConfig{
+		{Protocol: "tcp", Address: "127.0.0.1:30025", AllowCIDRs: []string{"wombat"}},
+		{Protocol: "tcp", Address: "127.0.0.1:30025", DenyCIDRs: []string{"2001:db8::/129"}},
+	} {
+		if _, err := NewListener(newTestLogger(t), s); err == nil {
+			t.Fatalf("Bad CIDR accepted: %v", s)
+		}
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+	stop := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol:   "tcp",
+		Address:    "127.0.0.1:30045",
+		Hostname:   "mx.example.com",
+		DenyCIDRs:  []string{"127.0.0.0/8"},
+		DenyBanner: true,
+	}, nil)
+	defer stop()
+
+	conn, err := dialWithRetries("127.0.0.1:30045")
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	if line, err := rd.ReadString('\n'); err != nil || line != "554 mx.example.com Error: access denied\r\n" {
+		t.Fatalf("Bad banner: %q %v", line, err)
+	}
+	if line, err := rd.ReadString('\n'); err == nil {
+		t.Fatalf("Connection not closed: %q", line)
+	}
+
+	// the allowed listener still converses normally
+	stop2 := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol:   "tcp",
+		Address:    "127.0.0.1:30046",
+		AllowCIDRs: []string{"127.0.0.0/8", "::1/128"},
+	}, nil)
+	defer stop2()
+	if err := greetAndQuit("127.0.0.1:30046"); err != nil {
+		t.Fatalf("Could not converse with listener: %v", err)
+	}
+}
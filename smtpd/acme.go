@@ -0,0 +1,186 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acmeDefaultHTTPAddress is the default address on which we answer ACME HTTP-01 challenges. The
+// CA always connects to port 80 of each hostname, so this must be reachable from the internet
+const acmeDefaultHTTPAddress = ":80"
+
+// initAcme sets up a manager which obtains and renews certificates for the configured hostnames
+// from an ACME CA (by default Let's Encrypt), caching them in the configured directory
+func (l *Listener) initAcme() error {
+	if l.tls.AcmeCacheDir == "" {
+		return errors.New("ACME requires a cache directory")
+	}
+	l.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(l.tls.AcmeCacheDir),
+		HostPolicy: autocert.HostWhitelist(l.tls.AcmeHostnames...),
+		Email:      l.tls.AcmeEmail,
+	}
+	if l.tls.AcmeDirectoryURL != "" {
+		l.acme.Client = &acme.Client{DirectoryURL: l.tls.AcmeDirectoryURL}
+	}
+	l.acmeHTTPAddress = l.tls.AcmeHTTPAddress
+	if l.acmeHTTPAddress == "" {
+		l.acmeHTTPAddress = acmeDefaultHTTPAddress
+	}
+	return nil
+}
+
+// acmeRoute is the challenge handler of a listener registered with acmeChallenges
+type acmeRoute struct {
+	handler http.Handler
+}
+
+// acmeChallenges answers ACME HTTP-01 challenges for every listener using ACME, passing each
+// request to the manager of the listener configured for the hostname requested. It is shared so
+// one HTTP server per address, bound with the listeners before privileges are dropped, serves them
+// all. If several listeners use a hostname, the one registered most recently answers; as tokens
+// are also stored in the cache, this works provided they share a cache directory
+type acmeChallenges struct {
+	mu     sync.Mutex
+	routes map[string][]*acmeRoute // by hostname, most recently registered last
+}
+
+// newAcmeChallenges returns a new acmeChallenges with no listeners registered
+func newAcmeChallenges() *acmeChallenges {
+	return &acmeChallenges{routes: make(map[string][]*acmeRoute)}
+}
+
+// register answers challenges for the hostnames given using the manager given, until the function
+// returned is called
+func (a *acmeChallenges) register(hostnames []string, m *autocert.Manager) func() {
+	route := &acmeRoute{handler: m.HTTPHandler(nil)}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, hostname := range hostnames {
+		hostname = strings.ToLower(hostname)
+		a.routes[hostname] = append(a.routes[hostname], route)
+	}
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for _, hostname := range hostnames {
+			hostname = strings.ToLower(hostname)
+			routes := a.routes[hostname][:0]
+			for _, r := range a.routes[hostname] {
+				if r != route {
+					routes = append(routes, r)
+				}
+			}
+			if len(routes) == 0 {
+				delete(a.routes, hostname)
+			} else {
+				a.routes[hostname] = routes
+			}
+		}
+	}
+}
+
+// ServeHTTP passes a request to the handler for its host. Requests for other hosts are not found
+func (a *acmeChallenges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	a.mu.Lock()
+	routes := a.routes[strings.ToLower(host)]
+	var route *acmeRoute
+	if len(routes) > 0 {
+		route = routes[len(routes)-1]
+	}
+	a.mu.Unlock()
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	route.handler.ServeHTTP(w, r)
+}
+
+// acmeHTTPAddresses returns the distinct addresses on which servers configured to use ACME answer
+// HTTP-01 challenges, in the order configured
+func (c *Config) acmeHTTPAddresses() []string {
+	addresses := []string{}
+	seen := make(map[string]bool)
+	for _, s := range c.Servers {
+		if len(s.Tls.AcmeHostnames) == 0 {
+			continue
+		}
+		address := s.Tls.AcmeHTTPAddress
+		if address == "" {
+			address = acmeDefaultHTTPAddress
+		}
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// listenAcme binds an HTTP server answering ACME HTTP-01 challenges for every listener registered
+// with challenges to the address given. It is served until ctx is done, and wg is released once it
+// has shut down. Requests for hostnames not registered are not found; other requests for a
+// registered hostname are redirected to HTTPS by the listener's autocert.Manager.HTTPHandler
+func listenAcme(ctx context.Context, wg *sync.WaitGroup, logger *log.Logger, address string, challenges *acmeChallenges) error {
+	li, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:      challenges,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	logger.Printf("[INFO] Answering ACME challenges on %s", li.Addr())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				server.Close()
+			case <-done:
+			}
+		}()
+		if err := server.Serve(li); err != http.ErrServerClosed {
+			logger.Printf("[ERROR] Could not answer ACME challenges on %s: %v", li.Addr(), err)
+		}
+		close(done)
+		logger.Printf("[INFO] Stopped answering ACME challenges on %s", li.Addr())
+	}()
+	return nil
+}
+
+// serveAcmeChallenges answers ACME HTTP-01 challenges for this listener alone until ctx is done,
+// for a listener started by StartServer, which has no shared acmeChallenges. Other HTTP requests
+// are redirected to HTTPS by autocert.Manager.HTTPHandler, whatever their hostname
+func (l *Listener) serveAcmeChallenges(ctx context.Context) {
+	server := &http.Server{
+		Addr:         l.acmeHTTPAddress,
+		Handler:      l.acme.HTTPHandler(nil),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	l.logger.Printf("[INFO] Answering ACME challenges on %s", l.acmeHTTPAddress)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		l.logger.Printf("[ERROR] Could not answer ACME challenges on %s: %v", l.acmeHTTPAddress, err)
+	}
+}
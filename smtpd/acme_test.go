@@ -0,0 +1,180 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAcmeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls:      TlsConfig{AcmeHostnames: []string{"mail.example.com"}},
+	}); err == nil {
+		t.Fatalf("Accepted ACME without a cache directory")
+	}
+
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls:      TlsConfig{AcmeHostnames: []string{"mail.example.com"}, AcmeCacheDir: dir, KeyFile: "/nonexistent"},
+	}); err == nil {
+		t.Fatalf("Accepted ACME with certificate files")
+	}
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls:      TlsConfig{AcmeHostnames: []string{"mail.example.com"}, AcmeCacheDir: dir},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	if l.acmeHTTPAddress != ":80" {
+		t.Fatalf("Wrong default ACME HTTP address: %s", l.acmeHTTPAddress)
+	}
+
+	// certificates must not be requested for other names (this fails before contacting the CA)
+	if _, err := l.tlsconfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Fatalf("Certificate requested for a name not configured")
+	}
+}
+
+func TestAcmeDebugAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "goms.conf")
+
+	testConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  tls:
+    acmehostnames: [ mail.example.com ]
+    acmecachedir: `+dir+`
+    acmehttpaddress: 127.0.0.1:30080
+debug:
+  address: 127.0.0.1:30080
+`,
+		fn, "debug server sharing the ACME address", false)
+
+	testConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  tls:
+    acmehostnames: [ mail.example.com ]
+    acmecachedir: `+dir+`
+debug:
+  address: :80
+`,
+		fn, "debug server sharing the default ACME address", false)
+
+	testConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  tls:
+    acmehostnames: [ mail.example.com ]
+    acmecachedir: `+dir+`
+    acmehttpaddress: 127.0.0.1:30080
+debug:
+  address: 127.0.0.1:30081
+`,
+		fn, "debug server on its own address", true)
+}
+
+func TestAcmeChallenges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{Servers: []ServerConfig{
+		{Tls: TlsConfig{AcmeHostnames: []string{"a.example.com"}}},
+		{Tls: TlsConfig{AcmeHostnames: []string{"b.example.com"}, AcmeHTTPAddress: ":8080"}},
+		{Tls: TlsConfig{AcmeHostnames: []string{"c.example.com"}}},
+		{},
+	}}
+	if addresses := c.acmeHTTPAddresses(); len(addresses) != 2 || addresses[0] != ":80" || addresses[1] != ":8080" {
+		t.Fatalf("Wrong ACME HTTP addresses: %q", addresses)
+	}
+
+	// each listener's token is in its own cache
+	challenges := newAcmeChallenges()
+	deregister := make(map[string]func())
+	for _, name := range []string{"a", "b"} {
+		cacheDir := filepath.Join(dir, name)
+		if err := os.Mkdir(cacheDir, 0700); err != nil {
+			t.Fatalf("Could not create cache directory: %v", err)
+		}
+		writeConfig(t, "token-"+name, filepath.Join(cacheDir, name+"+http-01"))
+		deregister[name] = challenges.register([]string{name + ".example.com"}, &autocert.Manager{Cache: autocert.DirCache(cacheDir)})
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancelFunc()
+		wg.Wait()
+	}()
+	if err := listenAcme(ctx, &wg, newTestLogger(t), "127.0.0.1:30061", challenges); err != nil {
+		t.Fatalf("Could not answer ACME challenges: %v", err)
+	}
+	for _, test := range []struct {
+		host  string
+		token string
+		code  int
+	}{
+		{"a.example.com", "a", http.StatusOK},
+		{"B.example.com:80", "b", http.StatusOK},
+		{"a.example.com", "b", http.StatusNotFound},
+		{"c.example.com", "a", http.StatusNotFound},
+	} {
+		if code, err := challengeRequest(test.host, test.token); err != nil || code != test.code {
+			t.Fatalf("Expected %d for token %s of %s, got %d: %v", test.code, test.token, test.host, code, err)
+		}
+	}
+
+	// a listener which has stopped no longer answers
+	deregister["a"]()
+	if code, err := challengeRequest("a.example.com", "a"); err != nil || code != http.StatusNotFound {
+		t.Fatalf("Expected 404 once deregistered, got %d: %v", code, err)
+	}
+	if code, err := challengeRequest("b.example.com", "b"); err != nil || code != http.StatusOK {
+		t.Fatalf("Expected 200 for the listener still registered, got %d: %v", code, err)
+	}
+}
+
+// challengeRequest requests an ACME HTTP-01 token for the host given from the server listening
+// on 127.0.0.1:30061, returning the status code
+func challengeRequest(host, token string) (int, error) {
+	req, err := http.NewRequest("GET", "http://127.0.0.1:30061/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,203 @@
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// adminRequest is a request to the admin socket. Each request is a single line of JSON
+type adminRequest struct {
+	Command string `json:"command"` // "stats", "reload", "drain", "pause" or "resume"
+}
+
+// adminResponse is the response to an admin request, which is a single line of JSON
+type adminResponse struct {
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Stats *adminStats `json:"stats,omitempty"`
+}
+
+// adminStats holds the runtime statistics returned by the stats command
+type adminStats struct {
+	Connections int64                         `json:"connections"` // sessions in progress across all listeners
+	Maintenance bool                          `json:"maintenance"` // true if new connections are refused
+	Config      string                        `json:"config"`      // SHA-256 of the configuration file loaded
+	Listeners   map[string]adminListenerStats `json:"listeners"`
+}
+
+// adminListenerStats holds the statistics for a single listener
+type adminListenerStats struct {
+	Bound         bool   `json:"bound"`
+	Active        int64  `json:"active"`         // sessions in progress
+	Accepted      uint64 `json:"accepted"`       // connections accepted since the listener started
+	WriteTimeouts uint64 `json:"write_timeouts"` // sessions ended as the client stopped reading
+	Disconnects   uint64 `json:"disconnects"`    // sessions ended by the client dropping the connection without QUIT
+}
+
+// adminServer answers requests on the admin socket
+type adminServer struct {
+	logger      *log.Logger
+	control     *Control
+	ready       *readiness
+	fingerprint string
+}
+
+// configFingerprint returns the SHA-256 of the configuration file, so it can be compared with
+// the file on disk to see whether a reload is needed. For a configuration directory, the names
+// and contents of the files read from it are hashed, so adding or removing one changes it too
+func configFingerprint(confFile string) (string, error) {
+	fragments, err := configFragments(confFile)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, fn := range fragments {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return "", err
+		}
+		if fn != confFile {
+			fmt.Fprintf(h, "%s %d\n", filepath.Base(fn), len(buf))
+		}
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listenAdmin binds the admin socket to the path given, and serves it until ctx is done. wg is
+// released once it has shut down. A stale socket left by a previous run is removed
+func listenAdmin(ctx context.Context, wg *sync.WaitGroup, logger *log.Logger, path string, control *Control, ready *readiness, fingerprint string) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return &net.OpError{Op: "listen", Net: "unix", Err: os.ErrExist}
+		}
+		os.Remove(path)
+	}
+	li, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		li.Close()
+		return err
+	}
+	a := &adminServer{
+		logger:      logger,
+		control:     control,
+		ready:       ready,
+		fingerprint: fingerprint,
+	}
+
+	logger.Printf("[INFO] Starting admin socket on %s", path)
+	var conns sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		go func() {
+			<-ctx.Done()
+			li.Close()
+		}()
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Printf("[ERROR] Admin socket failed: %v", err)
+				}
+				break
+			}
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				a.serve(ctx, conn)
+			}()
+		}
+		conns.Wait()
+		logger.Printf("[INFO] Stopped admin socket on %s", path)
+	}()
+	return nil
+}
+
+// serve answers requests on an admin connection until it is closed or ctx is done
+func (a *adminServer) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req adminRequest
+		var resp *adminResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp = &adminResponse{Error: "Bad request: " + err.Error()}
+		} else {
+			resp = a.command(req.Command)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// command runs an admin command
+func (a *adminServer) command(command string) *adminResponse {
+	switch command {
+	case "stats":
+		return &adminResponse{OK: true, Stats: a.stats()}
+	case "reload":
+		a.logger.Println("[INFO] Reload requested on admin socket")
+		a.control.Reload()
+		return &adminResponse{OK: true}
+	case "drain":
+		a.logger.Println("[INFO] Drain requested on admin socket")
+		a.control.Drain()
+		return &adminResponse{OK: true}
+	case "pause":
+		a.logger.Println("[INFO] Maintenance mode on; requested on admin socket")
+		a.control.SetMaintenance(true)
+		return &adminResponse{OK: true}
+	case "resume":
+		a.logger.Println("[INFO] Maintenance mode off; requested on admin socket")
+		a.control.SetMaintenance(false)
+		return &adminResponse{OK: true}
+	default:
+		return &adminResponse{Error: "Unknown command: " + command}
+	}
+}
+
+// stats returns the current runtime statistics
+func (a *adminServer) stats() *adminStats {
+	s := &adminStats{
+		Config:      a.fingerprint,
+		Maintenance: a.control.maintenance.On(),
+		Listeners:   make(map[string]adminListenerStats),
+	}
+	status := a.ready.status()
+	bound := a.ready.bound()
+	for name := range status.Listeners {
+		ls := adminListenerStats{}
+		if l, ok := bound[name]; ok {
+			ls.Bound = true
+			ls.Active = atomic.LoadInt64(&l.active)
+			ls.Accepted = atomic.LoadUint64(&l.accepted)
+			ls.WriteTimeouts = atomic.LoadUint64(&l.writeTimeouts)
+			ls.Disconnects = atomic.LoadUint64(&l.disconnects)
+		}
+		s.Connections += ls.Active
+		s.Listeners[name] = ls
+	}
+	return s
+}
@@ -0,0 +1,204 @@
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// adminCommand sends a command to the admin socket and returns the response
+func adminCommand(t *testing.T, conn net.Conn, rd *bufio.Reader, command string) *adminResponse {
+	if err := json.NewEncoder(conn).Encode(adminRequest{Command: command}); err != nil {
+		t.Fatalf("Could not send admin command: %v", err)
+	}
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("Could not read admin response: %v", err)
+	}
+	resp := &adminResponse{}
+	if err := json.Unmarshal(line, resp); err != nil {
+		t.Fatalf("Could not decode admin response %q: %v", line, err)
+	}
+	return resp
+}
+
+func TestAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conffn := filepath.Join(dir, "goms.conf")
+	writeConfig(t, controlTestConfig, conffn)
+	fingerprint, err := configFingerprint(conffn)
+	if err != nil {
+		t.Fatalf("Could not fingerprint configuration: %v", err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancelFunc()
+		wg.Wait()
+	}()
+
+	ready := newReadiness()
+	ready.expect("tcp:127.0.0.1:30042")
+	ready.expect("tcp:127.0.0.1:30043")
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30042",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.readiness = ready
+	defer startListener(l)()
+
+	control := &Control{
+		reload: make(chan struct{}, 1),
+		drain:  make(chan struct{}, 1),
+	}
+	socket := filepath.Join(dir, "goms.admin")
+	if err := listenAdmin(ctx, &wg, newTestLogger(t), socket, control, ready, fingerprint); err != nil {
+		t.Fatalf("Could not start admin socket: %v", err)
+	}
+
+	// hold a session open so it is counted
+	client := dialTestListener(t, "127.0.0.1:30042")
+	defer client.Close()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Could not connect to admin socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+
+	resp := adminCommand(t, conn, rd, "stats")
+	if !resp.OK || resp.Stats == nil {
+		t.Fatalf("Stats failed: %+v", resp)
+	}
+	if resp.Stats.Config != fingerprint || resp.Stats.Connections != 1 {
+		t.Fatalf("Wrong stats: %+v", resp.Stats)
+	}
+	if ls := resp.Stats.Listeners["tcp:127.0.0.1:30042"]; !ls.Bound || ls.Active != 1 || ls.Accepted != 1 {
+		t.Fatalf("Wrong listener stats: %+v", ls)
+	}
+	if ls, ok := resp.Stats.Listeners["tcp:127.0.0.1:30043"]; !ok || ls.Bound {
+		t.Fatalf("Wrong stats for unbound listener: %+v", ls)
+	}
+
+	if resp := adminCommand(t, conn, rd, "wombat"); resp.OK || resp.Error == "" {
+		t.Fatalf("Unknown command succeeded: %+v", resp)
+	}
+
+	if resp := adminCommand(t, conn, rd, "drain"); !resp.OK {
+		t.Fatalf("Drain failed: %+v", resp)
+	}
+	select {
+	case <-control.drain:
+	default:
+		t.Fatalf("Drain not requested")
+	}
+
+	if resp := adminCommand(t, conn, rd, "reload"); !resp.OK {
+		t.Fatalf("Reload failed: %+v", resp)
+	}
+	select {
+	case <-control.reload:
+	default:
+		t.Fatalf("Reload not requested")
+	}
+
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancelFunc()
+		wg.Wait()
+	}()
+
+	control := &Control{
+		reload: make(chan struct{}, 1),
+		drain:  make(chan struct{}, 1),
+	}
+	ready := newReadiness()
+	ready.expect("tcp:127.0.0.1:30052")
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30052",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.readiness = ready
+	l.SetMaintenance(&control.maintenance)
+	defer startListener(l)()
+
+	socket := filepath.Join(dir, "goms.admin")
+	if err := listenAdmin(ctx, &wg, newTestLogger(t), socket, control, ready, ""); err != nil {
+		t.Fatalf("Could not start admin socket: %v", err)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Could not connect to admin socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+
+	// a session in progress is unaffected by maintenance
+	client := dialTestListener(t, "127.0.0.1:30052")
+	defer client.Close()
+
+	if resp := adminCommand(t, conn, rd, "pause"); !resp.OK {
+		t.Fatalf("Pause failed: %+v", resp)
+	}
+	if resp := adminCommand(t, conn, rd, "stats"); !resp.OK || !resp.Stats.Maintenance {
+		t.Fatalf("Maintenance not reported: %+v", resp.Stats)
+	}
+	if _, err := smtp.Dial("127.0.0.1:30052"); err == nil {
+		t.Fatalf("Connection accepted during maintenance")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 421 || !strings.Contains(e.Msg, "try later") {
+		t.Fatalf("Expected 421 during maintenance, got %v", err)
+	}
+	if err := client.Noop(); err != nil {
+		t.Fatalf("Session in progress affected by maintenance: %v", err)
+	}
+
+	if resp := adminCommand(t, conn, rd, "resume"); !resp.OK {
+		t.Fatalf("Resume failed: %+v", resp)
+	}
+	if resp := adminCommand(t, conn, rd, "stats"); !resp.OK || resp.Stats.Maintenance {
+		t.Fatalf("Maintenance still reported: %+v", resp.Stats)
+	}
+	if err := greetAndQuit("127.0.0.1:30052"); err != nil {
+		t.Fatalf("Could not converse with listener after maintenance: %v", err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package smtpd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// aliasRule is a rule rewriting recipient addresses, matching either a literal address or a regexp
+type aliasRule struct {
+	literal string         // the address matched (if re is nil)
+	re      *regexp.Regexp // the regexp matching the whole address (nil for a literal rule)
+	rewrite string         // the address to rewrite to, which may refer to submatches of re
+}
+
+// Aliases rewrites recipient addresses before they are passed to the ITP, as an alias file would.
+// The rules are tried in order and the first to match determines the rewritten address, so a
+// catch-all rule (e.g. a regexp of ".*@example\.com") should be given last. Addresses matching no
+// rule pass through unchanged
+type Aliases struct {
+	rules []aliasRule
+}
+
+// NewAliases returns an Aliases from the configuration supplied. nil is returned if no rules
+// are configured
+func NewAliases(a []AliasConfig) (*Aliases, error) {
+	if len(a) == 0 {
+		return nil, nil
+	}
+	aliases := &Aliases{}
+	for _, rule := range a {
+		if (rule.Match == "") == (rule.Regexp == "") {
+			return nil, fmt.Errorf("Bad alias: exactly one of match and regexp must be given")
+		}
+		if rule.Match != "" {
+			match := CanonicaliseInboundAddress(rule.Match)
+			if match == nil {
+				return nil, fmt.Errorf("Bad alias address: '%s'", rule.Match)
+			}
+			if CanonicaliseInboundAddress(rule.Rewrite) == nil {
+				return nil, fmt.Errorf("Bad alias rewrite: '%s'", rule.Rewrite)
+			}
+			aliases.rules = append(aliases.rules, aliasRule{literal: match.String(), rewrite: rule.Rewrite})
+		} else {
+			// matching is case insensitive and must be of the whole address
+			re, err := regexp.Compile(`(?i)^(?:` + rule.Regexp + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("Bad alias regexp: '%s': %v", rule.Regexp, err)
+			}
+			if rule.Rewrite == "" {
+				return nil, fmt.Errorf("Bad alias rewrite: '%s'", rule.Rewrite)
+			}
+			aliases.rules = append(aliases.rules, aliasRule{re: re, rewrite: rule.Rewrite})
+		}
+	}
+	return aliases, nil
+}
+
+// Rewrite returns the address given rewritten by the first rule matching it, or the address
+// itself if none match. An error is returned if a regexp rule produces a malformed address
+func (a *Aliases) Rewrite(address *AddressString) (*AddressString, error) {
+	s := address.String()
+	for _, rule := range a.rules {
+		var rewritten string
+		if rule.re == nil {
+			if !strings.EqualFold(s, rule.literal) {
+				continue
+			}
+			rewritten = rule.rewrite
+		} else if match := rule.re.FindStringSubmatchIndex(s); match == nil {
+			continue
+		} else {
+			rewritten = string(rule.re.ExpandString(nil, rule.rewrite, s, match))
+		}
+		if r := CanonicaliseInboundAddress(rewritten); r == nil {
+			return nil, fmt.Errorf("Bad rewrite of '%s' by alias: '%s'", s, rewritten)
+		} else {
+			return r, nil
+		}
+	}
+	return address, nil
+}
@@ -0,0 +1,148 @@
+package smtpd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAliases(t *testing.T) {
+	a, err := NewAliases([]AliasConfig{
+		{Match: "Sales@Example.com", Rewrite: "team@example.com"},
+		{Regexp: `(.*)\+.*@example\.com`, Rewrite: "$1@example.com"},
+		{Regexp: `(.*)@old\.example\.org`, Rewrite: "${1}@new.example.org"},
+		{Regexp: `.*@example\.com`, Rewrite: "postmaster@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create aliases: %v", err)
+	}
+	for _, test := range []struct {
+		address   string
+		rewritten string
+	}{
+		{"sales@example.com", "team@example.com"},              // literal
+		{"SALES@EXAMPLE.COM", "team@example.com"},              // literal, case insensitive
+		{"bob+lists@example.com", "bob@example.com"},           // regexp rewrite
+		{"jane@old.example.org", "jane@new.example.org"},       // regexp rewrite
+		{"anyone@example.com", "postmaster@example.com"},       // catch-all
+		{"bob@mail.example.com", "bob@mail.example.com"},       // pass-through
+		{"jane@old.example.org.uk", "jane@old.example.org.uk"}, // regexps match the whole address
+	} {
+		if r, err := a.Rewrite(CanonicaliseInboundAddress(test.address)); err != nil || r.String() != test.rewritten {
+			t.Fatalf("Rewrite(%s) gave %v %v, expected %s", test.address, r, err, test.rewritten)
+		}
+	}
+
+	if a, err := NewAliases(nil); a != nil || err != nil {
+		t.Fatalf("Empty aliases created: %v %v", a, err)
+	}
+	for _, c := range []AliasConfig{
+		{Rewrite: "a@b"},
+		{Match: "a@b", Regexp: "a@b", Rewrite: "c@d"},
+		{Match: "a", Rewrite: "c@d"},
+		{Match: "a@b", Rewrite: "c"},
+		{Regexp: "(", Rewrite: "c@d"},
+		{Regexp: "a@b"},
+	} {
+		if _, err := NewAliases([]AliasConfig{c}); err == nil {
+			t.Fatalf("Bad alias config %v accepted", c)
+		}
+	}
+
+	if a, err := NewAliases([]AliasConfig{{Regexp: "(.*)@b", Rewrite: "$1"}}); err != nil {
+		t.Fatalf("Could not create aliases: %v", err)
+	} else if r, err := a.Rewrite(CanonicaliseInboundAddress("a@b")); err == nil {
+		t.Fatalf("Malformed rewrite gave %v", r)
+	}
+}
+
+// AliasITP records the recipients given to CheckRecipientAddress, as well as the transaction state
+type AliasITP struct {
+	StateITP
+	checked            []string
+	originalRecipients []*AddressString
+}
+
+func (i *AliasITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	i.checked = append(i.checked, address.String())
+	return nil, nil
+}
+
+func (i *AliasITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.originalRecipients = c.OriginalRecipients()
+	return i.StateITP.ProcessMail(ctx, c, data)
+}
+
+func TestAliasRewriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "goms.conf")
+	writeConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  aliases:
+  - match: sales@example.com
+    rewrite: team@example.com
+  - regexp: "(.*)\\+.*@example\\.com"
+    rewrite: "$1@example.com"
+`, fn)
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	l, err := NewListener(newTestLogger(t), c.Servers[0])
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	itp := &AliasITP{}
+	tc := newTestConnectionWithListener(t, l, itp)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	original := []string{"sales@example.com", "bob+lists@example.com", "c@d"}
+	for _, rcpt := range original {
+		if err := tc.client.Rcpt(rcpt); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Cannot write data: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Cannot close data: %v", err)
+		}
+	}
+
+	rewritten := []string{"team@example.com", "bob@example.com", "c@d"}
+	if len(itp.checked) != len(rewritten) || len(itp.recipients) != len(rewritten) || len(itp.originalRecipients) != len(original) {
+		t.Fatalf("Wrong recipients: checked %v, recipients %v, original %v", itp.checked, itp.recipients, itp.originalRecipients)
+	}
+	for i := range rewritten {
+		if itp.checked[i] != rewritten[i] || itp.recipients[i].String() != rewritten[i] || itp.originalRecipients[i].String() != original[i] {
+			t.Fatalf("Wrong recipient %d: checked %s, recipient %s, original %s", i, itp.checked[i], itp.recipients[i], itp.originalRecipients[i])
+		}
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
@@ -0,0 +1,226 @@
+package smtpd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks the credentials a client gives with AUTH (RFC4954). An ITP may implement
+// it to authenticate clients itself; a password file configured for the listener (see
+// ServerConfig.PasswordFile) takes precedence
+type Authenticator interface {
+	// Authenticate returns true if the password is correct for the identity. An error gives the
+	// client a temporary failure, so it may try again later
+	Authenticate(ctx context.Context, c *InboundConnection, identity string, password string) (bool, error)
+}
+
+// authMechanisms are the SASL mechanisms supported, as advertised in EHLO. Both carry the
+// password in the clear, so AUTH is only available once TLS is active
+var authMechanisms = []string{"PLAIN", "LOGIN"}
+
+// dummyHash is compared with the password given for an unknown identity, so the time taken
+// does not reveal which identities exist
+var dummyHash = []byte("$2a$10$ac4/.9Gd/uAr8BfYvyG3Bel2c39zHMYTXXWfoIy8LQ6WsbUNVlRIW")
+
+// PasswordFile is an Authenticator checking credentials against a file of lines of the form
+// identity:hash, where hash is a bcrypt hash (e.g. as written by htpasswd -B). Blank lines and
+// lines starting with '#' are ignored. The file is reread when it changes, so users may be added
+// without a reload
+type PasswordFile struct {
+	fn      string            // the file's path
+	mutex   sync.Mutex        // protects the following
+	modTime time.Time         // the modification time of the file when last read
+	hashes  map[string][]byte // bcrypt hashes by identity
+}
+
+// NewPasswordFile returns a new PasswordFile reading the file at fn
+func NewPasswordFile(fn string) (*PasswordFile, error) {
+	p := &PasswordFile{fn: fn}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// load reads the file if it has changed since it was last read. On error the previous contents
+// are kept. The caller must hold the mutex, unless it has the only reference
+func (p *PasswordFile) load() error {
+	fi, err := os.Stat(p.fn)
+	if err != nil {
+		return err
+	}
+	if p.hashes != nil && fi.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(p.fn)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string][]byte)
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return fmt.Errorf("Bad password file line %d in %s", i+1, p.fn)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return fmt.Errorf("Bad password hash for '%s' in %s: %v", fields[0], p.fn, err)
+		}
+		hashes[fields[0]] = []byte(fields[1])
+	}
+	p.hashes = hashes
+	p.modTime = fi.ModTime()
+	return nil
+}
+
+// Authenticate returns true if the password matches the hash for the identity
+func (p *PasswordFile) Authenticate(ctx context.Context, c *InboundConnection, identity string, password string) (bool, error) {
+	p.mutex.Lock()
+	if err := p.load(); err != nil {
+		c.logger.Printf("[WARN] Could not reload password file %s: %v", p.fn, err)
+	}
+	hash, ok := p.hashes[identity]
+	p.mutex.Unlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false, nil
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil, nil
+}
+
+// authenticator returns the Authenticator checking credentials given with AUTH, or nil if AUTH
+// is unavailable
+func (c *InboundConnection) authenticator() Authenticator {
+	if c.params.Authenticator != nil {
+		return c.params.Authenticator
+	}
+	if a, ok := c.ITP.(Authenticator); ok {
+		return a
+	}
+	return nil
+}
+
+// doAUTH implements the AUTH command (RFC4954) with the PLAIN (RFC4616) and LOGIN mechanisms
+func (c *InboundConnection) doAUTH(ctx context.Context, params []byte) (*ICResponse, error) {
+	if c.params.RequireTLS && c.tlsConn == nil {
+		// RFC3207 4
+		return NewResponse(530, c.message("5.7.0", "tlsrequired")), nil
+	}
+	a := c.authenticator()
+	if a == nil {
+		return c.notImplementedResponse(), nil
+	}
+	if c.tlsConn == nil {
+		// RFC4954 6
+		return NewResponse(538, c.message("5.7.11", "authencryption")), nil
+	}
+	if c.authIdentity != "" {
+		// RFC4954 4
+		return NewResponse(503, c.message("5.5.1", "authactive")), nil
+	}
+	if c.inTransaction {
+		// RFC4954 4
+		return NewResponse(503, c.message("5.5.1", "authintransaction")), nil
+	}
+	fields := strings.Fields(string(params))
+	if len(fields) < 1 || len(fields) > 2 {
+		return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+	}
+	var initial *string // the initial response, if given
+	if len(fields) == 2 {
+		initial = &fields[1]
+	}
+
+	var identity, password string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		response, r, err := c.authResponse(ctx, "", initial)
+		if r != nil || err != nil {
+			return r, err
+		}
+		// RFC4616 2: the authorization identity, the authentication identity and the password
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 || parts[1] == "" {
+			return NewResponse(501, c.message("5.5.2", "badsyntax")), nil
+		}
+		if parts[0] != "" && parts[0] != parts[1] {
+			// acting as another identity is not supported
+			return NewResponse(535, c.message("5.7.8", "authfailed")), nil
+		}
+		identity, password = parts[1], parts[2]
+	case "LOGIN":
+		var r *ICResponse
+		var err error
+		if identity, r, err = c.authResponse(ctx, "Username:", initial); r != nil || err != nil {
+			return r, err
+		}
+		if password, r, err = c.authResponse(ctx, "Password:", nil); r != nil || err != nil {
+			return r, err
+		}
+	default:
+		// RFC4954 4
+		return NewResponse(504, c.message("5.5.4", "badmechanism")), nil
+	}
+
+	if ok, err := a.Authenticate(ctx, c, identity, password); err != nil {
+		c.logger.Printf("[WARN] Could not authenticate %s as %s: %v", c.name, identity, err)
+		// RFC4954 6
+		return NewResponse(454, c.message("4.7.0", "authunavailable")), nil
+	} else if !ok {
+		c.logger.Printf("[INFO] Client %s failed to authenticate as %s", c.name, identity)
+		// RFC4954 6
+		return NewResponse(535, c.message("5.7.8", "authfailed")), nil
+	}
+	c.authIdentity = identity
+	c.logger.Printf("[INFO] Client %s authenticated as %s", c.name, identity)
+	// RFC4954 6
+	return NewResponse(235, "2.7.0 Authentication successful"), nil
+}
+
+// authResponse returns the client's decoded response to the challenge given: the initial response
+// given with AUTH if not nil, else the reply to a 334 challenge. If the client cancels or sends
+// bad base64, the response to send is returned instead
+func (c *InboundConnection) authResponse(ctx context.Context, challenge string, initial *string) (string, *ICResponse, error) {
+	var line string
+	if initial != nil {
+		line = *initial
+		if line == "=" {
+			// RFC4954 4, an empty initial response
+			return "", nil, nil
+		}
+	} else {
+		if err := c.Send(NewResponse(334, base64.StdEncoding.EncodeToString([]byte(challenge)))); err != nil {
+			return "", nil, err
+		}
+		cmd, err := c.Receive(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		if cmd.invalid {
+			// RFC5321 s4.5.3.1.4
+			return "", NewResponse(500, c.message("5.5.0", "linetoolong")), nil
+		}
+		line = string(cmd.buf)
+		if line == "*" {
+			// RFC4954 4
+			return "", NewResponse(501, c.message("5.0.0", "authcancelled")), nil
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		// RFC4954 4
+		return "", NewResponse(501, c.message("5.5.2", "badsyntax")), nil
+	}
+	return string(decoded), nil, nil
+}
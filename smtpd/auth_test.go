@@ -0,0 +1,278 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPasswordHash is a bcrypt hash (at the minimum cost, for speed) of "secret"
+const testPasswordHash = "$2a$04$yYFdiIFmKAkaGe.s9MORuu/qC1IwPhe08lJ1GD9XXCiLpIN8Ivx76"
+
+// writeTestPasswordFile writes a password file in dir giving the user alex the password
+// "secret", returning its path
+func writeTestPasswordFile(t *testing.T, dir string) string {
+	fn := filepath.Join(dir, "passwords")
+	writeConfig(t, "# test users\n\nalex:"+testPasswordHash+"\n", fn)
+	return fn
+}
+
+// newAuthTestConnection returns a test connection to a listener authenticating against a
+// password file, which has started TLS
+func newAuthTestConnection(t *testing.T, dir string, s ServerConfig, itp InboundTransactionProcessor) *TestConnection {
+	s.Protocol = "tcp"
+	s.Address = "127.0.0.1:30025"
+	s.PasswordFile = writeTestPasswordFile(t, dir)
+	s.Tls = TlsConfig{KeyFile: writeTestCertificate(t, dir, "mail.example.com")}
+	l, err := NewListener(newTestLogger(t), s)
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, itp)
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
+	}
+	return tc
+}
+
+// quitTLS ends a test session over TLS; Quit() would block closing TLS once the server has gone
+func quitTLS(t *testing.T, tc *TestConnection) {
+	if code, _, err := tc.client.Cmd(221, "QUIT"); err != nil {
+		t.Fatalf("Cannot send quit to server, got %d: %v", code, err)
+	}
+	tc.client = nil // don't attempt Close()
+}
+
+func TestPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := writeTestPasswordFile(t, dir)
+	p, err := NewPasswordFile(fn)
+	if err != nil {
+		t.Fatalf("Could not load password file: %v", err)
+	}
+	c, _ := newInboundConnection(nil, newTestLogger(t), nil)
+	for _, test := range []struct {
+		identity string
+		password string
+		ok       bool
+	}{
+		{"alex", "secret", true},
+		{"alex", "wrong", false},
+		{"Alex", "secret", false},
+		{"bob", "secret", false},
+	} {
+		if ok, err := p.Authenticate(context.Background(), c, test.identity, test.password); ok != test.ok || err != nil {
+			t.Fatalf("Wrong result authenticating %s with '%s': %v %v", test.identity, test.password, ok, err)
+		}
+	}
+
+	// the file is reread once it changes
+	writeConfig(t, "bob:"+testPasswordHash+"\n", fn)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(fn, future, future)
+	if ok, _ := p.Authenticate(context.Background(), c, "bob", "secret"); !ok {
+		t.Fatalf("Password file not reread")
+	}
+	if ok, _ := p.Authenticate(context.Background(), c, "alex", "secret"); ok {
+		t.Fatalf("Removed user still authenticated")
+	}
+
+	for _, contents := range []string{"alex", ":" + testPasswordHash, "alex:plaintext"} {
+		writeConfig(t, contents+"\n", fn)
+		if _, err := NewPasswordFile(fn); err == nil {
+			t.Fatalf("Accepted bad password file %q", contents)
+		}
+	}
+	if _, err := NewPasswordFile(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("Accepted missing password file")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tc := newAuthTestConnection(t, dir, ServerConfig{}, nil)
+	defer tc.Close()
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	for _, test := range []struct {
+		lines []string // command and responses to challenges
+		code  int      // final response code
+	}{
+		{[]string{"AUTH PLAIN " + encode("\x00alex\x00wrong")}, 535},
+		{[]string{"AUTH PLAIN " + encode("bob\x00alex\x00secret")}, 535},
+		{[]string{"AUTH PLAIN !!!"}, 501},
+		{[]string{"AUTH PLAIN " + encode("alex\x00secret")}, 501},
+		{[]string{"AUTH PLAIN", "*"}, 501},
+		{[]string{"AUTH LOGIN", encode("alex"), encode("wrong")}, 535},
+		{[]string{"AUTH CRAM-MD5"}, 504},
+		{[]string{"AUTH"}, 501},
+		{[]string{"AUTH LOGIN " + encode("alex"), encode("secret")}, 235},
+		{[]string{"AUTH PLAIN " + encode("\x00alex\x00secret")}, 503},
+	} {
+		for i, line := range test.lines {
+			code, _, _ := tc.client.Cmd(0, "%s", line)
+			if i < len(test.lines)-1 && code != 334 {
+				t.Fatalf("Expected 334 for '%s' in %q, got %d", line, test.lines, code)
+			} else if i == len(test.lines)-1 && code != test.code {
+				t.Fatalf("Expected %d for %q, got %d", test.code, test.lines, code)
+			}
+		}
+	}
+	if tc.ic.AuthIdentity() != "alex" {
+		t.Fatalf("Wrong identity: '%s'", tc.ic.AuthIdentity())
+	}
+
+	// AUTH may not be given in a transaction
+	if err := tc.client.Mail("alex@example.com"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if code, _, err := tc.client.Cmd(503, "AUTH PLAIN %s", encode("\x00alex\x00secret")); err != nil {
+		t.Fatalf("Expected 503 for AUTH in a transaction, got %d: %v", code, err)
+	}
+	quitTLS(t, tc)
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:     "tcp",
+		Address:      "127.0.0.1:30025",
+		PasswordFile: writeTestPasswordFile(t, dir),
+		Tls:          TlsConfig{KeyFile: writeTestCertificate(t, dir, "mail.example.com")},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if ok, _ := tc.client.Extension("AUTH"); ok {
+		t.Fatalf("AUTH advertised before STARTTLS")
+	}
+	if code, msg, err := tc.client.Cmd(235, "AUTH PLAIN AGFsZXgAc2VjcmV0"); err == nil || code != 538 || !strings.HasPrefix(msg, "5.7.11 ") {
+		t.Fatalf("Expected 538 5.7.11 for AUTH before STARTTLS, got %d %s: %v", code, msg, err)
+	}
+	if _, msg, err := tc.client.Cmd(214, "HELP"); err != nil || strings.Contains(msg, "AUTH") {
+		t.Fatalf("HELP lists AUTH before STARTTLS: %s %v", msg, err)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	}
+	tc.client = nil // don't attempt Close()
+}
+
+// AuthenticatorITP authenticates any identity whose password is its name reversed
+type AuthenticatorITP struct {
+	DummyITP
+}
+
+func (i *AuthenticatorITP) Authenticate(ctx context.Context, c *InboundConnection, identity string, password string) (bool, error) {
+	reversed := []byte(identity)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	return password == string(reversed), nil
+}
+
+func TestAuthITP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tlsConfig := TlsConfig{KeyFile: writeTestCertificate(t, dir, "mail.example.com")}
+
+	// a submission server needs TLS to authenticate clients
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:     "tcp",
+		Address:      "127.0.0.1:30025",
+		Mode:         "submission",
+		PasswordFile: writeTestPasswordFile(t, dir),
+	}); err == nil {
+		t.Fatalf("Accepted submission server without TLS")
+	}
+
+	// and some way to check their credentials when it starts, which may be an ITP set after
+	// the listener is created
+	for _, itp := range []InboundTransactionProcessor{nil, &SinkITP{}, &AuthenticatorITP{}} {
+		l, err := NewListener(newTestLogger(t), ServerConfig{
+			Protocol: "tcp",
+			Address:  "127.0.0.1:30025",
+			Mode:     "submission",
+			Tls:      tlsConfig,
+		})
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		if itp != nil {
+			l.SetITP(itp)
+		}
+		_, authenticates := itp.(Authenticator)
+		if err := l.checkAuth(); authenticates && err != nil {
+			t.Fatalf("Rejected submission server with an ITP authenticating clients: %v", err)
+		} else if !authenticates && err == nil {
+			t.Fatalf("Accepted submission server which cannot authenticate clients with ITP %T", itp)
+		}
+	}
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Mode:     "submission",
+		Tls:      tlsConfig,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.SetITP(&AuthenticatorITP{})
+	tc := newTestConnectionWithListener(t, l, l.itp)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
+	}
+	if err := tc.client.Auth(smtp.PlainAuth("", "alex", "xela", "localhost")); err != nil {
+		t.Fatalf("Cannot authenticate: %v", err)
+	}
+	if err := tc.client.Mail("alex@example.com"); err != nil {
+		t.Fatalf("MAIL rejected after authentication: %v", err)
+	}
+	quitTLS(t, tc)
+}
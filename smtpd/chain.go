@@ -0,0 +1,111 @@
+package smtpd
+
+import (
+	"context"
+)
+
+// ChainITP is an InboundTransactionProcessor which composes several, e.g. rate limiting, then an
+// RBL check, then greylisting, then relay policy, then delivery. Each check is passed to the
+// processors in order until one rejects it (returns an error, or an error response), which
+// determines the outcome; later processors are not consulted. If none rejects it, the last
+// non-nil response given (if any) is returned.
+//
+// Only the last processor delivers mail, i.e. is passed ProcessMail, unless DeliverAll is set, in
+// which case every processor is, in order, until one rejects the message. Processors earlier in
+// the chain than one rejecting a message may then already have delivered it.
+//
+// The optional interfaces DataOwner, ResourceChecker and ConnectionCloser are passed to the
+// processors implementing them. QueueRunner is not, as ETRN is only advertised to clients if the
+// ITP implements it; a QueueRunner should be wrapped to give a chain supporting ETRN
+type ChainITP struct {
+	Processors []InboundTransactionProcessor // the processors, in the order consulted
+	DeliverAll bool                          // pass each message to every processor, rather than only the last
+}
+
+// NewChainITP returns a ChainITP consulting the processors given in order, the last of which
+// delivers mail
+func NewChainITP(processors ...InboundTransactionProcessor) *ChainITP {
+	return &ChainITP{Processors: processors}
+}
+
+// run calls check for each processor given in turn until one rejects
+func (i *ChainITP) run(processors []InboundTransactionProcessor, check func(p InboundTransactionProcessor) (*ICResponse, error)) (*ICResponse, error) {
+	var response *ICResponse
+	for _, p := range processors {
+		r, err := check(p)
+		if err != nil || r != nil && r.IsError() {
+			return r, err
+		}
+		if r != nil {
+			response = r
+		}
+	}
+	return response, nil
+}
+
+// delivering returns the processors passed ProcessMail
+func (i *ChainITP) delivering() []InboundTransactionProcessor {
+	if i.DeliverAll || len(i.Processors) == 0 {
+		return i.Processors
+	}
+	return i.Processors[len(i.Processors)-1:]
+}
+
+// CheckConnection passes the check to each processor in turn
+func (i *ChainITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	return i.run(i.Processors, func(p InboundTransactionProcessor) (*ICResponse, error) {
+		return p.CheckConnection(ctx, c)
+	})
+}
+
+// CheckFromAddress passes the check to each processor in turn
+func (i *ChainITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return i.run(i.Processors, func(p InboundTransactionProcessor) (*ICResponse, error) {
+		return p.CheckFromAddress(ctx, c, address)
+	})
+}
+
+// CheckRecipientAddress passes the check to each processor in turn
+func (i *ChainITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return i.run(i.Processors, func(p InboundTransactionProcessor) (*ICResponse, error) {
+		return p.CheckRecipientAddress(ctx, c, address)
+	})
+}
+
+// ProcessMail passes the mail to the last processor, or if DeliverAll is set to each in turn
+func (i *ChainITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	return i.run(i.delivering(), func(p InboundTransactionProcessor) (*ICResponse, error) {
+		return p.ProcessMail(ctx, c, data)
+	})
+}
+
+// OwnsData returns true if any processor passed the mail owns the buffer (see DataOwner). Those
+// which do not will not retain it, so it may be handed over to those which do
+func (i *ChainITP) OwnsData() bool {
+	for _, p := range i.delivering() {
+		if o, ok := p.(DataOwner); ok && o.OwnsData() {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckResources passes the check to each processor implementing ResourceChecker in turn
+func (i *ChainITP) CheckResources(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	return i.run(i.Processors, func(p InboundTransactionProcessor) (*ICResponse, error) {
+		if checker, ok := p.(ResourceChecker); ok {
+			return checker.CheckResources(ctx, c)
+		}
+		return nil, nil
+	})
+}
+
+// ConnectionClosed informs each processor implementing ConnectionCloser that the connection has
+// closed
+func (i *ChainITP) ConnectionClosed(c *InboundConnection) {
+	for _, p := range i.Processors {
+		if closer, ok := p.(ConnectionCloser); ok {
+			closer.ConnectionClosed(c)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// ChainedITP records the calls made to it in a log shared with the rest of a chain, and rejects
+// the phases given
+type ChainedITP struct {
+	name     string
+	calls    *[]string
+	reject   map[string]*ICResponse
+	err      map[string]error
+	response *ICResponse
+	owns     bool
+}
+
+func (i *ChainedITP) respond(phase string) (*ICResponse, error) {
+	*i.calls = append(*i.calls, i.name+":"+phase)
+	if err := i.err[phase]; err != nil {
+		return nil, err
+	}
+	if r := i.reject[phase]; r != nil {
+		return r, nil
+	}
+	return i.response, nil
+}
+
+func (i *ChainedITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	return i.respond("connect")
+}
+
+func (i *ChainedITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return i.respond("mail")
+}
+
+func (i *ChainedITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return i.respond("rcpt")
+}
+
+func (i *ChainedITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	return i.respond("data")
+}
+
+func (i *ChainedITP) CheckResources(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	return i.respond("resources")
+}
+
+func (i *ChainedITP) ConnectionClosed(c *InboundConnection) {
+	i.respond("closed")
+}
+
+func (i *ChainedITP) OwnsData() bool {
+	return i.owns
+}
+
+func TestChainITPOrder(t *testing.T) {
+	calls := []string{}
+	first := &ChainedITP{name: "first", calls: &calls, response: NewResponse(250, "2.1.0 first")}
+	second := &ChainedITP{name: "second", calls: &calls}
+	last := &ChainedITP{name: "last", calls: &calls, response: NewResponse(250, "2.0.0 queued as last")}
+	chain := NewChainITP(first, second, last)
+	ctx := context.Background()
+	address := AddressString("a@b")
+
+	// the last response given is returned
+	if r, err := chain.CheckConnection(ctx, nil); err != nil || r != last.response {
+		t.Fatalf("Wrong response to CheckConnection: %v %v", r, err)
+	}
+	if r, err := chain.CheckFromAddress(ctx, nil, &address); err != nil || r != last.response {
+		t.Fatalf("Wrong response to CheckFromAddress: %v %v", r, err)
+	}
+	if r, err := chain.CheckRecipientAddress(ctx, nil, &address); err != nil || r != last.response {
+		t.Fatalf("Wrong response to CheckRecipientAddress: %v %v", r, err)
+	}
+	if r, err := chain.CheckResources(ctx, nil); err != nil || r != last.response {
+		t.Fatalf("Wrong response to CheckResources: %v %v", r, err)
+	}
+	// only the last processor delivers
+	if r, err := chain.ProcessMail(ctx, nil, nil); err != nil || r != last.response {
+		t.Fatalf("Wrong response to ProcessMail: %v %v", r, err)
+	}
+	chain.ConnectionClosed(nil)
+	expected := "first:connect second:connect last:connect first:mail second:mail last:mail " +
+		"first:rcpt second:rcpt last:rcpt first:resources second:resources last:resources last:data " +
+		"first:closed second:closed last:closed"
+	if strings.Join(calls, " ") != expected {
+		t.Fatalf("Wrong calls: %s", strings.Join(calls, " "))
+	}
+
+	// unless every processor is to
+	calls = calls[:0]
+	chain.DeliverAll = true
+	if r, err := chain.ProcessMail(ctx, nil, nil); err != nil || r != last.response {
+		t.Fatalf("Wrong response to ProcessMail: %v %v", r, err)
+	}
+	if strings.Join(calls, " ") != "first:data second:data last:data" {
+		t.Fatalf("Wrong calls: %s", strings.Join(calls, " "))
+	}
+
+	// an empty chain accepts everything
+	if r, err := NewChainITP().ProcessMail(ctx, nil, nil); err != nil || r != nil {
+		t.Fatalf("Wrong response from empty chain: %v %v", r, err)
+	}
+}
+
+func TestChainITPShortCircuit(t *testing.T) {
+	calls := []string{}
+	rejection := NewResponse(554, "5.7.1 listed")
+	failure := errors.New("greylist database unavailable")
+	first := &ChainedITP{name: "first", calls: &calls, response: NewResponse(250, "2.1.0 first")}
+	second := &ChainedITP{
+		name:   "second",
+		calls:  &calls,
+		reject: map[string]*ICResponse{"connect": rejection, "data": rejection},
+		err:    map[string]error{"rcpt": failure},
+	}
+	last := &ChainedITP{name: "last", calls: &calls}
+	chain := &ChainITP{Processors: []InboundTransactionProcessor{first, second, last}, DeliverAll: true}
+	ctx := context.Background()
+	address := AddressString("a@b")
+
+	if r, err := chain.CheckConnection(ctx, nil); err != nil || r != rejection {
+		t.Fatalf("Wrong response to CheckConnection: %v %v", r, err)
+	}
+	if r, err := chain.CheckFromAddress(ctx, nil, &address); err != nil || r != first.response {
+		t.Fatalf("Wrong response to CheckFromAddress: %v %v", r, err)
+	}
+	if _, err := chain.CheckRecipientAddress(ctx, nil, &address); err != failure {
+		t.Fatalf("Wrong error from CheckRecipientAddress: %v", err)
+	}
+	if r, err := chain.ProcessMail(ctx, nil, nil); err != nil || r != rejection {
+		t.Fatalf("Wrong response to ProcessMail: %v %v", r, err)
+	}
+	expected := "first:connect second:connect first:mail second:mail last:mail " +
+		"first:rcpt second:rcpt first:data second:data"
+	if strings.Join(calls, " ") != expected {
+		t.Fatalf("Wrong calls: %s", strings.Join(calls, " "))
+	}
+}
+
+func TestChainITPOwnsData(t *testing.T) {
+	calls := []string{}
+	owner := &ChainedITP{name: "owner", calls: &calls, owns: true}
+	other := &ChainedITP{name: "other", calls: &calls}
+	if NewChainITP(owner, other).OwnsData() {
+		t.Fatalf("Chain owns data not delivered to its owner")
+	}
+	if !NewChainITP(other, owner).OwnsData() {
+		t.Fatalf("Chain does not own data delivered to its owner")
+	}
+	if !(&ChainITP{Processors: []InboundTransactionProcessor{owner, other}, DeliverAll: true}).OwnsData() {
+		t.Fatalf("Chain does not own data delivered to its owner")
+	}
+}
@@ -0,0 +1,43 @@
+package smtpd
+
+import (
+	"time"
+)
+
+// Clock is a source of the current time, whose timers enforce timeouts. The real clock is used
+// unless another is set (see Listener.SetClock), which allows timeouts to be tested
+// deterministically
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer started by a Clock, which sends the current time on C once it expires. It
+// should be stopped if it is no longer needed before then, so it is not retained until it fires
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is a Clock which uses the system time
+type realClock struct{}
+
+// Now returns the current time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a timer which expires after the duration given
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// realTimer is a Timer using the system time
+type realTimer struct {
+	*time.Timer
+}
+
+// C returns the channel on which the time is sent when the timer expires
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
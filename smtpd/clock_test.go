@@ -0,0 +1,172 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only changes when advanced
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+// fakeTimer is a Timer returned by NewTimer, awaiting the clock reaching a time
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	ch    chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) Timer {
+	f.Lock()
+	defer f.Unlock()
+	t := &fakeTimer{clock: f, when: f.now.Add(d), ch: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, t)
+	return t
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop stops the timer firing, returning false if it has already fired or been stopped
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.Lock()
+	defer f.Unlock()
+	for i, w := range f.waiters {
+		if w == t {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// awaitTimer waits until a timer expiring d from now is waiting on the clock, so that advancing
+// the clock by d fires it
+func (f *fakeClock) awaitTimer(t *testing.T, d time.Duration) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		f.Lock()
+		for _, w := range f.waiters {
+			if w.when.Equal(f.now.Add(d)) {
+				f.Unlock()
+				return
+			}
+		}
+		f.Unlock()
+	}
+	t.Fatalf("No timer started for %v", d)
+}
+
+// Advance moves the clock forward, firing any timers that are due
+func (f *fakeClock) Advance(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.now = f.now.Add(d)
+	waiting := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.when.After(f.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- f.now
+		}
+	}
+	f.waiters = waiting
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	timer := clock.NewTimer(time.Minute)
+	clock.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatalf("Timer fired early")
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatalf("Timer did not fire")
+	}
+	if timer.Stop() {
+		t.Fatalf("Stopped a timer which had fired")
+	}
+
+	// a stopped timer never fires
+	timer = clock.NewTimer(time.Minute)
+	if !timer.Stop() {
+		t.Fatalf("Could not stop timer")
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatalf("Stopped timer fired")
+	default:
+	}
+}
+
+func TestIdleTimeoutFakeClock(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	clock := newFakeClock(time.Now())
+	l.SetClock(clock)
+
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	cc.SetDeadline(time.Now().Add(5 * time.Second))
+	ic, _ := newInboundConnection(l, newTestLogger(t), sc)
+
+	done := make(chan struct{})
+	go func() {
+		ic.Serve(context.Background())
+		close(done)
+	}()
+
+	client, err := smtp.NewClient(cc, "localhost")
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	defer client.Close()
+
+	// the (default) 30 second idle timeout follows the clock alone, however long we wait
+	clock.awaitTimer(t, ic.params.IdleTimeout)
+	clock.Advance(ic.params.IdleTimeout - time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if err := client.Noop(); err != nil {
+		t.Fatalf("Connection closed before the idle timeout: %v", err)
+	}
+
+	clock.awaitTimer(t, ic.params.IdleTimeout)
+	clock.Advance(ic.params.IdleTimeout)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Idle timeout did not close the connection")
+	}
+	if err := client.Noop(); err == nil {
+		t.Fatalf("Connection still open after idle timeout")
+	}
+}
@@ -8,6 +8,12 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /* Example configuration:
@@ -15,18 +21,77 @@ import (
 servers:
 - protocol: tcp
   address: 127.0.0.1:25
+  hostname: mx.example.com
+  maxmessagesize: 10485760
+  greetingdelay: 5s
+  messages:
+    toobig: "Error: message too big, see https://example.com/abuse"
+  filters:
+    senders:
+      domains: [ spammer.net, "*.spammer.org" ]
+    recipients:
+      domains: [ "*.internal.example.com" ]
+      code: 550
+      message: "5.7.1 Error: not routed from outside"
+    headers:
+      required: [ From, Date, Message-ID ]
+      forbidden: [ X-Spam-Flag ]
+  aliases:
+  - match: sales@example.com
+    rewrite: team@example.com
+  - regexp: "(.*)\\+.*@example\\.com"
+    rewrite: "$1@example.com"
+  - regexp: ".*@example\\.com"
+    rewrite: postmaster@example.com
+- protocol: tcp
+  address: 127.0.0.1:587
+  mode: submission
+  passwordfile: /etc/goms/passwords
+  tls:
+    keyfile: /etc/goms/key.pem
+    certfile: /etc/goms/cert.pem
+  disabledverbs: [ VRFY, EXPN, ETRN ]
+- protocol: tcp6
+  address: "[fe80::1%eth0]:25"
 - protocol: unix
   address: /var/run/goms.sock
+  sink:
+    phase: connect
+    code: 554
+    message: "5.7.1 Error: go away"
+- protocol: tcp
+  address: 127.0.0.1:2525
+  handler: proxy
+  handlerparams:
+    address: 127.0.0.1:10025
+    timeout: 1m
 logging:
   syslogfacility: local1
+messagelog:
+  file: /var/log/goms/messages.json
+debug:
+  address: 127.0.0.1:8080
+admin:
+  socket: /var/run/goms.admin
+draintimeout: 5m
+shutdowntimeout: 30s
+maintenance: false
+runasuser: goms
+runasgroup: goms
+chroot: /var/spool/goms
+
+The configuration may instead be split into fragments in a directory (e.g. /etc/goms.d), by
+giving the directory's path with -c. Its *.conf and *.yaml files are read in lexical order, and
+their servers combined, so a drop-in file such as 50-submission.conf may add a listener. Any other
+section (logging, debug, admin and so on) may be set by only one fragment.
 */
 
 // Location of the config file on disk; overriden by flags
-var configFile = flag.String("c", "/etc/goms.conf", "Path to YAML config file")
+var configFile = flag.String("c", "/etc/goms.conf", "Path to YAML config file, or directory of config files")
 var pidFile = flag.String("p", "/var/run/goms.pid", "Path to PID file")
-var sendSignal = flag.String("s", "", "Send signal to daemon (either \"stop\" or \"reload\")")
+var sendSignal = flag.String("s", "", "Send signal to daemon (either \"stop\", \"reload\" or \"drain\")")
 var foreground = flag.Bool("f", false, "Run in foreground (not as daemon)")
-var pprof = flag.Bool("pprof", false, "Run pprof")
+var pprof = flag.Bool("pprof", false, "Enable memory profiling (served by the debug server)")
 
 const (
 	ENV_CONFFILE = "_GOMS_CONFFILE"
@@ -52,35 +117,241 @@ var tlsClientAuthMap = map[string]tls.ClientAuthType{
 	"requireverify": tls.RequireAndVerifyClientCert,
 }
 
-// Config holds the config that applies to all servers (currently just logging), and an array of server configs
+// Config holds the config that applies to all servers (logging, the debug server and the admin socket), and an array of server configs
 type Config struct {
-	Servers []ServerConfig // array of server configs
-	Logging LogConfig      // Configuration for logging
+	Servers    []ServerConfig   // array of server configs
+	Logging    LogConfig        // Configuration for logging
+	Debug      DebugConfig      // Configuration for the debug HTTP server
+	Admin      AdminConfig      // Configuration for the admin socket
+	MessageLog MessageLogConfig // Configuration for the message log (an audit trail of each message)
+
+	// DrainTimeout gives the maximum time to wait for sessions to finish when draining (see
+	// Control.Drain), e.g. "5m", after which any still running are closed. If blank, draining
+	// waits for them indefinitely
+	DrainTimeout string
+
+	// ShutdownTimeout gives the maximum time to wait for sessions to finish once they have been
+	// told to close on shutdown (including after draining), e.g. "1m", after which their
+	// connections are closed and the process exits regardless, so a hung ITP cannot stop it.
+	// The default is 30s
+	ShutdownTimeout string
+
+	// RunAsUser and RunAsGroup give the user and group (names or IDs) to switch to once the
+	// listeners are bound and the log files opened, so goms can start as root to bind port 25.
+	// If only the user is given, its primary group is used. Anything bound later, such as
+	// listeners or ACME HTTP-01 addresses added on reload, is bound as this user
+	RunAsUser  string
+	RunAsGroup string
+
+	// Chroot gives a directory to change root to at the same point, before privileges are
+	// dropped. File-based ITPs then operate within it. Certificates and the configuration are
+	// read before the change of root, but must be present at the same paths within it to be
+	// reloaded; likewise the PID file, which is written before daemonizing, is only removed on
+	// exit if reachable at its path within the chroot. Changing user, group or root on reload
+	// has no effect
+	Chroot string
+
+	// Maintenance refuses every new connection with a 421, so senders retry later, whilst keeping
+	// the listeners up. It may also be turned on and off with the admin socket, until the next reload
+	Maintenance bool
+}
+
+// AdminConfig has the configuration for the admin socket, a unix socket accepting JSON commands
+// (one per line) to query runtime statistics ("stats"), reload the configuration ("reload"), shut
+// down once sessions have finished ("drain"), or turn maintenance mode on ("pause") or off ("resume")
+type AdminConfig struct {
+	Socket string // path of the socket (blank to disable)
+}
+
+// DebugConfig has the configuration for the debug HTTP server, which serves pprof and the
+// /healthz (liveness) and /readyz (readiness) endpoints
+type DebugConfig struct {
+	Address string // address to listen on, e.g. 127.0.0.1:8080 (blank to disable)
 }
 
 // ServerConfig holds the config that applies to each server (i.e. listener)
 type ServerConfig struct {
-	Protocol        string    // protocol it should listen on (in net.Conn form)
-	Address         string    // address to listen on
-	DefaultExport   string    // name of default export
-	Tls             TlsConfig // TLS configuration
-	DisableNoZeroes bool      // Disable NoZereos extension
+	Protocol                   string            // protocol it should listen on: tcp (the default), tcp4, tcp6 or unix
+	Mode                       string            // "mx" (the default) or "submission" (RFC6409; requires authentication)
+	PasswordFile               string            // file of identity:bcrypt-hash lines checking the credentials given with AUTH (after STARTTLS)
+	AddMissingHeaders          bool              // add Message-ID and Date headers to messages lacking them (submission mode only)
+	Address                    string            // address to listen on (an IPv6 address may give a zone, e.g. [fe80::1%eth0]:25)
+	Hostname                   string            // hostname given in the greeting and EHLO response (default localhost)
+	MaxMessageSize             *int              // maximum message size in bytes (default 20MiB; 0 for no fixed maximum)
+	IdleTimeout                string            // time to wait for a command before closing the connection (default 30s)
+	ReadTimeout                string            // time to wait for message data (default 15s)
+	WriteTimeout               string            // time to wait when sending a response (default 15s)
+	RequireTLS                 bool              // reject MAIL until the client has issued STARTTLS (RFC3207)
+	Tls                        TlsConfig         // TLS configuration
+	Sink                       SinkConfig        // configuration for sink mode (responds with a fixed code)
+	Proxy                      ProxyConfig       // configuration for proxy mode (relays transactions upstream)
+	ReusePort                  bool              // use SO_REUSEPORT to bind one listener per accept goroutine
+	AcceptGoroutines           int               // number of goroutines accepting connections (default 1)
+	ReadBufferSize             int               // SO_RCVBUF for each connection in bytes (0 for the OS default; advisory, as the OS may clamp it)
+	WriteBufferSize            int               // SO_SNDBUF for each connection in bytes (0 for the OS default; advisory, as the OS may clamp it)
+	QueueDepth                 int               // depth of the queue of messages awaiting processing (0 to disable the queue)
+	QueueWorkers               int               // number of workers processing the queue (default 1)
+	DisableESMTP               bool              // present a plain SMTP (HELO only) server which rejects EHLO
+	DisableEnhancedStatusCodes bool              // omit RFC3463 enhanced status codes from responses (for ancient clients)
+	GreetingDelay              string            // pause before the greeting, rejecting clients that talk first (e.g. "5s")
+	ParseHeaders               bool              // parse the headers of each message for the ITP (see InboundConnection.Headers)
+	MaxHeaderLines             int               // reject messages with more header lines than this (requires ParseHeaders; 0 for no limit)
+	MaxHeaderBytes             int               // reject messages whose header section is larger than this (requires ParseHeaders; 0 for no limit)
+	AllowNoRecipients          bool              // accept DATA after every recipient was rejected, e.g. to capture spam for a trap
+	DeferRecipientRejection    bool              // accept every RCPT, rejecting at DATA if any recipient was refused (against address harvesting)
+	Messages                   map[string]string // override rejection texts, keyed by identifier (see messages.go)
+	ReverseDNS                 bool              // look up the client's hostname with forward-confirmed reverse DNS
+	ReverseDNSTimeout          string            // maximum time to spend on reverse DNS (default 5s)
+	ReverseDNSStrict           bool              // reject clients without forward-confirmed reverse DNS
+	ReverseDNSExempt           []string          // CIDRs exempt from strict reverse DNS checking (e.g. internal relays)
+	AllowCIDRs                 []string          // CIDRs allowed to connect (empty to allow all); checked before the ITP
+	DenyCIDRs                  []string          // CIDRs whose connections are closed immediately (takes precedence over AllowCIDRs)
+	DenyBanner                 bool              // send denied clients a 554 greeting before closing (see the "denied" message)
+	DisabledVerbs              []string          // commands to refuse with 502 regardless of ITP support, e.g. VRFY, EXPN or ETRN
+	SuppressCapabilities       []string          // EHLO capabilities not to advertise (though still supported) for clients they confuse, e.g. PIPELINING
+	XForwardCIDRs              []string          // CIDRs of relays (e.g. Postfix) trusted to give the original client with XFORWARD
+	Transcript                 bool              // log every command and response line at trace level, redacting AUTH credentials
+	DeliverByMinimum           string            // minimum by-time for DELIVERBY (RFC2852), advertised and enforced for returns, e.g. "10m" (default none)
+	DeliverByMaximum           string            // reject BY parameters with a longer by-time, e.g. "24h" (default no limit)
+	Filters                    FiltersConfig     // configuration for the built-in envelope filters
+	Aliases                    []AliasConfig     // rules rewriting recipients before the ITP, tried in order
+
+	// Handler names the ITP to use (see RegisterHandler), e.g. sink or proxy, configured by
+	// HandlerParams, e.g. phase for sink or address for proxy. It may not be combined with Sink
+	// or Proxy. Listener.SetITP replaces the ITP it gives
+	Handler       string
+	HandlerParams DriverParametersConfig
+}
+
+// AliasConfig has the configuration for a rule rewriting recipient addresses. Exactly one of Match
+// and Regexp must be given
+type AliasConfig struct {
+	Match   string // address to rewrite (case insensitive)
+	Regexp  string // regexp matching the whole address to rewrite (case insensitive)
+	Rewrite string // address to rewrite to, which may refer to submatches of Regexp (e.g. $1)
+}
+
+// FiltersConfig has the configuration for the built-in envelope filters, which reject senders and
+// recipients in blocked domains before the ITP sees them
+type FiltersConfig struct {
+	Senders    DomainFilterConfig // sender domains to block
+	Recipients DomainFilterConfig // recipient domains to block
+	Headers    HeaderPolicyConfig // headers each message must, or must not, have
+}
+
+// HeaderPolicyConfig has the configuration for rejecting messages by the headers they have, once
+// they have been received
+type HeaderPolicyConfig struct {
+	Required  []string // headers every message must have, e.g. From, Date and Message-ID
+	Forbidden []string // headers no message may have
+	Code      int      // response code to return (default 550)
+	Message   string   // response text to return, including any enhanced status code (default names the header)
+}
+
+// DomainFilterConfig has the configuration for blocking addresses by domain
+type DomainFilterConfig struct {
+	Domains []string // domains to block, either exactly (e.g. spammer.net) or all subdomains (e.g. *.example.com)
+	Code    int      // response code to return (default 550)
+	Message string   // response text to return, including any enhanced status code
+}
+
+// TlsCertificate holds a certificate that is presented to clients requesting one of its hostnames with SNI
+type TlsCertificate struct {
+	KeyFile   string   // path to TLS key file
+	CertFile  string   // path to TLS cert file (defaults to the key file)
+	Hostnames []string // hostnames to present this certificate for, which may be wildcards (defaults to the names in the certificate)
+}
+
+// ProxyConfig has the configuration for proxy mode, where transactions are relayed to an upstream server
+type ProxyConfig struct {
+	Protocol string // protocol of the upstream (default tcp)
+	Address  string // address of the upstream (blank to disable proxy mode)
+	Hello    string // name to give in EHLO to the upstream (default localhost)
+	Timeout  string // timeout for connecting and each command (default 30s)
+}
+
+// SinkConfig has the configuration for sink mode, where a fixed response is returned at a given phase
+type SinkConfig struct {
+	Phase   string // phase to respond at: connect, mail, rcpt or data (blank to disable sink mode)
+	Code    int    // response code to return
+	Message string // response text to return
 }
 
 // TlsConfig has the configuration for TLS
 type TlsConfig struct {
-	KeyFile    string // path to TLS key file
-	CertFile   string // path to TLS cert file
-	ServerName string // server name
-	CaCertFile string // path to certificate file
-	ClientAuth string // client authentication strategy
-	MinVersion string // minimum TLS version
-	MaxVersion string // maximum TLS version
+	KeyFile          string           // path to TLS key file
+	CertFile         string           // path to TLS cert file
+	Certificates     []TlsCertificate // further certificates, selected by SNI server name
+	OcspStapleFile   string           // path to a DER encoded OCSP response to staple to the default certificate
+	OcspResponderURL string           // URL of the OCSP responder to fetch a staple from (the cert file must contain the issuer)
+	OcspRefresh      string           // interval between reloading the OCSP staple (default 1h)
+	ReloadInterval   string           // interval between checking certificate files for changes (default 1m)
+
+	// ACME (e.g. Let's Encrypt) obtains and renews certificates automatically, instead of using
+	// certificate files. Challenges are answered by HTTP-01, so AcmeHTTPAddress must be reachable
+	// as port 80 of every hostname from the internet
+	AcmeHostnames    []string // hostnames to obtain certificates for (empty to disable ACME)
+	AcmeCacheDir     string   // directory to cache certificates and the account key in (required)
+	AcmeEmail        string   // contact email address for the ACME account
+	AcmeHTTPAddress  string   // address to answer HTTP-01 challenges on, not the debug address (default :80)
+	AcmeDirectoryURL string   // ACME directory URL (default Let's Encrypt production)
+	ServerName       string   // server name
+	CaCertFile       string   // path to certificate file
+	ClientAuth       string   // client authentication strategy
+	MinVersion       string   // minimum TLS version
+	MaxVersion       string   // maximum TLS version
 }
 
-// DriverConfig is an arbitrary map of other parameters in string format
+// DriverParametersConfig is an arbitrary map of other parameters in string format, such as those
+// of a handler (see ServerConfig.Handler). A parameter which is absent or blank takes the default
+// passed to its accessor
 type DriverParametersConfig map[string]string
 
+// GetString returns the parameter key, or def if it is not given
+func (p DriverParametersConfig) GetString(key string, def string) string {
+	if v := p[key]; v != "" {
+		return v
+	}
+	return def
+}
+
+// GetInt returns the parameter key as an integer, or def if it is not given
+func (p DriverParametersConfig) GetInt(key string, def int) (int, error) {
+	v := p[key]
+	if v == "" {
+		return def, nil
+	}
+	if i, err := strconv.Atoi(v); err != nil {
+		return 0, fmt.Errorf("Bad %s: '%s'", key, v)
+	} else {
+		return i, nil
+	}
+}
+
+// GetBool returns the parameter key as a boolean ("true" or "false"), or def if it is not given
+func (p DriverParametersConfig) GetBool(key string, def bool) (bool, error) {
+	if tr, fa, err := isTrueFalse(p[key]); err != nil {
+		return false, fmt.Errorf("Bad %s: '%s'", key, p[key])
+	} else if !tr && !fa {
+		return def, nil
+	} else {
+		return tr, nil
+	}
+}
+
+// GetDuration returns the parameter key as a duration (e.g. "30s"), or def if it is not given
+func (p DriverParametersConfig) GetDuration(key string, def time.Duration) (time.Duration, error) {
+	v := p[key]
+	if v == "" {
+		return def, nil
+	}
+	if d, err := time.ParseDuration(v); err != nil {
+		return 0, fmt.Errorf("Bad %s: '%s'", key, v)
+	} else {
+		return d, nil
+	}
+}
+
 // isTrue determines whether an argument is true
 func isTrue(v string) (bool, error) {
 	if v == "true" {
@@ -113,23 +384,115 @@ func isTrueFalse(v string) (bool, bool, error) {
 	return false, false, fmt.Errorf("Unknown boolean value: %s", v)
 }
 
-// ParseConfig parses the YAML configuration provided
-func ParseConfig(confFile string) (*Config, error) {
-	if buf, err := ioutil.ReadFile(confFile); err != nil {
+// configExtensions are the extensions of the files read from a configuration directory
+var configExtensions = map[string]bool{
+	".conf": true,
+	".yaml": true,
+}
+
+// configFragments returns the files making up the configuration at confFile: the file itself or,
+// if it is a directory, the files within it with one of configExtensions, in lexical order. Other
+// entries, including subdirectories and hidden files (e.g. editor swap files), are ignored. A
+// directory with no such files is an error, as it is more likely a mistake than intended
+func configFragments(confFile string) ([]string, error) {
+	if fi, err := os.Stat(confFile); err != nil {
 		return nil, err
-	} else {
-		c := &Config{}
-		if err := yaml.Unmarshal(buf, c); err != nil {
+	} else if !fi.IsDir() {
+		return []string{confFile}, nil
+	}
+	entries, err := ioutil.ReadDir(confFile)
+	if err != nil {
+		return nil, err
+	}
+	fragments := []string{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || !configExtensions[filepath.Ext(e.Name())] {
+			continue
+		}
+		fn := filepath.Join(confFile, e.Name())
+		// follow symlinks, as drop-in files are often linked from elsewhere
+		if fi, err := os.Stat(fn); err != nil {
 			return nil, err
+		} else if fi.Mode().IsRegular() {
+			fragments = append(fragments, fn)
 		}
-		for i, _ := range c.Servers {
-			if c.Servers[i].Protocol == "" {
-				c.Servers[i].Protocol = "tcp"
+	}
+	if len(fragments) == 0 {
+		return nil, fmt.Errorf("Bad config: no configuration files in '%s'", confFile)
+	}
+	return fragments, nil
+}
+
+// mergeConfig merges the fragment f, read from fn, into c. Servers are appended; any other
+// section may only be set by one fragment, so set records which fragment set each
+func mergeConfig(c *Config, f *Config, fn string, set map[string]string) error {
+	cv := reflect.ValueOf(c).Elem()
+	fv := reflect.ValueOf(f).Elem()
+	for i := 0; i < fv.NumField(); i++ {
+		name := fv.Type().Field(i).Name
+		if name == "Servers" {
+			c.Servers = append(c.Servers, f.Servers...)
+			continue
+		}
+		if fv.Field(i).IsZero() {
+			continue
+		}
+		if prev, ok := set[name]; ok {
+			return fmt.Errorf("Bad config: '%s' set in both %s and %s", strings.ToLower(name), prev, fn)
+		}
+		cv.Field(i).Set(fv.Field(i))
+		set[name] = fn
+	}
+	return nil
+}
+
+// ParseConfig parses the YAML configuration provided, which is either a file or a directory of
+// files (see configFragments) merged into one configuration
+func ParseConfig(confFile string) (*Config, error) {
+	fragments, err := configFragments(confFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	set := make(map[string]string)
+	for _, fn := range fragments {
+		if buf, err := ioutil.ReadFile(fn); err != nil {
+			return nil, err
+		} else {
+			f := &Config{}
+			if err := yaml.Unmarshal(buf, f); err != nil {
+				if fn != confFile {
+					return nil, fmt.Errorf("%s: %v", fn, err)
+				}
+				return nil, err
 			}
-			if c.Servers[i].Protocol == "tcp" && c.Servers[i].Address == "" {
-				c.Servers[i].Protocol = fmt.Sprintf("0.0.0.0:%d", GOMS_DEFAULT_PORT)
+			if err := mergeConfig(c, f, fn, set); err != nil {
+				return nil, err
 			}
 		}
-		return c, nil
 	}
+	if fragments[0] != confFile && len(c.Servers) == 0 {
+		return nil, fmt.Errorf("Bad config: no servers configured in '%s'", confFile)
+	}
+	for i, _ := range c.Servers {
+		if c.Servers[i].Protocol == "" {
+			c.Servers[i].Protocol = "tcp"
+		}
+		if c.Servers[i].Address == "" {
+			switch c.Servers[i].Protocol {
+			case "tcp", "tcp4":
+				c.Servers[i].Address = fmt.Sprintf("0.0.0.0:%d", GOMS_DEFAULT_PORT)
+			case "tcp6":
+				c.Servers[i].Address = fmt.Sprintf("[::]:%d", GOMS_DEFAULT_PORT)
+			}
+		}
+	}
+	// the debug server is restarted on reload, when it may be unable to bind a privileged port, and
+	// must not expose pprof on the public port answering ACME challenges
+	for _, address := range c.acmeHTTPAddresses() {
+		if address == c.Debug.Address {
+			return nil, fmt.Errorf("Bad config: debug address '%s' is also used to answer ACME challenges", address)
+		}
+	}
+	return c, nil
 }
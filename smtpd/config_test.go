@@ -4,7 +4,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTrueFalse(t *testing.T) {
@@ -61,6 +63,77 @@ func testConfig(t *testing.T, conf string, fn string, desc string, shouldWork bo
 	}
 }
 
+func TestConfigGreetingDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "goms.conf")
+	writeConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  greetingdelay: 1500ms
+`, fn)
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	if l, err := NewListener(newTestLogger(t), c.Servers[0]); err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	} else if l.params.GreetingDelay != 1500*time.Millisecond {
+		t.Fatalf("Wrong greeting delay: %v", l.params.GreetingDelay)
+	}
+}
+
+func TestConfigConnectionParameters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "goms.conf")
+	writeConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  hostname: mx.example.com
+  maxmessagesize: 1000
+  idletimeout: 1m
+`, fn)
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	l, err := NewListener(newTestLogger(t), c.Servers[0])
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	if l.params.IdleTimeout != time.Minute || l.params.ReadTimeout != 15*time.Second {
+		t.Fatalf("Wrong timeouts: idle %v, read %v", l.params.IdleTimeout, l.params.ReadTimeout)
+	}
+
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if ok, size := tc.client.Extension("SIZE"); !ok || size != "1000" {
+		t.Fatalf("Wrong SIZE advertised: %s", size)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
 func TestConfigParser(t *testing.T) {
 	dir, err := ioutil.TempDir("", "gomstest")
 	if err != nil {
@@ -90,3 +163,145 @@ logging:
 		fn, "working config 1", true)
 
 }
+
+func TestConfigDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an empty directory is an error rather than a configuration with nothing to serve
+	if c, err := ParseConfig(dir); err == nil {
+		t.Fatalf("Empty directory accepted: %+v", c)
+	}
+	writeConfig(t, `
+admin:
+  socket: /var/run/goms.admin
+`, filepath.Join(dir, "05-admin.conf"))
+	if c, err := ParseConfig(dir); err == nil || !strings.Contains(err.Error(), "no servers") {
+		t.Fatalf("Directory without servers accepted: %+v %v", c, err)
+	}
+	adminFingerprint, err := configFingerprint(dir)
+	if err != nil {
+		t.Fatalf("Could not fingerprint configuration: %v", err)
+	}
+
+	writeConfig(t, `
+servers:
+- address: 127.0.0.1:30025
+logging:
+  syslogfacility: local1
+`, filepath.Join(dir, "10-mx.conf"))
+	writeConfig(t, `
+servers:
+- address: 127.0.0.1:30587
+  mode: submission
+- protocol: unix
+  address: /var/run/goms.sock
+`, filepath.Join(dir, "20-submission.yaml"))
+	// other files are ignored
+	writeConfig(t, "zz", filepath.Join(dir, "README"))
+	writeConfig(t, "zz", filepath.Join(dir, "10-mx.conf~"))
+	writeConfig(t, "zz", filepath.Join(dir, ".10-mx.conf.swp"))
+	if err := os.Mkdir(filepath.Join(dir, "old.conf"), 0777); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+
+	c, err := ParseConfig(dir)
+	if err != nil {
+		t.Fatalf("Could not parse config directory: %v", err)
+	}
+	addresses := []string{}
+	for _, s := range c.Servers {
+		addresses = append(addresses, s.Protocol+":"+s.Address)
+	}
+	if strings.Join(addresses, " ") != "tcp:127.0.0.1:30025 tcp:127.0.0.1:30587 unix:/var/run/goms.sock" {
+		t.Fatalf("Wrong servers: %v", addresses)
+	}
+	if c.Servers[1].Mode != "submission" || c.Logging.SyslogFacility != "local1" || c.Admin.Socket != "/var/run/goms.admin" {
+		t.Fatalf("Wrong config: %+v", c)
+	}
+	if fingerprint, err := configFingerprint(dir); err != nil || fingerprint == adminFingerprint {
+		t.Fatalf("Fingerprint unchanged by fragments: %v %v", fingerprint, err)
+	}
+
+	// only one fragment may set each section other than servers
+	writeConfig(t, `
+logging:
+  syslogfacility: local2
+`, filepath.Join(dir, "30-logging.conf"))
+	if _, err := ParseConfig(dir); err == nil || !strings.Contains(err.Error(), "'logging'") {
+		t.Fatalf("Conflicting logging sections accepted: %v", err)
+	}
+	os.Remove(filepath.Join(dir, "30-logging.conf"))
+
+	// a broken fragment is named in the error
+	writeConfig(t, "zz", filepath.Join(dir, "30-broken.conf"))
+	if _, err := ParseConfig(dir); err == nil || !strings.Contains(err.Error(), "30-broken.conf") {
+		t.Fatalf("Broken fragment accepted: %v", err)
+	}
+}
+
+func TestDriverParameters(t *testing.T) {
+	p := DriverParametersConfig{
+		"name":     "value",
+		"blank":    "",
+		"count":    "42",
+		"badcount": "4x2",
+		"on":       "true",
+		"off":      "false",
+		"badbool":  "yes",
+		"wait":     "1m30s",
+		"badwait":  "90",
+	}
+
+	if v := p.GetString("name", "default"); v != "value" {
+		t.Fatalf("Wrong string: %s", v)
+	}
+	if v := p.GetString("missing", "default"); v != "default" {
+		t.Fatalf("Wrong default string: %s", v)
+	}
+	if v := p.GetString("blank", "default"); v != "default" {
+		t.Fatalf("Wrong default string for blank parameter: %s", v)
+	}
+
+	if v, err := p.GetInt("count", 7); err != nil || v != 42 {
+		t.Fatalf("Wrong int: %d %v", v, err)
+	}
+	if v, err := p.GetInt("missing", 7); err != nil || v != 7 {
+		t.Fatalf("Wrong default int: %d %v", v, err)
+	}
+	if _, err := p.GetInt("badcount", 7); err == nil || err.Error() != "Bad badcount: '4x2'" {
+		t.Fatalf("Wrong error for bad int: %v", err)
+	}
+
+	if v, err := p.GetBool("on", false); err != nil || v != true {
+		t.Fatalf("Wrong bool: %v %v", v, err)
+	}
+	if v, err := p.GetBool("off", true); err != nil || v != false {
+		t.Fatalf("Wrong bool: %v %v", v, err)
+	}
+	if v, err := p.GetBool("missing", true); err != nil || v != true {
+		t.Fatalf("Wrong default bool: %v %v", v, err)
+	}
+	if _, err := p.GetBool("badbool", false); err == nil || err.Error() != "Bad badbool: 'yes'" {
+		t.Fatalf("Wrong error for bad bool: %v", err)
+	}
+
+	if v, err := p.GetDuration("wait", time.Second); err != nil || v != 90*time.Second {
+		t.Fatalf("Wrong duration: %v %v", v, err)
+	}
+	if v, err := p.GetDuration("missing", time.Second); err != nil || v != time.Second {
+		t.Fatalf("Wrong default duration: %v %v", v, err)
+	}
+	if _, err := p.GetDuration("badwait", time.Second); err == nil || err.Error() != "Bad badwait: '90'" {
+		t.Fatalf("Wrong error for bad duration: %v", err)
+	}
+
+	// a nil map gives every default
+	var none DriverParametersConfig
+	if v, err := none.GetInt("count", 7); err != nil || v != 7 {
+		t.Fatalf("Wrong default int from nil parameters: %d %v", v, err)
+	}
+}
@@ -0,0 +1,42 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// ConnInfoKey is the key under which the contexts passed to the ITP carry the connection, so code
+// which has only the context may find the connection's details with ConnInfoFromContext
+type ConnInfoKey struct{}
+
+// ConnInfo gives the details of a connection, as at the time it was retrieved
+type ConnInfo struct {
+	ID                     uint64               // the ID of the connection
+	RemoteAddr             net.Addr             // the client's address
+	RemoteHostname         string               // the client's hostname from reverse DNS, if any
+	RemoteHostnameVerified bool                 // true if the hostname resolves back to the client
+	HeloName               string               // the name given in the most recent HELO or EHLO
+	ESMTP                  bool                 // true if the client greeted us with EHLO
+	TLS                    *tls.ConnectionState // the state of the TLS connection, or nil if not encrypted
+	AuthIdentity           string               // the identity the client authenticated as, if any
+}
+
+// ConnInfoFromContext returns the details of the connection carried by a context passed to the
+// ITP (or one derived from it), and false if it carries none
+func ConnInfoFromContext(ctx context.Context) (*ConnInfo, bool) {
+	c, ok := ctx.Value(ConnInfoKey{}).(*InboundConnection)
+	if !ok || c == nil {
+		return nil, false
+	}
+	info := &ConnInfo{
+		ID:           c.ID(),
+		RemoteAddr:   c.plainConn.RemoteAddr(),
+		HeloName:     c.HeloName(),
+		ESMTP:        c.ESMTP(),
+		TLS:          c.TLS(),
+		AuthIdentity: c.AuthIdentity(),
+	}
+	info.RemoteHostname, info.RemoteHostnameVerified = c.RemoteHostname()
+	return info, true
+}
@@ -0,0 +1,74 @@
+package smtpd
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// ConnInfoITP records the connection details carried by the context given to ProcessMail
+type ConnInfoITP struct {
+	DummyITP
+	mutex sync.Mutex
+	info  *ConnInfo
+	ok    bool
+	id    uint64
+}
+
+func (i *ConnInfoITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.info, i.ok = ConnInfoFromContext(ctx)
+	i.id = c.ID()
+	return nil, nil
+}
+
+func TestConnInfoFromContext(t *testing.T) {
+	if _, ok := ConnInfoFromContext(context.Background()); ok {
+		t.Fatalf("Connection details found in a context without them")
+	}
+
+	itp := &ConnInfoITP{}
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("client.example.com"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Message not accepted: %v", err)
+		}
+	}
+
+	itp.mutex.Lock()
+	if !itp.ok || itp.info == nil {
+		t.Fatalf("No connection details in the context given to ProcessMail")
+	}
+	if itp.info.ID != itp.id || itp.info.HeloName != "client.example.com" || !itp.info.ESMTP {
+		t.Fatalf("Wrong connection details: %+v", itp.info)
+	}
+	if itp.info.RemoteAddr == nil || itp.info.TLS != nil || itp.info.AuthIdentity != "" {
+		t.Fatalf("Wrong connection details: %+v", itp.info)
+	}
+	itp.mutex.Unlock()
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
@@ -6,22 +6,74 @@ import (
 	"github.com/abligh/go-daemon"
 	"io"
 	"log"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"runtime/debug"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // Control mediates the running of the main process
 type Control struct {
 	quit     chan struct{}
+	reload   chan struct{} // requests a configuration reload, as SIGHUP does
+	drain    chan struct{} // requests a graceful shutdown once sessions have finished
 	wg       sync.WaitGroup
 	dummyRun bool
+
+	maintenance Maintenance // refuses new connections whilst on
+}
+
+// Reload requests that the configuration is reloaded. It does not wait for the reload
+func (c *Control) Reload() {
+	select {
+	case c.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Drain requests that the server stops accepting connections and exits once the sessions in
+// progress have finished, or the drain timeout has elapsed, as SIGUSR2 does. It does not wait for
+// this to happen
+func (c *Control) Drain() {
+	select {
+	case c.drain <- struct{}{}:
+	default:
+	}
+}
+
+// SetMaintenance turns maintenance mode on or off for every listener (see Maintenance). The
+// configuration's Maintenance setting applies again when it is next reloaded
+func (c *Control) SetMaintenance(on bool) {
+	c.maintenance.Set(on)
+}
+
+// waitForSessions waits for the sessions in progress to finish, for at most the timeout given (if
+// not zero), which is described by name in the log. Any still running after that are left for the
+// caller to close, and false returned
+func waitForSessions(logger *log.Logger, sessionWaitGroup *sync.WaitGroup, timeout time.Duration, name string) bool {
+	done := make(chan struct{})
+	go func() {
+		sessionWaitGroup.Wait()
+		close(done)
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-done:
+		return true
+	case <-expired:
+		logger.Printf("[WARN] Sessions still running after %s timeout of %v; closing them", name, timeout)
+		return false
+	}
 }
 
 // Startserver starts a single server.
@@ -29,6 +81,14 @@ type Control struct {
 // A parent context is given in which the listener runs, as well as a session context in which the sessions (connections) themselves run.
 // This enables the sessions to be retained when the listener is cancelled on a SIGHUP
 func StartServer(parentCtx context.Context, sessionParentCtx context.Context, sessionWaitGroup *sync.WaitGroup, logger *log.Logger, s ServerConfig) {
+	startServer(parentCtx, sessionParentCtx, sessionWaitGroup, logger, s, nil, nil, nil, nil, nil, nil)
+}
+
+// startServer starts a single server as StartServer does, recording whether it is bound in ready (if not nil),
+// waiting for privileges to be dropped (if not nil) before accepting connections, refusing them whilst
+// maintenance (if not nil) is on, recording its sessions in sessions (if not nil), passing their events to
+// messageLog (if not nil), and answering its ACME challenges through challenges (if not nil)
+func startServer(parentCtx context.Context, sessionParentCtx context.Context, sessionWaitGroup *sync.WaitGroup, logger *log.Logger, s ServerConfig, ready *readiness, privileges *privilegeDropper, maintenance *Maintenance, sessions *sessionSet, messageLog *MessageLog, challenges *acmeChallenges) {
 	ctx, cancelFunc := context.WithCancel(parentCtx)
 
 	defer func() {
@@ -40,28 +100,95 @@ func StartServer(parentCtx context.Context, sessionParentCtx context.Context, se
 
 	if l, err := NewListener(logger, s); err != nil {
 		logger.Printf("[ERROR] Could not create listener for %s:%s: %v", s.Protocol, s.Address, err)
+		if privileges != nil {
+			privileges.bound()
+		}
 	} else {
+		l.readiness = ready
+		l.privileges = privileges
+		l.maintenance = maintenance
+		l.sessionSet = sessions
+		l.acmeChallenges = challenges
+		if messageLog != nil {
+			l.SetEventHandler(messageLog)
+		}
 		l.Listen(ctx, sessionParentCtx, sessionWaitGroup)
 	}
 }
 
+// runningServer is a server started by RunConfig, which is kept across reloads whilst its
+// configuration is unchanged. ACME challenge servers are tracked likewise, without a configuration
+type runningServer struct {
+	config ServerConfig
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the server has stopped
+}
+
+// stop stops the server, without affecting its sessions, and waits for it to unbind
+func (s *runningServer) stop() {
+	s.cancel()
+	<-s.done
+}
+
 // RunConfig - this is effectively the main entry point of the program
 //
-// We parse the config, then start each of the listeners, restarting them when we get SIGHUP, but being sure not to kill the sessions
+// We parse the config, then start each of the listeners. When we get SIGHUP, servers added to the
+// config are started and those removed or changed are stopped (changed ones being restarted), but
+// being sure not to kill the sessions. Servers are identified by protocol and address; those whose
+// config is unchanged keep listening throughout, and those which failed to start are retried. Note
+// files named by the config (such as certificates) are only reread by servers which restart, or as
+// they are reloaded periodically
 func RunConfig(control *Control) {
-	// just until we read the configuration
+	// just until we read the configuration; it is updated in place on each load, so servers kept
+	// across a reload (and sessions begun before it) log to the new destination
 	logger := log.New(os.Stderr, "goms:", log.LstdFlags)
 	var logCloser io.Closer
+	// likewise the message log's destination is replaced on each load
+	messageLog := NewMessageLog(nil)
+	var messageLogCloser io.Closer
 	var sessionWaitGroup sync.WaitGroup
+	sessions := newSessionSet()
+	shutdownTimeout := defaultShutdownTimeout
+	ready := newReadiness()
+	servers := make(map[string]*runningServer) // by protocol:address
+	// ACME challenges for every server are answered by one HTTP server per address, kept across
+	// reloads as it cannot be bound again once privileges are dropped
+	challenges := newAcmeChallenges()
+	acmeServers := make(map[string]*runningServer) // by address
+	stopServers := func() {
+		for _, s := range servers {
+			s.cancel()
+		}
+	}
+	privilegesDropped := false // privileges cannot be regained, so are only dropped on the first load
+	if control.reload == nil {
+		control.reload = make(chan struct{}, 1)
+	}
+	if control.drain == nil {
+		control.drain = make(chan struct{}, 1)
+	}
+	// the debug server has its own context so it can report we are not ready whilst sessions drain
+	debugCancelFunc := func() {}
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer func() {
 		logger.Println("[INFO] Shutting down")
+		ready.shutdown()
 		cancelFunc()
-		sessionWaitGroup.Wait()
+		// a session with a hung ITP would otherwise stop us exiting
+		if !waitForSessions(logger, &sessionWaitGroup, shutdownTimeout, "shutdown") {
+			logger.Printf("[WARN] Force closed %d sessions", sessions.closeAll())
+		}
+		debugCancelFunc()
+		for _, rs := range acmeServers {
+			<-rs.done
+		}
 		logger.Println("[INFO] Shutdown complete")
 		if logCloser != nil {
 			logCloser.Close()
 		}
+		if messageLogCloser != nil {
+			messageLogCloser.Close()
+		}
 		control.wg.Done()
 	}()
 
@@ -69,10 +196,19 @@ func RunConfig(control *Control) {
 	term := make(chan os.Signal, 1)
 	hup := make(chan os.Signal, 1)
 	usr1 := make(chan os.Signal, 1)
+	usr2 := make(chan os.Signal, 1)
 	defer close(intr)
 	defer close(term)
 	defer close(hup)
 	defer close(usr1)
+	defer close(usr2)
+	// stop signal delivery before the channels are closed (deferred functions run in reverse order)
+	// so nothing is sent on a closed channel, and the signal package does not retain the channels
+	defer func() {
+		for _, ch := range []chan os.Signal{intr, term, hup, usr1, usr2} {
+			signal.Stop(ch)
+		}
+	}()
 	if !*foreground {
 		signal.Notify(intr, os.Interrupt)
 		signal.Notify(term, syscall.SIGTERM)
@@ -80,6 +216,7 @@ func RunConfig(control *Control) {
 	}
 
 	signal.Notify(usr1, syscall.SIGUSR1)
+	signal.Notify(usr2, syscall.SIGUSR2)
 	go func() {
 		for {
 			select {
@@ -87,11 +224,15 @@ func RunConfig(control *Control) {
 				if !ok {
 					return
 				}
-				logger.Println("[INFO] Run GC()")
+				// This is a diagnostic only; memory is released without it
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				logger.Printf("[INFO] Run GC() (heap in use %d bytes, %d goroutines)", m.HeapInuse, runtime.NumGoroutine())
 				runtime.GC()
 				logger.Println("[INFO] GC() done")
 				debug.FreeOSMemory()
-				logger.Println("[INFO] FreeOsMemory() done")
+				runtime.ReadMemStats(&m)
+				logger.Printf("[INFO] FreeOsMemory() done (heap in use %d bytes)", m.HeapInuse)
 			}
 		}
 	}()
@@ -110,21 +251,170 @@ func RunConfig(control *Control) {
 			if nlogger, nlogCloser, err := c.GetLogger(); err != nil {
 				logger.Printf("[ERROR] Could not load logger: %v", err)
 			} else {
+				logger.SetOutput(nlogger.Writer())
+				logger.SetFlags(nlogger.Flags())
+				logger.SetPrefix(nlogger.Prefix())
 				if logCloser != nil {
 					logCloser.Close()
 				}
-				logger = nlogger
 				logCloser = nlogCloser
 			}
 			logger.Printf("[INFO] Loaded configuration.")
+			if w, closer, err := c.GetMessageLog(); err != nil {
+				logger.Printf("[ERROR] Could not open message log: %v", err)
+			} else {
+				messageLog.SetOutput(w)
+				if messageLogCloser != nil {
+					messageLogCloser.Close()
+				}
+				messageLogCloser = closer
+			}
+			control.maintenance.Set(c.Maintenance)
+			if c.Maintenance {
+				logger.Println("[INFO] Maintenance mode on; refusing new connections")
+			}
+			drainTimeout := time.Duration(0)
+			if c.DrainTimeout != "" {
+				if d, err := time.ParseDuration(c.DrainTimeout); err != nil || d <= 0 {
+					logger.Printf("[ERROR] Bad drain timeout: '%s'", c.DrainTimeout)
+				} else {
+					drainTimeout = d
+				}
+			}
+			shutdownTimeout = defaultShutdownTimeout
+			if c.ShutdownTimeout != "" {
+				if d, err := time.ParseDuration(c.ShutdownTimeout); err != nil || d <= 0 {
+					logger.Printf("[ERROR] Bad shutdown timeout: '%s'", c.ShutdownTimeout)
+				} else {
+					shutdownTimeout = d
+				}
+			}
+			acmeAddresses := c.acmeHTTPAddresses()
+			acmeWanted := make(map[string]bool)
+			for _, address := range acmeAddresses {
+				acmeWanted[address] = true
+			}
+			for address, rs := range acmeServers {
+				if !acmeWanted[address] {
+					rs.stop()
+					delete(acmeServers, address)
+				}
+			}
+			if c.Debug.Address != "" {
+				debugCtx, cancel := context.WithCancel(context.Background())
+				debugCancelFunc = cancel
+				if err := listenDebug(debugCtx, &wg, logger, c.Debug.Address, ready); err != nil {
+					logger.Printf("[ERROR] Could not start debug server on %s: %v", c.Debug.Address, err)
+				}
+			}
+			for _, address := range acmeAddresses {
+				if _, ok := acmeServers[address]; ok {
+					continue
+				}
+				acmeCtx, acmeCancelFunc := context.WithCancel(ctx)
+				var acmeWaitGroup sync.WaitGroup
+				if err := listenAcme(acmeCtx, &acmeWaitGroup, logger, address, challenges); err != nil {
+					// it is retried on reload, though only binds then if privileges allow
+					logger.Printf("[ERROR] Could not answer ACME challenges on %s: %v", address, err)
+					acmeCancelFunc()
+					continue
+				}
+				rs := &runningServer{cancel: acmeCancelFunc, done: make(chan struct{})}
+				acmeServers[address] = rs
+				go func() {
+					acmeWaitGroup.Wait()
+					close(rs.done)
+				}()
+			}
+			if c.Admin.Socket != "" {
+				if fingerprint, err := configFingerprint(*configFile); err != nil {
+					logger.Printf("[ERROR] Could not fingerprint configuration: %v", err)
+				} else if err := listenAdmin(configCtx, &wg, logger, c.Admin.Socket, control, ready, fingerprint); err != nil {
+					logger.Printf("[ERROR] Could not start admin socket on %s: %v", c.Admin.Socket, err)
+				}
+			}
+			var privileges *privilegeDropper
+			if !privilegesDropped && (c.RunAsUser != "" || c.RunAsGroup != "" || c.Chroot != "") {
+				if uid, gid, err := lookupCredentials(c.RunAsUser, c.RunAsGroup); err != nil {
+					logger.Printf("[CRIT] Cannot drop privileges: %v", err)
+					configCancelFunc()
+					return
+				} else {
+					privileges = newPrivilegeDropper(uid, gid, c.Chroot)
+				}
+			}
+			wanted := make(map[string]ServerConfig, len(c.Servers))
+			names := []string{} // in the order configured
 			for _, s := range c.Servers {
-				s := s // localise loop variable
+				name := s.Protocol + ":" + s.Address
+				if _, ok := wanted[name]; ok {
+					logger.Printf("[ERROR] Ignoring duplicate server %s", name)
+					continue
+				}
+				wanted[name] = s
+				names = append(names, name)
+			}
+			for name, rs := range servers {
+				if s, ok := wanted[name]; !ok || !reflect.DeepEqual(s, rs.config) {
+					rs.stop()
+					delete(servers, name)
+					if !ok {
+						ready.forget(name)
+					}
+				}
+			}
+			for _, name := range names {
+				s := wanted[name]
+				if rs, ok := servers[name]; ok {
+					select {
+					case <-rs.done:
+						// it could not be created or could not bind, so is retried as before
+						logger.Printf("[INFO] Server %s unchanged but not running; restarting it", name)
+						rs.cancel()
+						delete(servers, name)
+					default:
+						logger.Printf("[INFO] Server %s unchanged; leaving it running", name)
+						continue
+					}
+				}
+				serverCtx, serverCancelFunc := context.WithCancel(ctx)
+				rs := &runningServer{config: s, cancel: serverCancelFunc, done: make(chan struct{})}
+				servers[name] = rs
+				ready.expect(name)
+				if privileges != nil {
+					privileges.expect()
+				}
 				go func() {
-					wg.Add(1)
-					StartServer(configCtx, ctx, &sessionWaitGroup, logger, s)
-					wg.Done()
+					defer close(rs.done)
+					startServer(serverCtx, ctx, &sessionWaitGroup, logger, s, ready, privileges, &control.maintenance, sessions, messageLog, challenges)
 				}()
 			}
+			// the log files, the debug server, the ACME challenge servers and the admin socket are
+			// open by now, so once the listeners have bound we can drop privileges before any
+			// connection is accepted
+			if privileges != nil {
+				if err := privileges.drop(logger); err != nil {
+					logger.Printf("[CRIT] Cannot drop privileges: %v", err)
+					configCancelFunc()
+					return
+				}
+				privilegesDropped = true
+			}
+
+			// a drain or reload may be requested programmatically or by a signal
+			drain := func(reason string) {
+				logger.Printf("[INFO] %s; waiting for sessions to finish", reason)
+				ready.shutdown()
+				configCancelFunc()
+				stopServers() // stop listening, but let the sessions finish
+				waitForSessions(logger, &sessionWaitGroup, drainTimeout, "drain")
+			}
+			reload := func(reason string) {
+				logger.Printf("[INFO] %s; reloading configuration which will be effective for new connections", reason)
+				configCancelFunc() // the admin socket and debug server are restarted with the new configuration
+				debugCancelFunc()
+				wg.Wait()
+			}
 
 			select {
 			case <-ctx.Done():
@@ -139,10 +429,16 @@ func RunConfig(control *Control) {
 			case <-control.quit:
 				logger.Println("[INFO] Programmatic quit received")
 				return
+			case <-control.drain:
+				drain("Drain requested")
+				return
+			case <-usr2:
+				drain("Drain signal received")
+				return
+			case <-control.reload:
+				reload("Reload requested")
 			case <-hup:
-				logger.Println("[INFO] Reload signal received; reloading configuration which will be effective for new connections")
-				configCancelFunc() // kill the listeners but not the sessions
-				wg.Wait()
+				reload("Reload signal received")
 			}
 		}
 	}
@@ -159,7 +455,6 @@ func Run(control *Control) {
 
 	if *pprof {
 		runtime.MemProfileRate = 1
-		go http.ListenAndServe(":8080", nil)
 	}
 
 	// Just for this routine
@@ -168,6 +463,7 @@ func Run(control *Control) {
 	daemon.AddFlag(daemon.StringFlag(sendSignal, "stop"), syscall.SIGTERM)
 	daemon.AddFlag(daemon.StringFlag(sendSignal, "reload"), syscall.SIGHUP)
 	daemon.AddFlag(daemon.StringFlag(sendSignal, "gc"), syscall.SIGUSR1)
+	daemon.AddFlag(daemon.StringFlag(sendSignal, "drain"), syscall.SIGUSR2)
 
 	if daemon.WasReborn() {
 		if val := os.Getenv(ENV_CONFFILE); val != "" {
@@ -190,8 +486,12 @@ func Run(control *Control) {
 	// but it eliminates a problem where the log of the configuration failing
 	// is invisible when daemonizing naively (e.g. when no alternate log
 	// destination is supplied) and the config file cannot be read
-	if _, err := ParseConfig(*configFile); err != nil {
+	if c, err := ParseConfig(*configFile); err != nil {
 		logger.Fatalf("[CRIT] Cannot parse configuration file: %v", err)
+	} else if _, _, err := lookupCredentials(c.RunAsUser, c.RunAsGroup); err != nil {
+		// likewise, fail before daemonizing (which writes the PID file as the starting user)
+		// rather than once the listeners are bound
+		logger.Fatalf("[CRIT] Cannot drop privileges: %v", err)
 	}
 
 	if *foreground {
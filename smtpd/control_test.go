@@ -1,6 +1,8 @@
 package smtpd
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -206,6 +209,327 @@ func TestForeground(t *testing.T) {
 	c.wg.Wait()
 }
 
+func TestDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conffn := filepath.Join(dir, "goms.conf")
+	if err := ioutil.WriteFile(conffn, []byte(`
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30048
+draintimeout: 2s
+`), 0666); err != nil {
+		t.Fatalf("Could not create config file: %v", err)
+	}
+	pidfn := filepath.Join(dir, "goms.pid")
+
+	// a session in progress when draining starts completes, unless it outlasts the drain timeout
+	for _, abandon := range []bool{false, true} {
+		c := &Control{
+			quit:  make(chan struct{}),
+			drain: make(chan struct{}, 1),
+		}
+		c.wg.Add(1)
+		flagParse([]string{"goms", "-c", conffn, "-p", pidfn, "-f"})
+		go Run(c)
+		stopped := make(chan struct{})
+		go func() {
+			c.wg.Wait()
+			close(stopped)
+		}()
+
+		client := dialTestListener(t, "127.0.0.1:30048")
+		if err := client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+
+		c.Drain()
+		refused := false
+		for retries := 0; retries < 20 && !refused; retries++ {
+			if conn, err := net.Dial("tcp", "127.0.0.1:30048"); err != nil {
+				refused = true
+			} else {
+				conn.Close()
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		if !refused {
+			t.Fatalf("New connections accepted whilst draining")
+		}
+
+		if abandon {
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Drain did not stop the server after the timeout")
+			}
+			if code, _, err := client.Cmd(250, "NOOP"); err == nil || code != 421 {
+				t.Fatalf("Expected 421 for a session closed after the drain timeout, got %d %v", code, err)
+			}
+			continue
+		}
+
+		select {
+		case <-stopped:
+			t.Fatalf("Drain stopped the server with a session in progress")
+		default:
+		}
+		if err := client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO' whilst draining: %v", err)
+		}
+		if writer, err := client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA' whilst draining: %v", err)
+		} else {
+			if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Message not accepted whilst draining: %v", err)
+			}
+		}
+		if err := client.Quit(); err != nil {
+			t.Fatalf("Cannot send quit to server: %v", err)
+		}
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Drain did not stop the server once the session finished")
+		}
+	}
+}
+
+// readGreeting dials the address given once and returns its greeting
+func readGreeting(address string) (string, error) {
+	conn, err := net.DialTimeout("tcp", address, 2*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Write([]byte("QUIT\r\n"))
+	return line, err
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conffn := filepath.Join(dir, "goms.conf")
+	pidfn := filepath.Join(dir, "goms.pid")
+	socket := filepath.Join(dir, "goms.admin")
+	admin := "admin:\n  socket: " + socket + "\n"
+	serverA := "- protocol: tcp\n  address: 127.0.0.1:30053\n  hostname: a.example.com\n"
+	serverB := "- protocol: tcp\n  address: 127.0.0.1:30054\n  hostname: b.example.com\n"
+	serverC := "- protocol: tcp\n  address: 127.0.0.1:30054\n  hostname: c.example.com\n"
+	writeConfig(t, admin+"servers:\n"+serverA, conffn)
+
+	c := &Control{
+		quit:   make(chan struct{}),
+		reload: make(chan struct{}, 1),
+	}
+	c.wg.Add(1)
+	flagParse([]string{"goms", "-c", conffn, "-p", pidfn, "-f"})
+	go Run(c)
+	defer func() {
+		close(c.quit)
+		c.wg.Wait()
+	}()
+
+	// a session begun before the reload
+	client := dialTestListener(t, "127.0.0.1:30053")
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+
+	// the unchanged server keeps accepting connections throughout a reload adding a server
+	stop := make(chan struct{})
+	failed := make(chan error, 1)
+	greetings := 0
+	go func() {
+		defer close(failed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if line, err := readGreeting("127.0.0.1:30053"); err != nil || !strings.Contains(line, "a.example.com") {
+				failed <- fmt.Errorf("%q %v", line, err)
+				return
+			}
+			greetings++
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	writeConfig(t, admin+"servers:\n"+serverA+serverB, conffn)
+	c.Reload()
+	if err := greetAndQuit("127.0.0.1:30054"); err != nil {
+		t.Fatalf("Added server not started: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	if err := <-failed; err != nil {
+		t.Fatalf("Unchanged server interrupted by reload: %v", err)
+	}
+	// the same listener accepted every connection, rather than one started by the reload
+	var conn net.Conn
+	for retries := 0; retries < 20; retries++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Cannot connect to admin socket: %v", err)
+	}
+	resp := adminCommand(t, conn, bufio.NewReader(conn), "stats")
+	conn.Close()
+	if accepted := resp.Stats.Listeners["tcp:127.0.0.1:30053"].Accepted; accepted != uint64(greetings+1) {
+		t.Fatalf("Unchanged server restarted by reload: accepted %d of %d connections", accepted, greetings+1)
+	}
+
+	if err := client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO' after reload: %v", err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send quit to server: %v", err)
+	}
+
+	// a removed server is stopped, and a changed one restarted
+	writeConfig(t, admin+"servers:\n"+serverC, conffn)
+	c.Reload()
+	removed, changed := false, false
+	for retries := 0; retries < 40 && !(removed && changed); retries++ {
+		time.Sleep(50 * time.Millisecond)
+		if conn, err := net.Dial("tcp", "127.0.0.1:30053"); err != nil {
+			removed = true
+		} else {
+			conn.Close()
+		}
+		if line, err := readGreeting("127.0.0.1:30054"); err == nil && strings.Contains(line, "c.example.com") {
+			changed = true
+		}
+	}
+	if !removed || !changed {
+		t.Fatalf("Reload did not apply: removed %v, changed %v", removed, changed)
+	}
+
+	// a server which could not bind is retried by the next reload, though its config is unchanged
+	occupier, err := net.Listen("tcp", "127.0.0.1:30056")
+	if err != nil {
+		t.Fatalf("Could not occupy address: %v", err)
+	}
+	serverD := "- protocol: tcp\n  address: 127.0.0.1:30056\n"
+	writeConfig(t, admin+"servers:\n"+serverC+serverD, conffn)
+	c.Reload()
+	time.Sleep(200 * time.Millisecond)
+	occupier.Close()
+	c.Reload()
+	if err := greetAndQuit("127.0.0.1:30056"); err != nil {
+		t.Fatalf("Server which could not bind not retried: %v", err)
+	}
+}
+
+// HungITP never finishes processing a message, ignoring cancellation, until released
+type HungITP struct {
+	TestITP
+	processing chan struct{} // closed once a message is being processed
+	release    chan struct{} // closed to release the message
+}
+
+func (i *HungITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	close(i.processing)
+	<-i.release
+	return nil, nil
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	itp := &HungITP{processing: make(chan struct{}), release: make(chan struct{})}
+	defer close(itp.release)
+	RegisterHandler("hung", func(p DriverParametersConfig) (InboundTransactionProcessor, error) {
+		return itp, nil
+	})
+	defer func() {
+		handlersMutex.Lock()
+		delete(handlers, "hung")
+		handlersMutex.Unlock()
+	}()
+
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conffn := filepath.Join(dir, "goms.conf")
+	pidfn := filepath.Join(dir, "goms.pid")
+	writeConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30055
+  handler: hung
+shutdowntimeout: 500ms
+`, conffn)
+
+	c := &Control{quit: make(chan struct{})}
+	c.wg.Add(1)
+	flagParse([]string{"goms", "-c", conffn, "-p", pidfn, "-f"})
+	go Run(c)
+	stopped := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
+
+	client := dialTestListener(t, "127.0.0.1:30055")
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	writer, err := client.Data()
+	if err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	}
+	if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- writer.Close()
+	}()
+	select {
+	case <-itp.processing:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message not passed to ITP")
+	}
+
+	// the session never finishes, so is closed once the shutdown timeout expires
+	close(c.quit)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown blocked by hung session")
+	}
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Fatalf("Message accepted by hung session")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Hung session not closed on shutdown")
+	}
+}
+
 func testForegroundAction(t *testing.T, action string) {
 	cmd := exec.Command(os.Args[0], "-test.run=TestForeground")
 	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", gomsfgaction, action))
@@ -0,0 +1,280 @@
+package smtpd_test
+
+import (
+	"github.com/abligh/goms/smtpd"
+	"github.com/abligh/goms/smtpd/gomstest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// These tests need only the public API, so run conversations through gomstest as an ITP's tests
+// would. Tests needing the package's internals use TestConnection instead
+
+// newServer starts a conversation with the ITP given and greets the server
+func newServer(t *testing.T, itp smtpd.InboundTransactionProcessor) *gomstest.Server {
+	s, err := gomstest.NewServer(t, itp, nil)
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := s.Client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	return s
+}
+
+// quit ends the conversation, which must end cleanly
+func quit(t *testing.T, s *gomstest.Server) {
+	if err := s.Client.Quit(); err != nil {
+		t.Fatalf("Cannot send quit to server: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Conversation ended by %v", err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	quit(t, newServer(t, &gomstest.CaptureITP{}))
+}
+
+func TestConnectForbidden(t *testing.T) {
+	if _, err := gomstest.NewServer(t, &gomstest.CaptureITP{
+		ConnectResponse: smtpd.NewResponse(550, "5.5.0 Error: prohibited"),
+	}, nil); err == nil {
+		t.Fatalf("Can connect to server when should have been prohibited")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 550 {
+		t.Fatalf("Expected 550 for prohibited connection, got %v", err)
+	}
+}
+
+func TestAddressingSequencing(t *testing.T) {
+	itp := &gomstest.CaptureITP{}
+	s := newServer(t, itp)
+	client := s.Client
+
+	if err := client.Rcpt("a@b"); err == nil {
+		t.Fatalf("Accepted 'RCPT TO' before MAIL")
+	}
+
+	if err := client.Mail("aa"); err == nil {
+		t.Fatalf("Incorrectly executed bad 'MAIL FROM'")
+	}
+
+	if _, _, err := client.Cmd(250, "MAIL FROM <a@a>"); err == nil {
+		t.Fatalf("Incorrectly executed bad 'MAIL FROM' (no colon)")
+	}
+
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+	}
+
+	if err := client.Mail("a@b"); err == nil {
+		t.Fatalf("Accepted second 'MAIL FROM'")
+	}
+
+	if err := client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+
+	if err := client.Rcpt("aa"); err == nil {
+		t.Fatalf("Incorrectly executed bad 'RCPT TO'")
+	}
+
+	if _, _, err := client.Cmd(250, "RCPT TO <a@a>"); err == nil {
+		t.Fatalf("Incorrectly executed bad 'RCPT TO' (no colon)")
+	}
+
+	itp.RcptResponse = smtpd.NewResponse(550, "5.5.0 Error: prohibited")
+	if err := client.Rcpt("a@a"); err == nil {
+		t.Fatalf("Incorrectly executed prohibited 'RCPT TO'")
+	}
+	itp.RcptResponse = smtpd.NewResponse(220, "OK")
+	if err := client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO' with explicit permission: %v", err)
+	}
+	itp.RcptResponse = nil
+
+	if err := client.Reset(); err != nil {
+		t.Fatalf("Cannot execute RSET: %v", err)
+	}
+
+	if err := client.Rcpt("a@b"); err == nil {
+		t.Fatalf("RSET appears not to have ended transaction")
+	}
+
+	itp.MailResponse = smtpd.NewResponse(550, "5.5.0 Error: prohibited")
+	if err := client.Mail("a@b"); err == nil {
+		t.Fatalf("Incorrectly executed prohibited 'MAIL FROM' after RSET")
+	}
+	itp.MailResponse = nil
+
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' after RSET: %v", err)
+	}
+
+	if err := client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO' after RSET: %v", err)
+	}
+
+	quit(t, s)
+}
+
+func TestData(t *testing.T) {
+	itp := &gomstest.CaptureITP{}
+	s := newServer(t, itp)
+	client := s.Client
+
+	if writer, err := client.Data(); err == nil {
+		t.Fatalf("Incorrectly executed 'DATA' before MAIL FROM")
+	} else if writer != nil {
+		writer.Close()
+	}
+
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+	}
+
+	if writer, err := client.Data(); err == nil {
+		t.Fatalf("Incorrectly executed 'DATA' before RCPT TO")
+	} else if writer != nil {
+		writer.Close()
+	}
+
+	if err := client.Reset(); err != nil {
+		t.Fatalf("Cannot execute RSET: %v", err)
+	}
+
+	// do not put broken line endings in here (e.g. \n rather than \r\n) and ensure you end with a \r, as otherwise
+	// golang's smtp sender fixes them up
+	towrite := "Subject: test\r\n\r\nA line\r\n\r\n.begins with a dot\r\n\r\n.\r\nmore\r\nthat's all folks!\r\n"
+	if err := client.SendMessage("a@b", []string{"a@b"}, towrite); err != nil {
+		t.Fatalf("Message not accepted: %v", err)
+	}
+	if messages := itp.Messages(); len(messages) != 1 || string(messages[0].Data) != towrite {
+		t.Fatalf("Written data not identical")
+	}
+
+	itp.DataResponse = smtpd.NewResponse(550, "5.5.0 Error: prohibited")
+	if err := client.SendMessage("a@b", []string{"a@b"}, towrite); err == nil {
+		t.Fatalf("Message accepted when expected to be prohibited")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 550 {
+		t.Fatalf("Expected 550 for prohibited message, got %v", err)
+	}
+	itp.DataResponse = nil
+
+	quit(t, s)
+}
+
+func TestInvalidAddressRejected(t *testing.T) {
+	s := newServer(t, &gomstest.CaptureITP{})
+	client := s.Client
+
+	// control characters are refused in any command line, before the address is parsed
+	for _, test := range []struct {
+		address string
+		code    int
+		status  string
+	}{
+		{"a\x00b@example.com", 500, "5.5.2 "},
+		{strings.Repeat("x", 300) + "@example.com", 501, "5.1.7 "},
+		{"a\rb@example.com", 500, "5.5.2 "},
+	} {
+		if code, msg, err := client.Cmd(250, "MAIL FROM:<%s>", test.address); err == nil || code != test.code || !strings.HasPrefix(msg, test.status) {
+			t.Fatalf("Expected %d %sfor sender %q, got %d %s", test.code, test.status, test.address, code, msg)
+		}
+	}
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	for _, test := range []struct {
+		address string
+		code    int
+		status  string
+	}{
+		{"c\x00d@example.com", 500, "5.5.2 "},
+		{strings.Repeat("x", 65) + "@example.com", 501, "5.1.3 "},
+		{"c\rd@example.com", 500, "5.5.2 "},
+	} {
+		if code, msg, err := client.Cmd(250, "RCPT TO:<%s>", test.address); err == nil || code != test.code || !strings.HasPrefix(msg, test.status) {
+			t.Fatalf("Expected %d %sfor recipient %q, got %d %s", test.code, test.status, test.address, code, msg)
+		}
+	}
+	quit(t, s)
+}
+
+func TestPathFramingRejected(t *testing.T) {
+	s := newServer(t, &gomstest.CaptureITP{})
+	client := s.Client
+
+	for _, args := range []string{"<a@b", "<a@b SIZE=100", "a@b>", "<a@b>SIZE=100"} {
+		if code, msg, err := client.Cmd(250, "MAIL FROM:%s", args); err == nil || code != 501 || !strings.HasPrefix(msg, "5.1.7 ") {
+			t.Fatalf("Expected 501 5.1.7 for MAIL FROM:%s, got %d %s", args, code, msg)
+		}
+	}
+	if _, _, err := client.Cmd(250, "MAIL FROM: a@b SIZE=100"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' without angle brackets: %v", err)
+	}
+	for _, args := range []string{"<c@d", "<c@d NOTIFY=NEVER", "c@d>", "<c@d>NOTIFY=NEVER"} {
+		if code, msg, err := client.Cmd(250, "RCPT TO:%s", args); err == nil || code != 501 || !strings.HasPrefix(msg, "5.1.3 ") {
+			t.Fatalf("Expected 501 5.1.3 for RCPT TO:%s, got %d %s", args, code, msg)
+		}
+	}
+	if code, msg, err := client.Cmd(250, "RCPT TO:<c@d> NOTIFY="); err == nil || code != 501 || !strings.HasPrefix(msg, "5.5.4 ") {
+		t.Fatalf("Expected 501 5.5.4 for malformed RCPT parameter, got %d %s", code, msg)
+	}
+	if _, _, err := client.Cmd(250, "RCPT TO:< c@d > NOTIFY=NEVER"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO' with parameters: %v", err)
+	}
+	quit(t, s)
+}
+
+func TestNullRecipient(t *testing.T) {
+	s := newServer(t, &gomstest.CaptureITP{})
+	client := s.Client
+
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	for _, args := range []string{"<>", "< >"} {
+		if code, msg, err := client.Cmd(250, "RCPT TO:%s", args); err == nil || code != 550 || msg != "5.1.3 Error: recipient address may not be null" {
+			t.Fatalf("Expected null recipient rejection for RCPT TO:%s, got %d %s", args, code, msg)
+		}
+	}
+	if err := client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO' after null recipient: %v", err)
+	}
+	quit(t, s)
+}
+
+func TestCommandCharacters(t *testing.T) {
+	itp := &gomstest.CaptureITP{}
+	s := newServer(t, itp)
+	client := s.Client
+
+	for _, line := range []string{"NO\x00OP", "NOOP\x00", "MAIL FROM:<a@b>\x00", "NOOP\rRSET", "MAIL FROM:<a@b>\rRCPT TO:<c@d>", "NOOP\x1b[2J", "NOOP\x7f"} {
+		if code, msg, err := client.Cmd(250, "%s", line); err == nil || code != 500 || !strings.HasPrefix(msg, "5.5.2 ") {
+			t.Fatalf("Expected 500 5.5.2 for %q, got %d %s", line, code, msg)
+		}
+	}
+	for _, line := range []string{"HELO bücher.example", "NOOP \xff", "RCPT TO:<c@b\xffcher.example>"} {
+		if code, msg, err := client.Cmd(250, "%s", line); err == nil || code != 500 || !strings.HasPrefix(msg, "5.5.2 ") {
+			t.Fatalf("Expected 500 5.5.2 for %q, got %d %s", line, code, msg)
+		}
+	}
+	// nothing was smuggled into a transaction
+	if code, _, err := client.Cmd(250, "RCPT TO:<c@d>"); err == nil || code != 503 {
+		t.Fatalf("Expected 503 for RCPT without MAIL, got %d %v", code, err)
+	}
+	if _, _, err := client.Cmd(250, "NOOP ignored\tstring"); err != nil {
+		t.Fatalf("NOOP with a tab rejected: %v", err)
+	}
+
+	// UTF-8 is permitted in addresses, and anything but NUL, CR and LF in DATA
+	if err := client.SendMessage("a@b", []string{"c@bücher.example"}, "Subject: \x1b\x7f\xff\r\n\r\nbody\r\n"); err != nil {
+		t.Fatalf("Message not accepted: %v", err)
+	}
+	if len(itp.Messages()) != 1 {
+		t.Fatalf("Message not received")
+	}
+	quit(t, s)
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd
+// +build linux darwin dragonfly freebsd
+
+package smtpd
+
+import (
+	"os"
+	"syscall"
+)
+
+// setCredentials changes the user and group IDs of the process, dropping supplementary groups.
+// The group must be changed first, as it cannot be changed once root privileges are given up
+func setCredentials(uid, gid int) error {
+	if os.Getuid() == uid && os.Geteuid() == uid && os.Getgid() == gid && os.Getegid() == gid {
+		return nil // e.g. privileges were dropped before a reload
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// changeRoot changes the root directory of the process to dir, and the working directory to
+// the new root so nothing outside it remains reachable
+func changeRoot(dir string) error {
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+	return os.Chdir("/")
+}
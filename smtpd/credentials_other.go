@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd
+// +build !linux,!darwin,!dragonfly,!freebsd
+
+package smtpd
+
+import (
+	"errors"
+)
+
+// setCredentials is not supported on this platform
+func setCredentials(uid, gid int) error {
+	return errors.New("Changing user and group is not supported on this platform")
+}
+
+// changeRoot is not supported on this platform
+func changeRoot(dir string) error {
+	return errors.New("Changing root directory is not supported on this platform")
+}
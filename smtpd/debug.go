@@ -0,0 +1,55 @@
+package smtpd
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"sync"
+	"time"
+)
+
+// debugShutdownTimeout is the time allowed for requests to the debug server to finish on shutdown
+const debugShutdownTimeout = 5 * time.Second
+
+// listenDebug binds the debug HTTP server, which serves pprof and the health check endpoints, to
+// the address given. It is served until ctx is done, and wg is released once it has shut down
+func listenDebug(ctx context.Context, wg *sync.WaitGroup, logger *log.Logger, address string, ready *readiness) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", ready.serveReadyz)
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+
+	li, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+
+	logger.Printf("[INFO] Starting debug server on %s", li.Addr())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				shutdownCtx, cancelFunc := context.WithTimeout(context.Background(), debugShutdownTimeout)
+				defer cancelFunc()
+				server.Shutdown(shutdownCtx)
+			case <-done:
+			}
+		}()
+		if err := server.Serve(li); err != http.ErrServerClosed {
+			logger.Printf("[ERROR] Debug server failed: %v", err)
+		}
+		close(done)
+		logger.Printf("[INFO] Stopped debug server on %s", li.Addr())
+	}()
+	return nil
+}
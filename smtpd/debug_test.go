@@ -0,0 +1,110 @@
+package smtpd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebugServer(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wg sync.WaitGroup
+	if err := listenDebug(ctx, &wg, newTestLogger(t), "127.0.0.1:30039", newReadiness()); err != nil {
+		t.Fatalf("Could not start debug server: %v", err)
+	}
+
+	if resp, err := http.Get("http://127.0.0.1:30039/debug/pprof/"); err != nil {
+		t.Fatalf("Could not reach debug server: %v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 from debug server, got %d", resp.StatusCode)
+		}
+	}
+
+	// the address is in use until the server is shut down
+	if err := listenDebug(ctx, &wg, newTestLogger(t), "127.0.0.1:30039", newReadiness()); err == nil {
+		t.Fatalf("Started a second debug server on the same address")
+	}
+
+	cancelFunc()
+	wg.Wait()
+	if resp, err := http.Get("http://127.0.0.1:30039/debug/pprof/"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("Debug server still running after shutdown")
+	}
+}
+
+// readyzStatus fetches /readyz, returning the status code and body
+func readyzStatus(t *testing.T, url string) (int, readinessStatus) {
+	var s readinessStatus
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Could not reach debug server: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatalf("Could not decode readiness: %v", err)
+	}
+	return resp.StatusCode, s
+}
+
+func TestHealthReadiness(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancelFunc()
+		wg.Wait()
+	}()
+
+	ready := newReadiness()
+	ready.expect("tcp:127.0.0.1:30040")
+	if err := listenDebug(ctx, &wg, newTestLogger(t), "127.0.0.1:30041", ready); err != nil {
+		t.Fatalf("Could not start debug server: %v", err)
+	}
+
+	if resp, err := http.Get("http://127.0.0.1:30041/healthz"); err != nil {
+		t.Fatalf("Could not reach debug server: %v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 from /healthz, got %d", resp.StatusCode)
+		}
+	}
+
+	if code, s := readyzStatus(t, "http://127.0.0.1:30041/readyz"); code != http.StatusServiceUnavailable || s.Ready || s.Listeners["tcp:127.0.0.1:30040"] {
+		t.Fatalf("Expected not ready before listener bound, got %d: %+v", code, s)
+	}
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30040",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.readiness = ready
+	stop := startListener(l)
+
+	code, s := 0, readinessStatus{}
+	for retries := 0; retries < 20; retries++ {
+		if code, s = readyzStatus(t, "http://127.0.0.1:30041/readyz"); code == http.StatusOK {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if code != http.StatusOK || !s.Ready || !s.Listeners["tcp:127.0.0.1:30040"] {
+		t.Fatalf("Expected ready once listener bound, got %d: %+v", code, s)
+	}
+
+	ready.shutdown()
+	if code, s := readyzStatus(t, "http://127.0.0.1:30041/readyz"); code != http.StatusServiceUnavailable || !s.ShuttingDown {
+		t.Fatalf("Expected not ready when shutting down, got %d: %+v", code, s)
+	}
+
+	stop()
+}
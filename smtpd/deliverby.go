@@ -0,0 +1,53 @@
+package smtpd
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byRE matches the value of the BY MAIL parameter (RFC2852 4), capturing the by-time, the
+// by-mode and the trace modifier
+var byRE = regexp.MustCompile(`^([+-]?[0-9]{1,9});([NnRr])([Tt]?)$`)
+
+// DeliverBy is the deadline for delivery given with the BY MAIL parameter (RFC2852)
+type DeliverBy struct {
+	Deadline time.Time // the time by which the message should be delivered
+	Return   bool      // true to return the message if it is not delivered in time (by-mode R)
+	Trace    bool      // true if a delay notification was requested if it is not (the T modifier)
+}
+
+// parseDeliverBy parses the value of the BY MAIL parameter received at the time given,
+// returning false if it is malformed or outside the limits configured
+func (c *InboundConnection) parseDeliverBy(value string, now time.Time) (*DeliverBy, bool) {
+	match := byRE.FindStringSubmatch(value)
+	if match == nil {
+		return nil, false
+	}
+	byTime, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, false
+	}
+	by := &DeliverBy{
+		Deadline: now.Add(time.Duration(byTime) * time.Second),
+		Return:   strings.EqualFold(match[2], "R"),
+		Trace:    match[3] != "",
+	}
+	// RFC2852 4.1, the minimum applying only where the message would be returned
+	if by.Return && (byTime <= 0 || time.Duration(byTime)*time.Second < c.params.DeliverByMinimum) {
+		return nil, false
+	}
+	if c.params.DeliverByMaximum > 0 && time.Duration(byTime)*time.Second > c.params.DeliverByMaximum {
+		return nil, false
+	}
+	return by, true
+}
+
+// DeliverBy returns the deadline for delivery of the current transaction given with the BY MAIL
+// parameter (RFC2852), or nil if none was given. An ITP relaying the message must pass on the
+// time remaining, and return it (or, if Return is false, notify the sender of the delay) if the
+// deadline passes
+func (c *InboundConnection) DeliverBy() *DeliverBy {
+	return c.deliverBy
+}
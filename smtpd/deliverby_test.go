@@ -0,0 +1,100 @@
+package smtpd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// DeliverByITP records the delivery deadline of each transaction
+type DeliverByITP struct {
+	DummyITP
+	deliverBy []*DeliverBy
+}
+
+func (i *DeliverByITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	i.deliverBy = append(i.deliverBy, c.DeliverBy())
+	return nil, nil
+}
+
+func TestDeliverBy(t *testing.T) {
+	for _, s := range []ServerConfig{
+		{Protocol: "tcp", Address: "127.0.0.1:30025", DeliverByMinimum: "wombat"},
+		{Protocol: "tcp", Address: "127.0.0.1:30025", DeliverByMaximum: "1.5s"},
+		{Protocol: "tcp", Address: "127.0.0.1:30025", DeliverByMinimum: "1h", DeliverByMaximum: "1m"},
+	} {
+		if _, err := NewListener(newTestLogger(t), s); err == nil {
+			t.Fatalf("Accepted bad DELIVERBY limits '%s' and '%s'", s.DeliverByMinimum, s.DeliverByMaximum)
+		}
+	}
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:         "tcp",
+		Address:          "127.0.0.1:30025",
+		DeliverByMinimum: "60s",
+		DeliverByMaximum: "24h",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	now := time.Now()
+	l.SetClock(newFakeClock(now))
+	itp := &DeliverByITP{}
+	tc := newTestConnectionWithListener(t, l, itp)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if ok, min := tc.client.Extension("DELIVERBY"); !ok || min != "60" {
+		t.Fatalf("Wrong DELIVERBY advertised: %v %s", ok, min)
+	}
+
+	for _, by := range []string{
+		"", "60", "60;X", ";R", "1234567890;R", "60;RT;", // malformed
+		"30;R", "0;R", "-60;R", // less than the minimum, or not positive, for a return
+		"86401;N", "86401;R", // more than the maximum
+	} {
+		if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<a@b> BY=%s", by); err == nil || code != 501 || !strings.HasPrefix(msg, "5.5.4 ") {
+			t.Fatalf("Expected 501 5.5.4 for BY=%s, got %d %s", by, code, msg)
+		}
+	}
+	if len(itp.deliverBy) != 0 {
+		t.Fatalf("ITP consulted for a bad BY parameter")
+	}
+
+	for _, test := range []struct {
+		by       string
+		expected *DeliverBy
+	}{
+		{"60;R", &DeliverBy{Deadline: now.Add(time.Minute), Return: true}},
+		{"86400;rt", &DeliverBy{Deadline: now.Add(24 * time.Hour), Return: true, Trace: true}},
+		{"-30;N", &DeliverBy{Deadline: now.Add(-30 * time.Second)}},
+		{"+10;NT", &DeliverBy{Deadline: now.Add(10 * time.Second), Trace: true}},
+		{"", nil},
+	} {
+		param := ""
+		if test.by != "" {
+			param = " BY=" + test.by
+		}
+		if _, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b>%s", param); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM' with BY=%s: %v", test.by, err)
+		}
+		by := itp.deliverBy[len(itp.deliverBy)-1]
+		if (by == nil) != (test.expected == nil) || by != nil && *by != *test.expected {
+			t.Fatalf("BY=%s gave %+v, expected %+v", test.by, by, test.expected)
+		}
+		if err := tc.client.Reset(); err != nil {
+			t.Fatalf("Cannot execute 'RSET': %v", err)
+		}
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
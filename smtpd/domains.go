@@ -0,0 +1,83 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	blockedSenderMessage    = "5.7.1 Error: sender domain blocked"
+	blockedRecipientMessage = "5.7.1 Error: recipient domain blocked"
+	blockedDefaultCode      = 550
+)
+
+// DomainFilter rejects envelope addresses whose domain matches any of a list of patterns, before
+// they are passed to the ITP. A pattern either gives a domain exactly (e.g. "spammer.net") or, if
+// it starts with "*.", matches every subdomain of the domain following (e.g. "*.example.com")
+type DomainFilter struct {
+	exact    map[string]bool // domains matched exactly
+	suffixes []string        // suffixes (with a leading dot) matching subdomains
+	response *ICResponse     // the response to return for a blocked address
+}
+
+// NewDomainFilter returns a DomainFilter from the configuration supplied, with the default text
+// given if none is configured. nil is returned if no domains are configured
+func NewDomainFilter(d DomainFilterConfig, defaultMessage string) (*DomainFilter, error) {
+	if len(d.Domains) == 0 {
+		return nil, nil
+	}
+	f := &DomainFilter{exact: make(map[string]bool)}
+	for _, pattern := range d.Domains {
+		domain := strings.TrimSuffix(pattern, ".")
+		wildcard := strings.HasPrefix(domain, "*.")
+		if wildcard {
+			domain = domain[2:]
+		}
+		if domain == "" || strings.ContainsAny(domain, "*@:<> \t") {
+			return nil, fmt.Errorf("Bad blocked domain: '%s'", pattern)
+		}
+		// match the canonical form of addresses' domains
+		if canonical, ok := canonicalDomain(domain); !ok {
+			return nil, fmt.Errorf("Bad blocked domain: '%s'", pattern)
+		} else {
+			domain = canonical
+		}
+		if wildcard {
+			f.suffixes = append(f.suffixes, "."+domain)
+		} else {
+			f.exact[domain] = true
+		}
+	}
+	code := d.Code
+	if code == 0 {
+		code = blockedDefaultCode
+	}
+	if code < 400 || code > 599 {
+		return nil, fmt.Errorf("Bad blocked domain response code: %d", d.Code)
+	}
+	message := d.Message
+	if message == "" {
+		message = defaultMessage
+	}
+	f.response = NewResponse(code, message)
+	return f, nil
+}
+
+// Check returns the configured response if the address is in a blocked domain, and otherwise nil
+func (f *DomainFilter) Check(address *AddressString) *ICResponse {
+	a := address.String()
+	i := strings.LastIndexByte(a, '@')
+	if i < 0 {
+		return nil
+	}
+	domain := a[i+1:]
+	if f.exact[domain] {
+		return f.response
+	}
+	for _, suffix := range f.suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return f.response
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainFilter(t *testing.T) {
+	f, err := NewDomainFilter(DomainFilterConfig{Domains: []string{"Spammer.NET", "*.example.com", "*.bad.example.org.", "bücher.example"}}, blockedSenderMessage)
+	if err != nil {
+		t.Fatalf("Could not create domain filter: %v", err)
+	}
+	for _, test := range []struct {
+		address string
+		blocked bool
+	}{
+		{"a@spammer.net", true},       // exact
+		{"a@mail.spammer.net", false}, // exact patterns do not match subdomains
+		{"a@mail.example.com", true},  // wildcard
+		{"a@x.y.example.com", true},   // wildcard at any depth
+		{"a@example.com", false},      // wildcard patterns do not match the domain itself
+		{"a@notexample.com", false},   // nor other domains with the same ending
+		{"a@x.bad.example.org", true}, // trailing dot ignored
+		{"a@spammer.net.au", false},   // non-matching
+		{"spammer.net@example.net", false},
+		{"a@xn--bcher-kva.example", true}, // IDN patterns match A-labels
+		{"a@Bücher.example", true},
+	} {
+		a := CanonicaliseInboundAddress(test.address)
+		if r := f.Check(a); (r != nil) != test.blocked {
+			t.Fatalf("Check(%s) gave %v, expected blocked %v", test.address, r, test.blocked)
+		} else if r != nil && (r.lines[0].code != 550 || r.lines[0].text != blockedSenderMessage) {
+			t.Fatalf("Wrong response for %s: %d %s", test.address, r.lines[0].code, r.lines[0].text)
+		}
+	}
+
+	if f, err := NewDomainFilter(DomainFilterConfig{}, blockedSenderMessage); f != nil || err != nil {
+		t.Fatalf("Empty domain filter created: %v %v", f, err)
+	}
+	for _, d := range []DomainFilterConfig{
+		{Domains: []string{""}},
+		{Domains: []string{"*"}},
+		{Domains: []string{"*."}},
+		{Domains: []string{"a.*.example.com"}},
+		{Domains: []string{"a@example.com"}},
+		{Domains: []string{"example.com"}, Code: 250},
+	} {
+		if _, err := NewDomainFilter(d, blockedSenderMessage); err == nil {
+			t.Fatalf("Bad domain filter config %v accepted", d)
+		}
+	}
+}
+
+func TestDomainFilterConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "goms.conf")
+	writeConfig(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  filters:
+    senders:
+      domains: [ spammer.net, "*.example.com" ]
+    recipients:
+      domains: [ "*.internal.example.org" ]
+      code: 551
+      message: "5.7.1 Error: not routed from outside"
+`, fn)
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	l, err := NewListener(newTestLogger(t), c.Servers[0])
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	for _, sender := range []string{"a@spammer.net", "a@mail.example.com"} {
+		if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<%s>", sender); err == nil || code != 550 || msg != blockedSenderMessage {
+			t.Fatalf("Expected blocked sender %s to be rejected, got %d %s", sender, code, msg)
+		}
+	}
+	if err := tc.client.Mail("a@example.com"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if code, msg, err := tc.client.Cmd(250, "RCPT TO:<b@hr.internal.example.org>"); err == nil || code != 551 || msg != "5.7.1 Error: not routed from outside" {
+		t.Fatalf("Expected blocked recipient to be rejected, got %d %s", code, msg)
+	}
+	if err := tc.client.Rcpt("b@internal.example.org"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
@@ -0,0 +1,87 @@
+package smtpd
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies what an Event records
+type EventType int
+
+const (
+	EventConnectionOpened   EventType = iota // a connection was accepted
+	EventConnectionClosed                    // a connection was closed (Err holds the error which ended it, if any)
+	EventTLSStarted                          // TLS was negotiated following STARTTLS
+	EventTransactionStarted                  // MAIL was accepted, starting a transaction
+	EventMessageAccepted                     // a message was accepted in response to DATA
+	EventMessageRejected                     // a message was rejected in response to DATA
+)
+
+// Map of event types to their names
+var eventTypeNames = map[EventType]string{
+	EventConnectionOpened:   "connection opened",
+	EventConnectionClosed:   "connection closed",
+	EventTLSStarted:         "TLS started",
+	EventTransactionStarted: "transaction started",
+	EventMessageAccepted:    "message accepted",
+	EventMessageRejected:    "message rejected",
+}
+
+// String returns the name of an event type
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event is a structured record of something happening on a connection, for metrics, auditing and
+// the like. Fields not relevant to the type of event are left empty
+type Event struct {
+	Type         EventType
+	Time         time.Time          // when the event happened
+	ConnectionID uint64             // the ID of the connection, unique within the process
+	RemoteAddr   net.Addr           // the client's address
+	Sender       AddressString      // the reverse path (transaction and message events)
+	Recipients   []*AddressString   // the forward paths (message events)
+	Code         int                // the response code sent (message events)
+	Response     string             // the text of the response sent, e.g. giving a queue ID (message events)
+	Size         int                // the size of the message in bytes (message events, if the message was received in full)
+	TLS          bool               // true if the connection is encrypted (message events)
+	AuthIdentity string             // the identity the client authenticated as, if any (message events)
+	Err          error              // the error ending the connection (nil if the client quit)
+	Timing       *TransactionTiming // the time taken by each phase (message events, if the message was received in full)
+}
+
+// EventHandler receives the events of each connection. HandleEvent is called from the goroutine
+// serving the connection, and so should not block; it may be called concurrently for different
+// connections
+type EventHandler interface {
+	HandleEvent(e *Event)
+}
+
+// connectionIDs is the ID most recently given to a connection
+var connectionIDs uint64
+
+// nextConnectionID returns a new connection ID
+func nextConnectionID() uint64 {
+	return atomic.AddUint64(&connectionIDs, 1)
+}
+
+// ID returns the ID of the connection, which is unique within the process
+func (c *InboundConnection) ID() uint64 {
+	return c.id
+}
+
+// sendEvent completes an event with the details of the connection and passes it to the event
+// handler, if there is one
+func (c *InboundConnection) sendEvent(e *Event) {
+	if c.params.EventHandler == nil {
+		return
+	}
+	e.Time = c.clock().Now()
+	e.ConnectionID = c.id
+	e.RemoteAddr = c.plainConn.RemoteAddr()
+	c.params.EventHandler.HandleEvent(e)
+}
@@ -0,0 +1,107 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// EventRecorder is an EventHandler which records the events it receives
+type EventRecorder struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (r *EventRecorder) HandleEvent(e *Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, *e)
+}
+
+func TestEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls: TlsConfig{
+			KeyFile: writeTestCertificate(t, dir, "mail.example.com"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	recorder := &EventRecorder{}
+	l.SetEventHandler(recorder)
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
+	}
+	if err := sendPartialRecipients(t, tc, "c@d", "e@f"); err != nil {
+		t.Fatalf("Message not accepted: %v", err)
+	}
+	if err := tc.client.Mail("g@h"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("i@j"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	tc.itp.r = NewResponse(554, "5.7.1 Error: rejected")
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("body\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		checkSinkCode(t, writer.Close(), 554, "data")
+	}
+	quitTLS(t, tc)
+	<-tc.done
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	expected := []struct {
+		eventType EventType
+		sender    AddressString
+		code      int
+	}{
+		{EventConnectionOpened, "", 0},
+		{EventTLSStarted, "", 0},
+		{EventTransactionStarted, "a@b", 0},
+		{EventMessageAccepted, "a@b", 250},
+		{EventTransactionStarted, "g@h", 0},
+		{EventMessageRejected, "g@h", 554},
+		{EventConnectionClosed, "", 0},
+	}
+	if len(recorder.events) != len(expected) {
+		t.Fatalf("Expected %d events, got %v", len(expected), recorder.events)
+	}
+	for i, e := range recorder.events {
+		if e.Type != expected[i].eventType || e.Sender != expected[i].sender || e.Code != expected[i].code {
+			t.Fatalf("Event %d was %s from %s with code %d, expected %s from %s with code %d", i, e.Type, e.Sender, e.Code, expected[i].eventType, expected[i].sender, expected[i].code)
+		}
+		if e.ConnectionID != tc.ic.ID() || e.RemoteAddr == nil || e.Time.IsZero() {
+			t.Fatalf("Event %d lacks connection details: %+v", i, e)
+		}
+	}
+	if r := recorder.events[3].Recipients; len(r) != 2 || r[0].String() != "c@d" || r[1].String() != "e@f" {
+		t.Fatalf("Wrong recipients for accepted message: %v", r)
+	}
+	if err := recorder.events[6].Err; err != nil {
+		t.Fatalf("Connection closed with error %v after QUIT", err)
+	}
+}
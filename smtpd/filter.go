@@ -0,0 +1,147 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// Envelope holds the envelope of a message and details of the client that sent it
+type Envelope struct {
+	Sender             AddressString        // the reverse path (empty for the null sender)
+	Recipients         []*AddressString     // the forward paths (after rewriting by any aliases)
+	OriginalRecipients []*AddressString     // the forward paths as given by the client
+	HeloName           string               // the name the client gave in HELO or EHLO
+	RemoteAddr         net.Addr             // the client's address
+	RequireTLS         bool                 // true if onward delivery must use TLS (RFC8689)
+	SMTPUTF8           bool                 // true if the envelope and headers may contain UTF-8 (RFC6531)
+	Priority           int                  // the priority given by the client, from -9 to 9 (RFC6710; 0 if none)
+	DeliverBy          *DeliverBy           // the deadline for delivery given by the client (RFC2852; nil if none)
+	Headers            textproto.MIMEHeader // the message headers (nil unless header parsing is enabled)
+	XForward           map[string]string    // the original client's attributes given by XFORWARD (nil if none)
+}
+
+// ContentFilter is implemented by content filters (e.g. spam scoring, virus scanning or header
+// policy), which examine each message once it has been received and before it is passed to the
+// ITP. The body has had its dot-stuffing removed. Scan returns an error response to reject the
+// message, which becomes the response to DATA, or nil to accept it
+type ContentFilter interface {
+	Scan(ctx context.Context, envelope *Envelope, body []byte) (*ICResponse, error)
+}
+
+// ContentFilters is a ContentFilter which runs a chain of filters in order. The first filter to
+// reject the message determines the response, and later filters are not run
+type ContentFilters []ContentFilter
+
+// Scan runs each filter in turn until one rejects the message
+func (f ContentFilters) Scan(ctx context.Context, envelope *Envelope, body []byte) (*ICResponse, error) {
+	for _, filter := range f {
+		if r, err := filter.Scan(ctx, envelope, body); err != nil || r != nil && r.IsError() {
+			return r, err
+		}
+	}
+	return nil, nil
+}
+
+// RequiredHeadersFilter is a ContentFilter which rejects messages lacking any of a list of
+// required headers, or having any of a list of forbidden ones. A header is present however many
+// times it is given. The headers parsed for the envelope are checked if header parsing is enabled,
+// and the message's own parsed otherwise
+type RequiredHeadersFilter struct {
+	Headers   []string // the names of the headers required
+	Forbidden []string // the names of the headers forbidden
+	Code      int      // the response code for a rejected message (default 550)
+	Message   string   // the response text for a rejected message (blank to name the header)
+}
+
+// NewRequiredHeadersFilter returns a RequiredHeadersFilter requiring the headers every message
+// must have (RFC5322 3.6)
+func NewRequiredHeadersFilter() *RequiredHeadersFilter {
+	return &RequiredHeadersFilter{Headers: []string{"Date", "From"}}
+}
+
+// NewHeaderPolicyFilter returns a RequiredHeadersFilter enforcing the header policy configured.
+// nil is returned if no headers are configured
+func NewHeaderPolicyFilter(h HeaderPolicyConfig) (*RequiredHeadersFilter, error) {
+	if len(h.Required) == 0 && len(h.Forbidden) == 0 {
+		return nil, nil
+	}
+	for _, name := range append(append([]string{}, h.Required...), h.Forbidden...) {
+		// RFC5322 2.2: printable characters other than colon
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' || r == ':' }) >= 0 {
+			return nil, fmt.Errorf("Bad header name: '%s'", name)
+		}
+	}
+	if h.Code != 0 && (h.Code < 400 || h.Code > 599) {
+		return nil, fmt.Errorf("Bad header policy response code: %d", h.Code)
+	}
+	return &RequiredHeadersFilter{
+		Headers:   h.Required,
+		Forbidden: h.Forbidden,
+		Code:      h.Code,
+		Message:   h.Message,
+	}, nil
+}
+
+// reject returns the response rejecting a message, with the default text given if none is configured
+func (f *RequiredHeadersFilter) reject(format string, name string) *ICResponse {
+	code := f.Code
+	if code == 0 {
+		code = 550
+	}
+	if f.Message != "" {
+		return NewResponse(code, f.Message)
+	}
+	// RFC3463 3.7
+	return NewResponse(code, fmt.Sprintf("%d.6.0 Error: message has "+format, code/100, name))
+}
+
+// Scan rejects the message if a required header is missing or a forbidden header is present
+func (f *RequiredHeadersFilter) Scan(ctx context.Context, envelope *Envelope, body []byte) (*ICResponse, error) {
+	headers := envelope.Headers
+	if headers == nil {
+		// header parsing is not enabled; a malformed header ends the headers, as it would have then
+		headers, _ = readHeaders(body)
+	}
+	present := headerNames(headers)
+	for _, h := range f.Headers {
+		if !present[strings.ToLower(h)] {
+			return f.reject("no %s header", h), nil
+		}
+	}
+	for _, h := range f.Forbidden {
+		if present[strings.ToLower(h)] {
+			return f.reject("forbidden %s header", h), nil
+		}
+	}
+	return nil, nil
+}
+
+// readHeaders parses the header section of a message, which ends at the first empty line (or the
+// end of the message if there is none). If a header is malformed, the headers before it are
+// returned with the error
+func readHeaders(body []byte) (textproto.MIMEHeader, error) {
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(body))).ReadMIMEHeader()
+	if err == io.EOF {
+		err = nil
+	}
+	if h == nil {
+		h = textproto.MIMEHeader{}
+	}
+	return h, err
+}
+
+// headerNames returns the set of the (lower-cased) names of the headers given. Whitespace before
+// the colon, which textproto keeps in the name, is ignored (RFC5322 4.5.8)
+func headerNames(headers textproto.MIMEHeader) map[string]bool {
+	names := make(map[string]bool)
+	for name := range headers {
+		names[strings.ToLower(strings.TrimRight(name, " \t"))] = true
+	}
+	return names
+}
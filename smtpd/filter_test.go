@@ -0,0 +1,276 @@
+package smtpd
+
+import (
+	"context"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// RecordingFilter records what it is passed, and returns a fixed response
+type RecordingFilter struct {
+	envelope *Envelope
+	body     []byte
+	response *ICResponse
+}
+
+func (f *RecordingFilter) Scan(ctx context.Context, envelope *Envelope, body []byte) (*ICResponse, error) {
+	f.envelope = envelope
+	f.body = append([]byte{}, body...)
+	return f.response, nil
+}
+
+func TestRequiredHeadersFilter(t *testing.T) {
+	f := NewRequiredHeadersFilter()
+	for _, test := range []struct {
+		body     string
+		rejected bool
+	}{
+		{"Date: today\r\nFrom: a@b\r\n\r\nbody\r\n", false},
+		{"date: today\r\nfrom : a@b\r\n\r\nbody\r\n", false},
+		{"Subject: folded\r\n header\r\nFrom: a@b\r\nDate: today\r\n", false},
+		{"From: a@b\r\n\r\nbody\r\n", true},
+		{"Date: today\r\n\r\nFrom: a@b\r\n", true},
+		{"Subject: folded\r\n From: a@b\r\nDate: today\r\n\r\n", true},
+		{"", true},
+	} {
+		r, err := f.Scan(context.Background(), &Envelope{}, []byte(test.body))
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if rejected := r != nil && r.IsError(); rejected != test.rejected {
+			t.Fatalf("Scan of %q rejected %v, expected %v", test.body, rejected, test.rejected)
+		}
+		if test.rejected && (r.Lines()[0].Code() != 550 || !strings.HasPrefix(r.Lines()[0].Text(), "5.6.0 ")) {
+			t.Fatalf("Wrong rejection: %v", r)
+		}
+	}
+}
+
+func TestContentFilters(t *testing.T) {
+	first := &RecordingFilter{}
+	second := &RecordingFilter{response: NewResponse(554, "5.7.1 Error: spam")}
+	third := &RecordingFilter{response: NewResponse(550, "5.7.1 Error: virus")}
+	r, err := ContentFilters{first, second, third}.Scan(context.Background(), &Envelope{}, []byte("body"))
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if r == nil || r.Lines()[0].Code() != 554 {
+		t.Fatalf("Expected the first rejection to win, got %v", r)
+	}
+	if first.body == nil || second.body == nil || third.body != nil {
+		t.Fatalf("Wrong filters run")
+	}
+}
+
+func TestContentFilterData(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	recorder := &RecordingFilter{}
+	l.SetContentFilter(ContentFilters{recorder, NewRequiredHeadersFilter()})
+	itp := &StateITP{}
+	tc := newTestConnectionWithListener(t, l, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("client.example.com"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+
+	send := func(msg string) error {
+		if err := tc.client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		writer, err := tc.client.Data()
+		if err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		}
+		if _, err := writer.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		return writer.Close()
+	}
+
+	if err := send("Subject: no date\r\n\r\n.dotted\r\n"); err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("Expected 550 for message without headers, got %v", err)
+	}
+	if string(recorder.body) != "Subject: no date\r\n\r\n.dotted\r\n" {
+		t.Fatalf("Filter saw wrong body: %q", recorder.body)
+	}
+	if recorder.envelope.Sender != "a@b" || recorder.envelope.HeloName != "client.example.com" ||
+		len(recorder.envelope.Recipients) != 1 || *recorder.envelope.Recipients[0] != "c@d" {
+		t.Fatalf("Filter saw wrong envelope: %+v", recorder.envelope)
+	}
+	if itp.sender != "" {
+		t.Fatalf("Rejected message passed to ITP")
+	}
+
+	if err := send("Date: today\r\nFrom: a@b\r\n\r\nbody\r\n"); err != nil {
+		t.Fatalf("Message with headers rejected: %v", err)
+	}
+	if itp.sender != "a@b" {
+		t.Fatalf("Accepted message not passed to ITP")
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestHeaderPolicyFilter(t *testing.T) {
+	f, err := NewHeaderPolicyFilter(HeaderPolicyConfig{
+		Required:  []string{"From", "Date", "Message-ID"},
+		Forbidden: []string{"X-Spam-Flag"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create header policy: %v", err)
+	}
+	for _, test := range []struct {
+		body     string
+		rejected string // the header named in the rejection (blank if accepted)
+	}{
+		{"From: a@b\r\nDate: today\r\nMessage-ID: <1@b>\r\n\r\nbody\r\n", ""},
+		{"from: a@b\r\ndate : today\r\nMESSAGE-ID: <1@b>\r\n\r\n", ""},
+		// a folded header is one header, and its continuation lines are not headers
+		{"From: a@b\r\nDate:\r\n today\r\nMessage-ID:\r\n\t<1@b>\r\nSubject: folded\r\n X-Spam-Flag: YES\r\n\r\n", ""},
+		{"From: a@b\r\nSubject: folded\r\n Date: today\r\nMessage-ID: <1@b>\r\n\r\n", "Date"},
+		// duplicates satisfy a requirement, and are as forbidden as one
+		{"From: a@b\r\nFrom: c@d\r\nDate: today\r\nMessage-ID: <1@b>\r\n\r\n", ""},
+		{"From: a@b\r\nDate: today\r\nMessage-ID: <1@b>\r\nX-Spam-Flag: NO\r\nX-Spam-Flag: YES\r\n\r\n", "X-Spam-Flag"},
+		{"From: a@b\r\nDate: today\r\n\r\nMessage-ID: <1@b>\r\n", "Message-ID"},
+		{"", "From"},
+	} {
+		r, err := f.Scan(context.Background(), &Envelope{}, []byte(test.body))
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if test.rejected == "" {
+			if r != nil {
+				t.Fatalf("Scan of %q rejected: %v", test.body, r)
+			}
+			continue
+		}
+		if r == nil || r.Lines()[0].Code() != 550 || !strings.HasPrefix(r.Lines()[0].Text(), "5.6.0 ") ||
+			!strings.Contains(r.Lines()[0].Text(), " "+test.rejected+" ") {
+			t.Fatalf("Scan of %q gave %v, expected rejection for %s", test.body, r, test.rejected)
+		}
+	}
+
+	// headers parsed for the envelope are checked rather than the body
+	envelope := &Envelope{Headers: textproto.MIMEHeader{"From": {"a@b"}, "Date": {"today"}, "Message-Id": {"<1@b>"}}}
+	if r, _ := f.Scan(context.Background(), envelope, []byte("X-Spam-Flag: YES\r\n\r\n")); r != nil {
+		t.Fatalf("Scan of parsed headers rejected: %v", r)
+	}
+	envelope.Headers.Add("X-Spam-Flag", "YES")
+	if r, _ := f.Scan(context.Background(), envelope, []byte("From: a@b\r\n\r\n")); r == nil || !strings.Contains(r.Lines()[0].Text(), " X-Spam-Flag ") {
+		t.Fatalf("Scan of parsed headers gave %v, expected rejection for X-Spam-Flag", r)
+	}
+
+	// the response may be configured
+	f, err = NewHeaderPolicyFilter(HeaderPolicyConfig{Required: []string{"Date"}, Code: 451})
+	if err != nil {
+		t.Fatalf("Could not create header policy: %v", err)
+	}
+	if r, _ := f.Scan(context.Background(), &Envelope{}, []byte("From: a@b\r\n\r\n")); r == nil || r.Lines()[0].Code() != 451 ||
+		r.Lines()[0].Text() != "4.6.0 Error: message has no Date header" {
+		t.Fatalf("Wrong rejection: %v", r)
+	}
+	f, err = NewHeaderPolicyFilter(HeaderPolicyConfig{Forbidden: []string{"Bcc"}, Message: "5.7.1 Error: policy"})
+	if err != nil {
+		t.Fatalf("Could not create header policy: %v", err)
+	}
+	if r, _ := f.Scan(context.Background(), &Envelope{}, []byte("Bcc: a@b\r\n\r\n")); r == nil || r.Lines()[0].Code() != 550 ||
+		r.Lines()[0].Text() != "5.7.1 Error: policy" {
+		t.Fatalf("Wrong rejection: %v", r)
+	}
+
+	// the policy is opt-in, and checked
+	if f, err := NewHeaderPolicyFilter(HeaderPolicyConfig{}); f != nil || err != nil {
+		t.Fatalf("Empty header policy created: %v %v", f, err)
+	}
+	for _, h := range []HeaderPolicyConfig{
+		{Required: []string{"From:"}},
+		{Forbidden: []string{"X Spam"}},
+		{Required: []string{""}},
+		{Required: []string{"From"}, Code: 250},
+	} {
+		if _, err := NewHeaderPolicyFilter(h); err == nil {
+			t.Fatalf("Bad header policy accepted: %+v", h)
+		}
+	}
+}
+
+func TestHeaderPolicyData(t *testing.T) {
+	l, err := newHandlerListener(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  filters:
+    headers:
+      required: [ From, Date, Message-ID ]
+      forbidden: [ X-Spam-Flag ]
+`)
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	recorder := &RecordingFilter{}
+	l.SetContentFilter(recorder)
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("client.example.com"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	send := func(msg string) error {
+		if err := tc.client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		writer, err := tc.client.Data()
+		if err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		}
+		if _, err := writer.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		return writer.Close()
+	}
+
+	// the policy runs before any other filter
+	if err := send("From: a@b\r\nDate: today\r\n\r\nbody\r\n"); err == nil || !strings.Contains(err.Error(), "5.6.0 Error: message has no Message-ID header") {
+		t.Fatalf("Expected 550 for message without Message-ID, got %v", err)
+	}
+	if recorder.body != nil {
+		t.Fatalf("Rejected message passed to filter")
+	}
+	if err := send("From: a@b\r\nDate: today\r\nMessage-ID: <1@b>\r\nX-Spam-Flag: YES\r\n\r\nbody\r\n"); err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("Expected 550 for message with forbidden header, got %v", err)
+	}
+	if err := send("From: a@b\r\nDate: today\r\nMessage-ID:\r\n <1@b>\r\n\r\nbody\r\n"); err != nil {
+		t.Fatalf("Compliant message rejected: %v", err)
+	}
+	if recorder.body == nil {
+		t.Fatalf("Accepted message not passed to filter")
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send quit to server: %v", err)
+	}
+	tc.client = nil // don't attempt Close()
+}
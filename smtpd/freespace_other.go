@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd
+// +build !linux,!darwin,!dragonfly,!freebsd
+
+package smtpd
+
+// freeSpace is not supported on this platform
+func freeSpace(path string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,185 @@
+// Package gomstest provides helpers for testing code built on package smtpd, such as ITPs, by
+// running SMTP conversations over an in-memory connection rather than a listener
+package gomstest
+
+import (
+	"context"
+	"github.com/abligh/goms/smtpd"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Timeout is the time after which a conversation is abandoned, so a stuck test fails rather
+// than hangs
+var Timeout = 10 * time.Second
+
+// logWriter passes log output to the test's log, so it is only shown for failed (or verbose) tests
+type logWriter struct {
+	tb testing.TB
+}
+
+func (w *logWriter) Write(d []byte) (int, error) {
+	w.tb.Log(strings.TrimSuffix(string(d), "\n"))
+	return len(d), nil
+}
+
+// NewLogger returns a logger writing to the test's log
+func NewLogger(tb testing.TB) *log.Logger {
+	return log.New(&logWriter{tb: tb}, "", log.Lmicroseconds)
+}
+
+// Client is an SMTP client with conveniences for driving a server under test
+type Client struct {
+	*smtp.Client
+}
+
+// Cmd sends a command and reads the response, returning an error if its code is not expectCode
+// (see textproto.Reader.ReadResponse). Unlike the methods of smtp.Client, it sends exactly the
+// command given, so may be used to send malformed commands
+func (c *Client) Cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.Text.ReadResponse(expectCode)
+}
+
+// SendMessage sends a message in a single transaction, returning the first error
+func (c *Client) SendMessage(from string, to []string, body string) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(body)); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// Server runs a single SMTP conversation (see smtpd.ServeConn) over an in-memory pipe, with a
+// client connected to the other end
+type Server struct {
+	Client *Client // the client, which has read the greeting
+	conn   net.Conn
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the conversation is over
+	err    error         // the error ending the conversation (valid once done is closed)
+	once   sync.Once
+}
+
+// NewServer starts a conversation with the ITP and parameters given (either of which may be nil,
+// as for smtpd.ServeConn), logging to the test's log, and connects a client. The server is closed
+// when the test ends. If the client cannot connect, e.g. because the ITP rejected the connection,
+// the server is closed and the error returned (a *textproto.Error for a rejection)
+func NewServer(tb testing.TB, itp smtpd.InboundTransactionProcessor, params *smtpd.InboundConnectionParameters) (*Server, error) {
+	sc, cc := net.Pipe()
+	cc.SetDeadline(time.Now().Add(Timeout))
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		conn:   cc,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		s.err = smtpd.ServeConn(ctx, sc, itp, params, NewLogger(tb))
+		close(s.done)
+	}()
+	tb.Cleanup(func() { s.Close() })
+
+	client, err := smtp.NewClient(cc, "localhost")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.Client = &Client{client}
+	return s, nil
+}
+
+// Close closes the client's connection, ending the conversation if the client has not quit, and
+// waits for the server to finish. It returns the error which ended the conversation, which is nil
+// if the client quit
+func (s *Server) Close() error {
+	s.once.Do(func() {
+		s.conn.Close()
+		<-s.done
+		s.cancel()
+	})
+	return s.err
+}
+
+// Message is a message received by a CaptureITP
+type Message struct {
+	Sender     string   // the reverse path (empty for the null sender)
+	Recipients []string // the forward paths
+	HeloName   string   // the name the client gave in HELO or EHLO
+	Data       []byte   // the message, with its dot-stuffing removed
+}
+
+// CaptureITP is an ITP which records each message it receives. Each phase may be given a
+// response to return (e.g. to test a rejection), else the default response is sent
+type CaptureITP struct {
+	ConnectResponse *smtpd.ICResponse // returned from CheckConnection
+	MailResponse    *smtpd.ICResponse // returned from CheckFromAddress
+	RcptResponse    *smtpd.ICResponse // returned from CheckRecipientAddress
+	DataResponse    *smtpd.ICResponse // returned from ProcessMail
+	mutex           sync.Mutex
+	messages        []Message
+}
+
+// CheckConnection returns ConnectResponse
+func (i *CaptureITP) CheckConnection(ctx context.Context, c *smtpd.InboundConnection) (*smtpd.ICResponse, error) {
+	return i.ConnectResponse, nil
+}
+
+// CheckFromAddress returns MailResponse
+func (i *CaptureITP) CheckFromAddress(ctx context.Context, c *smtpd.InboundConnection, address *smtpd.AddressString) (*smtpd.ICResponse, error) {
+	return i.MailResponse, nil
+}
+
+// CheckRecipientAddress returns RcptResponse
+func (i *CaptureITP) CheckRecipientAddress(ctx context.Context, c *smtpd.InboundConnection, address *smtpd.AddressString) (*smtpd.ICResponse, error) {
+	return i.RcptResponse, nil
+}
+
+// ProcessMail records the message unless DataResponse rejects it, and returns DataResponse
+func (i *CaptureITP) ProcessMail(ctx context.Context, c *smtpd.InboundConnection, data []byte) (*smtpd.ICResponse, error) {
+	if i.DataResponse != nil && i.DataResponse.IsError() {
+		return i.DataResponse, nil
+	}
+	sender := c.Sender()
+	m := Message{
+		Sender:   sender.String(),
+		HeloName: c.HeloName(),
+		Data:     append([]byte{}, data...),
+	}
+	for _, r := range c.Recipients() {
+		m.Recipients = append(m.Recipients, r.String())
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.messages = append(i.messages, m)
+	return i.DataResponse, nil
+}
+
+// Messages returns the messages received so far
+func (i *CaptureITP) Messages() []Message {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return append([]Message{}, i.messages...)
+}
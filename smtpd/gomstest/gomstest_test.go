@@ -0,0 +1,69 @@
+package gomstest
+
+import (
+	"github.com/abligh/goms/smtpd"
+	"net/textproto"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	itp := &CaptureITP{DataResponse: smtpd.NewResponse(250, "2.0.0 OK: queued as 1234")}
+	s, err := NewServer(t, itp, nil)
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := s.Client.Hello("client.example.com"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if code, _, err := s.Client.Cmd(250, "MAIL FROM"); err == nil || code != 501 {
+		t.Fatalf("Expected 501 for malformed MAIL, got %d %v", code, err)
+	}
+	if err := s.Client.SendMessage("a@b", []string{"c@d", "e@f"}, "Subject: test\r\n\r\n.body\r\n"); err != nil {
+		t.Fatalf("Cannot send message: %v", err)
+	}
+	if err := s.Client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Conversation ended by %v", err)
+	}
+
+	messages := itp.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	m := messages[0]
+	if m.Sender != "a@b" || len(m.Recipients) != 2 || m.Recipients[0] != "c@d" || m.Recipients[1] != "e@f" || m.HeloName != "client.example.com" {
+		t.Fatalf("Wrong envelope: %+v", m)
+	}
+	if string(m.Data) != "Subject: test\r\n\r\n.body\r\n" {
+		t.Fatalf("Wrong data: %q", m.Data)
+	}
+}
+
+func TestServerRejections(t *testing.T) {
+	itp := &CaptureITP{ConnectResponse: smtpd.NewResponse(554, "5.7.1 go away")}
+	if _, err := NewServer(t, itp, nil); err == nil {
+		t.Fatalf("Connected to server rejecting the connection")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 554 {
+		t.Fatalf("Expected 554 for rejected connection, got %v", err)
+	}
+
+	itp = &CaptureITP{DataResponse: smtpd.NewResponse(554, "5.7.1 spam")}
+	s, err := NewServer(t, itp, nil)
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := s.Client.SendMessage("a@b", []string{"c@d"}, "Subject: test\r\n\r\nbody\r\n"); err == nil {
+		t.Fatalf("Rejected message accepted")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 554 {
+		t.Fatalf("Expected 554 for rejected message, got %v", err)
+	}
+	if len(itp.Messages()) != 0 {
+		t.Fatalf("Rejected message recorded")
+	}
+	// the conversation is ended by closing the connection
+	if err := s.Close(); err == nil {
+		t.Fatalf("Conversation ended cleanly without QUIT")
+	}
+}
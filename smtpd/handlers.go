@@ -0,0 +1,110 @@
+package smtpd
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// HandlerFactory returns a new ITP configured by the parameters given in a server's
+// configuration (see ServerConfig.HandlerParams)
+type HandlerFactory func(params DriverParametersConfig) (InboundTransactionProcessor, error)
+
+// The handlers which may be selected by name in a server's configuration, keyed by name
+var (
+	handlersMutex sync.RWMutex
+	handlers      = map[string]HandlerFactory{
+		"proxy": newProxyHandler,
+		"sink":  newSinkHandler,
+	}
+)
+
+// RegisterHandler makes an ITP available to be selected by name in a server's configuration,
+// e.g. from the init function of the package implementing it. It panics if the name is already
+// registered or the factory is nil
+func RegisterHandler(name string, factory HandlerFactory) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	if factory == nil {
+		panic("smtpd: RegisterHandler factory is nil")
+	}
+	if _, ok := handlers[name]; ok {
+		panic("smtpd: RegisterHandler called twice for handler " + name)
+	}
+	handlers[name] = factory
+}
+
+// Handlers returns the names of the registered handlers, sorted
+func Handlers() []string {
+	handlersMutex.RLock()
+	defer handlersMutex.RUnlock()
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newHandler returns a new ITP from the handler named, configured by the parameters given
+func newHandler(name string, params DriverParametersConfig) (InboundTransactionProcessor, error) {
+	handlersMutex.RLock()
+	factory, ok := handlers[name]
+	handlersMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown handler: '%s'", name)
+	}
+	return factory(params)
+}
+
+// checkHandlerParams returns an error if params gives any parameter not in known, so a
+// misspelt parameter is reported rather than silently ignored
+func checkHandlerParams(handler string, params DriverParametersConfig, known ...string) error {
+	for k := range params {
+		found := false
+		for _, v := range known {
+			if k == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Bad %s handler parameter: '%s'", handler, k)
+		}
+	}
+	return nil
+}
+
+// newSinkHandler returns a SinkITP, with the parameters phase, code and message (see SinkConfig)
+func newSinkHandler(params DriverParametersConfig) (InboundTransactionProcessor, error) {
+	if err := checkHandlerParams("sink", params, "phase", "code", "message"); err != nil {
+		return nil, err
+	}
+	code, err := params.GetInt("code", 0)
+	if err != nil {
+		return nil, err
+	}
+	return NewSinkITP(SinkConfig{
+		Phase:   params.GetString("phase", ""),
+		Code:    code,
+		Message: params.GetString("message", ""),
+	})
+}
+
+// newProxyHandler returns a ProxyITP, with the parameters protocol, address (required), hello
+// and timeout (see ProxyConfig)
+func newProxyHandler(params DriverParametersConfig) (InboundTransactionProcessor, error) {
+	if err := checkHandlerParams("proxy", params, "protocol", "address", "hello", "timeout"); err != nil {
+		return nil, err
+	}
+	address := params.GetString("address", "")
+	if address == "" {
+		return nil, fmt.Errorf("Bad proxy address: ''")
+	}
+	return NewProxyITP(ProxyConfig{
+		Protocol: params.GetString("protocol", ""),
+		Address:  address,
+		Hello:    params.GetString("hello", ""),
+		Timeout:  params.GetString("timeout", ""),
+	})
+}
@@ -0,0 +1,134 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newHandlerListener returns a listener for the first server in the YAML supplied
+func newHandlerListener(t *testing.T, conf string) (*Listener, error) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "goms.conf")
+	writeConfig(t, conf, fn)
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	return NewListener(newTestLogger(t), c.Servers[0])
+}
+
+func TestHandlerSink(t *testing.T) {
+	l, err := newHandlerListener(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  handler: sink
+  handlerparams:
+    phase: rcpt
+    code: 550
+    message: "5.1.1 Error: no such user"
+`)
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	if _, ok := l.itp.(*SinkITP); !ok {
+		t.Fatalf("Wrong ITP for sink handler: %T", l.itp)
+	}
+
+	tc := newTestConnectionWithITP(t, l.itp)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	err = tc.client.Rcpt("a@b")
+	checkSinkCode(t, err, 550, "rcpt")
+	if !strings.Contains(err.Error(), "no such user") {
+		t.Fatalf("Wrong rejection: %v", err)
+	}
+}
+
+func TestHandlerProxy(t *testing.T) {
+	l, err := newHandlerListener(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  handler: proxy
+  handlerparams:
+    address: 127.0.0.1:30026
+    timeout: 1m
+`)
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	if p, ok := l.itp.(*ProxyITP); !ok || p.address != "127.0.0.1:30026" || p.timeout.String() != "1m0s" {
+		t.Fatalf("Wrong ITP for proxy handler: %#v", l.itp)
+	}
+}
+
+func TestHandlerBadConfig(t *testing.T) {
+	for _, s := range []struct {
+		conf  string
+		error string
+	}{
+		{"handler: wombat", "Unknown handler: 'wombat'"},
+		{"handler: sink\n  handlerparams:\n    phase: wombat", "Bad sink phase"},
+		{"handler: sink\n  handlerparams:\n    phase: rcpt\n    code: abc", "Bad code: 'abc'"},
+		{"handler: sink\n  handlerparams:\n    phase: rcpt\n    cdoe: 550", "Bad sink handler parameter: 'cdoe'"},
+		{"handler: proxy", "Bad proxy address"},
+		{"handler: sink\n  handlerparams:\n    phase: rcpt\n  sink:\n    phase: rcpt", "given with sink or proxy"},
+	} {
+		conf := "servers:\n- protocol: tcp\n  address: 127.0.0.1:30025\n  " + s.conf + "\n"
+		if _, err := newHandlerListener(t, conf); err == nil || !strings.Contains(err.Error(), s.error) {
+			t.Fatalf("Wrong error for %q: %v", s.conf, err)
+		}
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	var params DriverParametersConfig
+	RegisterHandler("test", func(p DriverParametersConfig) (InboundTransactionProcessor, error) {
+		params = p
+		return &TestITP{}, nil
+	})
+	defer func() {
+		handlersMutex.Lock()
+		delete(handlers, "test")
+		handlersMutex.Unlock()
+	}()
+	if strings.Join(Handlers(), " ") != "proxy sink test" {
+		t.Fatalf("Wrong handlers: %v", Handlers())
+	}
+
+	l, err := newHandlerListener(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  handler: test
+  handlerparams:
+    maildir: /var/mail
+`)
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	if _, ok := l.itp.(*TestITP); !ok || params["maildir"] != "/var/mail" {
+		t.Fatalf("Wrong ITP for test handler: %T %v", l.itp, params)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Registering a handler twice did not panic")
+		}
+	}()
+	RegisterHandler("sink", newSinkHandler)
+}
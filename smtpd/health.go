@@ -0,0 +1,101 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// readiness tracks whether each configured listener is bound, for the /readyz endpoint of the
+// debug server and the admin stats. The process is ready once every listener is bound, until it
+// starts shutting down
+type readiness struct {
+	mu           sync.Mutex
+	listeners    map[string]*Listener // bound listeners by protocol:address (nil if not bound)
+	shuttingDown bool                 // true once shutdown has started
+}
+
+// readinessStatus is the JSON body returned by /readyz
+type readinessStatus struct {
+	Ready        bool            `json:"ready"`
+	ShuttingDown bool            `json:"shuttingDown"`
+	Listeners    map[string]bool `json:"listeners"`
+}
+
+// newReadiness returns a new readiness tracker
+func newReadiness() *readiness {
+	return &readiness{listeners: make(map[string]*Listener)}
+}
+
+// expect records a listener which must be bound for the process to be ready
+func (r *readiness) expect(name string) {
+	r.setBound(name, nil)
+}
+
+// setBound records the listener bound for a name, or nil if it is no longer bound
+func (r *readiness) setBound(name string, l *Listener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners[name] = l
+}
+
+// forget stops tracking a listener which is no longer configured
+func (r *readiness) forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.listeners, name)
+}
+
+// bound returns the listeners currently bound, keyed by name
+func (r *readiness) bound() map[string]*Listener {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	listeners := make(map[string]*Listener, len(r.listeners))
+	for name, l := range r.listeners {
+		if l != nil {
+			listeners[name] = l
+		}
+	}
+	return listeners
+}
+
+// shutdown records that the process is shutting down, so is no longer ready
+func (r *readiness) shutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shuttingDown = true
+}
+
+// status returns the current readiness
+func (r *readiness) status() readinessStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := readinessStatus{
+		Ready:        !r.shuttingDown,
+		ShuttingDown: r.shuttingDown,
+		Listeners:    make(map[string]bool, len(r.listeners)),
+	}
+	for name, l := range r.listeners {
+		s.Listeners[name] = l != nil
+		if l == nil {
+			s.Ready = false
+		}
+	}
+	return s
+}
+
+// serveReadyz implements /readyz, returning 200 if ready and 503 otherwise
+func (r *readiness) serveReadyz(w http.ResponseWriter, req *http.Request) {
+	s := r.status()
+	w.Header().Set("Content-Type", "application/json")
+	if !s.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+// serveHealthz implements /healthz, which reports the process is alive if it can answer at all
+func serveHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
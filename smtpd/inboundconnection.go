@@ -4,20 +4,71 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"golang.org/x/net/idna"
+	"io"
 	"log"
 	"net"
+	"net/textproto"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	maxUnrecognisedCommands = 20 // this normally indicates SMTP has got out sync
+	maxUnrecognisedCommands = 20                 // this normally indicates SMTP has got out sync
+	maxPooledDataBuffer     = 1024 * 1024        // DATA buffers which have grown larger than this are not pooled
+	maxUnlimitedMessageSize = 1024 * 1024 * 1024 // messages are limited to this if there is no fixed maximum size
 )
 
+// Pools of buffered readers, writers and DATA buffers, to reduce allocation under load
+var (
+	readerPool = sync.Pool{
+		// RFC5321 s4.5.3.1.4 - maximum size of a command line is 512 bytes (subject to extensisons)
+		New: func() interface{} { return bufio.NewReaderSize(nil, 4096) },
+	}
+	writerPool = sync.Pool{
+		New: func() interface{} { return bufio.NewWriter(nil) },
+	}
+	dataBufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+)
+
+// dataBuffersHeld is the number of DATA buffers taken from the pool by connections and not yet
+// released, other than those handed over to an ITP implementing DataOwner
+var dataBuffersHeld int64
+
 // InboundTransactionProcessor is an interface representing an inbound transaction processor, i.e.
 // structs that satisfy this interface can check inbound SMTP connections and process their data
+//
+// A listener has a single ITP, shared by all of its connections (each connection served without a
+// listener by ServeConn may be given its own). Its methods are therefore called concurrently, so
+// any state it holds across connections must be protected, e.g. by embedding SharedState. State
+// relating to one connection belongs on the InboundConnection (see Params)
+//
+// The data passed to ProcessMail is only valid for the duration of the call, as the buffer holding
+// it is reused for later messages. An ITP that retains the data must copy it, or implement DataOwner
+//
+// ITPs return responses built with NewResponse, so may be implemented in another package. A nil
+// response means the default response is sent. An error response rejects the command; a success
+// response replaces the default one, e.g. so ProcessMail can give a queue ID, or CheckFromAddress
+// and CheckRecipientAddress can give routing information. The latter must use a code valid for
+// the command (250 for MAIL, 250 or 251 for RCPT), else the default response is sent. Any response
+// marked with Final closes the connection once sent, e.g. so ProcessMail can accept a message and
+// then politely end the session
+//
+// CheckConnection may return a 220 response to be sent as the greeting in place of the banner
+// (e.g. to vary it per client); other success responses are ignored. To delay the greeting (e.g.
+// to tarpit a client), CheckConnection may set Params().GreetingDelay
 type InboundTransactionProcessor interface {
 	CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error)
 	CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error)
@@ -25,6 +76,41 @@ type InboundTransactionProcessor interface {
 	ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error)
 }
 
+// ErrInsufficientStorage may be returned (or wrapped) by CheckFromAddress or ProcessMail to indicate
+// that the message cannot be accepted because storage is temporarily exhausted, e.g. the disk is full.
+// The client is sent a 452 and may try again later, as opposed to the 552 sent for messages that
+// exceed the fixed maximum size
+var ErrInsufficientStorage = errors.New("insufficient system storage")
+
+// DataOwner is an optional interface that an InboundTransactionProcessor may implement. If OwnsData
+// returns true, the buffer passed to ProcessMail is handed over to the ITP and never reused, so the
+// ITP may retain it without copying
+type DataOwner interface {
+	OwnsData() bool
+}
+
+// QueueRunner is an optional interface that an InboundTransactionProcessor may implement
+// to support the ETRN command (RFC1985). RequestQueueRun is passed the ETRN argument, i.e. a
+// domain optionally prefixed by '@' (meaning include subdomains), or a queue name prefixed by '#'
+type QueueRunner interface {
+	RequestQueueRun(ctx context.Context, c *InboundConnection, domain string) (*ICResponse, error)
+}
+
+// ResourceChecker is an optional interface that an InboundTransactionProcessor may implement to
+// refuse messages when the system is low on resources (e.g. spool space), so senders retry later
+// rather than mail being lost. CheckResources is called on DATA, before the client is invited to
+// send the message, and an error response (normally a 452) is sent instead (see SpoolSpaceChecker)
+type ResourceChecker interface {
+	CheckResources(ctx context.Context, c *InboundConnection) (*ICResponse, error)
+}
+
+// ConnectionCloser is an optional interface that an InboundTransactionProcessor may implement
+// to release per-connection resources. ConnectionClosed is called once the connection's
+// conversation has finished, after any other call to the ITP for that connection
+type ConnectionCloser interface {
+	ConnectionClosed(c *InboundConnection)
+}
+
 // DummyITP is an InboundTransactionProcessor which accepts all mail and dumps it
 type DummyITP struct{}
 
@@ -50,33 +136,88 @@ func (i *DummyITP) ProcessMail(ctx context.Context, c *InboundConnection, data [
 
 // ConnectionParameters holds parameters for each inbound connection
 type InboundConnectionParameters struct {
-	IdleTimeout        time.Duration // time to shut connection if idle
-	ReadTimeout        time.Duration // time to read other than at command stage
-	WriteTimeout       time.Duration // time to write
-	GreetingHostname   string
-	GreetingMailserver string
-	MaxMessageSize     int
+	IdleTimeout             time.Duration // time to shut connection if idle
+	ReadTimeout             time.Duration // time to read other than at command stage
+	WriteTimeout            time.Duration // time to write
+	GreetingHostname        string
+	GreetingMailserver      string
+	MaxMessageSize          int                               // maximum message size in bytes (0 for no fixed maximum)
+	TLSConfig               *tls.Config                       // the TLS configuration for STARTTLS (nil if TLS is unavailable)
+	RequireTLS              bool                              // reject MAIL until the client has issued STARTTLS
+	AddMissingHeaders       bool                              // add missing Message-ID and Date headers (submission mode)
+	RequireAuth             bool                              // reject MAIL until the client has authenticated (submission mode)
+	Authenticator           Authenticator                     // checks credentials given with AUTH (nil to use the ITP, if it is one)
+	DisableESMTP            bool                              // reject EHLO so only plain SMTP (HELO) is available
+	DisableEnhanced         bool                              // omit RFC3463 enhanced status codes from responses
+	GreetingDelay           time.Duration                     // pause before the greeting, rejecting clients that talk first
+	Banner                  func(c *InboundConnection) string // produces the greeting text (nil for the default)
+	ParseHeaders            bool                              // parse the headers of each message for the ITP
+	MaxHeaderLines          int                               // maximum number of header lines when parsing headers (0 for no limit)
+	MaxHeaderBytes          int                               // maximum size of the header section when parsing headers (0 for no limit)
+	AllowNoRecipients       bool                              // accept DATA after the ITP rejected every recipient (ProcessMail sees none)
+	DeferRecipientRejection bool                              // accept recipients provisionally, rejecting the message at DATA if any were rejected
+	Messages                map[string]string                 // rejection texts by identifier (nil for the defaults)
+	ReverseDNS              bool                              // look up the client's hostname before CheckConnection
+	ReverseDNSTimeout       time.Duration                     // maximum time to spend on reverse DNS
+	ContentFilter           ContentFilter                     // filter applied to each message before the ITP (nil for none)
+	SenderFilter            *DomainFilter                     // filter rejecting blocked senders before the ITP (nil for none)
+	RecipientFilter         *DomainFilter                     // filter rejecting blocked recipients before the ITP (nil for none)
+	Aliases                 *Aliases                          // rewrites recipients before the ITP (nil for none)
+	EventHandler            EventHandler                      // receives the events of each connection (nil for none)
+	DisabledVerbs           map[string]bool                   // verbs (in upper case) refused with 502 and not advertised
+	SuppressedCapabilities  map[string]bool                   // EHLO keywords (in upper case) not advertised, though still supported
+	XForwardTrusted         []*net.IPNet                      // networks of relays trusted to use XFORWARD
+	Transcript              bool                              // log every command and response line at trace level
+	DeliverByMinimum        time.Duration                     // minimum by-time advertised with DELIVERBY and accepted for by-mode R
+	DeliverByMaximum        time.Duration                     // maximum by-time accepted with BY (0 for no limit)
+	Clock                   Clock                             // source of time for timeouts (nil for the real clock)
+	Resolver                Resolver                          // resolver for reverse DNS (nil for the default)
+	ReverseDNSStrict        bool                              // reject clients without forward-confirmed reverse DNS
+	ReverseDNSExempt        []*net.IPNet                      // networks exempt from strict reverse DNS checking
 }
 
 // Connection holds the details for each connection
 type InboundConnection struct {
-	params               *InboundConnectionParameters // parameters
-	conn                 net.Conn                     // the connection that is used as the SMTP transport
-	plainConn            net.Conn                     // the unencrypted (original) connection
-	tlsConn              net.Conn                     // the TLS encrypted connection
-	logger               *log.Logger                  // a logger
-	listener             *Listener                    // the listener than invoked us
-	name                 string                       // the name of the connection for logging purposes
-	rd                   *bufio.Reader                // buffered reader
-	wr                   *bufio.Writer                // buffered writer
-	rdwr                 *bufio.ReadWriter            // composite read writer
-	needsFlush           bool                         // if we've skipped a flush due to pipelining mode
-	unrecognisedCommands int                          // Number of unrecognised commands so far
-	RecipientList        []*AddressString             // current recipient list
-	inTransaction        bool                         // true if in a transaction (i.e. has had 'MAIL FROM')
-	ReversePath          AddressString                // current sender
-	ITP                  InboundTransactionProcessor  // inbound transaction processor associated with this connection
-	noEsmtp              bool                         // turn on to disable ESMTP (for testing only - not for production)
+	params                 *InboundConnectionParameters // parameters
+	conn                   net.Conn                     // the connection that is used as the SMTP transport
+	plainConn              net.Conn                     // the unencrypted (original) connection
+	tlsConn                net.Conn                     // the TLS encrypted connection
+	logger                 *log.Logger                  // a logger
+	listener               *Listener                    // the listener than invoked us
+	id                     uint64                       // the ID of the connection (see ID)
+	name                   string                       // the name of the connection for logging purposes
+	rd                     *bufio.Reader                // buffered reader
+	wr                     *bufio.Writer                // buffered writer
+	rdwr                   *bufio.ReadWriter            // composite read writer
+	needsFlush             bool                         // if we've skipped a flush due to pipelining mode
+	stopDeadline           func()                       // stops the timer enforcing the current deadline (nil if none; see setDeadline)
+	unrecognisedCommands   int                          // Number of unrecognised commands so far
+	redactNextLine         bool                         // if the next line received may carry AUTH credentials (see trace)
+	esmtp                  bool                         // true if the client greeted us with EHLO
+	authIdentity           string                       // the identity the client authenticated as (empty if it has not)
+	heloName               string                       // the name the client gave in HELO or EHLO
+	remoteHostname         string                       // the client's hostname from reverse DNS
+	remoteHostnameVerified bool                         // true if the reverse DNS is forward confirmed
+	remoteHostnameTempFail bool                         // true if reverse DNS failed temporarily
+	ITP                    InboundTransactionProcessor  // inbound transaction processor associated with this connection
+
+	// state of the current transaction, all of which must be cleared by reset()
+	inTransaction      bool                 // true if in a transaction (i.e. has had 'MAIL FROM')
+	reversePath        AddressString        // current sender
+	recipientList      []*AddressString     // current recipient list (after rewriting by any aliases)
+	originalRecipients []*AddressString     // current recipient list as given by the client
+	requireTLS         bool                 // true if the sender requires onward delivery over TLS (RFC8689)
+	smtpUTF8           bool                 // true if the sender gave the SMTPUTF8 MAIL parameter (RFC6531)
+	priority           int                  // the priority given with the MT-PRIORITY MAIL parameter (RFC6710; 0 if absent)
+	deliverBy          *DeliverBy           // the deadline given with the BY MAIL parameter (RFC2852; nil if absent)
+	authParameter      AddressString        // the trusted AUTH parameter of MAIL (empty if absent or untrusted)
+	declaredSize       int                  // the size given with the SIZE MAIL parameter (RFC1870; 0 if absent)
+	headers            textproto.MIMEHeader // the headers of the current message (nil unless parsed)
+	transactionMaxSize *int                 // maximum message size for the current transaction (nil to use the parameters)
+	rejectedRecipients int                  // number of recipients the ITP rejected in the current transaction
+	deferredRejection  *ICResponse          // the strongest recipient rejection deferred to DATA (nil if none)
+	xforward           map[string]string    // attributes of the original client given by XFORWARD (nil if none)
+	transactionStart   time.Time            // when MAIL was accepted
 }
 
 // ICCommand holds an inbound command
@@ -99,22 +240,134 @@ type ICResponse struct {
 	lines       []ICResponseLine // The response lines
 	final       bool             // should the connection be closed after sending
 	canPipeline bool             // if we can skip a flush in pipelining mode
+	startTLS    bool             // should TLS be negotiated after sending
+}
+
+// Code returns the response code of the line
+func (l ICResponseLine) Code() int {
+	return l.code
 }
 
-// newICRL creates a new slice of response lines with consisting of one entry
-// made from the code and text specified
-func newICRL(code int, text string) []ICResponseLine {
-	return []ICResponseLine{ICResponseLine{code: code, text: text}}
+// Text returns the text of the line
+func (l ICResponseLine) Text() string {
+	return l.text
 }
 
-// addICRL adds a new line to an existing response code
-func (r *ICResponse) addICRL(code int, text string) {
+// NewResponse returns a new response with a single line made from the code and text
+// specified. The text should start with an enhanced status code (e.g. "2.0.0 OK"),
+// which is removed when sending if the session does not use them
+func NewResponse(code int, text string) *ICResponse {
+	return &ICResponse{lines: []ICResponseLine{ICResponseLine{code: code, text: text}}}
+}
+
+// Line adds a new line to the response, returning the response so calls can be chained
+func (r *ICResponse) Line(code int, text string) *ICResponse {
 	r.lines = append(r.lines, ICResponseLine{code: code, text: text})
+	return r
+}
+
+// Final marks the response as closing the connection once sent, returning the response
+func (r *ICResponse) Final() *ICResponse {
+	r.final = true
+	return r
+}
+
+// Pipelineable marks the response as one that need not be flushed immediately in
+// pipelining mode, returning the response
+func (r *ICResponse) Pipelineable() *ICResponse {
+	r.canPipeline = true
+	return r
+}
+
+// Lines returns the lines of the response
+func (r *ICResponse) Lines() []ICResponseLine {
+	return r.lines
+}
+
+// IsFinal returns true if the connection is closed once the response is sent
+func (r *ICResponse) IsFinal() bool {
+	return r.final
+}
+
+// CanPipeline returns true if the response need not be flushed immediately in pipelining mode
+func (r *ICResponse) CanPipeline() bool {
+	return r.canPipeline
+}
+
+// text returns the text of the response, its lines separated by newlines
+func (r *ICResponse) text() string {
+	texts := make([]string, len(r.lines))
+	for i, l := range r.lines {
+		texts[i] = l.text
+	}
+	return strings.Join(texts, "\n")
+}
+
+// enhancedRE matches an RFC3463 enhanced status code at the start of response text
+var enhancedRE = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3} `)
+
+// enhancedStatusCodes returns true if responses should carry enhanced status codes. These are
+// only sent once the client has greeted us with EHLO and we have advertised them (RFC2034 3)
+func (c *InboundConnection) enhancedStatusCodes() bool {
+	return c.esmtp && !c.params.DisableEnhanced
+}
+
+// formatICRL formats a response line for sending; dashspace is "-" for all but the last line
+// of a response. Response text is written with an enhanced status code, which is stripped
+// here unless the session uses enhanced status codes
+func (c *InboundConnection) formatICRL(l ICResponseLine, dashspace string) string {
+	text := l.text
+	if !c.enhancedStatusCodes() {
+		text = enhancedRE.ReplaceAllLiteralString(text, "")
+	}
+	return fmt.Sprintf("%03d%s%s\r\n", l.code, dashspace, text)
+}
+
+// applyITPResult interprets the result of a call to the ITP (or a content filter), returning
+// the response to send, whether the command is accepted, and the error to return:
+//
+//	(nil, nil)     accepted; nil is returned, so the caller sends its default response
+//	(errResp, nil) rejected; errResp is returned
+//	(okResp, nil)  accepted; a copy of okResp is returned if its code is one of those given (so
+//	               the caller may alter it, as the ITP may share it), else nil as for (nil, nil)
+//	(any, err)     rejected; err is returned, closing the connection
+func applyITPResult(r *ICResponse, err error, codes ...int) (*ICResponse, bool, error) {
+	if err != nil {
+		return nil, false, err
+	}
+	if r == nil || len(r.lines) == 0 {
+		return nil, true, nil
+	}
+	if r.IsError() {
+		return r, false, nil
+	}
+	for _, code := range codes {
+		if r.lines[0].code == code {
+			cp := *r
+			return &cp, true, nil
+		}
+	}
+	return nil, true, nil
+}
+
+// wellFormed returns true if r is a final response that may be sent to the client, i.e. has a
+// success or error code which is the same on every line (RFC5321 4.2.1). r must have a line
+func (r *ICResponse) wellFormed() bool {
+	code := r.lines[0].code
+	if code < 200 || code > 599 || code >= 300 && code < 400 {
+		return false
+	}
+	for _, l := range r.lines {
+		if l.code != code {
+			return false
+		}
+	}
+	return true
 }
 
 // IsError() returns true if and only if r is an error code (i.e. 400 to 599)
 // Technically there is a response code on each line of a multiline response, but
-// we assume these all have the same code
+// these all have the same code (RFC5321 4.2.1), which Send ensures
 func (r *ICResponse) IsError() bool {
 	if len(r.lines) == 0 {
 		return false
@@ -127,18 +380,90 @@ var (
 	inboundRE = regexp.MustCompile(`^([^:]+:)?([^@:]+)@([^@:]+)$`)
 )
 
+const (
+	// RFC5321 4.5.3.1
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+	maxPathLength      = 256
+)
+
+// validAddress returns true if an address (without angle brackets, but perhaps with a source
+// route) contains no control characters and is within the length limits of RFC5321 4.5.3.1, so
+// it cannot smuggle commands or headers into anything it is passed to
+func validAddress(a string) bool {
+	if len(a)+2 > maxPathLength {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] < ' ' || a[i] == 0x7f {
+			return false
+		}
+	}
+	mailbox := a
+	if i := strings.IndexByte(a, ':'); i >= 0 {
+		mailbox = a[i+1:]
+	}
+	if i := strings.LastIndexByte(mailbox, '@'); i >= 0 {
+		return i <= maxLocalPartLength && len(mailbox)-i-1 <= maxDomainLength
+	}
+	return len(mailbox) <= maxLocalPartLength
+}
+
+// idnaProfile converts domains to A-labels (RFC5890 2.3.2.1), mapping them first as for a
+// lookup (e.g. to lower case). Unlike idna.Lookup, it permits labels which are not hostnames
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// canonicalDomain returns the canonical form of the domain of an address, i.e. with any U-labels
+// converted to A-labels (punycode) and in lower case, returning false if it is not a valid IDN
+func canonicalDomain(domain string) (string, bool) {
+	if strings.HasPrefix(domain, "[") {
+		// RFC5321 4.1.3 address literal
+		return strings.ToLower(domain), true
+	}
+	if d, err := idnaProfile.ToASCII(domain); err != nil || len(d) > maxDomainLength {
+		return "", false
+	} else {
+		return d, true
+	}
+}
+
 // CanonicaliseInboundAddress changes a string containing an email address into
 // canonical format and returns it as an AddressString. This currently involves stripping
-// source routing information
+// source routing information, and converting the domain to A-labels in lower case. nil is
+// returned if the address is malformed
 func CanonicaliseInboundAddress(a string) *AddressString {
+	as, _ := canonicaliseAddress(a)
+	return as
+}
+
+// canonicaliseAddress is CanonicaliseInboundAddress, but also returns true if the address was
+// malformed only in that its domain is not a valid IDN
+func canonicaliseAddress(a string) (*AddressString, bool) {
+	if !validAddress(a) {
+		return nil, false
+	}
 	if match := inboundRE.FindStringSubmatch(a); match == nil || len(match) != 4 {
-		return nil
+		return nil, false
+	} else if domain, ok := canonicalDomain(match[3]); !ok {
+		return nil, true
 	} else {
-		as := AddressString(fmt.Sprintf("%s@%s", match[2], strings.ToLower(match[3])))
-		return &as
+		as := AddressString(fmt.Sprintf("%s@%s", match[2], domain))
+		return &as, false
 	}
 }
 
+// Unicode returns the address with its domain converted to U-labels, e.g. for display, or to
+// relay to a server supporting SMTPUTF8 (RFC6531)
+func (as *AddressString) Unicode() string {
+	a := string(*as)
+	if i := strings.LastIndexByte(a, '@'); i >= 0 {
+		if domain, err := idna.ToUnicode(a[i+1:]); err == nil {
+			return a[:i+1] + domain
+		}
+	}
+	return a
+}
+
 // String() returns a string representation of an AddressString
 func (as *AddressString) String() string {
 	return string(*as)
@@ -146,173 +471,631 @@ func (as *AddressString) String() string {
 
 // Verb represents an SMTP verb and the action method associated with it
 type Verb struct {
-	Run func(c *InboundConnection, ctx context.Context, params []byte) (*ICResponse, error)
+	Run  func(c *InboundConnection, ctx context.Context, params []byte) (*ICResponse, error)
+	Help string // syntax summary returned by HELP
 }
 
-// reset resets the internal transaction state of a connection
+// reset clears the state of the current transaction (RFC5321 4.1.1.5), such as on RSET or once a
+// message has been processed. Session state, such as the greeting, TLS and authentication, is kept
 func (c *InboundConnection) reset() {
-	c.RecipientList = []*AddressString{}
-	c.ReversePath = ""
 	c.inTransaction = false
+	c.reversePath = ""
+	c.recipientList = []*AddressString{}
+	c.originalRecipients = []*AddressString{}
+	c.requireTLS = false
+	c.smtpUTF8 = false
+	c.priority = 0
+	c.deliverBy = nil
+	c.authParameter = ""
+	c.declaredSize = 0
+	c.headers = nil
+	c.transactionMaxSize = nil
+	c.rejectedRecipients = 0
+	c.deferredRejection = nil
+	c.xforward = nil
+	c.transactionStart = time.Time{}
+}
+
+// Sender returns the reverse path of the current transaction, which is empty for the null
+// sender (bounces) or if there is no transaction
+func (c *InboundConnection) Sender() AddressString {
+	return c.reversePath
+}
+
+// RequireTLS returns true if the sender of the current transaction used the REQUIRETLS MAIL
+// parameter (RFC8689), in which case the message must not be relayed other than over TLS
+func (c *InboundConnection) RequireTLS() bool {
+	return c.requireTLS
+}
+
+// SMTPUTF8 returns true if the sender of the current transaction used the SMTPUTF8 MAIL parameter
+// (RFC6531 3.4), so the envelope and headers may contain UTF-8. An ITP relaying to a destination
+// which does not support SMTPUTF8 must either downgrade the message (e.g. using A-labels for
+// domains, see AddressString.Unicode) or reject it with UTF8NotSupported
+func (c *InboundConnection) SMTPUTF8() bool {
+	return c.smtpUTF8
+}
+
+// Priority returns the priority of the current transaction given with the MT-PRIORITY MAIL
+// parameter (RFC6710), from -9 (lowest) to 9 (highest), or 0 (normal) if none was given. The
+// client is not trusted to give it, so an ITP queueing messages by priority may wish to ignore it
+// other than from authenticated clients (RFC6710 5)
+func (c *InboundConnection) Priority() int {
+	return c.priority
+}
+
+// UTF8NotSupported returns the response an ITP should give to reject an SMTPUTF8 transaction it
+// cannot deliver, e.g. as the destination does not support SMTPUTF8 and the message cannot be
+// downgraded (550 5.6.7)
+func (c *InboundConnection) UTF8NotSupported() *ICResponse {
+	return NewResponse(550, c.message("5.6.7", "nosmtputf8"))
+}
+
+// Recipients returns a copy of the recipient list of the current transaction, after rewriting
+// by any aliases
+func (c *InboundConnection) Recipients() []*AddressString {
+	return append([]*AddressString{}, c.recipientList...)
+}
+
+// OriginalRecipients returns a copy of the recipient list of the current transaction as given by
+// the client, before rewriting by any aliases, in the same order as Recipients
+func (c *InboundConnection) OriginalRecipients() []*AddressString {
+	return append([]*AddressString{}, c.originalRecipients...)
+}
+
+// InTransaction returns true if a mail transaction is in progress (i.e. after 'MAIL FROM')
+func (c *InboundConnection) InTransaction() bool {
+	return c.inTransaction
+}
+
+// HeloName returns the name the client gave in its most recent HELO or EHLO, or an empty
+// string if it has not yet greeted us
+func (c *InboundConnection) HeloName() string {
+	return c.heloName
+}
+
+// AuthIdentity returns the identity the client authenticated as, or an empty string if it
+// has not authenticated. An ITP may use this to permit relaying for authenticated users
+func (c *InboundConnection) AuthIdentity() string {
+	return c.authIdentity
+}
+
+// RelayDenied returns the response an ITP should give from CheckRecipientAddress to reject a
+// recipient it will not relay to (554 5.7.1), as distinct from the 550 5.1.3 given for malformed
+// addresses and the 554 5.5.1 given at DATA if no recipients were accepted
+func (c *InboundConnection) RelayDenied() *ICResponse {
+	return NewResponse(554, c.message("5.7.1", "relaydenied"))
+}
+
+// AuthParameter returns the mailbox given in the AUTH parameter of the current transaction's
+// MAIL command (RFC4954 5), i.e. the identity which originally submitted the message, as asserted
+// by a trusted (authenticated) client. It is empty if the parameter was absent, was "<>", or was
+// given by an untrusted client; an ITP relaying the message should then send AUTH=<>
+func (c *InboundConnection) AuthParameter() AddressString {
+	return c.authParameter
+}
+
+// DeclaredSize returns the size of the message in bytes the client gave with the SIZE MAIL
+// parameter (RFC1870) in the current transaction, or 0 if it gave none. It is only an estimate
+func (c *InboundConnection) DeclaredSize() int {
+	return c.declaredSize
+}
+
+// Params returns the connection's parameters. These are the connection's own copy, so an ITP may
+// alter them in CheckConnection, e.g. to allow a particular client a larger message size. A
+// changed MaxMessageSize applies for the rest of the session, and is advertised if the client
+// sends EHLO again
+func (c *InboundConnection) Params() *InboundConnectionParameters {
+	return c.params
+}
+
+// SetMaxMessageSize sets the maximum message size (0 for no fixed maximum) for the current
+// transaction only, e.g. from CheckRecipientAddress for a recipient with a larger quota. The last
+// size set applies, and once the transaction ends the size in Params applies again
+func (c *InboundConnection) SetMaxMessageSize(size int) {
+	c.transactionMaxSize = &size
+}
+
+// ESMTP returns true if the client greeted us with EHLO
+func (c *InboundConnection) ESMTP() bool {
+	return c.esmtp
+}
+
+// TLS returns the state of the TLS connection, or nil if the connection is not encrypted
+func (c *InboundConnection) TLS() *tls.ConnectionState {
+	if tlsConn, ok := c.tlsConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
 }
 
 // doHELO implements the HELO command
 func (c *InboundConnection) doHELO(ctx context.Context, params []byte) (*ICResponse, error) {
 	c.reset()
-	return &ICResponse{
-		lines: newICRL(250, c.params.GreetingHostname),
-	}, nil
+	c.esmtp = false
+	c.heloName = string(bytes.TrimSpace(params))
+	return NewResponse(250, c.params.GreetingHostname), nil
+}
+
+// suppressibleCapabilities are the EHLO keywords which may be suppressed. ENHANCEDSTATUSCODES is
+// not, as we may only send enhanced status codes if we advertise them (see DisableEnhanced)
+var suppressibleCapabilities = []string{
+	"PIPELINING", "ETRN", "STARTTLS", "REQUIRETLS", "MT-PRIORITY", "DELIVERBY", "XFORWARD", "8BITMIME",
+	"SMTPUTF8", "SIZE", "AUTH",
 }
 
 // do EHLO implements the EHLO command
 func (c *InboundConnection) doEHLO(ctx context.Context, params []byte) (*ICResponse, error) {
 	c.reset()
+	c.esmtp = false
+	c.heloName = ""
 
-	// for coverage testing we have a secret flag to make this error
-	if c.noEsmtp {
-		return &ICResponse{
-			lines: newICRL(502, "5.5.1 Error: command not implemented"),
-		}, nil
+	// present a plain SMTP server if ESMTP is disabled, so clients fall back to HELO
+	if c.params.DisableESMTP {
+		// RFC5321 4.1.4
+		return NewResponse(500, c.message("5.5.1", "ehlodisabled")), nil
 	}
 
-	r := &ICResponse{
-		lines: newICRL(250, c.params.GreetingHostname),
+	c.esmtp = true
+	c.heloName = string(bytes.TrimSpace(params))
+	r := NewResponse(250, c.params.GreetingHostname)
+	// advertise adds a capability to the response unless it is suppressed. We still support
+	// suppressed capabilities if the client uses them regardless
+	advertise := func(capability string) {
+		keyword := strings.SplitN(capability, " ", 2)[0]
+		if !c.params.SuppressedCapabilities[keyword] {
+			r.Line(250, capability)
+		}
+	}
+	advertise("PIPELINING")
+	//r.Line(250, "VRFY")
+	if _, ok := c.ITP.(QueueRunner); ok && !c.params.DisabledVerbs["ETRN"] {
+		advertise("ETRN")
+	}
+	if !c.params.DisableEnhanced {
+		advertise("ENHANCEDSTATUSCODES")
 	}
-	r.addICRL(250, "PIPELINING")
-	//r.addICRL(250, "VRFY")
-	//r.addICRL(250, "ETRN")
-	r.addICRL(250, "ENHANCEDSTATUSCODES")
-	r.addICRL(250, "8BITMIME")
-	r.addICRL(250, "SMTPUTF8") // TODO - we may wish to check for this in the MAIL command, but currently unnecessary as we have no UTF8 replies
-	r.addICRL(250, fmt.Sprintf("SIZE %d", c.params.MaxMessageSize))
+	if c.params.TLSConfig != nil && c.tlsConn == nil && !c.params.DisabledVerbs["STARTTLS"] {
+		advertise("STARTTLS")
+	}
+	if c.tlsConn != nil {
+		// RFC8689 4.1
+		advertise("REQUIRETLS")
+	}
+	// RFC4954 3, only over TLS as the mechanisms send the password in the clear
+	if c.tlsConn != nil && c.authenticator() != nil && !c.params.DisabledVerbs["AUTH"] {
+		advertise("AUTH " + strings.Join(authMechanisms, " "))
+	}
+	// RFC6710 3
+	advertise("MT-PRIORITY")
+	// RFC2852 3
+	if c.params.DeliverByMinimum > 0 {
+		advertise(fmt.Sprintf("DELIVERBY %d", int(c.params.DeliverByMinimum/time.Second)))
+	} else {
+		advertise("DELIVERBY")
+	}
+	if c.xforwardTrusted() && !c.params.DisabledVerbs["XFORWARD"] {
+		advertise("XFORWARD " + strings.Join(xforwardAttributes, " "))
+	}
+	advertise("8BITMIME")
+	advertise("SMTPUTF8") // the ITP sees whether a transaction uses it (see SMTPUTF8)
+	advertise(fmt.Sprintf("SIZE %d", c.params.MaxMessageSize))
 	return r, nil
 }
 
+// pathRE matches the path given to MAIL or RCPT (RFC5321 4.1.2), capturing the address within
+// angle brackets (less any whitespace around it), or without them as despite the RFC they are
+// often ommitted, e.g. by WinCE, followed by any ESMTP parameters, which must be separated from
+// the path by whitespace
+const pathRE = `\s*(?:<\s*([^<>\s]*)\s*>|([^<>\s]*))(?:\s+(.*))?$`
+
 var (
-	// despite the RFC, the angle brackets are often ommitted, e.g. by WinCE
-	mailFromRE = regexp.MustCompile(`^[Ff][Rr][Oo][Mm]:\s*<?([^<>]*)>?.*`)
+	priorityRE = regexp.MustCompile(`^[+-]?[0-9]$`)
+	mailFromRE = regexp.MustCompile(`^[Ff][Rr][Oo][Mm]:` + pathRE)
 )
 
+// splitPath returns the address and the ESMTP parameters from a match of pathRE
+func splitPath(match [][]byte) ([]byte, []byte) {
+	if len(match[1]) != 0 {
+		return match[1], match[3]
+	}
+	return match[2], match[3]
+}
+
 // doMAIL implements the MAIL command
 func (c *InboundConnection) doMAIL(ctx context.Context, params []byte) (*ICResponse, error) {
 	if c.inTransaction {
-		return &ICResponse{
-			//RFC5321 4.4.1
-			lines: newICRL(503, "5.5.1 Error: nested MAIL commands"),
-		}, nil
-	}
-	if match := mailFromRE.FindSubmatch(params); match == nil || len(match) != 2 {
-		return &ICResponse{
-			//RFC5321 3.3
-			lines: newICRL(550, "5.1.7 Error: bad envelope sender address format"),
-		}, nil
+		//RFC5321 4.4.1
+		return NewResponse(503, c.message("5.5.1", "nestedmail")), nil
+	}
+	if c.params.RequireTLS && c.tlsConn == nil {
+		// RFC3207 4
+		return NewResponse(530, c.message("5.7.0", "tlsrequired")), nil
+	}
+	if c.params.RequireAuth && c.authIdentity == "" {
+		// RFC4954 6
+		return NewResponse(530, c.message("5.7.0", "authrequired")), nil
+	}
+	if match := mailFromRE.FindSubmatch(params); match == nil || len(match) != 4 {
+		// RFC5321 4.1.2
+		return NewResponse(501, c.message("5.1.7", "badsenderformat")), nil
 	} else {
+		path, esmtpParams := splitPath(match)
+		mailParams, ok := parseMailParameters(esmtpParams)
+		if !ok {
+			// RFC5321 4.1.2
+			return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+		}
+		requireTLS := false
+		if value, ok := mailParams["REQUIRETLS"]; ok {
+			if value != "" {
+				// RFC8689 3
+				return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+			}
+			if c.tlsConn == nil {
+				// RFC8689 4.1
+				return NewResponse(554, c.message("5.7.10", "requiretls")), nil
+			}
+			requireTLS = true
+		}
+		smtpUTF8 := false
+		if value, ok := mailParams["SMTPUTF8"]; ok {
+			if value != "" {
+				// RFC6531 3.4
+				return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+			}
+			smtpUTF8 = true
+		}
+		priority := 0
+		if value, ok := mailParams["MT-PRIORITY"]; ok {
+			// RFC6710 3
+			if !priorityRE.MatchString(value) {
+				return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+			}
+			priority, _ = strconv.Atoi(value)
+		}
+		var deliverBy *DeliverBy
+		if value, ok := mailParams["BY"]; ok {
+			// RFC2852 4.1
+			if deliverBy, ok = c.parseDeliverBy(value, c.clock().Now()); !ok {
+				return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+			}
+		}
+		declaredSize := 0
+		if value, ok := mailParams["SIZE"]; ok {
+			// RFC1870 6
+			if size, err := strconv.Atoi(value); err != nil || size < 0 {
+				return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+			} else if size > c.maxMessageSize() {
+				// RFC1870 6.1
+				return NewResponse(552, c.message("5.3.4", "toobig")), nil
+			} else {
+				declaredSize = size
+			}
+		}
+
+		authParameter := AddressString("")
+		if value, ok := mailParams["AUTH"]; ok {
+			// RFC4954 5
+			mailbox, ok := decodeXtext(value)
+			if !ok {
+				return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+			}
+			if mailbox != "<>" {
+				if c.authIdentity == "" {
+					// we do not trust an unauthenticated client's claim, so act as if given AUTH=<>
+					c.logger.Printf("[DEBUG] Ignoring AUTH=%s from unauthenticated client %s", mailbox, c.name)
+				} else if a := CanonicaliseInboundAddress(mailbox); a == nil {
+					return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+				} else {
+					authParameter = *a
+				}
+			}
+		}
+
 		f := AddressString("")
 		fromAddress := &f
-		if len(match[1]) != 0 {
-			if fromAddress = CanonicaliseInboundAddress(string(match[1])); fromAddress == nil {
-				return &ICResponse{
-					//RFC5321 3.3
-					lines: newICRL(550, "5.1.7 Error: bad envelope sender address component"),
-				}, nil
+		if len(path) != 0 {
+			if !validAddress(string(path)) {
+				// RFC5321 4.5.3.1
+				return NewResponse(501, c.message("5.1.7", "badsenderformat")), nil
+			}
+			var badIDN bool
+			if fromAddress, badIDN = canonicaliseAddress(string(path)); badIDN {
+				// RFC6531 3.2
+				return NewResponse(501, c.message("5.1.7", "badsenderformat")), nil
+			} else if fromAddress == nil {
+				//RFC5321 3.3
+				return NewResponse(550, c.message("5.1.7", "badsender")), nil
+			}
+		}
+
+		if c.params.SenderFilter != nil && len(*fromAddress) != 0 {
+			if r := c.params.SenderFilter.Check(fromAddress); r != nil {
+				return r, nil
 			}
 		}
 
 		// check with the ITP that this is acceptable
-		if r, err := c.ITP.CheckFromAddress(ctx, c, fromAddress); r != nil && r.IsError() || err != nil {
+		c.requireTLS = requireTLS
+		c.smtpUTF8 = smtpUTF8
+		c.priority = priority
+		c.deliverBy = deliverBy
+		c.authParameter = authParameter
+		c.declaredSize = declaredSize
+		r, err := c.ITP.CheckFromAddress(ctx, c, fromAddress)
+		if errors.Is(err, ErrInsufficientStorage) {
+			c.reset()
+			// RFC1870 6.1
+			return NewResponse(452, c.message("4.3.1", "nostorage")), nil
+		}
+		// RFC5321 4.3.2
+		r, accepted, err := applyITPResult(r, err, 250)
+		if !accepted {
+			c.reset() // e.g. a size set by the ITP must not apply to a later transaction
 			return r, err
 		}
 
 		c.inTransaction = true
-		c.ReversePath = *fromAddress
-		return &ICResponse{
-			lines:       newICRL(250, fmt.Sprintf("2.1.0 OK: mail is from '%s'", c.ReversePath)),
-			canPipeline: true,
-		}, nil
+		c.reversePath = *fromAddress
+		c.transactionStart = c.clock().Now()
+		c.sendEvent(&Event{Type: EventTransactionStarted, Sender: c.reversePath})
+		if r != nil {
+			return r.Pipelineable(), nil
+		}
+		return NewResponse(250, fmt.Sprintf("2.1.0 OK: mail is from '%s'", c.reversePath)).Pipelineable(), nil
 	}
 }
 
+// parseMailParameters parses the ESMTP parameters following the address in MAIL or RCPT
+// (RFC5321 4.1.2), returning them keyed by the upper-cased keyword. Keywords without a value map
+// to an empty string. false is returned if the parameters are malformed
+func parseMailParameters(params []byte) (map[string]string, bool) {
+	m := make(map[string]string)
+	for _, p := range strings.Fields(string(params)) {
+		keyword, value := p, ""
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			keyword, value = p[:i], p[i+1:]
+			if value == "" {
+				return nil, false
+			}
+		}
+		if keyword == "" {
+			return nil, false
+		}
+		keyword = strings.ToUpper(keyword)
+		if _, ok := m[keyword]; ok {
+			return nil, false
+		}
+		m[keyword] = value
+	}
+	return m, true
+}
+
+// decodeXtext decodes an xtext MAIL parameter value (RFC3461 4), in which "+" introduces two
+// upper case hex digits, returning false if it is malformed
+func decodeXtext(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < '!' || ch > '~' || ch == '=' {
+			return "", false
+		}
+		if ch == '+' {
+			if i+2 >= len(s) || !isUpperHex(s[i+1]) || !isUpperHex(s[i+2]) {
+				return "", false
+			}
+			v, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			ch = byte(v)
+			i += 2
+		}
+		b.WriteByte(ch)
+	}
+	return b.String(), true
+}
+
+// encodeXtext encodes a MAIL parameter value as xtext (RFC3461 4)
+func encodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if ch := s[i]; ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			fmt.Fprintf(&b, "+%02X", ch)
+		} else {
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// isUpperHex returns true if ch is a hex digit, with letters in upper case
+func isUpperHex(ch byte) bool {
+	return ch >= '0' && ch <= '9' || ch >= 'A' && ch <= 'F'
+}
+
 var (
-	// despite the RFC, the angle brackets are often ommitted, e.g. by WinCE
-	rcptToRE = regexp.MustCompile(`^[Tt][Oo]:\s*<?([^<>]*)>?.*`)
+	rcptToRE = regexp.MustCompile(`^[Tt][Oo]:` + pathRE)
 )
 
 // doRCPT implements the RCPT command
 func (c *InboundConnection) doRCPT(ctx context.Context, params []byte) (*ICResponse, error) {
 	if !c.inTransaction {
-		return &ICResponse{
-			// RFC5321 4.4.1
-			lines: newICRL(503, "5.5.1 Error: missing MAIL command before RCPT"),
-		}, nil
+		// RFC5321 4.4.1
+		return NewResponse(503, c.message("5.5.1", "nomailbeforercpt")), nil
 	}
-	if match := rcptToRE.FindSubmatch(params); match == nil || len(match) != 2 {
-		return &ICResponse{
-			// RFC5321 3.3
-			lines: newICRL(550, "5.1.3 Error: bad envelope recepient address format"),
-		}, nil
+	if match := rcptToRE.FindSubmatch(params); match == nil || len(match) != 4 {
+		// RFC5321 4.1.2
+		return NewResponse(501, c.message("5.1.3", "badrecipientformat")), nil
+	} else if path, esmtpParams := splitPath(match); len(path) == 0 {
+		// RFC5321 4.1.1.3 (the null path may only be used as a reverse-path)
+		return NewResponse(550, c.message("5.1.3", "nullrecipient")), nil
+	} else if !validAddress(string(path)) {
+		// RFC5321 4.5.3.1
+		return NewResponse(501, c.message("5.1.3", "badrecipientformat")), nil
+	} else if _, ok := parseMailParameters(esmtpParams); !ok {
+		// RFC5321 4.1.2
+		return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
 	} else {
-		if rcptAddress := CanonicaliseInboundAddress(string(match[1])); rcptAddress == nil {
-			return &ICResponse{
-				// RFC5321 3.3
-				lines: newICRL(550, "5.1.3 Error: bad envelope recepient address component"),
-			}, nil
+		if rcptAddress, badIDN := canonicaliseAddress(string(path)); badIDN {
+			// RFC6531 3.2
+			return NewResponse(501, c.message("5.1.3", "badrecipientformat")), nil
+		} else if rcptAddress == nil {
+			// RFC5321 3.3
+			return NewResponse(550, c.message("5.1.3", "badrecipient")), nil
 		} else {
-			// check with the ITP that this is acceptable
-			if r, err := c.ITP.CheckRecipientAddress(ctx, c, rcptAddress); r != nil && r.IsError() || err != nil {
-				return r, err
+			if c.params.RecipientFilter != nil {
+				if r := c.params.RecipientFilter.Check(rcptAddress); r != nil {
+					return c.rejectRecipient(r, rcptAddress), nil
+				}
+			}
+
+			deliverTo := rcptAddress
+			if c.params.Aliases != nil {
+				if a, err := c.params.Aliases.Rewrite(rcptAddress); err != nil {
+					c.logger.Printf("[ERROR] %v", err)
+					return NewResponse(451, c.message("4.3.0", "localerror")), nil
+				} else {
+					deliverTo = a
+				}
 			}
 
-			c.RecipientList = append(c.RecipientList, rcptAddress)
-			return &ICResponse{
-				lines:       newICRL(250, fmt.Sprintf("2.1.5 OK: mail recipient '%s'", rcptAddress.String())),
-				canPipeline: true,
-			}, nil
+			// check with the ITP that this is acceptable. A rejected recipient (even temporarily)
+			// leaves the transaction as it was, so the client can carry on with other recipients
+			maxSize := c.transactionMaxSize
+			r, err := c.ITP.CheckRecipientAddress(ctx, c, deliverTo)
+			// RFC5321 4.3.2
+			r, accepted, err := applyITPResult(r, err, 250, 251)
+			if !accepted {
+				c.transactionMaxSize = maxSize
+				if err != nil {
+					return nil, err
+				}
+				return c.rejectRecipient(r, rcptAddress), nil
+			}
+
+			c.recipientList = append(c.recipientList, deliverTo)
+			c.originalRecipients = append(c.originalRecipients, rcptAddress)
+			if r != nil {
+				return r.Pipelineable(), nil
+			}
+			return NewResponse(250, fmt.Sprintf("2.1.5 OK: mail recipient '%s'", rcptAddress.String())).Pipelineable(), nil
 		}
 	}
 }
 
+// rejectRecipient returns the response to a RCPT command whose recipient was rejected. If
+// rejection is deferred, the recipient is instead provisionally accepted, so as not to reveal which
+// addresses are valid, and the strongest rejection (permanent over temporary, then the first) is
+// kept to reject the message at DATA
+func (c *InboundConnection) rejectRecipient(r *ICResponse, address *AddressString) *ICResponse {
+	c.rejectedRecipients++
+	if !c.params.DeferRecipientRejection {
+		return r
+	}
+	if c.deferredRejection == nil || c.deferredRejection.lines[0].code < 500 && r.lines[0].code >= 500 {
+		c.deferredRejection = r
+	}
+	return NewResponse(250, fmt.Sprintf("2.1.5 OK: mail recipient '%s'", address.String())).Pipelineable()
+}
+
 // doDATA implements the DATA command
-func (c *InboundConnection) doDATA(ctx context.Context, params []byte) (*ICResponse, error) {
+func (c *InboundConnection) doDATA(ctx context.Context, params []byte) (resp *ICResponse, err error) {
 	if !c.inTransaction {
-		return &ICResponse{
-			// RFC5321 4.4.1
-			lines: newICRL(503, "5.5.1 Error: missing MAIL command before DATA"),
-		}, nil
+		// RFC5321 4.4.1
+		return NewResponse(503, c.message("5.5.1", "nomailbeforedata")), nil
 	}
-	if len(c.RecipientList) == 0 {
-		return &ICResponse{
-			// RFC5321 3.3
-			lines: newICRL(553, "5.5.1 Error: no valid recipients"),
-		}, nil
+	// report the outcome, taking the envelope now as the transaction is reset once the data is read
+	sender, recipients, start := c.reversePath, c.Recipients(), c.transactionStart
+	var dataStart, firstByte, received time.Time // set as the message is received
+	size := 0                                    // set once the message is received in full
+	defer func() {
+		if err == nil && resp != nil && len(resp.lines) > 0 {
+			e := &Event{
+				Type:         EventMessageAccepted,
+				Sender:       sender,
+				Recipients:   recipients,
+				Code:         resp.lines[0].code,
+				Response:     resp.text(),
+				Size:         size,
+				TLS:          c.TLS() != nil,
+				AuthIdentity: c.AuthIdentity(),
+			}
+			if resp.IsError() {
+				e.Type = EventMessageRejected
+			}
+			if !received.IsZero() {
+				now := c.clock().Now()
+				e.Timing = &TransactionTiming{
+					FirstByte:  firstByte.Sub(dataStart),
+					Transfer:   received.Sub(firstByte),
+					Processing: now.Sub(received),
+					Total:      now.Sub(start),
+				}
+				c.logger.Printf("[INFO] Timing of message from %s (connection %d): %v", c.name, c.id, e.Timing)
+			}
+			c.sendEvent(e)
+		}
+	}()
+	if c.deferredRejection != nil {
+		// a recipient was rejected, but we did not say so at the time
+		return c.deferredRejection, nil
 	}
-
-	ready := &ICResponse{
-		lines: newICRL(354, "354 End data with <CR><LF>.<CR><LF>"),
+	// The message goes to the recipients the ITP accepted, even if it rejected others. If it
+	// accepted none, DATA is refused, unless we are configured to take the message regardless
+	if len(c.recipientList) == 0 && !(c.params.AllowNoRecipients && c.rejectedRecipients > 0) {
+		// RFC5321 3.3
+		return NewResponse(554, c.message("5.5.1", "norecipients")), nil
+	}
+	if checker, ok := c.ITP.(ResourceChecker); ok {
+		if r, accepted, err := applyITPResult(checker.CheckResources(ctx, c)); !accepted {
+			return r, err
+		}
 	}
 
+	ready := NewResponse(354, "354 End data with <CR><LF>.<CR><LF>")
+
 	// This performs a flush too
 	if err := c.Send(ready); err != nil {
 		return nil, err
 	}
+	dataStart = c.clock().Now()
 
 	// on exit we have now lost our transaction
 	defer c.reset()
 
 	// perhaps we should textproto/DotReader with some form of LimitReader
 
-	var body bytes.Buffer
+	body := dataBufferPool.Get().(*bytes.Buffer)
+	atomic.AddInt64(&dataBuffersHeld, 1)
+	processed := false // true once the message has been passed to the ITP
+	defer func() {
+		atomic.AddInt64(&dataBuffersHeld, -1)
+		// if the ITP has taken ownership of the data it may still be using the buffer, but a
+		// partial message (e.g. if the client disconnected mid-DATA) is never passed to it
+		if o, ok := c.ITP.(DataOwner); !processed || !ok || !o.OwnsData() {
+			releaseDataBuffer(body)
+		}
+	}()
 	startOfLine := true
 	oversize := false
 	crlf := []byte("\r\n")
 
 	for {
 		// TODO: add total message timeout too, to stop sloris attack
-		c.conn.SetDeadline(time.Now().Add(c.params.ReadTimeout))
+		c.setDeadline(c.conn.SetDeadline, c.params.ReadTimeout)
+		// check for cancellation after setting the deadline, so a deadline set by
+		// watchContext to interrupt us cannot be overwritten
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		buf, err := c.rdwr.ReadSlice('\n')
 		if err != nil {
 			// buf may be non-empty, but that's OK as we're throwing it away anyway
 			return nil, err
 		}
+		if firstByte.IsZero() {
+			firstByte = c.clock().Now()
+		}
 
 		if len(buf) == 0 {
 			continue
@@ -328,10 +1111,10 @@ func (c *InboundConnection) doDATA(ctx context.Context, params []byte) (*ICRespo
 
 		// Allow some lee-way here. We do an exact check below
 		// We politely swallow oversize messages, but don't actually queue them
-		if !oversize && len(buf)+body.Len() > c.params.MaxMessageSize+1024 {
+		if !oversize && len(buf)+body.Len() > c.maxMessageSize()+1024 {
 			oversize = true
-			// release memory early
-			body.Reset()
+			// release memory early (Reset would retain the capacity)
+			*body = bytes.Buffer{}
 		}
 
 		if !bytes.HasSuffix(buf, crlf) {
@@ -364,154 +1147,462 @@ func (c *InboundConnection) doDATA(ctx context.Context, params []byte) (*ICRespo
 		// We don't add the (dropped) dot, or the final CRLF
 		break
 	}
+	received = c.clock().Now()
+
+	if !oversize {
+		size = body.Len()
+	}
 
 	// reject messages we have truncated, and any strictly oversize messages
-	if oversize || body.Len() > c.params.MaxMessageSize {
-		return &ICResponse{
-			// RFC5321 4.5.3.1.9
-			lines: newICRL(552, "4.3.4 Error: message too big for system"),
-		}, nil
+	if oversize || body.Len() > c.maxMessageSize() {
+		// RFC5321 4.5.3.1.9, RFC1870 6.3
+		return NewResponse(552, c.message("5.3.4", "toobig")), nil
+	}
+
+	// reject huge header sections before anything (including the ITP) has to parse them
+	if c.params.ParseHeaders && c.headersTooLarge(body.Bytes()) {
+		return NewResponse(552, c.message("5.6.0", "toomanyheaders")), nil
+	}
+
+	if c.params.AddMissingHeaders {
+		c.addMissingHeaders(body)
+	}
+
+	if c.params.ParseHeaders {
+		c.headers = c.parseHeaders(body.Bytes())
+	}
+
+	if c.params.ContentFilter != nil {
+		if r, accepted, err := applyITPResult(c.params.ContentFilter.Scan(ctx, c.envelope(), body.Bytes())); !accepted {
+			return r, err
+		}
 	}
 
+	processed = true
+
 	// Process via the ITP. Note this can return its own 250 message, with the appropriate 'queued' response
-	// (e.g. a queue ID), which is more helpful than the default message
-	if r, err := c.ITP.ProcessMail(ctx, c, body.Bytes()); r != nil || err != nil {
+	// (e.g. a queue ID), which is more helpful than the default message. A 2xx response accepts the
+	// message and a 4xx or 5xx rejects it; anything else cannot be relayed to the client
+	if r, err := c.processMail(ctx, body.Bytes()); errors.Is(err, ErrInsufficientStorage) {
+		// RFC1870 6.3
+		return NewResponse(452, c.message("4.3.1", "nostorage")), nil
+	} else if err == nil && r != nil && len(r.lines) > 0 && !r.wellFormed() {
+		c.logger.Printf("[ERROR] Malformed response from ProcessMail for %s: %v", c.name, r.lines)
+		// RFC5321 4.2.3
+		return NewResponse(451, c.message("4.3.0", "localerror")), nil
+	} else if r, accepted, err := applyITPResult(r, err, 250); !accepted || r != nil {
 		return r, err
 	}
 
-	return &ICResponse{
-		lines: newICRL(250, "2.0.0 OK: queued (ID unknown)"),
-	}, nil
+	return NewResponse(250, "2.0.0 OK: queued (ID unknown)"), nil
+}
+
+// envelope returns the envelope of the current transaction
+func (c *InboundConnection) envelope() *Envelope {
+	return &Envelope{
+		Sender:             c.reversePath,
+		Recipients:         c.Recipients(),
+		OriginalRecipients: c.OriginalRecipients(),
+		HeloName:           c.heloName,
+		RemoteAddr:         c.plainConn.RemoteAddr(),
+		RequireTLS:         c.requireTLS,
+		SMTPUTF8:           c.smtpUTF8,
+		Priority:           c.priority,
+		DeliverBy:          c.deliverBy,
+		Headers:            c.headers,
+		XForward:           c.XForward(),
+	}
+}
+
+// parseHeaders parses the header section of a message. Malformed headers do not make a message
+// unacceptable at the SMTP level, so rather than failing we return the headers parsed before the
+// problem was found
+func (c *InboundConnection) parseHeaders(body []byte) textproto.MIMEHeader {
+	h, err := readHeaders(body)
+	if err != nil {
+		c.logger.Printf("[DEBUG] Malformed headers from %s: %v", c.name, err)
+	}
+	return h
+}
+
+// headersTooLarge returns true if the header section of a message (everything before the first
+// empty line) exceeds the configured limits on its number of lines or size. Continuation lines of
+// folded headers count as lines, as they cost a parser as much
+func (c *InboundConnection) headersTooLarge(body []byte) bool {
+	if c.params.MaxHeaderLines <= 0 && c.params.MaxHeaderBytes <= 0 {
+		return false
+	}
+	lines, size := 0, 0
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line = body[:i+1]
+		}
+		body = body[len(line):]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		lines++
+		size += len(line)
+		if (c.params.MaxHeaderLines > 0 && lines > c.params.MaxHeaderLines) ||
+			(c.params.MaxHeaderBytes > 0 && size > c.params.MaxHeaderBytes) {
+			c.logger.Printf("[INFO] Rejecting message from %s with too many headers", c.name)
+			return true
+		}
+	}
+	return false
+}
+
+// Headers returns the headers of the message being processed, if header parsing is enabled, and
+// nil otherwise. It is valid in ProcessMail and content filters
+func (c *InboundConnection) Headers() textproto.MIMEHeader {
+	return c.headers
+}
+
+// maxMessageSize returns the size of the largest message we will accept. With no fixed maximum
+// (RFC1870 4, advertised as SIZE 0) a hard ceiling still applies, as messages are held in memory
+func (c *InboundConnection) maxMessageSize() int {
+	size := c.params.MaxMessageSize
+	if c.transactionMaxSize != nil {
+		size = *c.transactionMaxSize
+	}
+	if size == 0 {
+		return maxUnlimitedMessageSize
+	}
+	return size
+}
+
+// processMail passes a message to the ITP, via the listener's queue if it has one
+func (c *InboundConnection) processMail(ctx context.Context, data []byte) (*ICResponse, error) {
+	if c.listener != nil && c.listener.queue != nil {
+		return c.listener.queue.process(ctx, c, data)
+	}
+	return c.ITP.ProcessMail(ctx, c, data)
 }
 
 // doRSET implements the RSET command
 func (c *InboundConnection) doRSET(ctx context.Context, params []byte) (*ICResponse, error) {
 	c.reset()
-	return &ICResponse{
-		lines:       newICRL(250, "2.0.0 OK"),
-		canPipeline: true,
-	}, nil
+	return NewResponse(250, "2.0.0 OK").Pipelineable(), nil
+}
+
+var (
+	// a domain, optionally prefixed with '@', or a queue name prefixed with '#'
+	etrnRE = regexp.MustCompile(`^[@#]?[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+)
+
+// doETRN implements the ETRN command
+func (c *InboundConnection) doETRN(ctx context.Context, params []byte) (*ICResponse, error) {
+	qr, ok := c.ITP.(QueueRunner)
+	if !ok {
+		return c.notImplementedResponse(), nil
+	}
+	if c.inTransaction {
+		// RFC1985 5.1
+		return NewResponse(503, c.message("5.5.1", "etrnintransaction")), nil
+	}
+	domain := string(bytes.TrimSpace(params))
+	if !etrnRE.MatchString(domain) {
+		// RFC1985 5.1
+		return NewResponse(501, c.message("5.5.4", "badetrn")), nil
+	}
+	r, err := qr.RequestQueueRun(ctx, c, domain)
+	if err != nil {
+		c.logger.Printf("[WARN] Queue run for %s requested by %s failed: %v", domain, c.name, err)
+		// RFC1985 5.1
+		return NewResponse(458, fmt.Sprintf("4.3.0 Unable to queue messages for node %s", domain)), nil
+	}
+	if r != nil {
+		return r, nil
+	}
+	return NewResponse(250, fmt.Sprintf("2.0.0 OK: queuing for node %s started", domain)), nil
 }
 
 // doVRFY implements the VRFY command
 func (c *InboundConnection) doVRFY(ctx context.Context, params []byte) (*ICResponse, error) {
-	return &ICResponse{
-		lines:       newICRL(502, "5.5.1 Error: command not implemented"),
-		canPipeline: true,
-	}, nil
+	return c.notImplementedResponse().Pipelineable(), nil
 }
 
 // doEXPN implements the EXPN command
 func (c *InboundConnection) doEXPN(ctx context.Context, params []byte) (*ICResponse, error) {
-	return &ICResponse{
-		lines:       newICRL(502, "5.5.1 Error: command not implemented"),
-		canPipeline: true,
-	}, nil
+	return c.notImplementedResponse().Pipelineable(), nil
+}
+
+// verbAccepted returns true if this session would act on the verb, rather than refusing it as
+// disabled, not implemented or not permitted. This follows the gating of the EHLO capabilities
+func (c *InboundConnection) verbAccepted(verb string) bool {
+	if c.params.DisabledVerbs[verb] {
+		return false
+	}
+	switch verb {
+	case "EHLO":
+		return !c.params.DisableESMTP
+	case "VRFY", "EXPN":
+		return false
+	case "STARTTLS":
+		return c.params.TLSConfig != nil && c.tlsConn == nil
+	case "AUTH":
+		return c.tlsConn != nil && c.authenticator() != nil
+	case "ETRN":
+		_, ok := c.ITP.(QueueRunner)
+		return ok
+	case "XFORWARD":
+		return c.xforwardTrusted()
+	}
+	return true
 }
 
-// doHELP implements the HELP command
+// doHELP implements the HELP command. With no argument it lists the verbs supported;
+// with a verb as an argument it gives the syntax of that verb
 func (c *InboundConnection) doHELP(ctx context.Context, params []byte) (*ICResponse, error) {
-	return &ICResponse{
-		lines: newICRL(250, "2.0.0 OK: but I currently have no help to give"),
-	}, nil
+	topic := strings.ToUpper(string(bytes.TrimSpace(params)))
+	if topic != "" {
+		if v, ok := verbs[topic]; ok && v.Help != "" && c.verbAccepted(topic) {
+			// RFC5321 4.1.1.8
+			return NewResponse(214, "2.0.0 "+v.Help), nil
+		}
+		// RFC5321 4.2.4
+		return NewResponse(504, fmt.Sprintf("5.5.4 Error: no help available for '%s'", topic)), nil
+	}
+
+	names := make([]string, 0, len(verbs))
+	for name := range verbs {
+		if c.verbAccepted(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	r := NewResponse(214, "2.0.0 Commands supported:")
+	r.Line(214, "2.0.0 "+strings.Join(names, " "))
+	r.Line(214, "2.0.0 For more information use HELP <command>")
+	return r, nil
 }
 
 // doNOOP implements the NOOP command - oddly not pipelineable
+//
+// Any argument is ignored (RFC5321 4.1.1.9); over-long lines are rejected before we get here
 func (c *InboundConnection) doNOOP(ctx context.Context, params []byte) (*ICResponse, error) {
-	return &ICResponse{
-		lines: newICRL(250, "2.0.0 OK"),
-	}, nil
+	return NewResponse(250, "2.0.0 OK"), nil
+}
+
+// doSTARTTLS implements the STARTTLS command (RFC3207). The TLS handshake takes place once the
+// 220 response has been sent
+func (c *InboundConnection) doSTARTTLS(ctx context.Context, params []byte) (*ICResponse, error) {
+	if c.params.TLSConfig == nil {
+		return c.notImplementedResponse(), nil
+	}
+	if c.tlsConn != nil {
+		// RFC5321 4.2.4
+		return NewResponse(503, c.message("5.5.1", "tlsactive")), nil
+	}
+	if len(bytes.TrimSpace(params)) != 0 {
+		// RFC3207 4
+		return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+	}
+	r := NewResponse(220, "2.0.0 Ready to start TLS")
+	r.startTLS = true
+	return r, nil
 }
 
 // doQUIT implements the QUIT command
 func (c *InboundConnection) doQUIT(ctx context.Context, params []byte) (*ICResponse, error) {
 	c.reset()
-	return &ICResponse{
-		lines: newICRL(221, "2.0.0 Bye"),
-		final: true,
-	}, nil
+	return NewResponse(221, "2.0.0 Bye").Final(), nil
 }
 
 // verbs is a map of SMTP verbs to the handlers they use
 var verbs map[string]Verb = map[string]Verb{
-	"HELO": Verb{Run: (*InboundConnection).doHELO},
-	"EHLO": Verb{Run: (*InboundConnection).doEHLO},
-	"MAIL": Verb{Run: (*InboundConnection).doMAIL},
-	"RCPT": Verb{Run: (*InboundConnection).doRCPT},
-	"DATA": Verb{Run: (*InboundConnection).doDATA},
-	"RSET": Verb{Run: (*InboundConnection).doRSET},
-	"VRFY": Verb{Run: (*InboundConnection).doVRFY},
-	"EXPN": Verb{Run: (*InboundConnection).doEXPN},
-	"HELP": Verb{Run: (*InboundConnection).doHELP},
-	"NOOP": Verb{Run: (*InboundConnection).doNOOP},
-	"QUIT": Verb{Run: (*InboundConnection).doQUIT},
+	"HELO":     Verb{Run: (*InboundConnection).doHELO, Help: "HELO <domain>"},
+	"EHLO":     Verb{Run: (*InboundConnection).doEHLO, Help: "EHLO <domain>"},
+	"MAIL":     Verb{Run: (*InboundConnection).doMAIL, Help: "MAIL FROM:<reverse-path> [<parameters>]"},
+	"RCPT":     Verb{Run: (*InboundConnection).doRCPT, Help: "RCPT TO:<forward-path> [<parameters>]"},
+	"DATA":     Verb{Run: (*InboundConnection).doDATA, Help: "DATA"},
+	"RSET":     Verb{Run: (*InboundConnection).doRSET, Help: "RSET"},
+	"ETRN":     Verb{Run: (*InboundConnection).doETRN, Help: "ETRN [@|#]<domain>"},
+	"VRFY":     Verb{Run: (*InboundConnection).doVRFY, Help: "VRFY <string>"},
+	"EXPN":     Verb{Run: (*InboundConnection).doEXPN, Help: "EXPN <string>"},
+	"NOOP":     Verb{Run: (*InboundConnection).doNOOP, Help: "NOOP [<string>]"},
+	"QUIT":     Verb{Run: (*InboundConnection).doQUIT, Help: "QUIT"},
+	"STARTTLS": Verb{Run: (*InboundConnection).doSTARTTLS, Help: "STARTTLS"},
+	"XFORWARD": Verb{Run: (*InboundConnection).doXFORWARD, Help: "XFORWARD <attribute>=<value> ..."},
+	"AUTH":     Verb{Run: (*InboundConnection).doAUTH, Help: "AUTH <mechanism> [<initial-response>]"},
 }
 
-// newInboundConnection returns a new InboundConnection object
-func newInboundConnection(listener *Listener, logger *log.Logger, conn net.Conn) (*InboundConnection, error) {
-	params := &InboundConnectionParameters{
+// unimplementedVerbs are verbs which we recognise but do not implement. These receive a 502
+// rather than a 500, and do not count as unrecognised commands
+var unimplementedVerbs = map[string]bool{
+	"SEND": true, // RFC821
+	"SOML": true, // RFC821
+	"SAML": true, // RFC821
+	"TURN": true, // RFC821
+	"ATRN": true, // RFC2645
+	"BDAT": true, // RFC3030
+}
+
+// utf8Verbs are verbs whose arguments may contain UTF-8 under SMTPUTF8 (RFC6531 3.3), which we
+// always advertise. Other command lines must be ASCII
+var utf8Verbs = map[string]bool{
+	"MAIL": true,
+	"RCPT": true,
+	"VRFY": true,
+	"EXPN": true,
+}
+
+// controlCharacters returns true if a command line contains control characters other than HT,
+// including CR and LF other than as the line terminator, which could smuggle commands or confuse
+// logs and anything else the line is passed to
+func controlCharacters(line []byte) bool {
+	for _, b := range line {
+		if (b < ' ' && b != '\t') || b == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// eightBit returns true if a command line contains any 8-bit characters
+func eightBit(line []byte) bool {
+	for _, b := range line {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// notImplementedResponse returns the response for a recognised verb that is not implemented
+func (c *InboundConnection) notImplementedResponse() *ICResponse {
+	// RFC5321 4.2.4
+	return NewResponse(502, c.message("5.5.1", "notimplemented"))
+}
+
+// knownVerbs holds every verb we recognise, implemented or not
+var knownVerbs = map[string]bool{}
+
+func init() {
+	// HELP is added here as it refers to verbs, which would otherwise be an initialisation loop
+	verbs["HELP"] = Verb{Run: (*InboundConnection).doHELP, Help: "HELP [<command>]"}
+	// likewise knownVerbs, as responses refer to it via trace
+	for verb := range verbs {
+		knownVerbs[verb] = true
+	}
+	for verb := range unimplementedVerbs {
+		knownVerbs[verb] = true
+	}
+}
+
+// NewInboundConnectionParameters returns the default parameters for an inbound connection
+func NewInboundConnectionParameters() *InboundConnectionParameters {
+	return &InboundConnectionParameters{
 		IdleTimeout:        time.Second * 30,
 		ReadTimeout:        time.Second * 15,
 		WriteTimeout:       time.Second * 15,
 		GreetingHostname:   "localhost",
 		GreetingMailserver: "goms",
 		MaxMessageSize:     20 * 1024 * 1024,
+		ReverseDNSTimeout:  time.Second * 5,
 	}
+}
+
+// newInboundConnection returns a new InboundConnection object
+func newInboundConnection(listener *Listener, logger *log.Logger, conn net.Conn) (*InboundConnection, error) {
+	params := NewInboundConnectionParameters()
 	c := &InboundConnection{
 		plainConn: conn,
 		listener:  listener,
 		logger:    logger,
 		params:    params,
 		ITP:       &DummyITP{},
+		id:        nextConnectionID(),
+	}
+	if listener != nil {
+		// each connection has its own copy, so the ITP may alter it (see Params)
+		*params = *listener.params
+		if listener.itp != nil {
+			c.ITP = listener.itp
+		}
 	}
 	return c, nil
 }
 
 // Send sends a response to an inbound connection
 func (c *InboundConnection) Send(r *ICResponse) error {
-	c.conn.SetDeadline(time.Now().Add(c.params.WriteTimeout))
+	c.setDeadline(c.conn.SetDeadline, c.params.WriteTimeout)
 
 	c.logger.Printf("[DEBUG] Writing %v", r)
 
+	// RFC5321 4.2.1 requires every line of a multiline response to carry the same code, and
+	// RFC2034 4 the enhanced status code, so continuation lines take those of the first line.
+	// Responses whose first line has no enhanced status code (e.g. to EHLO) are sent as they are
+	enhanced := ""
+	if len(r.lines) > 0 {
+		enhanced = enhancedRE.FindString(r.lines[0].text)
+	}
 	for i, l := range r.lines {
 		dashspace := " "
 		if i != len(r.lines)-1 {
 			dashspace = "-"
 		}
-		towrite := fmt.Sprintf("%03d%s%s\r\n", l.code, dashspace, l.text)
-
-		for len(towrite) > 0 {
-			if written, err := c.rdwr.WriteString(towrite); err != nil {
-				return err
-			} else {
-				towrite = towrite[written:]
+		if i > 0 {
+			l.code = r.lines[0].code
+			if enhanced != "" && !enhancedRE.MatchString(l.text) {
+				l.text = enhanced + l.text
 			}
 		}
+		towrite := c.formatICRL(l, dashspace)
+		c.trace(">", []byte(strings.TrimSuffix(towrite, "\r\n")))
+
+		// a bufio.Writer only writes short on error (including a short write by the connection,
+		// which gives io.ErrShortWrite), so there is nothing to retry
+		if _, err := c.rdwr.WriteString(towrite); err != nil {
+			return c.writeFailed(err)
+		}
 	}
-	if r.canPipeline {
+	// a final response must be flushed, as the connection is closed once it is sent
+	if r.canPipeline && !r.final {
 		c.needsFlush = true
 	} else {
 		c.needsFlush = false
 		if err := c.rdwr.Flush(); err != nil {
-			return err
+			return c.writeFailed(err)
 		}
 	}
 	return nil
 }
 
+// writeFailed notes an error writing to the client, returning it. A write timeout means the
+// client has stopped reading (often a deliberate stall), so is logged and counted separately
+func (c *InboundConnection) writeFailed(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.logger.Printf("[WARN] Write timeout to %s (connection %d)", c.name, c.id)
+		if c.listener != nil {
+			atomic.AddUint64(&c.listener.writeTimeouts, 1)
+		}
+	}
+	return err
+}
+
 // Receive receives a command from an inbound connection
-func (c *InboundConnection) Receive() (*ICCommand, error) {
+//
+// If ctx is cancelled whilst waiting, the read will be interrupted (see watchContext) and an error returned
+func (c *InboundConnection) Receive(ctx context.Context) (*ICCommand, error) {
 	if c.needsFlush && c.rd.Buffered() == 0 {
 		c.needsFlush = false
 		if err := c.rdwr.Flush(); err != nil {
-			return nil, err
+			return nil, c.writeFailed(err)
 		}
 	}
 	cmd := &ICCommand{}
-	c.conn.SetDeadline(time.Now().Add(c.params.IdleTimeout))
+	c.setDeadline(c.conn.SetDeadline, c.params.IdleTimeout)
+	// check for cancellation after setting the deadline, so a deadline set by
+	// watchContext to interrupt us cannot be overwritten
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if line, isPrefix, err := c.rdwr.ReadLine(); err != nil {
 		return nil, err
 	} else if isPrefix {
+		c.trace("<", append(append([]byte{}, line...), "..."...))
 		cmd.invalid = true
 		// swallow the rest
 		for {
@@ -523,28 +1614,86 @@ func (c *InboundConnection) Receive() (*ICCommand, error) {
 		}
 		return cmd, nil
 	} else {
+		c.trace("<", line)
 		cmd.buf = line
 		return cmd, nil
 	}
 }
 
+// authRE matches an AUTH command, giving the part up to and including the mechanism and any
+// initial response (RFC4954 4)
+var authRE = regexp.MustCompile(`(?i)^(AUTH\s+\S+)(\s.*)?$`)
+
+// trace logs a line sent (">") or received ("<") on the wire at trace level, if the transcript is
+// enabled, with control characters escaped. Credentials are redacted, whether given as the initial
+// response of AUTH or on the line following it or a 334 challenge (RFC4954 4), which a client may
+// send even if we refused AUTH or its mechanism. As we cannot know how many lines a mechanism
+// takes, the line following AUTH is only logged if it is a command
+func (c *InboundConnection) trace(direction string, line []byte) {
+	if !c.params.Transcript {
+		return
+	}
+	if direction == ">" {
+		if bytes.HasPrefix(line, []byte("334 ")) {
+			c.redactNextLine = true
+		}
+	} else if match := authRE.FindSubmatch(line); match != nil {
+		c.redactNextLine = true
+		if len(bytes.TrimSpace(match[2])) != 0 {
+			line = append(append([]byte{}, match[1]...), " [redacted]"...)
+		}
+	} else if c.redactNextLine {
+		c.redactNextLine = false
+		if !knownVerbs[strings.ToUpper(string(bytes.SplitN(line, []byte(" "), 2)[0]))] {
+			line = []byte("[redacted]")
+		}
+	}
+	text := string(line)
+	if controlCharacters(line) {
+		text = strconv.Quote(text)
+	}
+	c.logger.Printf("[TRACE] Connection %d %s %s", c.id, direction, text)
+}
+
 // Process processes a command once received
 func (c *InboundConnection) Process(ctx context.Context, cmd *ICCommand) (*ICResponse, error) {
-	c.conn.SetDeadline(time.Now().Add(c.params.ReadTimeout))
+	c.setDeadline(c.conn.SetDeadline, c.params.ReadTimeout)
+
+	// the line terminator has already been removed, so any CR or LF left is embedded
+	if controlCharacters(cmd.buf) {
+		// RFC5321 2.3.8
+		return NewResponse(500, c.message("5.5.2", "controlchars")), nil
+	}
 
 	words := bytes.SplitN(bytes.Trim(cmd.buf, "\r\n"), []byte(" "), 2)
 
 	if len(words) < 1 {
 		// RFC5321 4.1.1
-		return &ICResponse{lines: newICRL(500, "5.5.2 Error: bad syntax")}, nil
+		return NewResponse(500, c.message("5.5.2", "badsyntax")), nil
 	} else if len(words) == 1 {
 		words = [][]byte{words[0], []byte{}}
 	}
 
-	if v, ok := verbs[strings.ToUpper(string(words[0]))]; !ok {
+	verb := strings.ToUpper(string(words[0]))
+	if eightBit(cmd.buf) && (!utf8Verbs[verb] || !utf8.Valid(cmd.buf)) {
+		// RFC6531 3.3
+		return NewResponse(500, c.message("5.5.2", "eightbit")), nil
+	}
+	if v, ok := verbs[verb]; !ok {
+		if unimplementedVerbs[verb] {
+			// a known verb, so this does not indicate we are out of sync
+			return c.notImplementedResponse(), nil
+		}
 		c.unrecognisedCommands++
+		if c.unrecognisedCommands > maxUnrecognisedCommands {
+			// RFC5321 3.8, tell the client why we are closing the connection
+			return NewResponse(421, c.message("4.7.0", "toomanyunknown")).Final(), nil
+		}
 		// RFC5321 4.2.4
-		return &ICResponse{lines: newICRL(500, "5.5.2 Error: command unknown"), final: c.unrecognisedCommands > maxUnrecognisedCommands}, nil
+		return NewResponse(500, c.message("5.5.2", "unknowncommand")), nil
+	} else if c.params.DisabledVerbs[verb] {
+		// refused as if we did not implement it
+		return c.notImplementedResponse(), nil
 	} else {
 		return v.Run(c, ctx, words[1])
 	}
@@ -552,6 +1701,12 @@ func (c *InboundConnection) Process(ctx context.Context, cmd *ICCommand) (*ICRes
 
 // Serve processes an SMTP conversation, closing the connections etc. when done
 func (c *InboundConnection) Serve(parentCtx context.Context) {
+	c.serve(parentCtx)
+}
+
+// serve processes an SMTP conversation, closing the connections etc. when done, and returns
+// the error (if any) which ended it
+func (c *InboundConnection) serve(parentCtx context.Context) error {
 	c.conn = c.plainConn
 	c.name = c.plainConn.RemoteAddr().String()
 	if c.name == "" {
@@ -559,8 +1714,9 @@ func (c *InboundConnection) Serve(parentCtx context.Context) {
 	}
 
 	c.logger.Printf("[INFO] Connection from %s", c.name)
+	c.sendEvent(&Event{Type: EventConnectionOpened})
 
-	ctx, cancelFunc := context.WithCancel(parentCtx)
+	ctx, cancelFunc := context.WithCancel(context.WithValue(parentCtx, ConnInfoKey{}, c))
 	defer func() {
 		if c.tlsConn != nil {
 			c.tlsConn.Close()
@@ -570,62 +1726,175 @@ func (c *InboundConnection) Serve(parentCtx context.Context) {
 		cancelFunc()
 	}()
 
-	// RFC5321 s4.5.3.1.4 - maximum size of a command line is 512 bytes (subject to extensisons)
-	c.rd = bufio.NewReaderSize(c.conn, 4096)
-	c.wr = bufio.NewWriter(c.conn)
+	c.rd = readerPool.Get().(*bufio.Reader)
+	c.rd.Reset(c.conn)
+	c.wr = writerPool.Get().(*bufio.Writer)
+	c.wr.Reset(c.conn)
 	c.rdwr = bufio.NewReadWriter(c.rd, c.wr)
 
+	var loopErr error // only valid once done is closed
 	done := make(chan struct{})
 	go func() {
-		if err := c.serveLoop(ctx); err != nil {
-			c.logger.Printf("[DEBUG] Server loop return %v", err)
+		loopErr = c.serveLoop(ctx)
+		c.clearDeadline()
+		c.logLoopError(loopErr)
+		if closer, ok := c.ITP.(ConnectionCloser); ok {
+			closer.ConnectionClosed(c)
 		}
+		c.sendEvent(&Event{Type: EventConnectionClosed, Err: loopErr})
+		// only release the buffers once the server loop can no longer use them
+		c.releaseBuffers()
 		close(done)
 	}()
 	select {
 	case <-ctx.Done():
 		c.logger.Printf("[INFO] Parent forced close for %s", c.name)
+		// give the server loop a chance to send a 421 before we close. Stop the timer so it
+		// is not retained until it fires
+		timer := c.clock().NewTimer(c.params.WriteTimeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return loopErr
+		case <-timer.C():
+			return ctx.Err()
+		}
 	case <-done:
 		c.logger.Printf("[INFO] Child quit for %s", c.name)
+		return loopErr
+	}
+}
+
+// disconnected returns true if err shows the client closed or reset the connection
+func disconnected(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// logLoopError logs the error which ended the conversation, if any. A client dropping the
+// connection without QUIT is logged and counted as a disconnection rather than as an error, and
+// cancellation (e.g. on shutdown, when we close the connection) is expected, so only logged at
+// debug level
+func (c *InboundConnection) logLoopError(err error) {
+	switch {
+	case err == nil:
+	case disconnected(err):
+		c.logger.Printf("[INFO] Client %s disconnected (connection %d)", c.name, c.id)
+		if c.listener != nil {
+			atomic.AddUint64(&c.listener.disconnects, 1)
+		}
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, net.ErrClosed):
+		c.logger.Printf("[DEBUG] Server loop return %v", err)
+	default:
+		c.logger.Printf("[WARN] Connection %d from %s ended by error: %v", c.id, c.name, err)
+	}
+}
+
+// ServeConn runs a single SMTP conversation over conn, without a listener, e.g. over an in-memory
+// pipe or a TLS connection that has already been negotiated. If itp is nil, mail is accepted and
+// discarded by a DummyITP. If params is nil the defaults are used; otherwise it should be obtained
+// from NewInboundConnectionParameters and then modified. It is copied, so may be reused
+//
+// ServeConn blocks until the conversation is over, and always closes conn before returning. If ctx
+// is cancelled, the client is sent a 421 and the connection closed. The error returned is that
+// which ended the conversation, which is nil if the client quit
+func ServeConn(ctx context.Context, conn net.Conn, itp InboundTransactionProcessor, params *InboundConnectionParameters, logger *log.Logger) error {
+	c, err := newInboundConnection(nil, logger, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if params != nil {
+		p := *params
+		c.params = &p
+	}
+	if itp != nil {
+		c.ITP = itp
 	}
+	return c.serve(ctx)
 }
 
 // ServeLoop is an internal routine that processes an SMTP conversation
 func (c *InboundConnection) serveLoop(ctx context.Context) error {
+	// ensure blocking reads are interrupted if the context is cancelled
+	defer c.watchContext(ctx)()
+
+	if c.listener != nil && c.listener.maintenance.On() {
+		// RFC5321 3.8, so the client retries later
+		c.logger.Printf("[INFO] Refusing %s during maintenance", c.name)
+		return c.Send(NewResponse(421, c.message("4.3.2", "maintenance")).Final())
+	}
+
+	// find the client's hostname so the ITP can consult it, and check it if we are strict
+	if ip := c.remoteIP(); ip != nil {
+		strict := c.params.ReverseDNSStrict && !c.reverseDNSExempt(ip)
+		if c.params.ReverseDNS || strict {
+			c.lookupRemoteHostname(ctx, ip)
+		}
+		if strict {
+			if r := c.checkReverseDNS(); r != nil {
+				c.logger.Printf("[INFO] Rejecting %s as reverse DNS validation failed", c.name)
+				return c.Send(r)
+			}
+		}
+	}
 
-	// check with the ITP that this is acceptable
+	// check with the ITP that this is acceptable, and whether it wants its own greeting
+	var greeting *ICResponse
 	if r, err := c.ITP.CheckConnection(ctx, c); err != nil {
 		return err
 	} else if r != nil && r.IsError() {
 		return c.Send(r)
+	} else if r != nil && len(r.lines) > 0 {
+		if r.lines[0].code == 220 {
+			greeting = r
+		} else {
+			c.logger.Printf("[WARN] Ignoring %d response to connection from %s; only 220 may replace the greeting", r.lines[0].code, c.name)
+		}
 	}
 
-	// for testing only
-	esmtp := "ESMTP"
-	if c.noEsmtp {
-		esmtp = "SMTP"
+	if c.params.GreetingDelay > 0 {
+		if talked, err := c.earlyTalker(ctx); err != nil {
+			if ctx.Err() != nil {
+				return c.sendShutdown(ctx)
+			}
+			return err
+		} else if talked {
+			c.logger.Printf("[INFO] Rejecting %s for talking before the greeting", c.name)
+			return c.Send(NewResponse(554, c.message("5.5.0", "earlytalker")).Final())
+		}
 	}
 
-	if err := c.Send(&ICResponse{
-		lines: newICRL(220, fmt.Sprintf("%s %s %s", c.params.GreetingHostname, esmtp, c.params.GreetingMailserver)),
-	}); err != nil {
+	if greeting == nil {
+		greeting = NewResponse(220, c.banner())
+	}
+	if err := c.Send(greeting); err != nil {
 		return err
 	}
 
 	c.logger.Println("[DEBUG] Starting server loop")
 
 	for {
-		if cmd, err := c.Receive(); err != nil {
+		select {
+		case <-ctx.Done():
+			return c.sendShutdown(ctx)
+		default:
+		}
+		if cmd, err := c.Receive(ctx); err != nil {
+			if ctx.Err() != nil {
+				return c.sendShutdown(ctx)
+			}
 			return err
 		} else {
 			if cmd.invalid {
-				if err := c.Send(&ICResponse{
-					// RFC5321 s4.5.3.1.4
-					lines: newICRL(500, "5.5.0 Error: invalid line length"),
-				}); err != nil {
+				// RFC5321 s4.5.3.1.4
+				if err := c.Send(NewResponse(500, c.message("5.5.0", "linetoolong"))); err != nil {
 					return err
 				}
 			} else if resp, err := c.Process(ctx, cmd); err != nil {
+				if ctx.Err() != nil {
+					return c.sendShutdown(ctx)
+				}
 				return err
 			} else {
 				if err := c.Send(resp); err != nil {
@@ -634,9 +1903,193 @@ func (c *InboundConnection) serveLoop(ctx context.Context) error {
 				if resp.final {
 					break
 				}
+				if resp.startTLS {
+					if err := c.startTLS(ctx); err != nil {
+						return err
+					}
+				}
 			}
 		}
 	}
 
 	return nil
 }
+
+// startTLS negotiates TLS on the connection after a STARTTLS command. Anything the client
+// sent after STARTTLS is discarded, as is all knowledge obtained from it (RFC3207 4.2), so the
+// client must greet us again
+func (c *InboundConnection) startTLS(ctx context.Context) error {
+	tlsConn := tls.Server(c.plainConn, c.params.TLSConfig)
+	c.setDeadline(tlsConn.SetDeadline, c.params.ReadTimeout)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.logger.Printf("[INFO] TLS handshake failed for %s: %v", c.name, err)
+		return err
+	}
+	c.tlsConn = tlsConn
+	c.conn = tlsConn
+	c.rd.Reset(c.conn)
+	c.wr.Reset(c.conn)
+	c.needsFlush = false
+	c.reset()
+	c.esmtp = false
+	c.heloName = ""
+	c.logTLS(tlsConn.ConnectionState())
+	c.sendEvent(&Event{Type: EventTLSStarted})
+	return nil
+}
+
+// logTLS logs the parameters negotiated by a TLS handshake on a single line, with the client's
+// certificate chain (if any) at debug level
+func (c *InboundConnection) logTLS(state tls.ConnectionState) {
+	clientCert := "none"
+	if len(state.VerifiedChains) > 0 {
+		clientCert = "verified"
+	} else if len(state.PeerCertificates) > 0 {
+		clientCert = "unverified"
+	}
+	sni := state.ServerName
+	if sni == "" {
+		sni = "none"
+	}
+	c.logger.Printf("[INFO] Started TLS for %s (connection %d): version=%s cipher=%s sni=%s client-cert=%s",
+		c.name, c.id, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), sni, clientCert)
+	for i, cert := range state.PeerCertificates {
+		c.logger.Printf("[DEBUG] TLS client certificate %d for %s (connection %d): subject='%s' issuer='%s' expires=%s",
+			i, c.name, c.id, cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// clock returns the clock from which timeouts are calculated
+func (c *InboundConnection) clock() Clock {
+	if c.params.Clock != nil {
+		return c.params.Clock
+	}
+	return realClock{}
+}
+
+// banner returns the text of the greeting
+func (c *InboundConnection) banner() string {
+	if c.params.Banner != nil {
+		return c.params.Banner(c)
+	}
+	esmtp := "ESMTP"
+	if c.params.DisableESMTP {
+		esmtp = "SMTP"
+	}
+	return fmt.Sprintf("%s %s %s", c.params.GreetingHostname, esmtp, c.params.GreetingMailserver)
+}
+
+// earlyTalker waits for the greeting delay, returning true if the client sends anything in
+// that time. Clients must wait for the greeting (RFC5321 3.1), so those that do not are
+// likely to be spam engines
+func (c *InboundConnection) earlyTalker(ctx context.Context) (bool, error) {
+	c.setDeadline(c.conn.SetReadDeadline, c.params.GreetingDelay)
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	_, err := c.rd.Peek(1)
+	if err == nil {
+		return true, nil
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return false, err
+}
+
+// setDeadline makes I/O on a connection fail once d has passed by the connection's clock,
+// replacing any deadline set before; set is the connection's SetDeadline or SetReadDeadline. The
+// real clock sets the socket's deadline. Any other clock has no socket deadline but a timer, which
+// moves the deadline into the past when it expires, so timeouts follow that clock alone
+func (c *InboundConnection) setDeadline(set func(time.Time) error, d time.Duration) {
+	c.clearDeadline()
+	clock := c.clock()
+	if _, ok := clock.(realClock); ok {
+		set(time.Now().Add(d))
+		return
+	}
+	set(time.Time{})
+	timer := clock.NewTimer(d)
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-timer.C():
+			set(time.Now())
+		case <-stop:
+			timer.Stop()
+		}
+	}()
+	c.stopDeadline = func() {
+		close(stop)
+		<-finished
+	}
+}
+
+// clearDeadline stops the timer enforcing the deadline set by setDeadline, if there is one, and
+// waits for it to exit so it cannot move a later deadline
+func (c *InboundConnection) clearDeadline() {
+	if c.stopDeadline != nil {
+		c.stopDeadline()
+		c.stopDeadline = nil
+	}
+}
+
+// watchContext starts a goroutine that interrupts any blocking read on the connection
+// when ctx is cancelled, by moving the read deadline into the past. Reads must therefore
+// check ctx after setting their own deadline. The returned function stops the watcher
+// and waits for it to exit, so the goroutine is never leaked
+func (c *InboundConnection) watchContext(ctx context.Context) func() {
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			c.plainConn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-finished
+	}
+}
+
+// sendShutdown sends a 421 to the client as the session is being closed by the server,
+// and returns the context's error
+func (c *InboundConnection) sendShutdown(ctx context.Context) error {
+	c.logger.Printf("[INFO] Closing connection from %s as session cancelled", c.name)
+	// RFC5321 3.8
+	if err := c.Send(NewResponse(421, c.message("4.3.2", "shutdown")).Final()); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// releaseBuffers returns the connection's buffered reader and writer to their pools,
+// discarding any buffered data
+func (c *InboundConnection) releaseBuffers() {
+	c.rd.Reset(nil)
+	readerPool.Put(c.rd)
+	c.wr.Reset(nil)
+	writerPool.Put(c.wr)
+	c.rd = nil
+	c.wr = nil
+	c.rdwr = nil
+}
+
+// releaseDataBuffer returns a DATA buffer to its pool. The buffer is reset so no message
+// data can be read from it by its next user, and large buffers are dropped so the pool
+// does not pin memory after a large message
+func releaseDataBuffer(body *bytes.Buffer) {
+	if body.Cap() > maxPooledDataBuffer {
+		return
+	}
+	body.Reset()
+	dataBufferPool.Put(body)
+}
@@ -1,13 +1,23 @@
 package smtpd
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,6 +52,9 @@ func newTestLoggerWithPrefix(t *testing.T, prefix string) *log.Logger {
 	return log.New(&testLoggerAdapter{t: t, prefix: prefix}, "", log.Lmicroseconds)
 }
 
+// SMTPClient is the client of a TestConnection. Tests needing only the public API are in package
+// smtpd_test and use gomstest (see conversation_test.go); tests in this package cannot, as
+// gomstest imports it
 type SMTPClient struct {
 	*smtp.Client
 }
@@ -68,7 +81,7 @@ func (c *SMTPClient) Expand(addr string) error {
 
 // Help
 func (c *SMTPClient) Help() error {
-	_, _, err := c.Cmd(250, "HELP")
+	_, _, err := c.Cmd(214, "HELP")
 	return err
 }
 
@@ -78,22 +91,15 @@ func (c *SMTPClient) Noop() error {
 	return err
 }
 
-// Long line
-func (c *SMTPClient) NoopLong() error {
-	_, _, err := c.Cmd(250, "NOOP", strings.Repeat("x", 4096))
-	return err
-}
-
-// Send a bad 'MAIL FROM' command
-func (c *SMTPClient) BadMail(addr string) error {
-	_, _, err := c.Cmd(250, "MAIL FROM", addr) // note missing colon
+// Noop with an argument
+func (c *SMTPClient) NoopArgs(args string) error {
+	_, _, err := c.Cmd(250, "NOOP %s", args)
 	return err
 }
 
-// Send a bad 'RCPT TO' command
-func (c *SMTPClient) BadRcpt(addr string) error {
-	_, _, err := c.Cmd(250, "RCPT TO", addr) // note missing colon
-	return err
+// Long line
+func (c *SMTPClient) NoopLong() error {
+	return c.NoopArgs(strings.Repeat("x", 4096))
 }
 
 // Send a bad empty command
@@ -149,11 +155,28 @@ type TestConnection struct {
 	client  *SMTPClient
 	timeout *time.Timer
 	itp     *TestITP
+	done    chan struct{} // closed when the server exits
 }
 
 func NewTestConnection(t *testing.T) *TestConnection {
+	return newTestConnectionWithITP(t, nil)
+}
+
+// newTestConnectionWithITP starts a test connection with the ITP specified, or
+// the TestITP if itp is nil
+func newTestConnectionWithITP(t *testing.T, itp InboundTransactionProcessor) *TestConnection {
+	return newTestConnectionWithListener(t, nil, itp)
+}
+
+// newTestConnectionWithListener starts a test connection as if accepted by the listener
+// specified, with the ITP specified, or the TestITP if itp is nil
+func newTestConnectionWithListener(t *testing.T, l *Listener, itp InboundTransactionProcessor) *TestConnection {
+	return newTestConnectionWithLogger(t, l, itp, newTestLogger(t))
+}
+
+func newTestConnectionWithLogger(t *testing.T, l *Listener, itp InboundTransactionProcessor, logger *log.Logger) *TestConnection {
 	sc, cc := net.Pipe()
-	ic, _ := newInboundConnection(nil, newTestLogger(t), sc)
+	ic, _ := newInboundConnection(l, logger, sc)
 	tc := &TestConnection{
 		sc:  sc,
 		cc:  cc,
@@ -161,6 +184,9 @@ func NewTestConnection(t *testing.T) *TestConnection {
 		itp: &TestITP{},
 	}
 	ic.ITP = tc.itp
+	if itp != nil {
+		ic.ITP = itp
+	}
 	cc.SetDeadline(time.Now().Add(5 * time.Second))
 
 	tc.ctx, tc.cancel = context.WithCancel(context.Background())
@@ -171,7 +197,11 @@ func NewTestConnection(t *testing.T) *TestConnection {
 	})
 
 	// Start the server
-	go ic.Serve(tc.ctx)
+	tc.done = make(chan struct{})
+	go func() {
+		ic.Serve(tc.ctx)
+		close(tc.done)
+	}()
 
 	return tc
 }
@@ -192,38 +222,11 @@ func (tc *TestConnection) Close() error {
 		tc.client.Close()
 	}
 	tc.cc.Close()
-	// server connection closed by Serve()
+	// server connection closed by Serve(); wait for it so it does not log after the test ends
+	<-tc.done
 	return nil
 }
 
-func TestConnect(t *testing.T) {
-	tc := NewTestConnection(t)
-	defer tc.Close()
-
-	if err := tc.Connect(); err != nil {
-		t.Fatalf("Cannot connect to server: %v", err)
-	}
-
-	if err := tc.client.Quit(); err != nil {
-		t.Fatal("Cannot send quit to server")
-	} else {
-		tc.client = nil // don't attempt Close()
-	}
-}
-
-func TestConnectForbidden(t *testing.T) {
-	tc := NewTestConnection(t)
-	defer tc.Close()
-
-	tc.itp.r = &ICResponse{
-		lines: newICRL(550, "5.5.0 Error: prohibited"),
-	}
-
-	if err := tc.Connect(); err == nil {
-		t.Fatalf("Can connect to server when should have been prohibited")
-	}
-}
-
 func TestAbort(t *testing.T) {
 	tc := NewTestConnection(t)
 	defer tc.Close()
@@ -242,18 +245,35 @@ func TestAbort(t *testing.T) {
 	}
 }
 
-func TestHello(t *testing.T) {
-	tc := NewTestConnection(t)
+func TestHelloNoEhlo(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:     "tcp",
+		Address:      "127.0.0.1:30025",
+		DisableESMTP: true,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
 	defer tc.Close()
 
 	if err := tc.Connect(); err != nil {
 		t.Fatalf("Cannot connect to server: %v", err)
 	}
 
+	if code, _, err := tc.client.Cmd(250, "EHLO localhost"); err == nil || code != 500 {
+		t.Fatalf("Expected 500 for EHLO with ESMTP disabled, got %d: %v", code, err)
+	}
+
+	// the client tries EHLO first and should fall back to HELO
 	if err := tc.client.Hello("localhost"); err != nil {
 		t.Fatalf("Cannot say hello to server: %v", err)
 	}
 
+	if ok, _ := tc.client.Extension("PIPELINING"); ok {
+		t.Fatalf("Client did not fall back to HELO")
+	}
+
 	if err := tc.client.Quit(); err != nil {
 		t.Fatal("Cannot send quit to server")
 	} else {
@@ -261,10 +281,27 @@ func TestHello(t *testing.T) {
 	}
 }
 
-func TestHelloNoEhlo(t *testing.T) {
-	tc := NewTestConnection(t)
+func TestSubmissionRequiresAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:     "tcp",
+		Address:      "127.0.0.1:30025",
+		Mode:         "submission",
+		PasswordFile: writeTestPasswordFile(t, dir),
+		Tls: TlsConfig{
+			KeyFile: writeTestCertificate(t, dir, "mail.example.com"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
 	defer tc.Close()
-	tc.ic.noEsmtp = true
 
 	if err := tc.Connect(); err != nil {
 		t.Fatalf("Cannot connect to server: %v", err)
@@ -274,62 +311,78 @@ func TestHelloNoEhlo(t *testing.T) {
 		t.Fatalf("Cannot say hello to server: %v", err)
 	}
 
-	if err := tc.client.Quit(); err != nil {
-		t.Fatal("Cannot send quit to server")
-	} else {
-		tc.client = nil // don't attempt Close()
+	if ok, _ := tc.client.Extension("AUTH"); ok {
+		t.Fatalf("AUTH advertised before STARTTLS")
 	}
-}
 
-func TestVrfyExpnHelpNoop(t *testing.T) {
-	tc := NewTestConnection(t)
-	defer tc.Close()
+	if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<alex@example.com>"); err == nil || code != 530 {
+		t.Fatalf("Expected 530 for MAIL before authentication, got %d: %v", code, err)
+	} else if !strings.HasPrefix(msg, "5.7.0 ") {
+		t.Fatalf("Expected enhanced status code 5.7.0, got '%s'", msg)
+	}
 
-	if err := tc.Connect(); err != nil {
-		t.Fatalf("Cannot connect to server: %v", err)
+	if code, _, err := tc.client.Cmd(503, "RCPT TO:<bob@example.com>"); err != nil {
+		t.Fatalf("Expected 503 for RCPT without MAIL, got %d: %v", code, err)
 	}
 
-	if err := tc.client.Hello("localhost"); err != nil {
-		t.Fatalf("Cannot say hello to server: %v", err)
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
 	}
 
-	if err := tc.client.Verify("aa"); err == nil {
-		t.Fatalf("VRFY unexpectedly worked")
+	if state := tc.ic.TLS(); state == nil || !state.HandshakeComplete {
+		t.Fatalf("Connection does not report TLS")
 	}
 
-	if err := tc.client.Expand("aa"); err == nil {
-		t.Fatalf("EXPN unexpectedly worked")
+	if ok, _ := tc.client.Extension("STARTTLS"); ok {
+		t.Fatalf("STARTTLS advertised after TLS started")
 	}
 
-	if err := tc.client.Help(); err != nil {
-		t.Fatalf("Cannot execute HELP: %v", err)
+	if code, _, err := tc.client.Cmd(503, "STARTTLS"); err != nil {
+		t.Fatalf("Expected 503 for STARTTLS with TLS active, got %d: %v", code, err)
 	}
 
-	if err := tc.client.Noop(); err != nil {
-		t.Fatalf("Cannot execute Noop: %v", err)
+	if ok, mechanisms := tc.client.Extension("AUTH"); !ok || mechanisms != "PLAIN LOGIN" {
+		t.Fatalf("AUTH not advertised after STARTTLS: %v '%s'", ok, mechanisms)
 	}
 
-	if err := tc.client.NoopLong(); err == nil {
-		t.Fatalf("Unexpectedly could execute command with too long line")
+	if code, _, err := tc.client.Cmd(250, "MAIL FROM:<alex@example.com>"); err == nil || code != 530 {
+		t.Fatalf("Expected 530 for MAIL after STARTTLS but before authentication, got %d: %v", code, err)
 	}
 
-	if err := tc.client.BadEmpty(); err == nil {
-		t.Fatalf("Unexpectedly could execute bad empty command")
+	if err := tc.client.Auth(smtp.PlainAuth("", "alex", "secret", "localhost")); err != nil {
+		t.Fatalf("Cannot authenticate: %v", err)
 	}
 
-	if err := tc.client.BadNonexistant(); err == nil {
-		t.Fatalf("Unexpectedly could execute bad non-existant command")
+	if err := tc.client.Mail("alex@example.com"); err != nil {
+		t.Fatalf("MAIL rejected after authentication: %v", err)
 	}
 
-	if err := tc.client.Quit(); err != nil {
-		t.Fatal("Cannot send quit to server")
-	} else {
-		tc.client = nil // don't attempt Close()
+	if tc.ic.AuthIdentity() != "alex" {
+		t.Fatalf("Wrong identity: '%s'", tc.ic.AuthIdentity())
 	}
+
+	quitTLS(t, tc)
 }
 
-func TestAddressingSequencing(t *testing.T) {
-	tc := NewTestConnection(t)
+func TestRequireTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:   "tcp",
+		Address:    "127.0.0.1:30025",
+		RequireTLS: true,
+		Tls: TlsConfig{
+			KeyFile: writeTestCertificate(t, dir, "mail.example.com"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
 	defer tc.Close()
 
 	if err := tc.Connect(); err != nil {
@@ -337,245 +390,808 @@ func TestAddressingSequencing(t *testing.T) {
 	}
 
 	if err := tc.client.Hello("localhost"); err != nil {
-		t.Fatalf("Cannot execute EHLO: %v", err)
+		t.Fatalf("Cannot say hello to server: %v", err)
 	}
 
-	if err := tc.client.Rcpt("a@b"); err == nil {
-		t.Fatalf("Accepted 'RCPT TO' before MAIL")
+	if ok, _ := tc.client.Extension("STARTTLS"); !ok {
+		t.Fatalf("STARTTLS not advertised")
 	}
 
-	if err := tc.client.Mail("aa"); err == nil {
-		t.Fatalf("Incorrectly executed bad 'MAIL FROM'")
+	if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<alex@example.com>"); err == nil || code != 530 {
+		t.Fatalf("Expected 530 for MAIL before STARTTLS, got %d: %v", code, err)
+	} else if !strings.HasPrefix(msg, "5.7.0 ") {
+		t.Fatalf("Expected enhanced status code 5.7.0, got '%s'", msg)
 	}
 
-	if err := tc.client.BadMail("a@a"); err == nil {
-		t.Fatalf("Incorrectly executed bad 'MAIL FROM' (no colon)")
+	if code, _, err := tc.client.Cmd(235, "AUTH PLAIN AGFsZXgAc2VjcmV0"); err == nil || code != 530 {
+		t.Fatalf("Expected 530 for AUTH before STARTTLS, got %d: %v", code, err)
 	}
 
-	if err := tc.client.Mail("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
 	}
 
-	if err := tc.client.Mail("a@b"); err == nil {
-		t.Fatalf("Accepted second 'MAIL FROM'")
+	if state := tc.ic.TLS(); state == nil || !state.HandshakeComplete {
+		t.Fatalf("Connection does not report TLS")
 	}
 
-	if err := tc.client.Rcpt("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	if ok, _ := tc.client.Extension("STARTTLS"); ok {
+		t.Fatalf("STARTTLS advertised after TLS started")
 	}
 
-	if err := tc.client.Rcpt("aa"); err == nil {
-		t.Fatalf("Incorrectly executed bad 'RCPT TO'")
+	if code, _, err := tc.client.Cmd(503, "STARTTLS"); err != nil {
+		t.Fatalf("Expected 503 for STARTTLS with TLS active, got %d: %v", code, err)
 	}
 
-	if err := tc.client.BadRcpt("a@a"); err == nil {
-		t.Fatalf("Incorrectly executed bad 'RCPT TO' (no colon)")
+	if err := tc.client.Mail("alex@example.com"); err != nil {
+		t.Fatalf("MAIL rejected after STARTTLS: %v", err)
 	}
 
-	tc.itp.r = &ICResponse{
-		lines: newICRL(550, "5.5.0 Error: prohibited"),
-	}
-	if err := tc.client.Rcpt("a@a"); err == nil {
-		t.Fatalf("Incorrectly executed prohibited 'RCPT TO'")
-	}
-	tc.itp.r = &ICResponse{
-		lines: newICRL(220, "OK"),
-	}
-	if err := tc.client.Rcpt("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'RCPT TO' with explicit permission: %v", err)
-	}
-	tc.itp.r = nil
+	quitTLS(t, tc)
+}
 
-	if err := tc.client.Reset(); err != nil {
-		t.Fatalf("Cannot execute RSET: %v", err)
+// logBuffer captures log output written concurrently by a connection
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(d []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(d)
+}
+
+func (b *logBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestTLSLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
 	}
+	defer os.RemoveAll(dir)
 
-	if err := tc.client.Rcpt("a@b"); err == nil {
-		t.Fatalf("RSET appears not to have ended transaction")
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls: TlsConfig{
+			KeyFile: writeTestCertificate(t, dir, "mail.example.com"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
 	}
+	logs := &logBuffer{}
+	tc := newTestConnectionWithLogger(t, l, nil, log.New(logs, "", 0))
+	defer tc.Close()
 
-	tc.itp.r = &ICResponse{
-		lines: newICRL(550, "5.5.0 Error: prohibited"),
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
 	}
-	if err := tc.client.Mail("a@b"); err == nil {
-		t.Fatalf("Incorrectly executed prohibited 'MAIL FROM' after RSET")
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
 	}
-	tc.itp.r = nil
-
-	if err := tc.client.Mail("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'MAIL FROM' after RSET: %v", err)
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
 	}
 
-	if err := tc.client.Rcpt("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'RCPT TO' after RSET: %v", err)
+	state := tc.ic.TLS()
+	if state == nil {
+		t.Fatalf("Connection does not report TLS")
 	}
-
-	if err := tc.client.Quit(); err != nil {
-		t.Fatal("Cannot send QUIT: %v", err)
-	} else {
-		tc.client = nil // don't attempt Close()
+	expected := fmt.Sprintf("[INFO] Started TLS for %s (connection %d): version=%s cipher=%s sni=mail.example.com client-cert=none\n",
+		tc.ic.name, tc.ic.ID(), tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if output := logs.String(); !strings.Contains(output, expected) {
+		t.Fatalf("TLS parameters not logged, expected '%s' in:\n%s", expected, output)
 	}
+
+	quitTLS(t, tc)
 }
 
-func TestData(t *testing.T) {
-	tc := NewTestConnection(t)
+func TestTranscript(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025", Transcript: true})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	logs := &logBuffer{}
+	tc := newTestConnectionWithLogger(t, l, nil, log.New(logs, "", 0))
 	defer tc.Close()
 
 	if err := tc.Connect(); err != nil {
 		t.Fatalf("Cannot connect to server: %v", err)
 	}
-
 	if err := tc.client.Hello("localhost"); err != nil {
-		t.Fatalf("Cannot execute EHLO: %v", err)
-	}
-
-	if writer, err := tc.client.Data(); err == nil {
-		t.Fatalf("Incorrectly executed 'DATA' before MAIL FROM")
-	} else {
-		if writer != nil {
-			writer.Close()
-		}
+		t.Fatalf("Cannot say hello to server: %v", err)
 	}
-
-	if err := tc.client.Mail("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+	if code, _, err := tc.client.Cmd(250, "AUTH PLAIN AGFsZXgAc2VjcmV0"); err == nil || code != 502 {
+		t.Fatalf("Expected 502 for AUTH, got %d %v", code, err)
 	}
-
-	if writer, err := tc.client.Data(); err == nil {
-		t.Fatalf("Incorrectly executed 'DATA' before RCPT TO")
-	} else {
-		if writer != nil {
-			writer.Close()
-		}
+	if _, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b>"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
 	}
-
-	if err := tc.client.Rcpt("a@b"); err != nil {
+	if err := tc.client.Rcpt("c@d"); err != nil {
 		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
 	}
-
 	if writer, err := tc.client.Data(); err != nil {
 		t.Fatalf("Cannot execute 'DATA': %v", err)
 	} else {
-		// do not put broken line endings in here (e.g. \n rather than \r\n) and ensure you end with a \r, as otherwise
-		// golang's smtp sender fixes them up
-		towrite := []byte("Subject: test\r\n\r\nA line\r\n\r\n.begins with a dot\r\n\r\n.\r\nmore\r\nthat's all folks!\r\n")
-		if n, err := writer.Write(towrite); err != nil || n != len(towrite) {
-			t.Fatalf("Write failed err=%v len=%d (expecting %d)", err, n, len(towrite))
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
 		}
 		if err := writer.Close(); err != nil {
-			t.Fatalf("Close failed: %v", err)
+			t.Fatalf("Message not accepted: %v", err)
 		}
-		if !bytes.Equal(tc.itp.data, towrite) {
-			t.Fatalf("Written data not identical")
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	}
+	tc.client = nil // don't attempt Close()
+	<-tc.done
+
+	output := logs.String()
+	prefix := fmt.Sprintf("[TRACE] Connection %d ", tc.ic.ID())
+	for _, line := range []string{
+		"> 220 localhost ESMTP goms",
+		"< EHLO localhost",
+		"> 250-PIPELINING",
+		"> 250 SIZE 20971520",
+		"< AUTH PLAIN [redacted]",
+		"< MAIL FROM:<a@b>",
+		"> 250 2.1.0 OK: mail is from 'a@b'",
+		"< RCPT TO:<c@d>",
+		"< DATA",
+		"> 250 2.0.0 OK: queued (ID unknown)",
+		"< QUIT",
+		"> 221 2.0.0 Bye",
+	} {
+		if !strings.Contains(output, prefix+line+"\n") {
+			t.Fatalf("Transcript does not contain '%s':\n%s", line, output)
 		}
 	}
-
-	if err := tc.client.Reset(); err != nil {
-		t.Fatalf("Cannot execute RSET: %v", err)
+	if strings.Contains(output, "AGFsZXgAc2VjcmV0") {
+		t.Fatalf("AUTH credentials not redacted:\n%s", output)
 	}
+	// the message itself is not part of the transcript
+	if strings.Contains(output, "Subject: test") {
+		t.Fatalf("Message data in transcript:\n%s", output)
+	}
+}
 
-	if err := tc.client.Mail("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+func TestTranscriptAuthRedacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
 	}
+	defer os.RemoveAll(dir)
 
-	if err := tc.client.Rcpt("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:     "tcp",
+		Address:      "127.0.0.1:30025",
+		Transcript:   true,
+		PasswordFile: writeTestPasswordFile(t, dir),
+		Tls:          TlsConfig{KeyFile: writeTestCertificate(t, dir, "mail.example.com")},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
 	}
+	logs := &logBuffer{}
+	tc := newTestConnectionWithLogger(t, l, nil, log.New(logs, "", 0))
+	defer tc.Close()
 
-	tc.itp.r = &ICResponse{
-		lines: newICRL(550, "5.5.0 Error: prohibited"),
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
 	}
-	if writer, err := tc.client.Data(); err != nil {
-		t.Fatalf("Cannot execute 'DATA': %v", err)
-	} else {
-		// do not put broken line endings in here (e.g. \n rather than \r\n) and ensure you end with a \r, as otherwise
-		// golang's smtp sender fixes them up
-		towrite := []byte("Subject: test\r\n\r\nA line\r\n\r\n.begins with a dot\r\n\r\n.\r\nmore\r\nthat's all folks!\r\n")
-		if n, err := writer.Write(towrite); err != nil || n != len(towrite) {
-			t.Fatalf("Write failed err=%v len=%d (expecting %d)", err, n, len(towrite))
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
+	}
+	// credentials given as an initial response, in reply to challenges, and after a mechanism we
+	// refuse (which a client may send regardless)
+	for _, test := range []struct {
+		lines []string
+		codes []int
+	}{
+		{[]string{"AUTH PLAIN AGFsZXgAaHVudGVyMg=="}, []int{535}},
+		{[]string{"AUTH PLAIN", "AGFsZXgAaHVudGVyMg=="}, []int{334, 535}},
+		{[]string{"auth login", "YWxleA==", "aHVudGVyMg=="}, []int{334, 334, 535}},
+		{[]string{"AUTH CRAM-MD5", "YWxleCBodW50ZXIy"}, []int{504, 500}},
+		{[]string{"AUTH PLAIN AGFsZXgAc2VjcmV0"}, []int{235}},
+	} {
+		for i, line := range test.lines {
+			if code, _, _ := tc.client.Cmd(0, "%s", line); code != test.codes[i] {
+				t.Fatalf("Expected %d for '%s', got %d", test.codes[i], line, code)
+			}
 		}
-		if err := writer.Close(); err == nil {
-			t.Fatalf("Close succeeded when expected to be prohibited")
+	}
+	if tc.ic.AuthIdentity() != "alex" {
+		t.Fatalf("Not authenticated: '%s'", tc.ic.AuthIdentity())
+	}
+	quitTLS(t, tc)
+	tc.cc.Close() // so the server need not wait to close TLS
+	<-tc.done
+
+	output := logs.String()
+	for _, secret := range []string{"AGFsZXgAaHVudGVyMg==", "aHVudGVyMg==", "YWxleA==", "YWxleCBodW50ZXIy", "AGFsZXgAc2VjcmV0", "hunter2", "secret"} {
+		if strings.Contains(output, secret) {
+			t.Fatalf("Credentials '%s' logged:\n%s", secret, output)
 		}
 	}
-	tc.itp.r = nil
+	if n := strings.Count(output, "[redacted]"); n != 6 {
+		t.Fatalf("Expected 6 lines redacted, got %d:\n%s", n, output)
+	}
+	// commands other than AUTH are not redacted, even if following it
+	if !strings.Contains(output, "< QUIT\n") {
+		t.Fatalf("Transcript does not contain QUIT:\n%s", output)
+	}
 
-	if err := tc.client.Quit(); err != nil {
-		t.Fatal("Cannot send QUIT: %v", err)
-	} else {
-		tc.client = nil // don't attempt Close()
+	// the response to any 334 challenge is redacted, whatever the command
+	c, _ := newInboundConnection(l, log.New(logs, "", 0), nil)
+	c.trace(">", []byte("334 UGFzc3dvcmQ6"))
+	c.trace("<", []byte("c2VjcmV0"))
+	c.trace("<", []byte("NOOP"))
+	if output := logs.String(); strings.Contains(output, "c2VjcmV0") || !strings.Contains(output, "< NOOP\n") {
+		t.Fatalf("Response to challenge not redacted:\n%s", output)
 	}
 }
 
-func sendOversizeData(t *testing.T, unit string, count int, max int) error {
-	tc := NewTestConnection(t)
-	defer tc.Close()
+func TestParseMailParameters(t *testing.T) {
+	for _, test := range []struct {
+		params string
+		ok     bool
+		parsed map[string]string
+	}{
+		{"", true, map[string]string{}},
+		{" SIZE=100 body=8BITMIME", true, map[string]string{"SIZE": "100", "BODY": "8BITMIME"}},
+		{" RequireTLS", true, map[string]string{"REQUIRETLS": ""}},
+		{" SIZE=", false, nil},
+		{" =100", false, nil},
+		{" REQUIRETLS REQUIRETLS", false, nil},
+	} {
+		parsed, ok := parseMailParameters([]byte(test.params))
+		if ok != test.ok {
+			t.Fatalf("Parsing '%s' gave %v, expected %v", test.params, ok, test.ok)
+		}
+		if len(parsed) != len(test.parsed) {
+			t.Fatalf("Parsing '%s' gave %v, expected %v", test.params, parsed, test.parsed)
+		}
+		for k, v := range test.parsed {
+			if parsed[k] != v {
+				t.Fatalf("Parsing '%s' gave %v, expected %v", test.params, parsed, test.parsed)
+			}
+		}
+	}
+}
 
-	tc.ic.params.MaxMessageSize = max
+func TestRequireTLSParameter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls: TlsConfig{
+			KeyFile: writeTestCertificate(t, dir, "mail.example.com"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	itp := &StateITP{}
+	tc := newTestConnectionWithListener(t, l, itp)
+	defer tc.Close()
 
 	if err := tc.Connect(); err != nil {
 		t.Fatalf("Cannot connect to server: %v", err)
 	}
 
 	if err := tc.client.Hello("localhost"); err != nil {
-		t.Fatalf("Cannot execute EHLO: %v", err)
+		t.Fatalf("Cannot say hello to server: %v", err)
 	}
-	if err := tc.client.Reset(); err != nil {
-		t.Fatalf("Cannot execute RSET to server: %v", err)
+
+	if ok, _ := tc.client.Extension("REQUIRETLS"); ok {
+		t.Fatalf("REQUIRETLS advertised without TLS")
 	}
 
-	if err := tc.client.Mail("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+	if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<a@b> REQUIRETLS"); err == nil || code != 554 {
+		t.Fatalf("Expected 554 for REQUIRETLS without TLS, got %d: %v", code, err)
+	} else if !strings.HasPrefix(msg, "5.7.10 ") {
+		t.Fatalf("Expected enhanced status code 5.7.10, got '%s'", msg)
 	}
 
-	if err := tc.client.Rcpt("a@b"); err != nil {
-		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	if err := tc.client.StartTLS(&tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Cannot start TLS: %v", err)
 	}
 
+	if ok, _ := tc.client.Extension("REQUIRETLS"); !ok {
+		t.Fatalf("REQUIRETLS not advertised with TLS")
+	}
+
+	if code, _, err := tc.client.Cmd(501, "MAIL FROM:<a@b> REQUIRETLS=yes"); err != nil {
+		t.Fatalf("Expected 501 for REQUIRETLS with a value, got %d: %v", code, err)
+	}
+
+	if code, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b> REQUIRETLS"); err != nil {
+		t.Fatalf("Expected 250 for REQUIRETLS with TLS, got %d: %v", code, err)
+	}
+	if err := tc.client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
 	if writer, err := tc.client.Data(); err != nil {
 		t.Fatalf("Cannot execute 'DATA': %v", err)
 	} else {
-		// do not put broken line endings in here (e.g. \n rather than \r\n) and ensure you end with a \r, as otherwise
-		// golang's smtp sender fixes them up
-		towrite := []byte(strings.Repeat(unit, count))
-		if n, err := writer.Write(towrite); err != nil || n != len(towrite) {
-			t.Logf("Write failed err=%v len=%d (expecting %d)", err, n, len(towrite))
-			return err
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
 		}
-
-		errClose := writer.Close()
-
-		if err := tc.client.Quit(); err != nil {
-			t.Fatal("Cannot send QUIT: %v", err)
-		} else {
-			tc.client = nil // don't attempt Close()
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
 		}
-
-		return errClose
-
 	}
-	return nil // not reached
-}
 
-func TestDataOversize(t *testing.T) {
-	if err := sendOversizeData(t, "x\n", 1024*1024, 4*1024*1024); err != nil {
-		t.Fatalf("Cannot send 2M message")
+	if !itp.requireTLS {
+		t.Fatalf("REQUIRETLS not exposed to the ITP")
 	}
 
-	if err := sendOversizeData(t, "x\n", 1024*1024, 1024*1024); err == nil { // note twice as long as maximum
-		t.Fatalf("Oversize detection failure 1")
-	}
+	quitTLS(t, tc)
+}
 
-	if err := sendOversizeData(t, "x", 2*1024*1024, 1024*1024); err == nil { // note twice as long as maximum
-		t.Fatalf("Oversize detection failure 2")
+func TestParseHeaders(t *testing.T) {
+	c, _ := newInboundConnection(nil, newTestLogger(t), nil)
+	for _, test := range []struct {
+		body    string
+		headers map[string]string
+	}{
+		{"Subject: test\r\nFrom: a@b\r\n\r\nbody\r\n", map[string]string{"Subject": "test", "From": "a@b"}},
+		{"Subject: folded\r\n  over lines\r\nTo: c@d\r\n\r\n", map[string]string{"Subject": "folded over lines", "To": "c@d"}},
+		{"Subject: no terminator\r\nFrom: a@b\r\n", map[string]string{"Subject": "no terminator", "From": "a@b"}},
+		{"Subject: no terminator or CRLF", map[string]string{"Subject": "no terminator or CRLF"}},
+		{"Subject: ugly\r\nthis is not a header\r\nFrom: a@b\r\n\r\n", map[string]string{"Subject": "ugly"}},
+		{"\r\nbody\r\n", map[string]string{}},
+		{"", map[string]string{}},
+	} {
+		h := c.parseHeaders([]byte(test.body))
+		if h == nil || len(h) != len(test.headers) {
+			t.Fatalf("Parsing %q gave %v, expected %v", test.body, h, test.headers)
+		}
+		for k, v := range test.headers {
+			if h.Get(k) != v {
+				t.Fatalf("Parsing %q gave %v, expected %v", test.body, h, test.headers)
+			}
+		}
 	}
 }
 
-// for coverage testing. We can't check the data actually works though
-func TestDummyITP(t *testing.T) {
+func TestHeadersExposed(t *testing.T) {
+	for _, parse := range []bool{false, true} {
+		l, err := NewListener(newTestLogger(t), ServerConfig{
+			Protocol:     "tcp",
+			Address:      "127.0.0.1:30025",
+			ParseHeaders: parse,
+		})
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		itp := &StateITP{}
+		tc := newTestConnectionWithListener(t, l, itp)
+
+		if err := tc.Connect(); err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		if err := tc.client.Hello("localhost"); err != nil {
+			t.Fatalf("Cannot say hello to server: %v", err)
+		}
+		if err := tc.client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if writer, err := tc.client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		} else {
+			if _, err := writer.Write([]byte("Message-ID: <1@b>\r\nSubject: a\r\n\tfolded subject\r\n\r\nbody\r\n")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+		}
+		if err := tc.client.Quit(); err != nil {
+			t.Fatal("Cannot send quit to server")
+		}
+		tc.client = nil // don't attempt Close()
+		tc.Close()
+
+		if !parse {
+			if itp.headers != nil {
+				t.Fatalf("Headers parsed when not enabled")
+			}
+		} else if itp.headers.Get("Message-Id") != "<1@b>" || itp.headers.Get("Subject") != "a folded subject" {
+			t.Fatalf("Wrong headers: %v", itp.headers)
+		}
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	if _, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025", MaxHeaderLines: 10}); err == nil {
+		t.Fatalf("Header limit accepted without parsing headers")
+	}
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:       "tcp",
+		Address:        "127.0.0.1:30025",
+		ParseHeaders:   true,
+		MaxHeaderLines: 10,
+		MaxHeaderBytes: 400,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	for _, test := range []struct {
+		headers  string
+		accepted bool
+	}{
+		{strings.Repeat("X-Header: value\r\n", 10), true},
+		{strings.Repeat("X-Header: value\r\n", 11), false},
+		{"Subject: folded\r\n" + strings.Repeat(" over lines\r\n", 10), false},
+		{"Subject: " + strings.Repeat("x", 380) + "\r\n", true},
+		{"Subject: " + strings.Repeat("x", 400) + "\r\n", false},
+		{strings.Repeat("X-Header: value\r\n", 100000), false},
+	} {
+		itp := &StateITP{}
+		tc := newTestConnectionWithListener(t, l, itp)
+		if err := tc.Connect(); err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		if err := tc.client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		// the body is not part of the header section however many lines it has
+		if writer, err := tc.client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		} else {
+			if _, err := writer.Write([]byte(test.headers + "\r\n" + strings.Repeat("body\r\n", 20))); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			err := writer.Close()
+			if test.accepted && err != nil {
+				t.Fatalf("Message with %d header bytes rejected: %v", len(test.headers), err)
+			} else if !test.accepted {
+				checkSinkCode(t, err, 552, "too many headers")
+				if itp.headers != nil {
+					t.Fatalf("Message with too many headers processed")
+				}
+			}
+		}
+		if err := tc.client.Quit(); err != nil {
+			t.Fatal("Cannot send quit to server")
+		}
+		tc.client = nil // don't attempt Close()
+		tc.Close()
+	}
+}
+
+func TestSendMultiline(t *testing.T) {
+	for _, test := range []struct {
+		esmtp    bool
+		response *ICResponse
+		wire     string
+	}{
+		{true, NewResponse(550, "5.7.1 Rejected").Line(550, "5.7.1 See policy").Line(550, "5.7.1 Goodbye"),
+			"550-5.7.1 Rejected\r\n550-5.7.1 See policy\r\n550 5.7.1 Goodbye\r\n"},
+		{true, NewResponse(550, "5.7.1 Rejected").Line(550, "See policy").Line(550, "Goodbye"),
+			"550-5.7.1 Rejected\r\n550-5.7.1 See policy\r\n550 5.7.1 Goodbye\r\n"},
+		{true, NewResponse(451, "4.3.0 Failed").Line(250, "2.0.0 Mismatched").Line(0, "No code"),
+			"451-4.3.0 Failed\r\n451-2.0.0 Mismatched\r\n451 4.3.0 No code\r\n"},
+		{false, NewResponse(550, "5.7.1 Rejected").Line(550, "5.7.1 See policy").Line(550, "Goodbye"),
+			"550-Rejected\r\n550-See policy\r\n550 Goodbye\r\n"},
+		{true, NewResponse(250, "localhost").Line(250, "PIPELINING").Line(250, "SIZE 100"),
+			"250-localhost\r\n250-PIPELINING\r\n250 SIZE 100\r\n"},
+	} {
+		sc, cc := net.Pipe()
+		c, _ := newInboundConnection(nil, newTestLogger(t), sc)
+		c.conn = sc
+		c.rdwr = bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc))
+		c.esmtp = test.esmtp
+		go func() {
+			if err := c.Send(test.response); err != nil {
+				t.Errorf("Send failed: %v", err)
+			}
+			sc.Close()
+		}()
+		if wire, err := ioutil.ReadAll(cc); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		} else if string(wire) != test.wire {
+			t.Fatalf("Sent %q, expected %q", wire, test.wire)
+		}
+	}
+}
+
+// writeCountingConn counts the writes made to a connection, each of which is a syscall on a socket
+type writeCountingConn struct {
+	net.Conn
+	writes int64 // atomic
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestPipelinedResponsesCoalesced(t *testing.T) {
+	sc, cc := net.Pipe()
+	conn := &writeCountingConn{Conn: sc}
+	ic, _ := newInboundConnection(nil, newTestLogger(t), conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		ic.Serve(ctx)
+		close(done)
+	}()
+	defer func() {
+		cc.Close()
+		<-done
+	}()
+	cc.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := textproto.NewReader(bufio.NewReader(cc))
+	if _, _, err := rd.ReadResponse(220); err != nil {
+		t.Fatalf("Bad greeting: %v", err)
+	}
+	if _, err := cc.Write([]byte("EHLO localhost\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, _, err := rd.ReadResponse(250); err != nil {
+		t.Fatalf("Bad response to EHLO: %v", err)
+	}
+
+	// the client sends a batch in one turn (RFC2920 3.1), so every response is written at once
+	before := atomic.LoadInt64(&conn.writes)
+	batch := "MAIL FROM:<a@b>\r\n" + strings.Repeat("RCPT TO:<c@d>\r\n", 5)
+	go cc.Write([]byte(batch))
+	for i := 0; i < 6; i++ {
+		if _, _, err := rd.ReadResponse(250); err != nil {
+			t.Fatalf("Bad response %d to pipelined batch: %v", i, err)
+		}
+	}
+	if writes := atomic.LoadInt64(&conn.writes) - before; writes != 1 {
+		t.Fatalf("Responses to a pipelined batch took %d writes, expected 1", writes)
+	}
+
+	// responses which cannot be pipelined are flushed at once
+	before = atomic.LoadInt64(&conn.writes)
+	go cc.Write([]byte("NOOP\r\nNOOP\r\n"))
+	for i := 0; i < 2; i++ {
+		if _, _, err := rd.ReadResponse(250); err != nil {
+			t.Fatalf("Bad response %d: %v", i, err)
+		}
+	}
+	if writes := atomic.LoadInt64(&conn.writes) - before; writes != 2 {
+		t.Fatalf("Unpipelined responses took %d writes, expected 2", writes)
+	}
+}
+
+// shortWriteConn writes at most half of what it is given, without returning an error
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	return c.Conn.Write(b[:len(b)/2])
+}
+
+func TestSendWrites(t *testing.T) {
+	long := NewResponse(250, "2.0.0 "+strings.Repeat("x", 100)).Line(250, "2.0.0 "+strings.Repeat("y", 100))
+	wire := "250-2.0.0 " + strings.Repeat("x", 100) + "\r\n250 2.0.0 " + strings.Repeat("y", 100) + "\r\n"
+	for _, short := range []bool{false, true} {
+		sc, cc := net.Pipe()
+		var conn net.Conn = sc
+		if short {
+			conn = &shortWriteConn{sc}
+		}
+		c, _ := newInboundConnection(nil, newTestLogger(t), sc)
+		c.conn = sc
+		c.esmtp = true
+		// a small buffer so that the response is written in several pieces
+		c.rdwr = bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriterSize(conn, 16))
+		sent := make(chan error, 1)
+		go func() {
+			sent <- c.Send(long)
+			sc.Close()
+		}()
+		// if Send spun, the connection would never be closed
+		cc.SetDeadline(time.Now().Add(5 * time.Second))
+		received, err := ioutil.ReadAll(cc)
+		if err != nil {
+			t.Fatalf("Send did not return: %v", err)
+		}
+		if err := <-sent; short && err != io.ErrShortWrite {
+			t.Fatalf("Expected a short write error, got %v", err)
+		} else if !short && (err != nil || string(received) != wire) {
+			t.Fatalf("Sent %q (%v), expected %q", received, err, wire)
+		}
+	}
+}
+
+// TuningITP raises the message size limit for each connection
+type TuningITP struct {
+	DummyITP
+}
+
+func (i *TuningITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	c.Params().MaxMessageSize = 5000
+	return nil, nil
+}
+
+func TestParamsTunedByITP(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &TuningITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if ok, size := tc.client.Extension("SIZE"); !ok || size != "5000" {
+		t.Fatalf("Wrong SIZE advertised: %s", size)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// SizeOverrideITP raises the message size limit for trusted senders for the rest of the session
+// (standing in for an authenticated user), and for big recipients for a single transaction
+type SizeOverrideITP struct {
+	DummyITP
+}
+
+func (i *SizeOverrideITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	c.Params().MaxMessageSize = 1000
+	return nil, nil
+}
+
+func (i *SizeOverrideITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if *address == "trusted@example.com" {
+		c.Params().MaxMessageSize = 4000
+	}
+	return nil, nil
+}
+
+func (i *SizeOverrideITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if *address == "big@example.com" {
+		c.SetMaxMessageSize(0)
+	}
+	return nil, nil
+}
+
+func TestMaxMessageSizeOverride(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &SizeOverrideITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if ok, size := tc.client.Extension("SIZE"); !ok || size != "1000" {
+		t.Fatalf("Wrong SIZE advertised: %s", size)
+	}
+
+	send := func(sender, recipient string) error {
+		if err := tc.client.Mail(sender); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt(recipient); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		writer, err := tc.client.Data()
+		if err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		}
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\n" + strings.Repeat("x", 2000) + "\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		return writer.Close()
+	}
+
+	// the recipient's limit applies to its transaction only
+	if err := send("a@example.com", "big@example.com"); err != nil {
+		t.Fatalf("Message to big recipient rejected: %v", err)
+	}
+	if err := send("a@example.com", "small@example.com"); err == nil {
+		t.Fatalf("Oversize message accepted")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 552 {
+		t.Fatalf("Expected 552 for oversize message, got %v", err)
+	}
+
+	// the trusted sender's limit applies to the rest of the session, and is advertised on EHLO
+	if err := send("trusted@example.com", "small@example.com"); err != nil {
+		t.Fatalf("Message from trusted sender rejected: %v", err)
+	}
+	if _, msg, err := tc.client.Cmd(250, "EHLO localhost"); err != nil {
+		t.Fatalf("Cannot say hello again: %v", err)
+	} else if !strings.Contains(msg, "\nSIZE 4000") {
+		t.Fatalf("Raised SIZE not advertised: %s", msg)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestVrfyExpnHelpNoop(t *testing.T) {
+	tc := NewTestConnection(t)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+
+	if err := tc.client.Verify("aa"); err == nil {
+		t.Fatalf("VRFY unexpectedly worked")
+	}
+
+	if err := tc.client.Expand("aa"); err == nil {
+		t.Fatalf("EXPN unexpectedly worked")
+	}
+
+	if err := tc.client.Help(); err != nil {
+		t.Fatalf("Cannot execute HELP: %v", err)
+	}
+
+	if err := tc.client.Noop(); err != nil {
+		t.Fatalf("Cannot execute Noop: %v", err)
+	}
+
+	if err := tc.client.NoopArgs("some arbitrary text"); err != nil {
+		t.Fatalf("Cannot execute Noop with arguments: %v", err)
+	}
+
+	if err := tc.client.NoopLong(); err == nil {
+		t.Fatalf("Unexpectedly could execute command with too long line")
+	}
+
+	if err := tc.client.BadEmpty(); err == nil {
+		t.Fatalf("Unexpectedly could execute bad empty command")
+	}
+
+	if err := tc.client.BadNonexistant(); err == nil {
+		t.Fatalf("Unexpectedly could execute bad non-existant command")
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func sendOversizeData(t *testing.T, unit string, count int, max int) error {
 	tc := NewTestConnection(t)
 	defer tc.Close()
-	tc.ic.ITP = &DummyITP{}
+
+	tc.ic.params.MaxMessageSize = max
 
 	if err := tc.Connect(); err != nil {
 		t.Fatalf("Cannot connect to server: %v", err)
@@ -584,6 +1200,9 @@ func TestDummyITP(t *testing.T) {
 	if err := tc.client.Hello("localhost"); err != nil {
 		t.Fatalf("Cannot execute EHLO: %v", err)
 	}
+	if err := tc.client.Reset(); err != nil {
+		t.Fatalf("Cannot execute RSET to server: %v", err)
+	}
 
 	if err := tc.client.Mail("a@b"); err != nil {
 		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
@@ -594,22 +1213,1958 @@ func TestDummyITP(t *testing.T) {
 	}
 
 	if writer, err := tc.client.Data(); err != nil {
-		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		t.Fatalf("Cannot execute 'DATA': %v", err)
 	} else {
 		// do not put broken line endings in here (e.g. \n rather than \r\n) and ensure you end with a \r, as otherwise
 		// golang's smtp sender fixes them up
-		towrite := []byte("Subject: test\r\n\r\nA line\r\n\r\n.begins with a dot\r\n\r\n.\r\nmore\r\nthat's all folks!\r\n")
+		towrite := []byte(strings.Repeat(unit, count))
 		if n, err := writer.Write(towrite); err != nil || n != len(towrite) {
-			t.Fatalf("Write failed err=%v len=%d (expecting %d)", err, n, len(towrite))
+			t.Logf("Write failed err=%v len=%d (expecting %d)", err, n, len(towrite))
+			return err
 		}
-		if err := writer.Close(); err != nil {
-			t.Fatalf("Close failed: %v", err)
+
+		errClose := writer.Close()
+
+		if err := tc.client.Quit(); err != nil {
+			t.Fatal("Cannot send QUIT: %v", err)
+		} else {
+			tc.client = nil // don't attempt Close()
 		}
+
+		return errClose
+
+	}
+	return nil // not reached
+}
+
+func TestDataOversize(t *testing.T) {
+	if err := sendOversizeData(t, "x\n", 1024*1024, 4*1024*1024); err != nil {
+		t.Fatalf("Cannot send 2M message")
 	}
 
-	if err := tc.client.Quit(); err != nil {
-		t.Fatal("Cannot send QUIT: %v", err)
-	} else {
+	if err := sendOversizeData(t, "x\n", 1024*1024, 1024*1024); err == nil { // note twice as long as maximum
+		t.Fatalf("Oversize detection failure 1")
+	}
+
+	if err := sendOversizeData(t, "x", 2*1024*1024, 1024*1024); err == nil { // note twice as long as maximum
+		t.Fatalf("Oversize detection failure 2")
+	}
+}
+
+func TestDataUnlimitedSize(t *testing.T) {
+	if err := sendOversizeData(t, "x\n", 1024*1024, 0); err != nil {
+		t.Fatalf("Cannot send 2M message with no fixed maximum: %v", err)
+	}
+
+	c, _ := newInboundConnection(nil, newTestLogger(t), nil)
+	c.params.MaxMessageSize = 0
+	if c.maxMessageSize() != maxUnlimitedMessageSize {
+		t.Fatalf("Wrong ceiling with no fixed maximum: %d", c.maxMessageSize())
+	}
+}
+
+func TestMailSizeParameter(t *testing.T) {
+	for _, test := range []struct {
+		max       int
+		advertise string
+		accepted  []string
+		rejected  map[string]int
+	}{
+		{1000, "1000", []string{"SIZE=0", "SIZE=1000"}, map[string]int{"SIZE=1001": 552, "SIZE=abc": 501, "SIZE=-1": 501}},
+		{0, "0", []string{"SIZE=1000", "SIZE=1000000000"}, map[string]int{"SIZE=2000000000": 552, "SIZE=abc": 501}},
+	} {
+		max := test.max
+		l, err := NewListener(newTestLogger(t), ServerConfig{
+			Protocol:       "tcp",
+			Address:        "127.0.0.1:30025",
+			MaxMessageSize: &max,
+		})
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		tc := newTestConnectionWithListener(t, l, nil)
+
+		if err := tc.Connect(); err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		if err := tc.client.Hello("localhost"); err != nil {
+			t.Fatalf("Cannot say hello to server: %v", err)
+		}
+		if ok, size := tc.client.Extension("SIZE"); !ok || size != test.advertise {
+			t.Fatalf("Wrong SIZE advertised: %s", size)
+		}
+		for _, param := range test.accepted {
+			if code, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b> %s", param); err != nil {
+				t.Fatalf("MAIL with %s rejected with maximum %d, got %d: %v", param, max, code, err)
+			}
+			if err := tc.client.Reset(); err != nil {
+				t.Fatalf("Cannot execute RSET: %v", err)
+			}
+		}
+		for param, expected := range test.rejected {
+			if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<a@b> %s", param); err == nil || code != expected {
+				t.Fatalf("Expected %d for MAIL with %s with maximum %d, got %d: %v", expected, param, max, code, err)
+			} else if code == 552 && !strings.HasPrefix(msg, "5.3.4 ") {
+				t.Fatalf("Expected enhanced status code 5.3.4, got '%s'", msg)
+			}
+		}
+		if err := tc.client.Quit(); err != nil {
+			t.Fatal("Cannot send quit to server")
+		}
 		tc.client = nil // don't attempt Close()
+		tc.Close()
+	}
+}
+
+// StorageITP reports storage exhaustion for messages from full@b, and for all message data
+type StorageITP struct {
+	DummyITP
+}
+
+func (i *StorageITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if *address == "full@b" {
+		return nil, ErrInsufficientStorage
+	}
+	return nil, nil
+}
+
+func (i *StorageITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	return nil, fmt.Errorf("spool: %w", ErrInsufficientStorage)
+}
+
+func TestSizeResponseCodes(t *testing.T) {
+	// a fixed maximum is a permanent failure
+	if err := sendOversizeData(t, "x\n", 1024*1024, 1024*1024); err == nil {
+		t.Fatalf("Oversize message accepted")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 552 || !strings.HasPrefix(e.Msg, "5.3.4 ") {
+		t.Fatalf("Expected 552 5.3.4 for oversize message, got %v", err)
+	}
+
+	// lack of storage is a temporary failure
+	tc := newTestConnectionWithITP(t, &StorageITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<full@b> SIZE=100"); err == nil || code != 452 {
+		t.Fatalf("Expected 452 for MAIL with storage exhausted, got %d: %v", code, err)
+	} else if !strings.HasPrefix(msg, "4.3.1 ") {
+		t.Fatalf("Expected enhanced status code 4.3.1, got '%s'", msg)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err == nil {
+			t.Fatalf("Message accepted with storage exhausted")
+		} else if e, ok := err.(*textproto.Error); !ok || e.Code != 452 || !strings.HasPrefix(e.Msg, "4.3.1 ") {
+			t.Fatalf("Expected 452 4.3.1 with storage exhausted, got %v", err)
+		}
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// for coverage testing. We can't check the data actually works though
+func TestDummyITP(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &DummyITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot execute EHLO: %v", err)
+	}
+
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+	}
+
+	if err := tc.client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	} else {
+		// do not put broken line endings in here (e.g. \n rather than \r\n) and ensure you end with a \r, as otherwise
+		// golang's smtp sender fixes them up
+		towrite := []byte("Subject: test\r\n\r\nA line\r\n\r\n.begins with a dot\r\n\r\n.\r\nmore\r\nthat's all folks!\r\n")
+		if n, err := writer.Write(towrite); err != nil || n != len(towrite) {
+			t.Fatalf("Write failed err=%v len=%d (expecting %d)", err, n, len(towrite))
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestShutdownWhileIdle(t *testing.T) {
+	tc := NewTestConnection(t)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+
+	tc.cancel()
+
+	if code, _, err := tc.client.Text.ReadResponse(250); err == nil || code != 421 {
+		t.Fatalf("Expected 421 on shutdown, got %d: %v", code, err)
+	}
+}
+
+func TestCancelIdleRead(t *testing.T) {
+	tc := NewTestConnection(t)
+	defer tc.Close()
+
+	// ensure we are not relying on the idle timeout to tear down
+	tc.ic.params.IdleTimeout = time.Hour
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+
+	start := time.Now()
+	tc.cancel()
+
+	if code, _, err := tc.client.Text.ReadResponse(250); err == nil || code != 421 {
+		t.Fatalf("Expected 421 on cancel, got %d: %v", code, err)
+	}
+
+	// the server should now close the connection
+	if _, err := tc.client.Text.ReadLine(); err == nil {
+		t.Fatalf("Connection unexpectedly still open")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Teardown took too long: %v", elapsed)
+	}
+}
+
+// benchmarkData sends b.N messages with the body supplied over a single connection
+func benchmarkData(b *testing.B, body []byte) {
+	sc, cc := net.Pipe()
+	ic, _ := newInboundConnection(nil, log.New(ioutil.Discard, "", 0), sc)
+	ic.ITP = &DummyITP{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ic.Serve(ctx)
+
+	client, err := smtp.NewClient(cc, "localhost")
+	if err != nil {
+		b.Fatalf("Cannot connect to server: %v", err)
+	}
+	defer client.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Mail("a@b"); err != nil {
+			b.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := client.Rcpt("a@b"); err != nil {
+			b.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		writer, err := client.Data()
+		if err != nil {
+			b.Fatalf("Cannot execute 'DATA': %v", err)
+		}
+		if _, err := writer.Write(body); err != nil {
+			b.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			b.Fatalf("Close failed: %v", err)
+		}
+	}
+	b.StopTimer()
+
+	if err := client.Quit(); err != nil {
+		b.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
+
+func BenchmarkDataSmallMessage(b *testing.B) {
+	benchmarkData(b, []byte("Subject: test\r\n\r\n"+strings.Repeat("A short line of text\r\n", 50)))
+}
+
+func BenchmarkDataLargeMessage(b *testing.B) {
+	benchmarkData(b, []byte("Subject: test\r\n\r\n"+strings.Repeat(strings.Repeat("x", 998)+"\r\n", 10*1024)))
+}
+
+func BenchmarkDataManyLines(b *testing.B) {
+	benchmarkData(b, []byte("Subject: test\r\n\r\n"+strings.Repeat("x\r\n", 256*1024)))
+}
+
+// OwningITP is an InboundTransactionProcessor which takes ownership of the mail data
+type OwningITP struct {
+	DummyITP
+	data []byte // retained data
+}
+
+// OwnsData indicates we retain the data passed to ProcessMail
+func (i *OwningITP) OwnsData() bool {
+	return true
+}
+
+// ProcessMail retains the data without copying it
+func (i *OwningITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.data = data
+	return nil, nil
+}
+
+// sendMessage sends a single message using the client supplied
+func sendMessage(t *testing.T, client *smtp.Client, towrite []byte) {
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' to server: %v", err)
+	}
+	if err := client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if writer, err := client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if n, err := writer.Write(towrite); err != nil || n != len(towrite) {
+			t.Fatalf("Write failed err=%v len=%d (expecting %d)", err, n, len(towrite))
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+}
+
+func TestDataMemoryReleased(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &DummyITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	sendMessage(t, tc.client.Client, []byte(strings.Repeat(strings.Repeat("x", 998)+"\r\n", 8*1024)))
+
+	// the connection is still open, but the 8MB message should no longer be held
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc > before.HeapAlloc+4*1024*1024 {
+		t.Fatalf("Message data retained after DATA: heap grew from %d to %d", before.HeapAlloc, after.HeapAlloc)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestDataOwnership(t *testing.T) {
+	itp := &OwningITP{}
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	first := []byte("Subject: first\r\n\r\nFirst message\r\n")
+	sendMessage(t, tc.client.Client, first)
+	retained := itp.data
+	sendMessage(t, tc.client.Client, []byte("Subject: second\r\n\r\nSecond message\r\n"))
+
+	// the first message must not have been overwritten by the second
+	if !bytes.Equal(retained, first) {
+		t.Fatalf("Owned data was reused: %q", retained)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestDataDisconnect(t *testing.T) {
+	for _, owning := range []bool{false, true} {
+		held := atomic.LoadInt64(&dataBuffersHeld)
+		var itp InboundTransactionProcessor
+		owningITP := &OwningITP{}
+		if owning {
+			itp = owningITP
+		}
+		tc := newTestConnectionWithITP(t, itp)
+		if err := tc.Connect(); err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		if err := tc.client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if _, _, err := tc.client.Cmd(354, "DATA"); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		}
+		if _, err := tc.cc.Write([]byte("Subject: test\r\n\r\npartial body\r\n")); err != nil {
+			t.Fatalf("Cannot write data: %v", err)
+		}
+		// drop the connection mid-body
+		tc.cc.Close()
+		tc.client = nil // don't attempt Close()
+		<-tc.done
+
+		if tc.itp.data != nil || owningITP.data != nil {
+			t.Fatalf("Partial message processed (owning %v)", owning)
+		}
+		if h := atomic.LoadInt64(&dataBuffersHeld); h != held {
+			t.Fatalf("DATA buffer not released (owning %v): %d held, expected %d", owning, h, held)
+		}
+		tc.Close()
+	}
+}
+
+// ETRNITP is an InboundTransactionProcessor which supports ETRN
+type ETRNITP struct {
+	DummyITP
+	domain string // the domain a queue run was requested for
+	err    error  // error to return
+}
+
+// RequestQueueRun records the domain and returns the stored error
+func (i *ETRNITP) RequestQueueRun(ctx context.Context, c *InboundConnection, domain string) (*ICResponse, error) {
+	i.domain = domain
+	return nil, i.err
+}
+
+func TestETRN(t *testing.T) {
+	itp := &ETRNITP{}
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot execute EHLO: %v", err)
+	}
+
+	if ok, _ := tc.client.Extension("ETRN"); !ok {
+		t.Fatalf("ETRN not advertised")
+	}
+
+	if _, _, err := tc.client.Cmd(250, "ETRN @example.com"); err != nil {
+		t.Fatalf("Cannot execute ETRN: %v", err)
+	}
+	if itp.domain != "@example.com" {
+		t.Fatalf("Queue run requested for wrong domain: %s", itp.domain)
+	}
+
+	if code, _, err := tc.client.Cmd(250, "ETRN bad..domain!"); err == nil || code != 501 {
+		t.Fatalf("Expected 501 for bad ETRN parameter, got %d: %v", code, err)
+	}
+
+	itp.err = errors.New("backend failure")
+	if code, _, err := tc.client.Cmd(250, "ETRN example.com"); err == nil || code != 458 {
+		t.Fatalf("Expected 458 for backend failure, got %d: %v", code, err)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestETRNNotImplemented(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &DummyITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot execute EHLO: %v", err)
+	}
+
+	if ok, _ := tc.client.Extension("ETRN"); ok {
+		t.Fatalf("ETRN advertised when not supported")
+	}
+
+	if code, _, err := tc.client.Cmd(250, "ETRN example.com"); err == nil || code != 502 {
+		t.Fatalf("Expected 502 for unsupported ETRN, got %d: %v", code, err)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	tc := NewTestConnection(t)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if _, msg, err := tc.client.Cmd(214, "HELP"); err != nil {
+		t.Fatalf("Cannot execute HELP: %v", err)
+	} else {
+		for _, verb := range []string{"HELO", "EHLO", "MAIL", "RCPT", "DATA", "RSET", "NOOP", "QUIT", "HELP"} {
+			if !strings.Contains(msg, verb) {
+				t.Fatalf("HELP does not list %s: %s", verb, msg)
+			}
+		}
+	}
+
+	if _, msg, err := tc.client.Cmd(214, "HELP"); err != nil {
+		t.Fatalf("Cannot execute HELP: %v", err)
+	} else {
+		// these would be refused by this session, so are not listed
+		for _, verb := range []string{"VRFY", "EXPN", "STARTTLS", "ETRN", "XFORWARD"} {
+			if strings.Contains(msg, verb) {
+				t.Fatalf("HELP lists %s: %s", verb, msg)
+			}
+		}
+	}
+	if code, _, err := tc.client.Cmd(214, "HELP VRFY"); err == nil || code != 504 {
+		t.Fatalf("Expected 504 for HELP on unimplemented verb, got %d: %v", code, err)
+	}
+
+	if _, msg, err := tc.client.Cmd(214, "HELP rcpt"); err != nil {
+		t.Fatalf("Cannot execute HELP RCPT: %v", err)
+	} else if !strings.Contains(msg, "RCPT TO:<forward-path>") {
+		t.Fatalf("HELP RCPT gave wrong text: %s", msg)
+	}
+
+	if code, _, err := tc.client.Cmd(214, "HELP WOMBAT"); err == nil || code != 504 {
+		t.Fatalf("Expected 504 for unknown HELP topic, got %d: %v", code, err)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestUnknownVersusUnimplemented(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &DummyITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	for _, cmd := range []string{"VRFY a@b", "EXPN list", "ETRN example.com", "TURN", "STARTTLS"} {
+		if code, _, err := tc.client.Cmd(250, "%s", cmd); err == nil || code != 502 {
+			t.Fatalf("Expected 502 for '%s', got %d: %v", cmd, code, err)
+		}
+	}
+
+	if code, _, err := tc.client.Cmd(250, "WOMBAT"); err == nil || code != 500 {
+		t.Fatalf("Expected 500 for unknown command, got %d: %v", code, err)
+	}
+
+	// unimplemented verbs must not count towards the unrecognised command limit
+	for i := 0; i <= maxUnrecognisedCommands; i++ {
+		if code, _, err := tc.client.Cmd(250, "TURN"); err == nil || code != 502 {
+			t.Fatalf("Expected 502 for TURN, got %d: %v", code, err)
+		}
+	}
+
+	if err := tc.client.Noop(); err != nil {
+		t.Fatalf("Connection closed after unimplemented commands: %v", err)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestTooManyUnrecognisedCommands(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Messages: map[string]string{"toomanyunknown": "Too many unrecognised commands, goodbye"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	for i := 0; i < maxUnrecognisedCommands; i++ {
+		if code, _, err := tc.client.Cmd(250, "WOMBAT"); err == nil || code != 500 {
+			t.Fatalf("Expected 500 for unknown command, got %d: %v", code, err)
+		}
+	}
+	if code, msg, err := tc.client.Cmd(250, "WOMBAT"); err == nil || code != 421 || msg != "4.7.0 Too many unrecognised commands, goodbye" {
+		t.Fatalf("Expected 421 for too many unknown commands, got %d %s: %v", code, msg, err)
+	}
+	if _, _, err := tc.client.Cmd(250, "NOOP"); err == nil {
+		t.Fatalf("Connection still open after too many unknown commands")
+	} else if _, ok := err.(*textproto.Error); ok {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+// checkEnhancedStatusCodes checks responses include or omit enhanced status codes as configured
+func checkEnhancedStatusCodes(t *testing.T, disable bool) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:                   "tcp",
+		Address:                    "127.0.0.1:30025",
+		DisableEnhancedStatusCodes: disable,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+
+	if ok, _ := tc.client.Extension("ENHANCEDSTATUSCODES"); ok == disable {
+		t.Fatalf("ENHANCEDSTATUSCODES advertised incorrectly (disabled=%v)", disable)
+	}
+
+	if _, msg, err := tc.client.Cmd(250, "NOOP"); err != nil {
+		t.Fatalf("Cannot execute NOOP: %v", err)
+	} else if enhancedRE.MatchString(msg) == disable {
+		t.Fatalf("Enhanced status code wrongly present or absent (disabled=%v): %s", disable, msg)
+	}
+
+	if code, msg, err := tc.client.Cmd(250, "WOMBAT"); err == nil || code != 500 {
+		t.Fatalf("Expected 500 for unknown command, got %d: %v", code, err)
+	} else if enhancedRE.MatchString(msg) == disable {
+		t.Fatalf("Enhanced status code wrongly present or absent (disabled=%v): %s", disable, msg)
+	}
+
+	if _, msg, err := tc.client.Cmd(214, "HELP"); err != nil {
+		t.Fatalf("Cannot execute HELP: %v", err)
+	} else if strings.Contains(msg, "2.0.0") == disable {
+		t.Fatalf("Enhanced status code wrongly present or absent in multiline response (disabled=%v): %s", disable, msg)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestEnhancedStatusCodes(t *testing.T) {
+	checkEnhancedStatusCodes(t, false)
+}
+
+func TestDisableEnhancedStatusCodes(t *testing.T) {
+	checkEnhancedStatusCodes(t, true)
+}
+
+func TestEnhancedStatusCodesHeloEhlo(t *testing.T) {
+	tc := NewTestConnection(t)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+
+	if _, _, err := tc.client.Cmd(250, "HELO localhost"); err != nil {
+		t.Fatalf("Cannot execute HELO: %v", err)
+	}
+	if _, msg, err := tc.client.Cmd(250, "NOOP"); err != nil {
+		t.Fatalf("Cannot execute NOOP: %v", err)
+	} else if enhancedRE.MatchString(msg) {
+		t.Fatalf("Enhanced status code sent after HELO: %s", msg)
+	}
+
+	if _, _, err := tc.client.Cmd(250, "EHLO localhost"); err != nil {
+		t.Fatalf("Cannot execute EHLO: %v", err)
+	}
+	if _, msg, err := tc.client.Cmd(250, "NOOP"); err != nil {
+		t.Fatalf("Cannot execute NOOP: %v", err)
+	} else if !enhancedRE.MatchString(msg) {
+		t.Fatalf("Enhanced status code not sent after EHLO: %s", msg)
+	}
+
+	// a subsequent HELO reverts to plain SMTP
+	if _, _, err := tc.client.Cmd(250, "HELO localhost"); err != nil {
+		t.Fatalf("Cannot execute HELO: %v", err)
+	}
+	if code, msg, err := tc.client.Cmd(250, "WOMBAT"); err == nil || code != 500 {
+		t.Fatalf("Expected 500 for unknown command, got %d: %v", code, err)
+	} else if enhancedRE.MatchString(msg) {
+		t.Fatalf("Enhanced status code sent after HELO: %s", msg)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestResponseBuilder(t *testing.T) {
+	r := NewResponse(250, "2.0.0 first").Line(250, "2.0.0 second").Pipelineable()
+	if len(r.Lines()) != 2 || r.Lines()[1].Code() != 250 || r.Lines()[1].Text() != "2.0.0 second" {
+		t.Fatalf("Response has wrong lines: %v", r.Lines())
+	}
+	if !r.CanPipeline() || r.IsFinal() || r.IsError() {
+		t.Fatalf("Response has wrong flags: %v", r)
+	}
+	if r := NewResponse(421, "4.3.2 go away").Final(); !r.IsFinal() || r.CanPipeline() || !r.IsError() {
+		t.Fatalf("Response has wrong flags: %v", r)
+	}
+}
+
+// StateITP records the transaction state seen by ProcessMail
+type StateITP struct {
+	DummyITP
+	sender     AddressString
+	recipients []*AddressString
+	heloName   string
+	requireTLS bool
+	headers    textproto.MIMEHeader
+}
+
+func (i *StateITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.sender = c.Sender()
+	i.recipients = c.Recipients()
+	i.heloName = c.HeloName()
+	i.requireTLS = c.RequireTLS()
+	i.headers = c.Headers()
+	return nil, nil
+}
+
+func TestTransactionState(t *testing.T) {
+	itp := &StateITP{}
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("client.example.com"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	for _, rcpt := range []string{"c@d", "e@f"} {
+		if err := tc.client.Rcpt(rcpt); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	if itp.sender != "a@b" || itp.heloName != "client.example.com" || len(itp.recipients) != 2 || *itp.recipients[1] != "e@f" {
+		t.Fatalf("Wrong transaction state: sender %s, HELO %s, recipients %v", itp.sender, itp.heloName, itp.recipients)
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// newGreetingTestConnection returns a test connection using a listener with the greeting delay and banner given
+func newGreetingTestConnection(t *testing.T, delay string, banner func(c *InboundConnection) string) *TestConnection {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:      "tcp",
+		Address:       "127.0.0.1:30025",
+		GreetingDelay: delay,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.SetBanner(banner)
+	return newTestConnectionWithListener(t, l, nil)
+}
+
+func TestEarlyTalker(t *testing.T) {
+	tc := newGreetingTestConnection(t, "2s", nil)
+	defer tc.Close()
+
+	text := textproto.NewConn(tc.cc)
+	if err := text.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatalf("Cannot write to server: %v", err)
+	}
+	if _, _, err := text.ReadResponse(220); err == nil {
+		t.Fatalf("Early talker was greeted")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 554 {
+		t.Fatalf("Expected 554 for early talker, got %v", err)
+	}
+}
+
+func TestEarlyTalkerDuringDelay(t *testing.T) {
+	tc := newGreetingTestConnection(t, "2s", nil)
+	defer tc.Close()
+
+	// talk part way through the delay rather than immediately
+	time.Sleep(100 * time.Millisecond)
+	text := textproto.NewConn(tc.cc)
+	if err := text.PrintfLine("HELO localhost"); err != nil {
+		t.Fatalf("Cannot write to server: %v", err)
+	}
+	if _, _, err := text.ReadResponse(220); err == nil {
+		t.Fatalf("Early talker was greeted")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 554 {
+		t.Fatalf("Expected 554 for early talker, got %v", err)
+	}
+}
+
+func TestGreetingDelay(t *testing.T) {
+	tc := newGreetingTestConnection(t, "100ms", nil)
+	defer tc.Close()
+
+	start := time.Now()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("Greeting was not delayed")
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestBanner(t *testing.T) {
+	tc := newGreetingTestConnection(t, "", func(c *InboundConnection) string {
+		return "mx.example.com ESMTP node " + c.name
+	})
+	defer tc.Close()
+
+	text := textproto.NewConn(tc.cc)
+	if _, msg, err := text.ReadResponse(220); err != nil {
+		t.Fatalf("Cannot read greeting: %v", err)
+	} else if !strings.HasPrefix(msg, "mx.example.com ESMTP node ") {
+		t.Fatalf("Wrong banner: %s", msg)
+	}
+	if err := text.PrintfLine("QUIT"); err != nil {
+		t.Fatalf("Cannot write to server: %v", err)
+	}
+	if _, _, err := text.ReadResponse(221); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
+
+// GreetingITP supplies its own greeting, after a delay
+type GreetingITP struct {
+	DummyITP
+}
+
+func (i *GreetingITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	c.Params().GreetingDelay = 200 * time.Millisecond
+	return NewResponse(220, "mx.example.com ESMTP welcome back").Line(220, "friendly greeting"), nil
+}
+
+func TestCheckConnectionGreeting(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &GreetingITP{})
+	defer tc.Close()
+
+	start := time.Now()
+	text := textproto.NewConn(tc.cc)
+	if _, msg, err := text.ReadResponse(220); err != nil {
+		t.Fatalf("Cannot read greeting: %v", err)
+	} else if msg != "mx.example.com ESMTP welcome back\nfriendly greeting" {
+		t.Fatalf("Wrong greeting: %s", msg)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("Greeting not delayed: %v", elapsed)
+	}
+	if err := text.PrintfLine("QUIT"); err != nil {
+		t.Fatalf("Cannot write to server: %v", err)
+	}
+	if _, _, err := text.ReadResponse(221); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
+
+// RoutingITP gives its own success responses to MAIL and RCPT
+type RoutingITP struct {
+	DummyITP
+}
+
+func (i *RoutingITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return NewResponse(250, "2.1.0 Sender accepted by backend 3"), nil
+}
+
+func (i *RoutingITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return NewResponse(250, "2.1.5 Recipient routed to "+address.String()+" via backend 3"), nil
+}
+
+func TestCheckAddressSuccessResponse(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &RoutingITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if _, msg, err := tc.client.Cmd(250, "MAIL FROM:<a@b>"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	} else if msg != "2.1.0 Sender accepted by backend 3" {
+		t.Fatalf("Wrong response to MAIL: %s", msg)
+	}
+	if _, msg, err := tc.client.Cmd(250, "RCPT TO:<c@d>"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	} else if msg != "2.1.5 Recipient routed to c@d via backend 3" {
+		t.Fatalf("Wrong response to RCPT: %s", msg)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestApplyITPResult(t *testing.T) {
+	errResp := NewResponse(550, "5.7.1 Go away")
+	okResp := NewResponse(250, "2.1.0 Fine")
+	itpErr := errors.New("backend failed")
+
+	if r, accepted, err := applyITPResult(nil, nil, 250); r != nil || !accepted || err != nil {
+		t.Fatalf("(nil, nil) gave %v %v %v", r, accepted, err)
+	}
+	if r, accepted, err := applyITPResult(errResp, nil, 250); r != errResp || accepted || err != nil {
+		t.Fatalf("(errResp, nil) gave %v %v %v", r, accepted, err)
+	}
+	if r, accepted, err := applyITPResult(okResp, nil, 250); r == nil || r == okResp || !accepted || err != nil {
+		t.Fatalf("(okResp, nil) gave %v %v %v", r, accepted, err)
+	} else if r.Lines()[0].Text() != "2.1.0 Fine" {
+		t.Fatalf("(okResp, nil) gave wrong text: %s", r.Lines()[0].Text())
+	} else if r.Pipelineable(); okResp.CanPipeline() {
+		t.Fatalf("(okResp, nil) did not return a copy")
+	}
+	if r, accepted, err := applyITPResult(okResp, nil, 251); r != nil || !accepted || err != nil {
+		t.Fatalf("(okResp, nil) with the wrong code gave %v %v %v", r, accepted, err)
+	}
+	if r, accepted, err := applyITPResult(nil, itpErr, 250); r != nil || accepted || err != itpErr {
+		t.Fatalf("(nil, err) gave %v %v %v", r, accepted, err)
+	}
+	if r, accepted, err := applyITPResult(errResp, itpErr, 250); r != nil || accepted || err != itpErr {
+		t.Fatalf("(errResp, err) gave %v %v %v", r, accepted, err)
+	}
+}
+
+func TestProcessMailResponses(t *testing.T) {
+	tc := NewTestConnection(t)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+
+	for _, test := range []struct {
+		r    *ICResponse
+		code int
+		msg  string
+	}{
+		{nil, 250, "2.0.0 OK: queued (ID unknown)"},
+		{NewResponse(250, "2.0.0 OK: queued as 4F2A1C"), 250, "2.0.0 OK: queued as 4F2A1C"},
+		{NewResponse(251, "2.0.0 Odd"), 250, "2.0.0 OK: queued (ID unknown)"},
+		{NewResponse(450, "4.2.0 Mailbox busy, try later"), 450, "4.2.0 Mailbox busy, try later"},
+		{NewResponse(554, "5.6.0 Content rejected"), 554, "5.6.0 Content rejected"},
+		{NewResponse(354, "Go ahead"), 451, "4.3.0 Error: local error in processing"},
+		{NewResponse(250, "2.0.0 OK").Line(550, "5.0.0 Not OK"), 451, "4.3.0 Error: local error in processing"},
+	} {
+		tc.itp.r = nil
+		if err := tc.client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if _, _, err := tc.client.Cmd(354, "DATA"); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		}
+		tc.itp.r = test.r
+		if err := tc.client.Text.PrintfLine("Subject: test\r\n\r\nbody\r\n."); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if code, msg, err := tc.client.Text.ReadResponse(0); code != test.code || msg != test.msg {
+			t.Fatalf("ProcessMail returning %v gave %d %s (%v), expected %d %s", test.r, code, msg, err, test.code, test.msg)
+		}
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// TempFailITP temporarily rejects the sender and recipient busy@example.com, having first
+// restricted the message size (which must not then apply)
+type TempFailITP struct {
+	StateITP
+}
+
+func (i *TempFailITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if *address == "busy@example.com" {
+		c.SetMaxMessageSize(10)
+		return NewResponse(451, "4.3.2 Try again later"), nil
+	}
+	return nil, nil
+}
+
+func (i *TempFailITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if *address == "busy@example.com" {
+		c.SetMaxMessageSize(10)
+		return NewResponse(450, "4.2.1 Mailbox busy"), nil
+	}
+	return nil, nil
+}
+
+func TestTemporaryRejection(t *testing.T) {
+	itp := &TempFailITP{}
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.Mail("busy@example.com"); err == nil {
+		t.Fatalf("Temporarily rejected sender accepted")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 451 {
+		t.Fatalf("Expected 451 for sender, got %v", err)
+	}
+	// no transaction was started, so another MAIL is not nested
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' after temporary rejection: %v", err)
+	}
+	for _, rcpt := range []string{"c@d", "busy@example.com", "e@f"} {
+		if err := tc.client.Rcpt(rcpt); rcpt == "busy@example.com" {
+			if e, ok := err.(*textproto.Error); !ok || e.Code != 450 {
+				t.Fatalf("Expected 450 for recipient, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO' for %s: %v", rcpt, err)
+		}
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nlonger than ten bytes\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Message rejected after temporary rejections: %v", err)
+		}
+	}
+	if itp.sender != "a@b" || len(itp.recipients) != 2 || itp.recipients[0].String() != "c@d" || itp.recipients[1].String() != "e@f" {
+		t.Fatalf("Wrong envelope: %s %v", itp.sender, itp.recipients)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// sendPartialRecipients sends a message to the recipients given, which the ITP rejects if
+// prefixed by "bad", returning the error from DATA
+func sendPartialRecipients(t *testing.T, tc *TestConnection, recipients ...string) error {
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	for _, rcpt := range recipients {
+		if strings.HasPrefix(rcpt, "bad") {
+			tc.itp.r = NewResponse(550, "5.1.1 No such user")
+			if err := tc.client.Rcpt(rcpt); err == nil {
+				t.Fatalf("Rejected recipient %s accepted", rcpt)
+			}
+			tc.itp.r = nil
+		} else if err := tc.client.Rcpt(rcpt); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO' for %s: %v", rcpt, err)
+		}
+	}
+	writer, err := tc.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	return writer.Close()
+}
+
+func TestPartialRecipients(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		l, err := NewListener(newTestLogger(t), ServerConfig{
+			Protocol:          "tcp",
+			Address:           "127.0.0.1:30025",
+			AllowNoRecipients: allow,
+		})
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		tc := newTestConnectionWithListener(t, l, nil)
+		if err := tc.Connect(); err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		if err := tc.client.Hello("localhost"); err != nil {
+			t.Fatalf("Cannot say hello to server: %v", err)
+		}
+
+		// the message goes to the recipients accepted
+		if err := sendPartialRecipients(t, tc, "bad1@example.com", "good@example.com", "bad2@example.com"); err != nil {
+			t.Fatalf("Message to partially rejected recipients not accepted (allow %v): %v", allow, err)
+		} else if !bytes.Contains(tc.itp.data, []byte("body")) {
+			t.Fatalf("Message not processed")
+		}
+
+		// with every recipient rejected, it is only accepted if allowed
+		tc.itp.data = nil
+		if err := sendPartialRecipients(t, tc, "bad1@example.com", "bad2@example.com"); allow && err != nil {
+			t.Fatalf("Message to rejected recipients not accepted: %v", err)
+		} else if !allow && err == nil {
+			t.Fatalf("Message to rejected recipients accepted")
+		} else if allow != (tc.itp.data != nil) {
+			t.Fatalf("Message processed %v, expected %v", tc.itp.data != nil, allow)
+		}
+		if !allow {
+			if err := tc.client.Reset(); err != nil {
+				t.Fatalf("Cannot execute RSET: %v", err)
+			}
+		}
+
+		// with no recipients at all, DATA is always refused
+		if err := tc.client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if _, _, err := tc.client.Cmd(354, "DATA"); err == nil {
+			t.Fatalf("DATA accepted without recipients (allow %v)", allow)
+		}
+		if err := tc.client.Quit(); err != nil {
+			t.Fatal("Cannot send quit to server")
+		}
+		tc.client = nil // don't attempt Close()
+		tc.Close()
+	}
+}
+
+func TestResetScope(t *testing.T) {
+	size := 10
+	address := AddressString("c@d")
+	c := &InboundConnection{
+		esmtp:              true,
+		authIdentity:       "user",
+		heloName:           "client.example.com",
+		remoteHostname:     "client.example.com",
+		inTransaction:      true,
+		reversePath:        "a@b",
+		recipientList:      []*AddressString{&address},
+		requireTLS:         true,
+		smtpUTF8:           true,
+		priority:           5,
+		deliverBy:          &DeliverBy{Return: true},
+		authParameter:      "e@f",
+		declaredSize:       100,
+		headers:            textproto.MIMEHeader{"Subject": {"test"}},
+		transactionMaxSize: &size,
+		rejectedRecipients: 1,
+		originalRecipients: []*AddressString{&address},
+		deferredRejection:  NewResponse(550, "5.1.1 Error: no such user"),
+		xforward:           map[string]string{"ADDR": "192.0.2.1"},
+		transactionStart:   time.Now(),
+	}
+	c.reset()
+	if c.inTransaction || c.reversePath != "" || len(c.recipientList) != 0 || c.requireTLS || c.smtpUTF8 || c.priority != 0 || c.deliverBy != nil || c.authParameter != "" || c.declaredSize != 0 || c.headers != nil || c.transactionMaxSize != nil || c.rejectedRecipients != 0 || len(c.originalRecipients) != 0 || c.deferredRejection != nil || c.xforward != nil || !c.transactionStart.IsZero() {
+		t.Fatalf("Transaction state not cleared: %+v", c)
+	}
+	if !c.esmtp || c.authIdentity != "user" || c.heloName != "client.example.com" || c.remoteHostname != "client.example.com" {
+		t.Fatalf("Session state not kept: %+v", c)
+	}
+}
+
+// ReuseITP checks no transaction state is visible at the start of each transaction, and
+// restricts the message size for the recipient tiny@example.com
+type ReuseITP struct {
+	StateITP
+	leaked []string // descriptions of state leaked into new transactions
+}
+
+func (i *ReuseITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if len(c.Recipients()) != 0 || c.RequireTLS() || c.Headers() != nil || c.maxMessageSize() != c.Params().MaxMessageSize {
+		i.leaked = append(i.leaked, fmt.Sprintf("%s: recipients %v, headers %v, size %d", *address, c.Recipients(), c.Headers(), c.maxMessageSize()))
+	}
+	return nil, nil
+}
+
+func (i *ReuseITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if *address == "tiny@example.com" {
+		c.SetMaxMessageSize(10)
+	}
+	return nil, nil
+}
+
+func TestTransactionReuse(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:     "tcp",
+		Address:      "127.0.0.1:30025",
+		ParseHeaders: true,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	itp := &ReuseITP{}
+	tc := newTestConnectionWithListener(t, l, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("client.example.com"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		sender := fmt.Sprintf("sender%d@example.com", i)
+		recipients := []string{fmt.Sprintf("rcpt%d@example.com", i)}
+		if i%5 == 0 {
+			recipients = append(recipients, "tiny@example.com")
+		} else if i%2 == 0 {
+			recipients = append(recipients, fmt.Sprintf("other%d@example.com", i))
+		}
+		if err := tc.client.Mail(sender); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM' in transaction %d: %v", i, err)
+		}
+		for _, rcpt := range recipients {
+			if err := tc.client.Rcpt(rcpt); err != nil {
+				t.Fatalf("Cannot execute 'RCPT TO' in transaction %d: %v", i, err)
+			}
+		}
+		writer, err := tc.client.Data()
+		if err != nil {
+			t.Fatalf("Cannot execute 'DATA' in transaction %d: %v", i, err)
+		}
+		if _, err := writer.Write([]byte(fmt.Sprintf("Subject: test %d\r\n\r\nbody\r\n", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); i%5 == 0 {
+			if err == nil {
+				t.Fatalf("Oversize message accepted in transaction %d", i)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("Message rejected in transaction %d: %v", i, err)
+		}
+		if string(itp.sender) != sender || len(itp.recipients) != len(recipients) || itp.recipients[0].String() != recipients[0] {
+			t.Fatalf("Wrong envelope in transaction %d: %s %v", i, itp.sender, itp.recipients)
+		}
+		if subject := itp.headers.Get("Subject"); subject != fmt.Sprintf("test %d", i) {
+			t.Fatalf("Wrong headers in transaction %d: %s", i, subject)
+		}
+		if itp.heloName != "client.example.com" {
+			t.Fatalf("Session state lost in transaction %d: HELO name %s", i, itp.heloName)
+		}
+	}
+	if len(itp.leaked) != 0 {
+		t.Fatalf("Transaction state leaked: %v", itp.leaked)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	for _, test := range []struct {
+		xtext   string
+		decoded string
+		ok      bool
+	}{
+		{"<>", "<>", true},
+		{"a@b", "a@b", true},
+		{"e+3Dmc2@example.com", "e=mc2@example.com", true},
+		{"a+2Bb@c", "a+b@c", true},
+		{"e=mc2@example.com", "", false},
+		{"a+2bb@c", "", false},
+		{"a+2", "", false},
+		{"a+", "", false},
+		{"a b", "", false},
+	} {
+		if decoded, ok := decodeXtext(test.xtext); decoded != test.decoded || ok != test.ok {
+			t.Fatalf("decodeXtext(%q) gave %q %v, expected %q %v", test.xtext, decoded, ok, test.decoded, test.ok)
+		}
+	}
+}
+
+func TestEncodeXtext(t *testing.T) {
+	for _, s := range []string{"a@b", "e=mc2@example.com", "a+b@c", "a b", "<>"} {
+		if decoded, ok := decodeXtext(encodeXtext(s)); decoded != s || !ok {
+			t.Fatalf("encodeXtext(%q) gave %q, which decodes to %q %v", s, encodeXtext(s), decoded, ok)
+		}
+	}
+}
+
+// AuthParameterITP records the AUTH parameter of MAIL
+type AuthParameterITP struct {
+	DummyITP
+	authParameter AddressString
+}
+
+func (i *AuthParameterITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	i.authParameter = c.AuthParameter()
+	return nil, nil
+}
+
+func TestMailAuthParameter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, authenticated := range []bool{true, false} {
+		itp := &AuthParameterITP{}
+		tc := newAuthTestConnection(t, dir, ServerConfig{}, itp)
+		if authenticated {
+			if err := tc.client.Auth(smtp.PlainAuth("", "alex", "secret", "localhost")); err != nil {
+				t.Fatalf("Cannot authenticate: %v", err)
+			}
+		}
+
+		for _, test := range []struct {
+			param   string
+			code    int
+			trusted AddressString // expected from a trusted client; an untrusted one always gives ""
+		}{
+			{"AUTH=e+3Dmc2@Example.COM", 250, "e=mc2@example.com"},
+			{"AUTH=<>", 250, ""},
+			{"", 250, ""},
+			{"AUTH=e=mc2@example.com", 501, ""},
+		} {
+			itp.authParameter = "unset"
+			if code, _, err := tc.client.Cmd(test.code, "MAIL FROM:<a@b> %s", test.param); err != nil {
+				t.Fatalf("MAIL with '%s' gave %d, expected %d (authenticated %v): %v", test.param, code, test.code, authenticated, err)
+			}
+			if test.code != 250 {
+				continue
+			}
+			expected := test.trusted
+			if !authenticated {
+				expected = ""
+			}
+			if itp.authParameter != expected {
+				t.Fatalf("MAIL with '%s' gave AUTH parameter '%s', expected '%s' (authenticated %v)", test.param, itp.authParameter, expected, authenticated)
+			}
+			if err := tc.client.Reset(); err != nil {
+				t.Fatalf("Cannot execute RSET: %v", err)
+			}
+		}
+		quitTLS(t, tc)
+		tc.Close()
+	}
+}
+
+func TestValidAddress(t *testing.T) {
+	local := strings.Repeat("l", 64)
+	domain := strings.Repeat("d", 63) + "." + strings.Repeat("d", 63) + "." + strings.Repeat("d", 63) + "." + strings.Repeat("d", 60)
+	for _, test := range []struct {
+		address string
+		valid   bool
+	}{
+		{"a@b", true},
+		{"@relay.example.com:a@b", true},
+		{local + "@example.com", true},
+		{local + "l@example.com", false},
+		{"a@" + domain, true},
+		{local + "@" + domain, false}, // path too long
+		{"a\x00b@example.com", false},
+		{"a@example.com\r\nRCPT TO:<c@d>", false},
+		{"a\tb@example.com", false},
+		{"a\x7f@example.com", false},
+	} {
+		if valid := validAddress(test.address); valid != test.valid {
+			t.Fatalf("validAddress(%q) gave %v, expected %v", test.address, valid, test.valid)
+		}
+		if a := CanonicaliseInboundAddress(test.address); !test.valid && a != nil {
+			t.Fatalf("Invalid address %q canonicalised", test.address)
+		}
+	}
+}
+
+func TestPathFraming(t *testing.T) {
+	for _, test := range []struct {
+		args    string
+		address string
+		params  string
+		ok      bool
+	}{
+		{"FROM:<a@b>", "a@b", "", true},
+		{"FROM:<>", "", "", true},
+		{"from:<a@b>", "a@b", "", true},
+		{"FROM: <a@b>", "a@b", "", true},
+		{"FROM:< a@b >", "a@b", "", true},
+		{"FROM:<a@b> SIZE=100 BODY=8BITMIME", "a@b", "SIZE=100 BODY=8BITMIME", true},
+		{"FROM:<a@b>  SIZE=100  ", "a@b", "SIZE=100  ", true},
+		{"FROM:<> AUTH=<>", "", "AUTH=<>", true},
+		{"FROM:a@b", "a@b", "", true}, // WinCE
+		{"FROM: a@b SIZE=100", "a@b", "SIZE=100", true},
+		{"FROM:", "", "", true},
+		{"FROM:<a@b", "", "", false},
+		{"FROM:<a@b SIZE=100", "", "", false},
+		{"FROM:a@b>", "", "", false},
+		{"FROM:<a@b>SIZE=100", "", "", false},
+		{"FROM:<a@b>>", "", "", false},
+		{"FROM:<<a@b>", "", "", false},
+		{"FROM:<a b@c>", "", "", false},
+		{"FROM<a@b>", "", "", false},
+	} {
+		match := mailFromRE.FindSubmatch([]byte(test.args))
+		if !test.ok {
+			if match != nil {
+				t.Fatalf("Malformed %q matched", test.args)
+			}
+			continue
+		}
+		if match == nil {
+			t.Fatalf("Well formed %q did not match", test.args)
+		}
+		if address, params := splitPath(match); string(address) != test.address || string(params) != test.params {
+			t.Fatalf("%q gave address %q params %q, expected %q and %q", test.args, address, params, test.address, test.params)
+		}
+	}
+}
+
+// RelayITP denies relaying to recipients other than in example.com
+type RelayITP struct {
+	DummyITP
+}
+
+func (i *RelayITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if !strings.HasSuffix(address.String(), "@example.com") {
+		return c.RelayDenied(), nil
+	}
+	return nil, nil
+}
+
+func TestRecipientRejectionCodes(t *testing.T) {
+	tc := newTestConnectionWithITP(t, &RelayITP{})
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	// address malformed
+	if code, msg, err := tc.client.Cmd(250, "RCPT TO:<nodomain>"); err == nil || code != 550 || !strings.HasPrefix(msg, "5.1.3 ") {
+		t.Fatalf("Expected 550 5.1.3 for malformed recipient, got %d %s", code, msg)
+	}
+	// relay denied
+	if code, msg, err := tc.client.Cmd(250, "RCPT TO:<c@elsewhere.example.net>"); err == nil || code != 554 || msg != "5.7.1 Error: relay access denied" {
+		t.Fatalf("Expected 554 5.7.1 for relay denied, got %d %s", code, msg)
+	}
+	// no valid recipients
+	if code, msg, err := tc.client.Cmd(354, "DATA"); err == nil || code != 554 || !strings.HasPrefix(msg, "5.5.1 ") {
+		t.Fatalf("Expected 554 5.5.1 for DATA without recipients, got %d %s", code, msg)
+	}
+	if err := tc.client.Rcpt("c@example.com"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO' for local recipient: %v", err)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// VerdictITP rejects recipients prefixed by "unknown" permanently and by "busy" temporarily
+type VerdictITP struct {
+	DummyITP
+}
+
+func (i *VerdictITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if strings.HasPrefix(address.String(), "unknown") {
+		return NewResponse(550, "5.1.1 Error: no such user"), nil
+	} else if strings.HasPrefix(address.String(), "busy") {
+		return NewResponse(450, "4.2.1 Error: mailbox busy"), nil
+	}
+	return nil, nil
+}
+
+func TestDeferredRecipientRejection(t *testing.T) {
+	for _, deferred := range []bool{false, true} {
+		l, err := NewListener(newTestLogger(t), ServerConfig{
+			Protocol:                "tcp",
+			Address:                 "127.0.0.1:30025",
+			DeferRecipientRejection: deferred,
+		})
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		tc := newTestConnectionWithListener(t, l, &VerdictITP{})
+		if err := tc.Connect(); err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		if err := tc.client.Hello("localhost"); err != nil {
+			t.Fatalf("Cannot say hello to server: %v", err)
+		}
+
+		for _, test := range []struct {
+			recipients []string
+			code       int // the response to DATA if rejection is deferred
+		}{
+			{[]string{"busy@example.com", "good@example.com", "unknown@example.com", "busy2@example.com"}, 550},
+			{[]string{"busy@example.com", "good@example.com"}, 450},
+			{[]string{"good@example.com"}, 354},
+		} {
+			if err := tc.client.Mail("a@b"); err != nil {
+				t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+			}
+			for _, rcpt := range test.recipients {
+				code, _, err := tc.client.Cmd(250, "RCPT TO:<%s>", rcpt)
+				if rejected := strings.HasPrefix(rcpt, "unknown") || strings.HasPrefix(rcpt, "busy"); rejected && !deferred {
+					if err == nil {
+						t.Fatalf("Rejected recipient %s accepted immediately", rcpt)
+					}
+				} else if err != nil {
+					t.Fatalf("Cannot execute 'RCPT TO' for %s (deferred %v): %d %v", rcpt, deferred, code, err)
+				}
+			}
+			// without deferral the message goes to the recipients accepted
+			expected := test.code
+			if !deferred {
+				expected = 354
+			}
+			if code, msg, err := tc.client.Cmd(354, "DATA"); code != expected {
+				t.Fatalf("Expected %d for DATA to %v (deferred %v), got %d %s %v", expected, test.recipients, deferred, code, msg, err)
+			} else if code == 354 {
+				if _, _, err := tc.client.Cmd(250, "."); err != nil {
+					t.Fatalf("Message not accepted: %v", err)
+				}
+			} else if err := tc.client.Reset(); err != nil {
+				t.Fatalf("Cannot execute 'RSET': %v", err)
+			}
+		}
+
+		if err := tc.client.Quit(); err != nil {
+			t.Fatal("Cannot send quit to server")
+		} else {
+			tc.client = nil // don't attempt Close()
+		}
+		tc.Close()
+	}
+}
+
+func TestDisabledVerbs(t *testing.T) {
+	if _, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025", DisabledVerbs: []string{"FOO"}}); err == nil {
+		t.Fatalf("Unknown disabled verb accepted")
+	}
+	if _, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025", DisabledVerbs: []string{"quit"}}); err == nil {
+		t.Fatalf("Disabling QUIT accepted")
+	}
+
+	for _, disabled := range []bool{false, true} {
+		s := ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025"}
+		if disabled {
+			s.DisabledVerbs = []string{"etrn", "NOOP"}
+		}
+		l, err := NewListener(newTestLogger(t), s)
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		tc := newTestConnectionWithListener(t, l, &ETRNITP{})
+		if err := tc.Connect(); err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		if err := tc.client.Hello("localhost"); err != nil {
+			t.Fatalf("Cannot say hello to server: %v", err)
+		}
+		if ok, _ := tc.client.Extension("ETRN"); ok == disabled {
+			t.Fatalf("ETRN advertised %v with disabled %v", ok, disabled)
+		}
+		code, msg, _ := tc.client.Cmd(250, "ETRN example.com")
+		if disabled && (code != 502 || !strings.HasPrefix(msg, "5.5.1 ")) || !disabled && code != 250 {
+			t.Fatalf("Wrong response to ETRN with disabled %v: %d %s", disabled, code, msg)
+		}
+		if code, _, _ := tc.client.Cmd(250, "NOOP"); disabled && code != 502 || !disabled && code != 250 {
+			t.Fatalf("Wrong response to NOOP with disabled %v: %d", disabled, code)
+		}
+		if _, msg, err := tc.client.Cmd(214, "HELP"); err != nil {
+			t.Fatalf("Cannot execute HELP: %v", err)
+		} else if strings.Contains(msg, "ETRN") == disabled {
+			t.Fatalf("Wrong HELP with disabled %v: %s", disabled, msg)
+		}
+		if err := tc.client.Quit(); err != nil {
+			t.Fatal("Cannot send quit to server")
+		} else {
+			tc.client = nil // don't attempt Close()
+		}
+		tc.Close()
+	}
+}
+
+func TestSuppressCapabilities(t *testing.T) {
+	for _, name := range []string{"WOMBAT", "enhancedstatuscodes"} {
+		if _, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025", SuppressCapabilities: []string{name}}); err == nil {
+			t.Fatalf("Suppressing %s accepted", name)
+		}
+	}
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:             "tcp",
+		Address:              "127.0.0.1:30025",
+		SuppressCapabilities: []string{"pipelining", "SMTPUTF8"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	for _, capability := range []string{"PIPELINING", "SMTPUTF8"} {
+		if ok, _ := tc.client.Extension(capability); ok {
+			t.Fatalf("Suppressed %s advertised", capability)
+		}
+	}
+	if ok, _ := tc.client.Extension("8BITMIME"); !ok {
+		t.Fatalf("8BITMIME not advertised")
+	}
+
+	// the suppressed capabilities are still supported if the client uses them
+	if _, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b> SMTPUTF8"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM' with SMTPUTF8: %v", err)
+	}
+	if !tc.ic.SMTPUTF8() {
+		t.Fatalf("SMTPUTF8 parameter ignored")
+	}
+	if err := tc.client.Reset(); err != nil {
+		t.Fatalf("Cannot execute 'RSET': %v", err)
+	}
+	if err := tc.client.Text.PrintfLine("MAIL FROM:<a@b>\r\nRCPT TO:<c@d>"); err != nil {
+		t.Fatalf("Cannot send pipelined commands: %v", err)
+	}
+	for _, expected := range []int{250, 250} {
+		if _, _, err := tc.client.Text.ReadResponse(expected); err != nil {
+			t.Fatalf("Pipelined command failed: %v", err)
+		}
+	}
+
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+func TestIDNAddresses(t *testing.T) {
+	for _, test := range []struct {
+		address   string
+		canonical string
+		badIDN    bool
+	}{
+		{"a@Bücher.Example", "a@xn--bcher-kva.example", false},
+		{"a@xn--bcher-kva.example", "a@xn--bcher-kva.example", false},
+		{"a@XN--BCHER-KVA.EXAMPLE", "a@xn--bcher-kva.example", false},
+		{"Ä@例え.テスト", "Ä@xn--r8jz45g.xn--zckzah", false},
+		{"a@[192.0.2.1]", "a@[192.0.2.1]", false},
+		{"a@xn--a.example", "", true},
+		{"a@-bad.example", "", true},
+		{"a@bü‍cher.example", "", true},
+	} {
+		a, badIDN := canonicaliseAddress(test.address)
+		if badIDN != test.badIDN {
+			t.Fatalf("%s gave bad IDN %v, expected %v", test.address, badIDN, test.badIDN)
+		}
+		if test.canonical == "" {
+			if a != nil {
+				t.Fatalf("Malformed %s canonicalised as %s", test.address, a)
+			}
+		} else if a == nil || a.String() != test.canonical {
+			t.Fatalf("%s canonicalised as %v, expected %s", test.address, a, test.canonical)
+		}
+	}
+
+	a := AddressString("a@xn--bcher-kva.example")
+	if u := a.Unicode(); u != "a@bücher.example" {
+		t.Fatalf("Wrong Unicode form: %s", u)
+	}
+
+	tc := NewTestConnection(t)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if code, msg, err := tc.client.Cmd(250, "RCPT TO:<c@xn--a.example>"); err == nil || code != 501 || !strings.HasPrefix(msg, "5.1.3 ") {
+		t.Fatalf("Expected 501 5.1.3 for invalid IDN, got %d %s", code, msg)
+	}
+	if _, msg, err := tc.client.Cmd(250, "RCPT TO:<c@Bücher.example>"); err != nil || !strings.Contains(msg, "c@xn--bcher-kva.example") {
+		t.Fatalf("U-label recipient not canonicalised: %s %v", msg, err)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// ASCIIRelayITP relays to a destination without SMTPUTF8, so rejects SMTPUTF8 transactions
+type ASCIIRelayITP struct {
+	DummyITP
+	smtpUTF8 []bool // whether each message (rejected or not) used SMTPUTF8
+}
+
+func (i *ASCIIRelayITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.smtpUTF8 = append(i.smtpUTF8, c.SMTPUTF8())
+	if c.SMTPUTF8() != c.envelope().SMTPUTF8 {
+		return nil, errors.New("envelope does not match connection")
+	}
+	if c.SMTPUTF8() {
+		return c.UTF8NotSupported(), nil
+	}
+	return nil, nil
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	itp := &ASCIIRelayITP{}
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if code, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b> SMTPUTF8=yes"); err == nil || code != 501 {
+		t.Fatalf("Expected 501 for SMTPUTF8 with a value, got %d %v", code, err)
+	}
+	for _, smtpUTF8 := range []bool{true, false} {
+		// Mail() would add SMTPUTF8 as we advertise it
+		if smtpUTF8 {
+			if _, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b> SMTPUTF8"); err != nil {
+				t.Fatalf("Cannot execute 'MAIL FROM' with SMTPUTF8: %v", err)
+			}
+		} else if _, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b>"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if writer, err := tc.client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		} else {
+			if _, err := writer.Write([]byte("Subject: tést\r\n\r\nbody\r\n")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			err := writer.Close()
+			if !smtpUTF8 && err != nil {
+				t.Fatalf("Message not accepted: %v", err)
+			} else if e, ok := err.(*textproto.Error); smtpUTF8 && (!ok || e.Code != 550 || !strings.HasPrefix(e.Msg, "5.6.7 ")) {
+				t.Fatalf("Expected 550 5.6.7 for SMTPUTF8 message, got %v", err)
+			}
+		}
+	}
+	if len(itp.smtpUTF8) != 2 || !itp.smtpUTF8[0] || itp.smtpUTF8[1] {
+		t.Fatalf("Wrong SMTPUTF8 flags seen by the ITP: %v", itp.smtpUTF8)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// PriorityITP records the priority of each message
+type PriorityITP struct {
+	DummyITP
+	priorities []int
+}
+
+func (i *PriorityITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	if c.Priority() != c.envelope().Priority {
+		return nil, errors.New("envelope does not match connection")
+	}
+	i.priorities = append(i.priorities, c.Priority())
+	return nil, nil
+}
+
+func TestMTPriority(t *testing.T) {
+	itp := &PriorityITP{}
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if ok, _ := tc.client.Extension("MT-PRIORITY"); !ok {
+		t.Fatalf("MT-PRIORITY not advertised")
+	}
+	for _, priority := range []string{"10", "-10", "x", "+", "3.0", "++3", "٣"} {
+		if code, msg, err := tc.client.Cmd(250, "MAIL FROM:<a@b> MT-PRIORITY=%s", priority); err == nil || code != 501 || !strings.HasPrefix(msg, "5.5.4 ") {
+			t.Fatalf("Expected 501 5.5.4 for priority %s, got %d %s", priority, code, msg)
+		}
+	}
+	for _, param := range []string{" MT-PRIORITY=3", " mt-priority=-9", " MT-PRIORITY=+9", ""} {
+		if _, _, err := tc.client.Cmd(250, "MAIL FROM:<a@b>%s", param); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM' with '%s': %v", param, err)
+		}
+		if err := tc.client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if writer, err := tc.client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		} else {
+			if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Message not accepted: %v", err)
+			}
+		}
+	}
+	if fmt.Sprint(itp.priorities) != "[3 -9 9 0]" {
+		t.Fatalf("Wrong priorities seen by the ITP: %v", itp.priorities)
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+}
+
+// FinalITP ends the session after accepting a message, or after a recipient prefixed by "last"
+type FinalITP struct {
+	DummyITP
+}
+
+func (i *FinalITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if strings.HasPrefix(address.String(), "last") {
+		return NewResponse(250, "2.1.5 OK: last recipient, goodbye").Final(), nil
+	}
+	return nil, nil
+}
+
+func (i *FinalITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	return NewResponse(250, "2.0.0 OK: queued, goodbye").Final(), nil
+}
+
+func TestITPFinalResponse(t *testing.T) {
+	// after DATA
+	tc := newTestConnectionWithITP(t, &FinalITP{})
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if _, _, err := tc.client.Cmd(354, "DATA"); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	}
+	if _, msg, err := tc.client.Cmd(250, "Subject: test\r\n\r\nbody\r\n."); err != nil || msg != "2.0.0 OK: queued, goodbye" {
+		t.Fatalf("Final response not sent: %s %v", msg, err)
+	}
+	<-tc.done // the server has closed the connection
+	if err := tc.client.Noop(); err == nil {
+		t.Fatalf("Connection not closed after final response")
+	}
+	tc.client = nil // don't attempt Close()
+	tc.Close()
+
+	// after a pipelined RCPT, which must still be flushed
+	tc = newTestConnectionWithITP(t, &FinalITP{})
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if _, msg, err := tc.client.Cmd(250, "RCPT TO:<last@d>"); err != nil || msg != "2.1.5 OK: last recipient, goodbye" {
+		t.Fatalf("Final response not sent: %s %v", msg, err)
 	}
+	<-tc.done
+	tc.client = nil // don't attempt Close()
+	tc.Close()
 }
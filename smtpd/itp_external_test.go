@@ -0,0 +1,164 @@
+package smtpd_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/abligh/goms/smtpd"
+	"github.com/abligh/goms/smtpd/gomstest"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// externalITP is an ITP implemented outside the smtpd package
+type externalITP struct {
+	smtpd.DummyITP
+}
+
+// CheckRecipientAddress refuses recipients at example.com with a multiline response
+func (i *externalITP) CheckRecipientAddress(ctx context.Context, c *smtpd.InboundConnection, address *smtpd.AddressString) (*smtpd.ICResponse, error) {
+	if strings.HasSuffix(address.String(), "@example.com") {
+		return smtpd.NewResponse(550, "5.1.1 Error: no such user").Line(550, "5.1.1 Error: try elsewhere"), nil
+	}
+	return nil, nil
+}
+
+// ProcessMail returns a response with a queue ID
+func (i *externalITP) ProcessMail(ctx context.Context, c *smtpd.InboundConnection, data []byte) (*smtpd.ICResponse, error) {
+	return smtpd.NewResponse(250, fmt.Sprintf("2.0.0 OK: queued as %d", len(data))), nil
+}
+
+func TestExternalITP(t *testing.T) {
+	s, err := gomstest.NewServer(t, &externalITP{}, nil)
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	client := s.Client
+
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := client.Rcpt("a@example.com"); err == nil {
+		t.Fatalf("Recipient not refused by external ITP")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 550 || !strings.Contains(e.Msg, "try elsewhere") {
+		t.Fatalf("Expected multiline 550 from external ITP, got %v", err)
+	}
+	if err := client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+
+	if writer, err := client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Message not accepted: %v", err)
+		}
+	}
+
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	cc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	params := smtpd.NewInboundConnectionParameters()
+	params.GreetingHostname = "mx.example.org"
+	result := make(chan error, 1)
+	go func() {
+		result <- smtpd.ServeConn(context.Background(), sc, &externalITP{}, params, log.New(ioutil.Discard, "", 0))
+	}()
+
+	client, err := smtp.NewClient(cc, "localhost")
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := client.Rcpt("a@example.com"); err == nil {
+		t.Fatalf("Recipient not refused by ITP")
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("ServeConn returned error after QUIT: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ServeConn did not return")
+	}
+	if _, err := sc.Write([]byte("x")); err == nil {
+		t.Fatalf("ServeConn did not close the connection")
+	}
+}
+
+func TestServeConnCancel(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	cc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- smtpd.ServeConn(ctx, sc, nil, nil, log.New(ioutil.Discard, "", 0))
+	}()
+
+	text := textproto.NewConn(cc)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatalf("No greeting: %v", err)
+	}
+	cancelFunc()
+	if _, _, err := text.ReadResponse(421); err != nil {
+		t.Fatalf("Expected 421 on cancellation: %v", err)
+	}
+	if err := <-result; err != context.Canceled {
+		t.Fatalf("Expected ServeConn to return context.Canceled, got %v", err)
+	}
+}
+
+// summaryITP is an ITP that logs a summary of each message using the transaction state
+type summaryITP struct {
+	smtpd.DummyITP
+	logger *log.Logger
+}
+
+func (i *summaryITP) ProcessMail(ctx context.Context, c *smtpd.InboundConnection, data []byte) (*smtpd.ICResponse, error) {
+	recipients := []string{}
+	for _, r := range c.Recipients() {
+		recipients = append(recipients, r.String())
+	}
+	i.logger.Printf("[INFO] %d byte message from <%s> (HELO %s) to %s", len(data), c.Sender(), c.HeloName(), strings.Join(recipients, ", "))
+	return nil, nil
+}
+
+// An ITP reads the sender and recipients of the current transaction through the accessors
+// on InboundConnection
+func Example_transactionState() {
+	logger := log.New(ioutil.Discard, "", 0)
+	l, err := smtpd.NewListener(logger, smtpd.ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:25",
+	})
+	if err != nil {
+		logger.Fatalf("[CRIT] Could not create listener: %v", err)
+	}
+	l.SetITP(&summaryITP{logger: logger})
+}
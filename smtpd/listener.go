@@ -6,24 +6,63 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"golang.org/x/crypto/acme/autocert"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // A single listener on a given net.Conn address
 type Listener struct {
-	logger          *log.Logger // a logger
-	protocol        string      // the protocol we are listening on
-	addr            string      // the address
-	defaultExport   string      // name of default export
-	tls             TlsConfig   // the TLS configuration
-	tlsconfig       *tls.Config // the TLS configuration
-	disableNoZeroes bool        // disable the 'no zeroes' extension
+	accepted         uint64                       // number of connections accepted (atomic; first for alignment)
+	active           int64                        // number of sessions in progress (atomic)
+	writeTimeouts    uint64                       // number of sessions ended by a write timeout (atomic)
+	disconnects      uint64                       // number of sessions ended by the client dropping the connection (atomic)
+	logger           *log.Logger                  // a logger
+	protocol         string                       // the protocol we are listening on
+	addr             string                       // the address
+	tls              TlsConfig                    // the TLS configuration
+	tlsconfig        *tls.Config                  // the TLS configuration
+	stapler          *ocspStapler                 // maintains the OCSP staple (nil if not stapling)
+	certificates     *certificateSelector         // the TLS certificates (nil if no TLS)
+	certReload       time.Duration                // interval between checking certificate files for changes
+	acme             *autocert.Manager            // obtains certificates by ACME (nil if not in use)
+	acmeHTTPAddress  string                       // address to answer ACME HTTP-01 challenges on
+	acmeChallenges   *acmeChallenges              // answers ACME HTTP-01 challenges for all listeners (nil to answer our own)
+	params           *InboundConnectionParameters // parameters copied to each connection
+	readiness        *readiness                   // records whether we are bound (nil if not tracked)
+	privileges       *privilegeDropper            // drops privileges once all listeners are bound (nil if not dropping)
+	maintenance      *Maintenance                 // refuses new connections whilst on (nil if never)
+	sessionSet       *sessionSet                  // sessions across all listeners, closed if shutdown times out (nil if not tracked)
+	itp              InboundTransactionProcessor  // the ITP shared by connections (nil for the default)
+	allow            []*net.IPNet                 // networks allowed to connect (empty to allow all)
+	deny             []*net.IPNet                 // networks denied from connecting (takes precedence over allow)
+	denyBanner       bool                         // send a 554 greeting to denied clients before closing
+	reusePort        bool                         // use SO_REUSEPORT to bind multiple listeners
+	acceptGoroutines int                          // number of goroutines accepting connections
+	readBufferSize   int                          // SO_RCVBUF for each connection (0 for the OS default)
+	writeBufferSize  int                          // SO_SNDBUF for each connection (0 for the OS default)
+	queue            *mailQueue                   // queue of messages awaiting processing (nil if disabled)
+	headerPolicy     *RequiredHeadersFilter       // the configured header policy (nil if none)
+	sessions         sync.WaitGroup               // sessions started by this listener
+}
+
+const (
+	minSocketBufferSize = 4 * 1024
+	maxSocketBufferSize = 64 * 1024 * 1024
+)
+
+// socketBuffers is implemented by connections whose socket buffer sizes can be set, such as
+// *net.TCPConn and *net.UnixConn
+type socketBuffers interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
 }
 
 // An listener type that does what we want
@@ -50,24 +89,197 @@ func (l *Listener) Listen(parentCtx context.Context, sessionParentCtx context.Co
 		sessionWaitGroup.Done()
 	}()
 
-	nli, err := net.Listen(l.protocol, l.addr)
+	listeners, err := l.listen(ctx)
+	if l.privileges != nil {
+		l.privileges.bound()
+	}
 	if err != nil {
-		l.logger.Printf("[ERROR] Could not listen on address %s", addr)
+		l.logger.Printf("[ERROR] Could not listen on address %s: %v", addr, err)
 		return
 	}
 
+	// accept nothing until privileges have been dropped
+	if l.privileges != nil {
+		if err := l.privileges.wait(ctx); err != nil {
+			l.logger.Printf("[ERROR] Not accepting connections on %s as privileges were not dropped: %v", addr, err)
+			for _, li := range listeners {
+				li.Close()
+			}
+			return
+		}
+	}
+
+	if l.readiness != nil {
+		l.readiness.setBound(addr, l)
+	}
+
 	defer func() {
 		l.logger.Printf("[INFO] Stopping listening on %s", addr)
-		nli.Close()
+		if l.readiness != nil {
+			l.readiness.setBound(addr, nil)
+		}
+		for _, li := range listeners {
+			li.Close()
+		}
 	}()
 
-	li, ok := nli.(DeadlineListener)
-	if !ok {
-		l.logger.Printf("[ERROR] Invalid protocol to listen on %s", addr)
-		return
+	goroutines := l.acceptGoroutines
+	if goroutines < 1 {
+		goroutines = 1
+	}
+
+	if l.queue != nil {
+		l.queue.start()
+	}
+
+	if l.certificates != nil {
+		go l.reloadCertificates(ctx)
+	}
+	if l.acme != nil {
+		if l.acmeChallenges != nil {
+			defer l.acmeChallenges.register(l.tls.AcmeHostnames, l.acme)()
+		} else {
+			go l.serveAcmeChallenges(ctx)
+		}
+	}
+	if l.stapler != nil {
+		go l.stapler.run(ctx, l.logger)
 	}
 
 	l.logger.Printf("[INFO] Starting listening on %s", addr)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		// if we have fewer listeners than goroutines, the goroutines share them
+		li := listeners[i%len(listeners)]
+		wg.Add(1)
+		go func() {
+			l.acceptLoop(ctx, sessionParentCtx, sessionWaitGroup, li)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if l.queue != nil {
+		// the queue must outlive the listener until all its sessions are done
+		sessionWaitGroup.Add(1)
+		go func() {
+			l.sessions.Wait()
+			l.queue.stop()
+			sessionWaitGroup.Done()
+		}()
+	}
+}
+
+// checkAuth returns an error if the listener requires authentication but has no way to check
+// the credentials clients give. This is checked when the listener starts rather than in
+// NewListener, as an authenticating ITP may be given with SetITP
+func (l *Listener) checkAuth() error {
+	if !l.params.RequireAuth || l.params.Authenticator != nil {
+		return nil
+	}
+	if _, ok := l.itp.(Authenticator); !ok {
+		return errors.New("Cannot use submission mode without a password file or an ITP authenticating clients")
+	}
+	return nil
+}
+
+// listen creates the underlying listeners. Normally this is a single listener, but if
+// ReusePort is set and supported by the platform, one listener is bound per accept goroutine
+func (l *Listener) listen(ctx context.Context) ([]DeadlineListener, error) {
+	if err := l.checkAuth(); err != nil {
+		return nil, err
+	}
+	count := 1
+	lc := net.ListenConfig{}
+	if l.reusePort && l.acceptGoroutines > 1 {
+		if reusePortControl == nil {
+			l.logger.Printf("[WARN] SO_REUSEPORT not supported on this platform; using a single listener for %s:%s", l.protocol, l.addr)
+		} else {
+			count = l.acceptGoroutines
+			lc.Control = reusePortControl
+		}
+	}
+
+	listeners := []DeadlineListener{}
+	address := l.addr
+	for i := 0; i < count; i++ {
+		nli, err := lc.Listen(ctx, l.protocol, address)
+		if err != nil {
+			for _, li := range listeners {
+				li.Close()
+			}
+			return nil, err
+		}
+		li, ok := nli.(DeadlineListener)
+		if !ok {
+			nli.Close()
+			for _, li := range listeners {
+				li.Close()
+			}
+			return nil, errors.New("Invalid protocol")
+		}
+		listeners = append(listeners, li)
+		// bind subsequent listeners to the address actually obtained, in case we were given port 0
+		address = nli.Addr().String()
+	}
+	return listeners, nil
+}
+
+// validateAddress checks the protocol and address a listener is configured with. A TCP address
+// may be an IPv6 address with a zone (e.g. "[fe80::1%eth0]:25"), which must name an interface
+// present, and must match the protocol's address family if the protocol is tcp4 or tcp6. Note
+// that tcp6 with the unspecified address ("[::]:25") sets IPV6_V6ONLY, so accepts only IPv6
+// clients, whereas tcp accepts IPv4 clients too (as IPv4-mapped addresses) where the OS permits
+func validateAddress(protocol, address string) error {
+	switch protocol {
+	case "unix":
+		if address == "" {
+			return errors.New("Cannot listen on a unix socket without a path")
+		}
+		return nil
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("Bad protocol: '%s'", protocol)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Bad address: '%s'", address)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("Bad port: '%s'", address)
+	}
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if zone != "" {
+			return fmt.Errorf("Bad address: '%s'", address)
+		}
+		// a hostname (or empty for all addresses), resolved when we listen
+		return nil
+	}
+	ipv4 := !strings.Contains(host, ":")
+	if zone != "" {
+		if ipv4 {
+			return fmt.Errorf("Cannot give a zone with an IPv4 address: '%s'", address)
+		}
+		if _, err := strconv.Atoi(zone); err != nil {
+			if _, err := net.InterfaceByName(zone); err != nil {
+				return fmt.Errorf("Bad zone: '%s'", address)
+			}
+		}
+	}
+	if protocol == "tcp4" && !ipv4 || protocol == "tcp6" && ipv4 {
+		return fmt.Errorf("Address '%s' does not match protocol '%s'", address, protocol)
+	}
+	return nil
+}
+
+// acceptLoop accepts connections on li until ctx is cancelled, starting a session for each
+func (l *Listener) acceptLoop(ctx context.Context, sessionParentCtx context.Context, sessionWaitGroup *sync.WaitGroup, li DeadlineListener) {
+	addr := l.protocol + ":" + l.addr
 	for {
 		select {
 		case <-ctx.Done():
@@ -80,40 +292,78 @@ func (l *Listener) Listen(parentCtx context.Context, sessionParentCtx context.Co
 				continue
 			}
 			l.logger.Printf("[ERROR] Error %s listening on %s", err, addr)
+		} else if !l.permitted(conn.RemoteAddr()) {
+			l.logger.Printf("[INFO] Denied connection to %s from %s", addr, conn.RemoteAddr())
+			l.refuse(conn)
 		} else {
 			l.logger.Printf("[INFO] Connect to %s from %s", addr, conn.RemoteAddr())
+			l.setBufferSizes(conn)
 			if connection, err := newInboundConnection(l, l.logger, conn); err != nil {
 				l.logger.Printf("[ERROR] Error %s establishing connection to %s from %s", err, addr, conn.RemoteAddr())
 				conn.Close()
 			} else {
+				l.sessions.Add(1)
+				atomic.AddUint64(&l.accepted, 1)
+				atomic.AddInt64(&l.active, 1)
 				go func() {
 					// do not use our parent ctx as a context, as we don't want it to cancel when
 					// we reload config and cancel this listener
 					ctx, cancelFunc := context.WithCancel(sessionParentCtx)
 					defer cancelFunc()
 					sessionWaitGroup.Add(1)
+					l.sessionSet.add(connection)
 					connection.Serve(ctx)
+					l.sessionSet.remove(connection)
 					sessionWaitGroup.Done()
+					atomic.AddInt64(&l.active, -1)
+					l.sessions.Done()
 				}()
 			}
 		}
 	}
+}
 
+// setBufferSizes sets the socket buffer sizes of a connection, if configured. The sizes are only
+// advice to the OS, which may clamp them (e.g. to net.core.rmem_max on Linux), so failure to set
+// them is not fatal
+func (l *Listener) setBufferSizes(conn net.Conn) {
+	if l.readBufferSize == 0 && l.writeBufferSize == 0 {
+		return
+	}
+	s, ok := conn.(socketBuffers)
+	if !ok {
+		return
+	}
+	if l.readBufferSize != 0 {
+		if err := s.SetReadBuffer(l.readBufferSize); err != nil {
+			l.logger.Printf("[WARN] Could not set read buffer size for %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+	if l.writeBufferSize != 0 {
+		if err := s.SetWriteBuffer(l.writeBufferSize); err != nil {
+			l.logger.Printf("[WARN] Could not set write buffer size for %s: %v", conn.RemoteAddr(), err)
+		}
+	}
 }
 
 // make an appropriate TLS config
 func (l *Listener) initTls() error {
-	keyFile := l.tls.KeyFile
-	if keyFile == "" {
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if len(l.tls.AcmeHostnames) > 0 {
+		if l.tls.KeyFile != "" || len(l.tls.Certificates) > 0 {
+			return errors.New("Cannot use both ACME and TLS certificate files")
+		}
+		if err := l.initAcme(); err != nil {
+			return err
+		}
+		getCertificate = l.acme.GetCertificate
+	} else if l.tls.KeyFile == "" && len(l.tls.Certificates) == 0 {
 		return nil // no TLS
-	}
-	certFile := l.tls.CertFile
-	if certFile == "" {
-		certFile = keyFile
-	}
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+	} else {
+		if err := l.initCertificates(); err != nil {
+			return err
+		}
+		getCertificate = l.certificates.getCertificate
 	}
 
 	var clientCAs *x509.CertPool
@@ -130,6 +380,7 @@ func (l *Listener) initTls() error {
 
 	serverName := l.tls.ServerName
 	if serverName == "" {
+		var err error
 		serverName, err = os.Hostname()
 		if err != nil {
 			return err
@@ -160,28 +411,367 @@ func (l *Listener) initTls() error {
 	}
 
 	l.tlsconfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ServerName:   serverName,
-		ClientAuth:   clientAuth,
-		ClientCAs:    clientCAs,
-		MinVersion:   minVersion,
-		MaxVersion:   maxVersion,
+		GetCertificate: getCertificate,
+		ServerName:     serverName,
+		ClientAuth:     clientAuth,
+		ClientCAs:      clientCAs,
+		MinVersion:     minVersion,
+		MaxVersion:     maxVersion,
 	}
 	return nil
 }
 
+// initCertificates loads the TLS certificate files; the main certificate is the default,
+// otherwise the first of the others is
+func (l *Listener) initCertificates() error {
+	selector := &certificateSelector{}
+	if l.tls.KeyFile != "" {
+		if err := selector.add(l.tls.CertFile, l.tls.KeyFile, nil); err != nil {
+			return err
+		}
+	}
+	for _, c := range l.tls.Certificates {
+		if err := selector.add(c.CertFile, c.KeyFile, c.Hostnames); err != nil {
+			return err
+		}
+	}
+	l.certificates = selector
+	l.certReload = tlsDefaultReload
+	if l.tls.ReloadInterval != "" {
+		if d, err := time.ParseDuration(l.tls.ReloadInterval); err != nil || d <= 0 {
+			return fmt.Errorf("Bad certificate reload interval: '%s'", l.tls.ReloadInterval)
+		} else {
+			l.certReload = d
+		}
+	}
+
+	var err error
+	if l.stapler, err = newOCSPStapler(l.tls, selector); err != nil {
+		return err
+	}
+	if l.stapler != nil {
+		// a missing staple should not prevent us listening, so just log the failure
+		if err := l.stapler.update(context.Background()); err != nil {
+			l.logger.Printf("[WARN] Could not load OCSP staple: %v", err)
+		}
+	}
+	return nil
+}
+
+// reloadCertificates checks the TLS certificate files periodically until ctx is done, reloading
+// any that have changed so new connections use them
+func (l *Listener) reloadCertificates(ctx context.Context) {
+	ticker := time.NewTicker(l.certReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, defaultChanged, err := l.certificates.reload()
+			if err != nil {
+				l.logger.Printf("[ERROR] Could not reload TLS certificate, continuing with previous one: %v", err)
+			}
+			if changed {
+				l.logger.Printf("[INFO] Reloaded TLS certificates for %s", l.addr)
+			}
+			if defaultChanged {
+				// the staple for the previous certificate has been dropped, so get a new one now
+				if l.stapler != nil {
+					if err := l.stapler.update(ctx); err != nil {
+						l.logger.Printf("[WARN] Could not load OCSP staple: %v", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// SetITP sets the inbound transaction processor used by connections accepted by the listener,
+// replacing any set by the configuration. The one ITP is used by every connection concurrently (see
+// InboundTransactionProcessor). It must be called before Listen
+func (l *Listener) SetITP(itp InboundTransactionProcessor) {
+	l.itp = itp
+}
+
+// SetBanner sets a function producing the text of the 220 greeting for each connection
+// (e.g. "mx.example.com ESMTP ready"), replacing the default. It must be called before Listen
+func (l *Listener) SetBanner(banner func(c *InboundConnection) string) {
+	l.params.Banner = banner
+}
+
+// SetContentFilter sets the filter each message is passed to before the ITP. Use ContentFilters
+// to apply several. Any header policy configured is applied first. It must be called before Listen
+func (l *Listener) SetContentFilter(filter ContentFilter) {
+	if l.headerPolicy != nil {
+		if filter == nil {
+			filter = l.headerPolicy
+		} else {
+			filter = ContentFilters{l.headerPolicy, filter}
+		}
+	}
+	l.params.ContentFilter = filter
+}
+
+// SetEventHandler sets the handler receiving the events of each connection accepted by the
+// listener. It must be called before Listen
+func (l *Listener) SetEventHandler(handler EventHandler) {
+	l.params.EventHandler = handler
+}
+
+// SetClock sets the clock whose timers enforce connection timeouts, replacing the real clock.
+// This is intended for testing. It must be called before Listen
+func (l *Listener) SetClock(clock Clock) {
+	l.params.Clock = clock
+}
+
+// SetResolver sets the resolver used for reverse DNS lookups, replacing the system resolver.
+// It must be called before Listen
+func (l *Listener) SetResolver(resolver Resolver) {
+	l.params.Resolver = resolver
+}
+
 // NewListener returns a new listener object
 func NewListener(logger *log.Logger, s ServerConfig) (*Listener, error) {
 	l := &Listener{
-		logger:          logger,
-		protocol:        s.Protocol,
-		addr:            s.Address,
-		defaultExport:   s.DefaultExport,
-		disableNoZeroes: s.DisableNoZeroes,
-		tls:             s.Tls,
+		logger:           logger,
+		protocol:         s.Protocol,
+		addr:             s.Address,
+		tls:              s.Tls,
+		reusePort:        s.ReusePort,
+		acceptGoroutines: s.AcceptGoroutines,
+		readBufferSize:   s.ReadBufferSize,
+		writeBufferSize:  s.WriteBufferSize,
+		params:           NewInboundConnectionParameters(),
+	}
+	if err := validateAddress(s.Protocol, s.Address); err != nil {
+		return nil, err
+	}
+	l.params.DisableESMTP = s.DisableESMTP
+	l.params.DisableEnhanced = s.DisableEnhancedStatusCodes
+	l.params.ReverseDNS = s.ReverseDNS
+	l.params.ReverseDNSStrict = s.ReverseDNSStrict
+	l.params.RequireTLS = s.RequireTLS
+	l.params.ParseHeaders = s.ParseHeaders
+	l.params.AllowNoRecipients = s.AllowNoRecipients
+	l.params.DeferRecipientRejection = s.DeferRecipientRejection
+	l.params.Transcript = s.Transcript
+	if s.Hostname != "" {
+		l.params.GreetingHostname = s.Hostname
+	}
+	for _, b := range []struct {
+		name string
+		size int
+	}{
+		{"read", s.ReadBufferSize},
+		{"write", s.WriteBufferSize},
+	} {
+		if b.size != 0 && (b.size < minSocketBufferSize || b.size > maxSocketBufferSize) {
+			return nil, fmt.Errorf("Bad %s buffer size: '%d'", b.name, b.size)
+		}
+	}
+	if s.MaxMessageSize != nil {
+		if *s.MaxMessageSize < 0 {
+			return nil, fmt.Errorf("Bad maximum message size: '%d'", *s.MaxMessageSize)
+		}
+		l.params.MaxMessageSize = *s.MaxMessageSize
+	}
+	for _, t := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"idle", s.IdleTimeout, &l.params.IdleTimeout},
+		{"read", s.ReadTimeout, &l.params.ReadTimeout},
+		{"write", s.WriteTimeout, &l.params.WriteTimeout},
+	} {
+		if t.value != "" {
+			if d, err := time.ParseDuration(t.value); err != nil || d <= 0 {
+				return nil, fmt.Errorf("Bad %s timeout: '%s'", t.name, t.value)
+			} else {
+				*t.d = d
+			}
+		}
 	}
 	if err := l.initTls(); err != nil {
 		return nil, err
 	}
+	l.params.TLSConfig = l.tlsconfig
+	if l.params.RequireTLS && l.tlsconfig == nil {
+		return nil, errors.New("Cannot require TLS without a TLS configuration")
+	}
+	switch strings.ToLower(s.Mode) {
+	case "", "mx":
+	case "submission":
+		// RFC6409 4.3, clients must authenticate (see doAUTH) before MAIL
+		l.params.RequireAuth = true
+	default:
+		return nil, fmt.Errorf("Bad server mode: '%s'", s.Mode)
+	}
+	if s.AddMissingHeaders {
+		if !l.params.RequireAuth {
+			return nil, errors.New("Cannot add missing headers other than in submission mode")
+		}
+		l.params.AddMissingHeaders = true
+	}
+	if s.MaxHeaderLines != 0 || s.MaxHeaderBytes != 0 {
+		if !s.ParseHeaders {
+			return nil, errors.New("Cannot limit headers without parsing headers")
+		}
+		if s.MaxHeaderLines < 0 {
+			return nil, fmt.Errorf("Bad maximum header lines: '%d'", s.MaxHeaderLines)
+		}
+		if s.MaxHeaderBytes < 0 {
+			return nil, fmt.Errorf("Bad maximum header size: '%d'", s.MaxHeaderBytes)
+		}
+		l.params.MaxHeaderLines = s.MaxHeaderLines
+		l.params.MaxHeaderBytes = s.MaxHeaderBytes
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"minimum", s.DeliverByMinimum, &l.params.DeliverByMinimum},
+		{"maximum", s.DeliverByMaximum, &l.params.DeliverByMaximum},
+	} {
+		if d.value != "" {
+			if by, err := time.ParseDuration(d.value); err != nil || by < 0 || by%time.Second != 0 {
+				return nil, fmt.Errorf("Bad DELIVERBY %s: '%s'", d.name, d.value)
+			} else {
+				*d.d = by
+			}
+		}
+	}
+	if l.params.DeliverByMaximum > 0 && l.params.DeliverByMaximum < l.params.DeliverByMinimum {
+		return nil, errors.New("Cannot have a DELIVERBY maximum less than the minimum")
+	}
+	if s.GreetingDelay != "" {
+		if d, err := time.ParseDuration(s.GreetingDelay); err != nil || d < 0 {
+			return nil, fmt.Errorf("Bad greeting delay: '%s'", s.GreetingDelay)
+		} else {
+			l.params.GreetingDelay = d
+		}
+	}
+	if s.ReverseDNSTimeout != "" {
+		if d, err := time.ParseDuration(s.ReverseDNSTimeout); err != nil || d <= 0 {
+			return nil, fmt.Errorf("Bad reverse DNS timeout: '%s'", s.ReverseDNSTimeout)
+		} else {
+			l.params.ReverseDNSTimeout = d
+		}
+	}
+	if exempt, err := parseCIDRs("reverse DNS exemption", s.ReverseDNSExempt); err != nil {
+		return nil, err
+	} else {
+		l.params.ReverseDNSExempt = exempt
+	}
+	if allow, err := parseCIDRs("allowed network", s.AllowCIDRs); err != nil {
+		return nil, err
+	} else {
+		l.allow = allow
+	}
+	if trusted, err := parseCIDRs("XFORWARD network", s.XForwardCIDRs); err != nil {
+		return nil, err
+	} else {
+		l.params.XForwardTrusted = trusted
+	}
+	if deny, err := parseCIDRs("denied network", s.DenyCIDRs); err != nil {
+		return nil, err
+	} else {
+		l.deny = deny
+	}
+	l.denyBanner = s.DenyBanner
+	if len(s.DisabledVerbs) > 0 {
+		l.params.DisabledVerbs = make(map[string]bool)
+		for _, v := range s.DisabledVerbs {
+			verb := strings.ToUpper(v)
+			// clients must always be able to end the session
+			if _, ok := verbs[verb]; !ok || verb == "QUIT" {
+				return nil, fmt.Errorf("Bad disabled verb: '%s'", v)
+			}
+			l.params.DisabledVerbs[verb] = true
+		}
+	}
+	if len(s.SuppressCapabilities) > 0 {
+		l.params.SuppressedCapabilities = make(map[string]bool)
+		for _, name := range s.SuppressCapabilities {
+			keyword := strings.ToUpper(name)
+			known := false
+			for _, capability := range suppressibleCapabilities {
+				known = known || capability == keyword
+			}
+			if !known {
+				return nil, fmt.Errorf("Bad suppressed capability: '%s'", name)
+			}
+			l.params.SuppressedCapabilities[keyword] = true
+		}
+	}
+	if f, err := NewDomainFilter(s.Filters.Senders, blockedSenderMessage); err != nil {
+		return nil, err
+	} else {
+		l.params.SenderFilter = f
+	}
+	if f, err := NewDomainFilter(s.Filters.Recipients, blockedRecipientMessage); err != nil {
+		return nil, err
+	} else {
+		l.params.RecipientFilter = f
+	}
+	if f, err := NewHeaderPolicyFilter(s.Filters.Headers); err != nil {
+		return nil, err
+	} else if f != nil {
+		l.headerPolicy = f
+		l.params.ContentFilter = f
+	}
+	if aliases, err := NewAliases(s.Aliases); err != nil {
+		return nil, err
+	} else {
+		l.params.Aliases = aliases
+	}
+	if messages, err := newMessages(s.Messages); err != nil {
+		return nil, err
+	} else {
+		l.params.Messages = messages
+	}
+	if s.QueueDepth > 0 {
+		l.queue = newMailQueue(s.QueueDepth, s.QueueWorkers)
+	}
+	// AUTH is only available over TLS, so without it no client could send mail
+	if l.params.RequireAuth && l.tlsconfig == nil {
+		return nil, errors.New("Cannot use submission mode without a TLS configuration")
+	}
+	if s.PasswordFile != "" {
+		if p, err := NewPasswordFile(s.PasswordFile); err != nil {
+			return nil, err
+		} else {
+			l.params.Authenticator = p
+		}
+	}
+	if s.Proxy.Address != "" {
+		if itp, err := NewProxyITP(s.Proxy); err != nil {
+			return nil, err
+		} else {
+			l.itp = itp
+		}
+	}
+	if s.Sink.Phase != "" {
+		if s.Proxy.Address != "" {
+			return nil, errors.New("Bad config: sink given with proxy")
+		}
+		if itp, err := NewSinkITP(s.Sink); err != nil {
+			return nil, err
+		} else {
+			l.itp = itp
+		}
+	}
+	if s.Handler != "" {
+		if s.Sink.Phase != "" || s.Proxy.Address != "" {
+			return nil, fmt.Errorf("Bad config: handler '%s' given with sink or proxy", s.Handler)
+		}
+		if itp, err := newHandler(s.Handler, s.HandlerParams); err != nil {
+			return nil, err
+		} else {
+			l.itp = itp
+		}
+	}
 	return l, nil
 }
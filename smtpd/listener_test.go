@@ -0,0 +1,473 @@
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestListener starts a listener with the config and ITP (nil for the default) supplied,
+// returning a function that stops it
+func startTestListener(tb testing.TB, logger *log.Logger, s ServerConfig, itp InboundTransactionProcessor) func() {
+	l, err := NewListener(logger, s)
+	if err != nil {
+		tb.Fatalf("Could not create listener: %v", err)
+	}
+	if itp != nil {
+		l.SetITP(itp)
+	}
+	return startListener(l)
+}
+
+// startListener starts a listener already created (and perhaps set up further), returning a
+// function that stops it and waits for its sessions to finish
+func startListener(l *Listener) func() {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	var sessionWaitGroup sync.WaitGroup
+	go l.Listen(ctx, ctx, &sessionWaitGroup)
+	return func() {
+		cancelFunc()
+		sessionWaitGroup.Wait()
+	}
+}
+
+// dialWithRetries connects to the address given, retrying whilst the listener there starts
+func dialWithRetries(address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	for retries := 0; retries < 20; retries++ {
+		if conn, err = net.DialTimeout("tcp", address, 2*time.Second); err == nil {
+			return conn, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, err
+}
+
+// dialTestListener connects an SMTP client to the address given, retrying whilst the listener
+// there starts, and reads the greeting
+func dialTestListener(tb testing.TB, address string) *SMTPClient {
+	conn, err := dialWithRetries(address)
+	if err != nil {
+		tb.Fatalf("Cannot connect to server: %v", err)
+	}
+	host, _, _ := net.SplitHostPort(address)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		tb.Fatalf("Cannot connect to server: %v", err)
+	}
+	return &SMTPClient{client}
+}
+
+// greetAndQuit dials the address given, waits for the greeting and quits
+func greetAndQuit(address string) error {
+	conn, err := dialWithRetries(address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	if line, err := rd.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "220 ") {
+		return fmt.Errorf("Bad greeting: %s", line)
+	}
+	if _, err := conn.Write([]byte("QUIT\r\n")); err != nil {
+		return err
+	}
+	if line, err := rd.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "221 ") {
+		return fmt.Errorf("Bad response to QUIT: %s", line)
+	}
+	return nil
+}
+
+func TestListenReusePort(t *testing.T) {
+	stop := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol:         "tcp",
+		Address:          "127.0.0.1:30026",
+		ReusePort:        true,
+		AcceptGoroutines: 4,
+	}, nil)
+	defer stop()
+
+	for i := 0; i < 8; i++ {
+		if err := greetAndQuit("127.0.0.1:30026"); err != nil {
+			t.Fatalf("Could not converse with listener: %v", err)
+		}
+	}
+}
+
+func benchmarkAccept(b *testing.B, address string, reusePort bool, acceptGoroutines int) {
+	stop := startTestListener(b, log.New(ioutil.Discard, "", 0), ServerConfig{
+		Protocol:         "tcp",
+		Address:          address,
+		ReusePort:        reusePort,
+		AcceptGoroutines: acceptGoroutines,
+	}, nil)
+	defer stop()
+
+	// ensure the listener is up before timing
+	if err := greetAndQuit(address); err != nil {
+		b.Fatalf("Could not converse with listener: %v", err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := greetAndQuit(address); err != nil {
+				b.Errorf("Could not converse with listener: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkAcceptSingle(b *testing.B) {
+	benchmarkAccept(b, "127.0.0.1:30027", false, 1)
+}
+
+func BenchmarkAcceptReusePort(b *testing.B) {
+	benchmarkAccept(b, "127.0.0.1:30028", true, 4)
+}
+
+// soakListener runs n complete SMTP conversations against the address given, each on a new connection
+func soakListener(t *testing.T, address string, n int) {
+	for i := 0; i < n; i++ {
+		client, err := smtp.Dial(address)
+		if err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		sendMessage(t, client, []byte("Subject: soak\r\n\r\n"+strings.Repeat("A line of text\r\n", 100)))
+		if err := client.Quit(); err != nil {
+			t.Fatalf("Cannot send QUIT: %v", err)
+		}
+	}
+}
+
+// settledMemStats waits for session goroutines to exit (up to a limit) and then reads
+// memory statistics after a GC, returning the number of goroutines
+func settledMemStats(m *runtime.MemStats, goroutines int) int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	runtime.GC()
+	runtime.ReadMemStats(m)
+	return n
+}
+
+func TestListenSoak(t *testing.T) {
+	stop := startTestListener(t, log.New(ioutil.Discard, "", 0), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30029",
+	}, nil)
+	defer stop()
+
+	if err := greetAndQuit("127.0.0.1:30029"); err != nil {
+		t.Fatalf("Could not converse with listener: %v", err)
+	}
+
+	// warm up the pools
+	soakListener(t, "127.0.0.1:30029", 100)
+
+	var before, after runtime.MemStats
+	goroutines := settledMemStats(&before, 0)
+
+	soakListener(t, "127.0.0.1:30029", 1000)
+
+	if n := settledMemStats(&after, goroutines); n > goroutines {
+		t.Fatalf("Goroutines grew from %d to %d over 1000 connections", goroutines, n)
+	}
+	if after.HeapAlloc > before.HeapAlloc+1024*1024 {
+		t.Fatalf("Heap grew from %d to %d over 1000 connections", before.HeapAlloc, after.HeapAlloc)
+	}
+}
+
+func TestListenBadGreetingDelay(t *testing.T) {
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:      "tcp",
+		Address:       "127.0.0.1:30025",
+		GreetingDelay: "wombat",
+	}); err == nil {
+		t.Fatalf("Accepted bad greeting delay")
+	}
+}
+
+func TestListenBadTimeout(t *testing.T) {
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:    "tcp",
+		Address:     "127.0.0.1:30025",
+		ReadTimeout: "0s",
+	}); err == nil {
+		t.Fatalf("Accepted bad read timeout")
+	}
+}
+
+func TestListenBadMode(t *testing.T) {
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Mode:     "wombat",
+	}); err == nil {
+		t.Fatalf("Accepted bad server mode")
+	}
+}
+
+func TestListenRequireTLSWithoutTls(t *testing.T) {
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:   "tcp",
+		Address:    "127.0.0.1:30025",
+		RequireTLS: true,
+	}); err == nil {
+		t.Fatalf("Accepted requiring TLS without a TLS configuration")
+	}
+}
+
+func TestListenAddMissingHeadersNotSubmission(t *testing.T) {
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:          "tcp",
+		Address:           "127.0.0.1:30025",
+		AddMissingHeaders: true,
+	}); err == nil {
+		t.Fatalf("Accepted adding missing headers other than in submission mode")
+	}
+}
+
+func TestListenBadBufferSize(t *testing.T) {
+	for _, s := range []ServerConfig{
+		{Protocol: "tcp", Address: "127.0.0.1:30025", ReadBufferSize: -1},
+		{Protocol: "tcp", Address: "127.0.0.1:30025", ReadBufferSize: 100},
+		{Protocol: "tcp", Address: "127.0.0.1:30025", WriteBufferSize: 1024 * 1024 * 1024},
+	} {
+		if _, err := NewListener(newTestLogger(t), s); err == nil {
+			t.Fatalf("Accepted bad buffer sizes %d and %d", s.ReadBufferSize, s.WriteBufferSize)
+		}
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	for _, test := range []struct {
+		protocol string
+		address  string
+		valid    bool
+	}{
+		{"tcp", "127.0.0.1:25", true},
+		{"tcp", "[::1]:25", true},
+		{"tcp", ":25", true},
+		{"tcp", "localhost:25", true},
+		{"tcp4", "127.0.0.1:25", true},
+		{"tcp4", "[::1]:25", false},
+		{"tcp6", "[::]:25", true},
+		{"tcp6", "127.0.0.1:25", false},
+		{"tcp6", "[fe80::1%lo]:25", true},
+		{"tcp6", "[fe80::1%1]:25", true},
+		{"tcp6", "[fe80::1%nosuchif0]:25", false},
+		{"tcp", "127.0.0.1%lo:25", false},
+		{"tcp", "localhost%lo:25", false},
+		{"tcp", "127.0.0.1", false},
+		{"tcp", "127.0.0.1:65536", false},
+		{"unix", "/var/run/goms.sock", true},
+		{"unix", "", false},
+		{"udp", "127.0.0.1:25", false},
+		{"", "127.0.0.1:25", false},
+	} {
+		if err := validateAddress(test.protocol, test.address); (err == nil) != test.valid {
+			t.Fatalf("validateAddress(%s, %s) gave %v, expected valid %v", test.protocol, test.address, err, test.valid)
+		}
+	}
+	if _, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp4", Address: "[::1]:30025"}); err == nil {
+		t.Fatalf("Accepted an IPv6 address for tcp4")
+	}
+}
+
+func TestListenTCP6(t *testing.T) {
+	if li, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	} else {
+		li.Close()
+	}
+	stop := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol: "tcp6",
+		Address:  "[::]:30049",
+	}, nil)
+	defer stop()
+
+	if err := greetAndQuit("[::1]:30049"); err != nil {
+		t.Fatalf("Could not converse with listener: %v", err)
+	}
+	// IPV6_V6ONLY is set, so IPv4 clients are not accepted
+	if conn, err := net.DialTimeout("tcp4", "127.0.0.1:30049", 2*time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("tcp6 listener accepted an IPv4 connection")
+	}
+}
+
+func TestListenWriteTimeout(t *testing.T) {
+	logs := &logBuffer{}
+	l, err := NewListener(log.New(logs, "", 0), ServerConfig{
+		Protocol:        "tcp",
+		Address:         "127.0.0.1:30050",
+		WriteTimeout:    "200ms",
+		WriteBufferSize: minSocketBufferSize,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	defer startListener(l)()
+
+	conn, err := dialWithRetries("127.0.0.1:30050")
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(minSocketBufferSize)
+
+	// send commands but never read the responses, so the socket buffers fill
+	go func() {
+		for i := 0; i < 10000; i++ {
+			if _, err := conn.Write([]byte("EHLO client.example.com\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	for retries := 0; retries < 100 && atomic.LoadUint64(&l.writeTimeouts) == 0; retries++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := atomic.LoadUint64(&l.writeTimeouts); n != 1 {
+		t.Fatalf("Expected 1 write timeout, got %d", n)
+	}
+	if !strings.Contains(logs.String(), "[WARN] Write timeout to ") {
+		t.Fatalf("Write timeout not logged:\n%s", logs.String())
+	}
+
+	// the connection is closed (and, as commands were left unread, probably reset)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("Connection not closed after write timeout: %v", err)
+		}
+	}
+}
+
+func TestListenDisconnects(t *testing.T) {
+	logs := &logBuffer{}
+	l, err := NewListener(log.New(logs, "", 0), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30051",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	defer startListener(l)()
+
+	// a clean QUIT is not a disconnection
+	if err := greetAndQuit("127.0.0.1:30051"); err != nil {
+		t.Fatalf("Could not converse with listener: %v", err)
+	}
+
+	// waitForDisconnects waits for the number of disconnections given to be counted
+	waitForDisconnects := func(n uint64) {
+		for retries := 0; retries < 100 && atomic.LoadUint64(&l.disconnects) < n; retries++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if d := atomic.LoadUint64(&l.disconnects); d != n {
+			t.Fatalf("Expected %d disconnections, got %d:\n%s", n, d, logs.String())
+		}
+	}
+
+	// the client closes the connection, or resets it, mid-session
+	for i, reset := range []bool{false, true} {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:30051", 2*time.Second)
+		if err != nil {
+			t.Fatalf("Cannot connect to server: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(conn)
+		if line, err := rd.ReadString('\n'); err != nil || !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("Bad greeting: %s %v", line, err)
+		}
+		if _, err := conn.Write([]byte("HELO client.example.com\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if line, err := rd.ReadString('\n'); err != nil || !strings.HasPrefix(line, "250 ") {
+			t.Fatalf("Bad response to HELO: %s %v", line, err)
+		}
+		if reset {
+			conn.(*net.TCPConn).SetLinger(0)
+		}
+		conn.Close()
+		waitForDisconnects(uint64(i + 1))
+	}
+
+	if n := strings.Count(logs.String(), "[INFO] Client "); n != 2 {
+		t.Fatalf("Expected 2 disconnections logged, got %d:\n%s", n, logs.String())
+	}
+	if strings.Contains(logs.String(), "[WARN]") {
+		t.Fatalf("Disconnection logged as an error:\n%s", logs.String())
+	}
+}
+
+// bufferConn records the socket buffer sizes set on it
+type bufferConn struct {
+	net.Conn
+	readBuffer  int
+	writeBuffer int
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = bytes
+	return nil
+}
+
+func TestListenBufferSizes(t *testing.T) {
+	for _, s := range []ServerConfig{
+		{Protocol: "tcp", Address: "127.0.0.1:30025"},
+		{Protocol: "tcp", Address: "127.0.0.1:30025", ReadBufferSize: 1024 * 1024},
+		{Protocol: "tcp", Address: "127.0.0.1:30025", ReadBufferSize: 256 * 1024, WriteBufferSize: 512 * 1024},
+	} {
+		l, err := NewListener(newTestLogger(t), s)
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		sc, cc := net.Pipe()
+		conn := &bufferConn{Conn: sc}
+		l.setBufferSizes(conn)
+		// unconfigured sizes are left as the OS default
+		if conn.readBuffer != s.ReadBufferSize || conn.writeBuffer != s.WriteBufferSize {
+			t.Fatalf("Buffer sizes set to %d and %d, expected %d and %d", conn.readBuffer, conn.writeBuffer, s.ReadBufferSize, s.WriteBufferSize)
+		}
+		sc.Close()
+		cc.Close()
+	}
+
+	// connections which cannot have their buffer sizes set are left alone
+	l, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025", ReadBufferSize: 1024 * 1024})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	l.setBufferSizes(sc)
+}
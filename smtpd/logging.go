@@ -65,6 +65,7 @@ var levelMap map[string]syslog.Priority = map[string]syslog.Priority{
 	"NOTICE":  syslog.LOG_NOTICE,
 	"INFO":    syslog.LOG_INFO,
 	"DEBUG":   syslog.LOG_DEBUG,
+	"TRACE":   syslog.LOG_DEBUG,
 }
 
 // Create a new syslog writer
@@ -100,7 +101,7 @@ func (s *SyslogWriter) Write(p []byte) (n int, err error) {
 		return ""
 	}))
 	switch level {
-	case "[DEBUG] ":
+	case "[DEBUG] ", "[TRACE] ":
 		s.w.Debug(tolog)
 	case "[INFO] ":
 		s.w.Info(tolog)
@@ -0,0 +1,32 @@
+package smtpd
+
+import (
+	"sync/atomic"
+)
+
+// Maintenance is a switch which, whilst on, makes listeners refuse each new connection with a
+// 421, so senders queue their mail and retry later rather than bounce it, whilst the listeners
+// stay up for monitoring. Sessions in progress are unaffected. The zero value is off
+type Maintenance struct {
+	on int32 // 1 if on (atomic)
+}
+
+// Set turns maintenance mode on or off
+func (m *Maintenance) Set(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&m.on, v)
+}
+
+// On returns true if maintenance mode is on. A nil Maintenance is always off
+func (m *Maintenance) On() bool {
+	return m != nil && atomic.LoadInt32(&m.on) != 0
+}
+
+// SetMaintenance sets the switch which puts the listener into maintenance mode, replacing any
+// set before. It must be called before Listen
+func (l *Listener) SetMaintenance(m *Maintenance) {
+	l.maintenance = m
+}
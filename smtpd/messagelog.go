@@ -0,0 +1,134 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MessageLogConfig has the configuration for the message log, an audit trail of each message
+// accepted or rejected, written as one JSON object per line for ingestion by other tools. It is
+// separate from the operational log configured by LogConfig
+type MessageLogConfig struct {
+	File           string // a file to write records to
+	FileMode       string // file mode (default 0644)
+	SyslogFacility string // a syslog facility name to send records to instead of a file
+}
+
+// messageRecord is the JSON record written to the message log for each message
+type messageRecord struct {
+	Time         time.Time `json:"time"`
+	ConnectionID uint64    `json:"connection_id"`
+	RemoteIP     string    `json:"remote_ip"`
+	TLS          bool      `json:"tls"`
+	AuthIdentity string    `json:"auth_identity,omitempty"`
+	Sender       string    `json:"sender"`     // the reverse path (empty for the null sender)
+	Recipients   []string  `json:"recipients"` // the forward paths accepted
+	Size         int       `json:"size"`       // the size in bytes (0 if not received in full)
+	Accepted     bool      `json:"accepted"`
+	Code         int       `json:"code"`               // the final response code
+	QueueID      string    `json:"queue_id,omitempty"` // the queue ID given in the response, if any
+}
+
+// queueIDRE matches the queue ID given in the response to an accepted message, by convention
+// (as Postfix does) in the form "queued as ID"
+var queueIDRE = regexp.MustCompile(`(?i)queued as ([^\s,;]+)`)
+
+// MessageLog is an EventHandler writing a record of each message accepted or rejected in
+// response to DATA to the message log. Each record is a single write of a line of JSON, so is
+// complete once HandleEvent returns. It may be used by several listeners concurrently
+type MessageLog struct {
+	mu sync.Mutex
+	w  io.Writer // where records are written (nil to discard them)
+}
+
+// NewMessageLog returns a new MessageLog writing to w, which may be nil to discard records
+func NewMessageLog(w io.Writer) *MessageLog {
+	return &MessageLog{w: w}
+}
+
+// SetOutput replaces the writer records are written to, which may be nil to discard them
+func (m *MessageLog) SetOutput(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.w = w
+}
+
+// HandleEvent writes a record of a message event, ignoring other events
+func (m *MessageLog) HandleEvent(e *Event) {
+	if e.Type != EventMessageAccepted && e.Type != EventMessageRejected {
+		return
+	}
+	r := &messageRecord{
+		Time:         e.Time.UTC(),
+		ConnectionID: e.ConnectionID,
+		TLS:          e.TLS,
+		AuthIdentity: e.AuthIdentity,
+		Sender:       e.Sender.String(),
+		Recipients:   make([]string, len(e.Recipients)),
+		Size:         e.Size,
+		Accepted:     e.Type == EventMessageAccepted,
+		Code:         e.Code,
+	}
+	if e.RemoteAddr != nil {
+		r.RemoteIP = e.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(r.RemoteIP); err == nil {
+			r.RemoteIP = host
+		}
+	}
+	for i, recipient := range e.Recipients {
+		r.Recipients[i] = recipient.String()
+	}
+	if match := queueIDRE.FindStringSubmatch(e.Response); r.Accepted && match != nil {
+		r.QueueID = match[1]
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.w != nil {
+		m.w.Write(buf)
+	}
+}
+
+// GetMessageLog opens the destination of the message log, returning a nil writer if it is not
+// configured
+func (c *Config) GetMessageLog() (io.Writer, io.Closer, error) {
+	if c.MessageLog.File != "" {
+		mode := os.FileMode(0644)
+		if c.MessageLog.FileMode != "" {
+			if i, err := strconv.ParseInt(c.MessageLog.FileMode, 8, 32); err != nil {
+				return nil, nil, fmt.Errorf("Cannot read message log file mode: %v", err)
+			} else {
+				mode = os.FileMode(i)
+			}
+		}
+		if file, err := os.OpenFile(c.MessageLog.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, mode); err != nil {
+			return nil, nil, err
+		} else {
+			return file, file, nil
+		}
+	}
+	if c.MessageLog.SyslogFacility != "" {
+		f, ok := facilityMap[c.MessageLog.SyslogFacility]
+		if !ok {
+			return nil, nil, fmt.Errorf("Bad message log syslog facility: '%s'", c.MessageLog.SyslogFacility)
+		}
+		if w, err := syslog.New(f|syslog.LOG_INFO, "goms"); err != nil {
+			return nil, nil, err
+		} else {
+			return w, w, nil
+		}
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,146 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessageLog(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025"})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	var buf bytes.Buffer
+	l.SetEventHandler(NewMessageLog(&buf))
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	tc.itp.r = NewResponse(250, "2.0.0 OK: queued as 4F2A1C")
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	for _, recipient := range []string{"c@d", "e@f"} {
+		if err := tc.client.Rcpt(recipient); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Message not accepted: %v", err)
+		}
+	}
+	tc.itp.r = nil
+	if err := tc.client.Mail(""); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("g@h"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	tc.itp.r = NewResponse(554, "5.7.1 Error: rejected")
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("body\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		checkSinkCode(t, writer.Close(), 554, "data")
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatalf("Cannot send quit to server: %v", err)
+	}
+	tc.client = nil // don't attempt Close()
+	<-tc.done
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %q", buf.String())
+	}
+	// each record is a self-contained JSON object
+	for _, line := range lines {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("Bad record %q: %v", line, err)
+		}
+		for _, field := range []string{"time", "connection_id", "remote_ip", "tls", "sender", "recipients", "size", "accepted", "code"} {
+			if _, ok := fields[field]; !ok {
+				t.Fatalf("Record %q lacks %s", line, field)
+			}
+		}
+	}
+
+	var accepted, rejected messageRecord
+	json.Unmarshal([]byte(lines[0]), &accepted)
+	json.Unmarshal([]byte(lines[1]), &rejected)
+	if !accepted.Accepted || accepted.Code != 250 || accepted.QueueID != "4F2A1C" || accepted.Sender != "a@b" ||
+		strings.Join(accepted.Recipients, " ") != "c@d e@f" || accepted.Size != len("Subject: test\r\n\r\nbody\r\n") ||
+		accepted.ConnectionID != tc.ic.ID() || accepted.TLS || accepted.Time.IsZero() {
+		t.Fatalf("Wrong record of accepted message: %+v", accepted)
+	}
+	if rejected.Accepted || rejected.Code != 554 || rejected.QueueID != "" || rejected.Sender != "" ||
+		strings.Join(rejected.Recipients, " ") != "g@h" || rejected.ConnectionID != accepted.ConnectionID {
+		t.Fatalf("Wrong record of rejected message: %+v", rejected)
+	}
+}
+
+func TestMessageLogConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without a destination, records are discarded
+	c := &Config{}
+	if w, closer, err := c.GetMessageLog(); w != nil || closer != nil || err != nil {
+		t.Fatalf("Message log opened without a destination: %v %v %v", w, closer, err)
+	}
+
+	c.MessageLog.SyslogFacility = "wombat"
+	if _, _, err := c.GetMessageLog(); err == nil {
+		t.Fatalf("Accepted bad syslog facility")
+	}
+
+	fn := filepath.Join(dir, "messages.json")
+	c.MessageLog = MessageLogConfig{File: fn}
+	w, closer, err := c.GetMessageLog()
+	if err != nil {
+		t.Fatalf("Could not open message log: %v", err)
+	}
+	address := AddressString("a@b")
+	m := NewMessageLog(w)
+	m.HandleEvent(&Event{Type: EventConnectionOpened})
+	m.HandleEvent(&Event{Type: EventMessageAccepted, Sender: address, Recipients: []*AddressString{&address}, Code: 250})
+	closer.Close()
+
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatalf("Could not open message log: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	records := 0
+	for scanner.Scan() {
+		var r messageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Sender != "a@b" || !r.Accepted {
+			t.Fatalf("Bad record %q: %v", scanner.Text(), err)
+		}
+		records++
+	}
+	if records != 1 {
+		t.Fatalf("Expected 1 record, got %d", records)
+	}
+}
@@ -0,0 +1,85 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultMessages holds the default text of rejection responses, keyed by the identifier used to
+// override them in the configuration (e.g. to add an abuse contact). The text excludes the response
+// code and enhanced status code, which cannot be changed
+var defaultMessages = map[string]string{
+	"shutdown":           "Service not available, closing transmission channel",
+	"maintenance":        "Service temporarily unavailable, try later",
+	"earlytalker":        "Error: you talked before I said hello",
+	"ehlodisabled":       "Error: command not recognized",
+	"tlsrequired":        "Must issue a STARTTLS command first",
+	"tlsactive":          "Error: TLS already active",
+	"requiretls":         "REQUIRETLS support required",
+	"authrequired":       "Authentication required",
+	"authencryption":     "Encryption required for requested authentication mechanism",
+	"authactive":         "Error: already authenticated",
+	"authintransaction":  "Error: AUTH not permitted during a mail transaction",
+	"badmechanism":       "Error: unrecognized authentication type",
+	"authcancelled":      "Authentication cancelled",
+	"authfailed":         "Error: authentication failed",
+	"authunavailable":    "Temporary authentication failure",
+	"nestedmail":         "Error: nested MAIL commands",
+	"badsenderformat":    "Error: bad envelope sender address format",
+	"badsender":          "Error: bad envelope sender address component",
+	"nomailbeforercpt":   "Error: missing MAIL command before RCPT",
+	"badrecipientformat": "Error: bad envelope recepient address format",
+	"badrecipient":       "Error: bad envelope recepient address component",
+	"nullrecipient":      "Error: recipient address may not be null",
+	"relaydenied":        "Error: relay access denied",
+	"nosmtputf8":         "Error: SMTPUTF8 not supported by the destination",
+	"nodeliverby":        "Error: DELIVERBY not supported by the destination",
+	"nomailbeforedata":   "Error: missing MAIL command before DATA",
+	"norecipients":       "Error: no valid recipients",
+	"toobig":             "Error: message too big for system",
+	"toomanyheaders":     "Error: too many headers",
+	"nostorage":          "Error: insufficient system storage",
+	"localerror":         "Error: local error in processing",
+	"queuefull":          "Insufficient system storage",
+	"etrnintransaction":  "Error: ETRN not permitted during a mail transaction",
+	"xforwardinmail":     "Error: MAIL transaction in progress",
+	"notauthorized":      "Error: insufficient authorization",
+	"badetrn":            "Error: bad ETRN parameter syntax",
+	"notimplemented":     "Error: command not implemented",
+	"badsyntax":          "Error: bad syntax",
+	"unknowncommand":     "Error: command unknown",
+	"toomanyunknown":     "Too many unrecognised commands, closing connection",
+	"linetoolong":        "Error: invalid line length",
+	"controlchars":       "Error: control characters in command",
+	"eightbit":           "Error: 8-bit characters not permitted in command",
+	"reversedns":         "Reverse DNS validation failed",
+	"denied":             "Error: access denied",
+	"upstreamfailed":     "Error: upstream server unavailable",
+}
+
+// newMessages returns the table of rejection texts with the overrides given applied
+func newMessages(overrides map[string]string) (map[string]string, error) {
+	messages := make(map[string]string, len(defaultMessages))
+	for id, text := range defaultMessages {
+		messages[id] = text
+	}
+	for id, text := range overrides {
+		if _, ok := defaultMessages[id]; !ok {
+			return nil, fmt.Errorf("Unknown message: '%s'", id)
+		}
+		if text == "" || strings.ContainsAny(text, "\r\n") {
+			return nil, fmt.Errorf("Bad text for message '%s'", id)
+		}
+		messages[id] = text
+	}
+	return messages, nil
+}
+
+// message returns the text of a rejection response prefixed by the enhanced status code given
+func (c *InboundConnection) message(status string, id string) string {
+	text, ok := c.params.Messages[id]
+	if !ok {
+		text = defaultMessages[id]
+	}
+	return status + " " + text
+}
@@ -0,0 +1,57 @@
+package smtpd
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestMessagesOverride(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Messages: map[string]string{"toobig": "Error: too big, see https://example.com/abuse"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	tc := newTestConnectionWithListener(t, l, nil)
+	defer tc.Close()
+	tc.ic.params.MaxMessageSize = 1024
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte(strings.Repeat("A line of text\r\n", 100))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err == nil {
+			t.Fatalf("Oversize message accepted")
+		} else if e, ok := err.(*textproto.Error); !ok || e.Code != 552 || e.Msg != "5.3.4 Error: too big, see https://example.com/abuse" {
+			t.Fatalf("Expected overridden 552, got %v", err)
+		}
+	}
+
+	// other messages are unchanged
+	if code, msg, err := tc.client.Cmd(250, "WOMBAT"); err == nil || code != 500 || msg != "5.5.2 Error: command unknown" {
+		t.Fatalf("Expected default 500 for unknown command, got %d %s: %v", code, msg, err)
+	}
+}
+
+func TestMessagesBadConfig(t *testing.T) {
+	if _, err := newMessages(map[string]string{"wombat": "Error: wombat"}); err == nil {
+		t.Fatalf("Accepted unknown message")
+	}
+	if _, err := newMessages(map[string]string{"toobig": "Error: too\r\nbig"}); err == nil {
+		t.Fatalf("Accepted message with line break")
+	}
+}
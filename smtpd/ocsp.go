@@ -0,0 +1,131 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	ocspDefaultRefresh = time.Hour
+	ocspMaxResponse    = 1024 * 1024 // maximum size of an OCSP response we accept
+)
+
+// ocspStapler maintains the OCSP staple of a listener's default certificate, loading it from a
+// file or fetching it from the issuer's OCSP responder
+type ocspStapler struct {
+	file     string               // file holding a DER encoded OCSP response
+	url      string               // URL of the OCSP responder
+	refresh  time.Duration        // interval between refreshes
+	selector *certificateSelector // the certificates whose default we staple
+}
+
+// newOCSPStapler returns a stapler for the selector's default certificate, or nil if OCSP
+// stapling is not configured
+func newOCSPStapler(t TlsConfig, selector *certificateSelector) (*ocspStapler, error) {
+	if t.OcspStapleFile == "" && t.OcspResponderURL == "" {
+		return nil, nil
+	}
+	s := &ocspStapler{
+		file:     t.OcspStapleFile,
+		url:      t.OcspResponderURL,
+		refresh:  ocspDefaultRefresh,
+		selector: selector,
+	}
+	if t.OcspRefresh != "" {
+		if d, err := time.ParseDuration(t.OcspRefresh); err != nil || d <= 0 {
+			return nil, fmt.Errorf("Bad OCSP refresh interval: '%s'", t.OcspRefresh)
+		} else {
+			s.refresh = d
+		}
+	}
+	if _, err := issuer(selector.defaultCertificate()); s.url != "" && err != nil {
+		return nil, fmt.Errorf("Cannot fetch OCSP staple: %v", err)
+	}
+	return s, nil
+}
+
+// issuer returns the issuer of a certificate, which must be the second in its chain
+func issuer(cert *tls.Certificate) (*x509.Certificate, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("Certificate file does not contain the issuer")
+	}
+	return x509.ParseCertificate(cert.Certificate[1])
+}
+
+// load reads the OCSP response for a certificate from the file or responder
+func (s *ocspStapler) load(ctx context.Context, leaf *x509.Certificate, issuer *x509.Certificate) ([]byte, error) {
+	if s.file != "" {
+		return ioutil.ReadFile(s.file)
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancelFunc := context.WithTimeout(ctx, 30*time.Second)
+	defer cancelFunc()
+	httpReq, err := http.NewRequest("POST", s.url, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: ocspMaxResponse})
+}
+
+// update loads the OCSP response and staples it to the default certificate if it is valid
+// and says the certificate is good
+func (s *ocspStapler) update(ctx context.Context) error {
+	cert := s.selector.defaultCertificate()
+	// without the issuer we can still staple from a file, but cannot check the signature
+	issuer, _ := issuer(cert)
+	staple, err := s.load(ctx, cert.Leaf, issuer)
+	if err != nil {
+		return err
+	}
+	resp, err := ocsp.ParseResponseForCert(staple, cert.Leaf, issuer)
+	if err != nil {
+		return err
+	}
+	if resp.Status != ocsp.Good {
+		return fmt.Errorf("OCSP status of certificate is not good (%d)", resp.Status)
+	}
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return errors.New("OCSP response has expired")
+	}
+	s.selector.setStaple(cert.Leaf, staple)
+	return nil
+}
+
+// run refreshes the staple periodically until ctx is done, logging any failures; the
+// previous staple (if any) remains in use until it is successfully replaced
+func (s *ocspStapler) run(ctx context.Context, logger *log.Logger) {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.update(ctx); err != nil {
+				logger.Printf("[WARN] Could not refresh OCSP staple: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestOCSPFixture writes a certificate chain signed by a test CA, and an OCSP response
+// for it with the status given, returning the paths of the chain and the response
+func writeTestOCSPFixture(t *testing.T, dir string, status int) (string, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Could not create CA certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mail.example.com"},
+		DNSNames:     []string{"mail.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})...)
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	chainFile := filepath.Join(dir, "chain.pem")
+	if err := ioutil.WriteFile(chainFile, chain, 0600); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+
+	staple, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+		Status:       status,
+		SerialNumber: template.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, crypto.Signer(caKey))
+	if err != nil {
+		t.Fatalf("Could not create OCSP response: %v", err)
+	}
+	stapleFile := filepath.Join(dir, "staple.der")
+	if err := ioutil.WriteFile(stapleFile, staple, 0600); err != nil {
+		t.Fatalf("Could not write OCSP response: %v", err)
+	}
+	return chainFile, stapleFile
+}
+
+// servedStaple performs a TLS handshake with the config given and returns the OCSP staple served
+func servedStaple(t *testing.T, config *tls.Config) []byte {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	sc.SetDeadline(time.Now().Add(5 * time.Second))
+	cc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go tls.Server(sc, config).Handshake()
+
+	client := tls.Client(cc, &tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	return client.ConnectionState().OCSPResponse
+}
+
+func TestOCSPStapleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	chainFile, stapleFile := writeTestOCSPFixture(t, dir, ocsp.Good)
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls:      TlsConfig{KeyFile: chainFile, ServerName: "mail.example.com", OcspStapleFile: stapleFile},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	staple, _ := ioutil.ReadFile(stapleFile)
+	if served := servedStaple(t, l.tlsconfig); !bytes.Equal(served, staple) {
+		t.Fatalf("OCSP staple not served")
+	}
+}
+
+func TestOCSPStapleRevoked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	chainFile, stapleFile := writeTestOCSPFixture(t, dir, ocsp.Revoked)
+
+	// a bad staple is logged, and the listener works without one
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls:      TlsConfig{KeyFile: chainFile, ServerName: "mail.example.com", OcspStapleFile: stapleFile},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	if served := servedStaple(t, l.tlsconfig); len(served) != 0 {
+		t.Fatalf("Revoked OCSP staple served")
+	}
+}
@@ -0,0 +1,108 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// privilegeDropper drops privileges once every listener has attempted to bind, so ports below
+// 1024 can be bound as root without any connection being accepted as root. It also changes the
+// root directory, as this too requires root
+type privilegeDropper struct {
+	uid     int            // user ID to run as
+	gid     int            // group ID to run as
+	chroot  string         // directory to change root to (blank for none)
+	pending sync.WaitGroup // listeners yet to attempt to bind
+	dropped chan struct{}  // closed once privileges have been dropped (or dropping failed)
+	err     error          // the result of dropping privileges, valid once dropped is closed
+}
+
+// newPrivilegeDropper returns a privilegeDropper which will change root to chroot (if not blank),
+// then change to the user and group IDs given
+func newPrivilegeDropper(uid, gid int, chroot string) *privilegeDropper {
+	return &privilegeDropper{
+		uid:     uid,
+		gid:     gid,
+		chroot:  chroot,
+		dropped: make(chan struct{}),
+	}
+}
+
+// expect records a listener which must attempt to bind before privileges are dropped
+func (p *privilegeDropper) expect() {
+	p.pending.Add(1)
+}
+
+// bound records that a listener has attempted to bind, whether or not it succeeded
+func (p *privilegeDropper) bound() {
+	p.pending.Done()
+}
+
+// drop waits for every expected listener to attempt to bind, then drops privileges, releasing
+// the listeners waiting to accept connections
+func (p *privilegeDropper) drop(logger *log.Logger) error {
+	p.pending.Wait()
+	if p.chroot != "" {
+		if p.err = changeRoot(p.chroot); p.err != nil {
+			close(p.dropped)
+			return p.err
+		}
+		logger.Printf("[INFO] Changed root to %s", p.chroot)
+	}
+	if p.err = setCredentials(p.uid, p.gid); p.err == nil {
+		logger.Printf("[INFO] Running as uid %d, gid %d", p.uid, p.gid)
+	}
+	close(p.dropped)
+	return p.err
+}
+
+// wait blocks until privileges have been dropped, returning an error if this failed or ctx is done
+func (p *privilegeDropper) wait(ctx context.Context) error {
+	select {
+	case <-p.dropped:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lookupCredentials returns the user and group IDs for the user and group given, each of which
+// may be a name or a numeric ID. If the group is blank, the user's primary group is used; if the
+// user is blank, the user ID is left unchanged
+func lookupCredentials(userName, groupName string) (int, int, error) {
+	uid := os.Getuid()
+	gid := os.Getgid()
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Bad user: '%s'", userName)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("Bad user: '%s'", userName)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, fmt.Errorf("Bad user: '%s'", userName)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Bad group: '%s'", groupName)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("Bad group: '%s'", groupName)
+		}
+	}
+	return uid, gid, nil
+}
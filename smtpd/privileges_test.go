@@ -0,0 +1,133 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+const (
+	gomsprivaction = "GOMS_PRIV_ACTION"
+	gomschrootdir  = "GOMS_CHROOT_DIR"
+)
+
+func TestLookupCredentials(t *testing.T) {
+	if uid, gid, err := lookupCredentials("", ""); err != nil || uid != os.Getuid() || gid != os.Getgid() {
+		t.Fatalf("Blank credentials changed: %d %d %v", uid, gid, err)
+	}
+	if _, _, err := lookupCredentials("no-such-user-goms", ""); err == nil {
+		t.Fatalf("Unknown user accepted")
+	}
+	if _, _, err := lookupCredentials("", "no-such-group-goms"); err == nil {
+		t.Fatalf("Unknown group accepted")
+	}
+	if u, err := user.Current(); err == nil {
+		if uid, _, err := lookupCredentials(u.Uid, ""); err != nil || strconv.Itoa(uid) != u.Uid {
+			t.Fatalf("Numeric user ID not accepted: %d %v", uid, err)
+		}
+	}
+}
+
+// TestDropPrivileges drops privileges in a child process, as they cannot be regained
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv(gomsprivaction) == "drop" {
+		testDropPrivilegesChild(t)
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("Not running as root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("No user 'nobody'")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestDropPrivileges", "-test.v")
+	cmd.Env = append(os.Environ(), gomsprivaction+"=drop")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Dropping privileges failed: %v\n%s", err, out)
+	}
+}
+
+func testDropPrivilegesChild(t *testing.T) {
+	uid, gid, err := lookupCredentials("nobody", "")
+	if err != nil {
+		t.Fatalf("Could not look up credentials: %v", err)
+	}
+
+	privileges := newPrivilegeDropper(uid, gid, "")
+	privileges.expect()
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30044",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.privileges = privileges
+	defer startListener(l)()
+
+	if err := privileges.drop(newTestLogger(t)); err != nil {
+		t.Fatalf("Could not drop privileges: %v", err)
+	}
+	if os.Getuid() != uid || os.Geteuid() != uid || os.Getgid() != gid || os.Getegid() != gid {
+		t.Fatalf("Wrong credentials: uid %d euid %d gid %d egid %d", os.Getuid(), os.Geteuid(), os.Getgid(), os.Getegid())
+	}
+	if groups, err := os.Getgroups(); err != nil || len(groups) != 1 || groups[0] != gid {
+		t.Fatalf("Wrong supplementary groups: %v %v", groups, err)
+	}
+
+	// the listener bound before privileges were dropped still accepts connections
+	client := dialTestListener(t, "127.0.0.1:30044")
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
+
+// TestChroot changes root in a child process, as this cannot be undone
+func TestChroot(t *testing.T) {
+	if os.Getenv(gomsprivaction) == "chroot" {
+		testChrootChild(t, os.Getenv(gomschrootdir))
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("Not running as root")
+	}
+
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "jail"), 0755); err != nil {
+		t.Fatalf("Could not create chroot directory: %v", err)
+	}
+	writeConfig(t, "inside", filepath.Join(dir, "jail", "inside"))
+	writeConfig(t, "outside", filepath.Join(dir, "outside"))
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestChroot", "-test.v")
+	cmd.Env = append(os.Environ(), gomsprivaction+"=chroot", gomschrootdir+"="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Changing root failed: %v\n%s", err, out)
+	}
+}
+
+func testChrootChild(t *testing.T, dir string) {
+	privileges := newPrivilegeDropper(os.Getuid(), os.Getgid(), filepath.Join(dir, "jail"))
+	if err := privileges.drop(newTestLogger(t)); err != nil {
+		t.Fatalf("Could not change root: %v", err)
+	}
+	if buf, err := ioutil.ReadFile("/inside"); err != nil || string(buf) != "inside" {
+		t.Fatalf("Cannot read file inside chroot: %v", err)
+	}
+	if wd, err := os.Getwd(); err != nil || wd != "/" {
+		t.Fatalf("Wrong working directory: %s %v", wd, err)
+	}
+	for _, path := range []string{filepath.Join(dir, "outside"), "../outside", "/../outside"} {
+		if _, err := os.Stat(path); err == nil {
+			t.Fatalf("File outside chroot is accessible as %s", path)
+		}
+	}
+}
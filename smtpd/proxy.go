@@ -0,0 +1,342 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyDefaultTimeout = 30 * time.Second
+	proxyDefaultHello   = "localhost"
+)
+
+// proxySession is a connection to the upstream server on behalf of one inbound connection
+type proxySession struct {
+	conn       net.Conn          // the connection to the upstream
+	text       *textproto.Conn   // the upstream conversation
+	timeout    time.Duration     // timeout for each upstream command
+	extensions map[string]string // the extensions the upstream advertised in EHLO, with their parameters
+}
+
+// ProxyITP is an InboundTransactionProcessor which relays each transaction to an upstream
+// SMTP server, returning the upstream's responses to the client. This allows goms to act as
+// a policy-enforcing front end. The upstream connection is made when the first MAIL command
+// is accepted, and is closed with the inbound connection. Upstream failures give a 451. MAIL
+// parameters are relayed where the upstream advertises their extension (see mailParameters)
+type ProxyITP struct {
+	protocol string                               // the upstream's protocol
+	address  string                               // the upstream's address
+	hello    string                               // the name we give the upstream in EHLO
+	timeout  time.Duration                        // timeout for connecting and for each command
+	mutex    sync.Mutex                           // protects sessions
+	sessions map[*InboundConnection]*proxySession // upstream sessions by inbound connection
+}
+
+// NewProxyITP returns a new ProxyITP from the configuration supplied
+func NewProxyITP(p ProxyConfig) (*ProxyITP, error) {
+	protocol := p.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	timeout := proxyDefaultTimeout
+	if p.Timeout != "" {
+		if d, err := time.ParseDuration(p.Timeout); err != nil || d <= 0 {
+			return nil, fmt.Errorf("Bad proxy timeout: '%s'", p.Timeout)
+		} else {
+			timeout = d
+		}
+	}
+	hello := p.Hello
+	if hello == "" {
+		hello = proxyDefaultHello
+	}
+	return &ProxyITP{
+		protocol: protocol,
+		address:  p.Address,
+		hello:    hello,
+		timeout:  timeout,
+		sessions: make(map[*InboundConnection]*proxySession),
+	}, nil
+}
+
+// upstreamFailure returns the response sent to the client when the upstream fails
+func upstreamFailure(c *InboundConnection) *ICResponse {
+	return NewResponse(451, c.message("4.4.0", "upstreamfailed"))
+}
+
+// relayResponse converts a response from the upstream (with lines separated by newlines, as
+// returned by textproto) into a response for the client
+func relayResponse(code int, msg string) *ICResponse {
+	lines := strings.Split(msg, "\n")
+	r := NewResponse(code, lines[0])
+	for _, line := range lines[1:] {
+		r.Line(code, line)
+	}
+	if code == 421 {
+		// RFC5321 3.8, the upstream is closing the transmission channel, so we close the client's
+		r.Final()
+	}
+	return r
+}
+
+// upstreamResponse converts an error from the upstream into a response for the client. Error
+// responses from the upstream are relayed; anything else (e.g. a broken connection) gives a 451
+func upstreamResponse(c *InboundConnection, err error) *ICResponse {
+	if e, ok := err.(*textproto.Error); ok && e.Code >= 400 && e.Code <= 599 {
+		return relayResponse(e.Code, e.Msg)
+	}
+	c.logger.Printf("[WARN] Upstream failed for %s: %v", c.name, err)
+	return upstreamFailure(c)
+}
+
+// deadline sets the deadline for the next exchange with the upstream: the timeout, or ctx's
+// deadline if sooner. Until the returned function is called, ctx is watched, and the deadline
+// moved into the past if it is cancelled, so the inbound connection never waits on the upstream
+// once it is done
+func (s *proxySession) deadline(ctx context.Context) func() {
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	s.conn.SetDeadline(deadline)
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			s.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-finished
+	}
+}
+
+// cmd sends a command to the upstream and reads the response, giving up once ctx is done
+func (s *proxySession) cmd(ctx context.Context, expectCode int, format string, args ...interface{}) (int, string, error) {
+	defer s.deadline(ctx)()
+	id, err := s.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	s.text.StartResponse(id)
+	defer s.text.EndResponse(id)
+	return s.text.ReadResponse(expectCode)
+}
+
+// close closes the upstream session, quitting politely if possible
+func (s *proxySession) close() {
+	s.cmd(context.Background(), 221, "QUIT")
+	s.text.Close()
+}
+
+// dial connects to the upstream and greets it
+func (i *ProxyITP) dial(ctx context.Context) (*proxySession, error) {
+	d := net.Dialer{Timeout: i.timeout}
+	conn, err := d.DialContext(ctx, i.protocol, i.address)
+	if err != nil {
+		return nil, err
+	}
+	s := &proxySession{
+		conn:       conn,
+		text:       textproto.NewConn(conn),
+		timeout:    i.timeout,
+		extensions: make(map[string]string),
+	}
+	stop := s.deadline(ctx)
+	_, _, err = s.text.ReadResponse(220)
+	stop()
+	if err != nil {
+		s.text.Close()
+		return nil, err
+	}
+	if _, msg, err := s.cmd(ctx, 250, "EHLO %s", i.hello); err != nil {
+		// no extensions are available after HELO
+		if _, _, err := s.cmd(ctx, 250, "HELO %s", i.hello); err != nil {
+			s.text.Close()
+			return nil, err
+		}
+	} else {
+		// RFC5321 4.1.1.1, the first line is the greeting and each other names an extension
+		for _, line := range strings.Split(msg, "\n")[1:] {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) == 2 {
+				s.extensions[strings.ToUpper(fields[0])] = fields[1]
+			} else {
+				s.extensions[strings.ToUpper(fields[0])] = ""
+			}
+		}
+	}
+	return s, nil
+}
+
+// supports returns true if the upstream advertised the extension named
+func (s *proxySession) supports(extension string) bool {
+	_, ok := s.extensions[extension]
+	return ok
+}
+
+// mailParameters returns the MAIL parameters (with a leading space) to relay the current
+// transaction upstream: those of the client's the upstream supports. If the transaction
+// cannot be relayed as the upstream lacks an extension it requires, the response to give the
+// client is returned instead
+func (s *proxySession) mailParameters(c *InboundConnection) (string, *ICResponse) {
+	var params []string
+	if c.RequireTLS() {
+		// RFC8689 5, we never use TLS upstream
+		return "", NewResponse(550, c.message("5.7.30", "requiretls"))
+	}
+	if c.SMTPUTF8() {
+		// RFC6531 3.4, we cannot downgrade the message
+		if !s.supports("SMTPUTF8") {
+			return "", c.UTF8NotSupported()
+		}
+		params = append(params, "SMTPUTF8")
+	}
+	if by := c.DeliverBy(); by != nil {
+		if s.supports("DELIVERBY") {
+			// RFC2852 4, pass on the time remaining (rounding down)
+			remaining := int64(math.Floor(by.Deadline.Sub(c.clock().Now()).Seconds()))
+			mode := "N"
+			if by.Return {
+				mode = "R"
+			}
+			if by.Trace {
+				mode += "T"
+			}
+			params = append(params, fmt.Sprintf("BY=%d;%s", remaining, mode))
+		} else if by.Return {
+			// RFC2852 4, a message to be returned may not be relayed without the deadline
+			return "", NewResponse(555, c.message("5.5.4", "nodeliverby"))
+		}
+		// RFC2852 4, otherwise it may be relayed without it
+	}
+	if size := c.DeclaredSize(); size > 0 && s.supports("SIZE") {
+		params = append(params, fmt.Sprintf("SIZE=%d", size))
+	}
+	if priority := c.Priority(); priority != 0 && s.supports("MT-PRIORITY") {
+		params = append(params, fmt.Sprintf("MT-PRIORITY=%d", priority))
+	}
+	if s.supports("AUTH") {
+		// RFC4954 5, giving <> where the submitter is not known (or the client not trusted)
+		if identity := c.AuthParameter(); identity != "" {
+			params = append(params, "AUTH="+encodeXtext(string(identity)))
+		} else {
+			params = append(params, "AUTH=<>")
+		}
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return " " + strings.Join(params, " "), nil
+}
+
+// session returns the upstream session for the connection, or nil if there is none
+func (i *ProxyITP) session(c *InboundConnection) *proxySession {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.sessions[c]
+}
+
+// dropSession closes and forgets the upstream session for the connection
+func (i *ProxyITP) dropSession(c *InboundConnection) {
+	i.mutex.Lock()
+	s := i.sessions[c]
+	delete(i.sessions, c)
+	i.mutex.Unlock()
+	if s != nil {
+		s.close()
+	}
+}
+
+// CheckConnection accepts all connections; the upstream is only contacted once there is mail
+func (i *ProxyITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	return nil, nil
+}
+
+// CheckFromAddress starts a transaction upstream, connecting if necessary
+func (i *ProxyITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	s := i.session(c)
+	if s != nil {
+		// abandon any previous transaction (e.g. one reset by the client)
+		if _, _, err := s.cmd(ctx, 250, "RSET"); err != nil {
+			c.logger.Printf("[WARN] Upstream %s failed for %s: %v", i.address, c.name, err)
+			i.dropSession(c)
+			s = nil
+		}
+	}
+	if s == nil {
+		var err error
+		if s, err = i.dial(ctx); err != nil {
+			c.logger.Printf("[WARN] Cannot connect to upstream %s for %s: %v", i.address, c.name, err)
+			return upstreamFailure(c), nil
+		}
+		i.mutex.Lock()
+		i.sessions[c] = s
+		i.mutex.Unlock()
+	}
+	params, r := s.mailParameters(c)
+	if r != nil {
+		return r, nil
+	}
+	if _, _, err := s.cmd(ctx, 250, "MAIL FROM:<%s>%s", *address, params); err != nil {
+		return upstreamResponse(c, err), nil
+	}
+	return nil, nil
+}
+
+// CheckRecipientAddress relays the recipient upstream
+func (i *ProxyITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	s := i.session(c)
+	if s == nil {
+		return upstreamFailure(c), nil
+	}
+	// accept 251 (user not local; will forward) as well as 250
+	if _, _, err := s.cmd(ctx, 25, "RCPT TO:<%s>", *address); err != nil {
+		return upstreamResponse(c, err), nil
+	}
+	return nil, nil
+}
+
+// ProcessMail relays the message upstream, returning the upstream's response
+func (i *ProxyITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	s := i.session(c)
+	if s == nil {
+		return upstreamFailure(c), nil
+	}
+	if _, _, err := s.cmd(ctx, 354, "DATA"); err != nil {
+		return upstreamResponse(c, err), nil
+	}
+	defer s.deadline(ctx)()
+	w := s.text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		c.logger.Printf("[WARN] Upstream %s failed for %s: %v", i.address, c.name, err)
+		i.dropSession(c)
+		return upstreamFailure(c), nil
+	}
+	if err := w.Close(); err != nil {
+		c.logger.Printf("[WARN] Upstream %s failed for %s: %v", i.address, c.name, err)
+		i.dropSession(c)
+		return upstreamFailure(c), nil
+	}
+	// the upstream's response is more useful than ours, as it will contain its queue ID
+	code, msg, err := s.text.ReadResponse(250)
+	if err != nil {
+		return upstreamResponse(c, err), nil
+	}
+	return relayResponse(code, msg), nil
+}
+
+// ConnectionClosed closes the upstream session when the inbound connection closes
+func (i *ProxyITP) ConnectionClosed(c *InboundConnection) {
+	i.dropSession(c)
+}
@@ -0,0 +1,274 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// UpstreamITP is the ITP of the upstream server in proxy tests. It refuses recipients
+// at 'refused', closes the connection for recipients at 'closing', and passes each message it receives with its envelope on a channel
+type UpstreamITP struct {
+	DummyITP
+	messages chan string
+}
+
+func (i *UpstreamITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	if *address == "user@refused" {
+		return NewResponse(550, "5.1.1 Error: upstream refused this recipient"), nil
+	} else if *address == "user@closing" {
+		return NewResponse(421, "4.3.2 Error: upstream closing").Final(), nil
+	}
+	return nil, nil
+}
+
+func (i *UpstreamITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	recipients := ""
+	for _, r := range c.Recipients() {
+		recipients += " " + r.String()
+	}
+	i.messages <- string(c.Sender()) + recipients + "\n" + string(data)
+	return NewResponse(250, "2.0.0 OK: queued upstream as 1234"), nil
+}
+
+func TestProxy(t *testing.T) {
+	upstream := &UpstreamITP{messages: make(chan string, 1)}
+	stopUpstream := startTestListener(t, newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30034"}, upstream)
+	defer stopUpstream()
+	stopProxy := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30035",
+		Proxy:    ProxyConfig{Address: "127.0.0.1:30034", Timeout: "5s"},
+	}, nil)
+	defer stopProxy()
+
+	client := dialTestListener(t, "127.0.0.1:30035")
+	defer client.Close()
+
+	// send two messages to check the upstream session is reused
+	for _, subject := range []string{"first", "second"} {
+		if err := client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := client.Rcpt("user@refused"); err == nil {
+			t.Fatalf("Recipient refused upstream was accepted")
+		} else if e, ok := err.(*textproto.Error); !ok || e.Code != 550 || e.Msg != "5.1.1 Error: upstream refused this recipient" {
+			t.Fatalf("Upstream refusal not relayed: %v", err)
+		}
+		if err := client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if writer, err := client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		} else {
+			if _, err := writer.Write([]byte("Subject: " + subject + "\r\n\r\n.leading dot\r\n")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Message not accepted: %v", err)
+			}
+		}
+		if msg := <-upstream.messages; msg != "a@b c@d\nSubject: "+subject+"\r\n\r\n.leading dot\r\n" {
+			t.Fatalf("Upstream received wrong message: %q", msg)
+		}
+	}
+
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
+
+func TestProxyUpstreamClosing(t *testing.T) {
+	upstream := &UpstreamITP{messages: make(chan string, 1)}
+	stopUpstream := startTestListener(t, newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30062"}, upstream)
+	defer stopUpstream()
+	stopProxy := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30063",
+		Proxy:    ProxyConfig{Address: "127.0.0.1:30062", Timeout: "5s"},
+	}, nil)
+	defer stopProxy()
+
+	client := dialTestListener(t, "127.0.0.1:30063")
+	defer client.Close()
+
+	if err := client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := client.Rcpt("user@closing"); err == nil {
+		t.Fatalf("Recipient closing the upstream was accepted")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 421 || e.Msg != "4.3.2 Error: upstream closing" {
+		t.Fatalf("Upstream 421 not relayed: %v", err)
+	}
+	// the proxy closes the connection too
+	if err := client.Noop(); err == nil {
+		t.Fatalf("Connection still open after the upstream's 421")
+	}
+}
+
+func TestProxyContext(t *testing.T) {
+	conn, upstream := net.Pipe()
+	defer upstream.Close()
+	// the upstream reads commands but never answers
+	go io.Copy(ioutil.Discard, upstream)
+	s := &proxySession{conn: conn, text: textproto.NewConn(conn), timeout: time.Minute}
+	defer s.text.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err := s.cmd(ctx, 250, "NOOP"); err == nil {
+		t.Fatalf("Command succeeded without an answer")
+	} else if time.Since(start) > 10*time.Second {
+		t.Fatalf("Command not abandoned when its context was cancelled")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, _, err := s.cmd(ctx, 250, "NOOP"); err == nil {
+		t.Fatalf("Command succeeded without an answer")
+	} else if time.Since(start) > 10*time.Second {
+		t.Fatalf("Command not abandoned at its context's deadline")
+	}
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	stopProxy := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30036",
+		Proxy:    ProxyConfig{Address: "127.0.0.1:30037", Timeout: "1s"},
+	}, nil)
+	defer stopProxy()
+
+	client := dialTestListener(t, "127.0.0.1:30036")
+	defer client.Close()
+
+	if err := client.Mail("a@b"); err == nil {
+		t.Fatalf("Mail accepted with upstream down")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 451 {
+		t.Fatalf("Expected 451 with upstream down, got %v", err)
+	}
+}
+
+func TestProxyBadConfig(t *testing.T) {
+	if _, err := NewProxyITP(ProxyConfig{Address: "127.0.0.1:30037", Timeout: "wombat"}); err == nil {
+		t.Fatalf("Accepted bad proxy timeout")
+	}
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30036",
+		Proxy:    ProxyConfig{Address: "127.0.0.1:30037"},
+		Sink:     SinkConfig{Phase: "rcpt"},
+	}); err == nil {
+		t.Fatalf("Accepted proxy with sink")
+	}
+}
+
+// ParamsUpstreamITP is the ITP of the upstream server in proxy tests of MAIL parameters. It passes
+// the parameters of each transaction it sees on a channel, and accepts no recipients
+type ParamsUpstreamITP struct {
+	DummyITP
+	params chan string
+}
+
+func (i *ParamsUpstreamITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	by := ""
+	if d := c.DeliverBy(); d != nil {
+		by = fmt.Sprintf(" return=%v trace=%v", d.Return, d.Trace)
+	}
+	i.params <- fmt.Sprintf("size=%d utf8=%v priority=%d%s", c.DeclaredSize(), c.SMTPUTF8(), c.Priority(), by)
+	return nil, nil
+}
+
+func TestProxyMailParameters(t *testing.T) {
+	upstream := &ParamsUpstreamITP{params: make(chan string, 1)}
+	stopUpstream := startTestListener(t, newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30057"}, upstream)
+	defer stopUpstream()
+	stopProxy := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30058",
+		Proxy:    ProxyConfig{Address: "127.0.0.1:30057", Timeout: "5s"},
+	}, nil)
+	defer stopProxy()
+
+	client := dialTestListener(t, "127.0.0.1:30058")
+	defer client.Close()
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to proxy: %v", err)
+	}
+	for _, test := range []struct {
+		params   string
+		upstream string // the parameters the upstream saw
+	}{
+		{"", "size=0 utf8=false priority=0"},
+		{"SIZE=1000 SMTPUTF8 MT-PRIORITY=-3", "size=1000 utf8=true priority=-3"},
+		{"BY=3600;RT", "size=0 utf8=false priority=0 return=true trace=true"},
+		{"BY=-10;N", "size=0 utf8=false priority=0 return=false trace=false"},
+	} {
+		if code, msg, err := client.Cmd(250, "MAIL FROM:<a@b> %s", test.params); err != nil {
+			t.Fatalf("MAIL with '%s' rejected, got %d %s: %v", test.params, code, msg, err)
+		}
+		if params := <-upstream.params; params != test.upstream {
+			t.Fatalf("Upstream saw '%s' for '%s', expected '%s'", params, test.params, test.upstream)
+		}
+		if err := client.Reset(); err != nil {
+			t.Fatalf("Cannot execute 'RSET': %v", err)
+		}
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+
+	// parameters the upstream does not advertise are dropped, or the transaction refused if they
+	// cannot be
+	limited := &ParamsUpstreamITP{params: make(chan string, 1)}
+	stopLimited := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol:             "tcp",
+		Address:              "127.0.0.1:30059",
+		SuppressCapabilities: []string{"SMTPUTF8", "DELIVERBY", "SIZE", "MT-PRIORITY"},
+	}, limited)
+	defer stopLimited()
+	stopLimitedProxy := startTestListener(t, newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30060",
+		Proxy:    ProxyConfig{Address: "127.0.0.1:30059", Timeout: "5s"},
+	}, nil)
+	defer stopLimitedProxy()
+
+	client = dialTestListener(t, "127.0.0.1:30060")
+	defer client.Close()
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to proxy: %v", err)
+	}
+	if code, msg, err := client.Cmd(250, "MAIL FROM:<a@b> SIZE=1000 MT-PRIORITY=3 BY=3600;N"); err != nil {
+		t.Fatalf("MAIL rejected, got %d %s: %v", code, msg, err)
+	}
+	if params := <-limited.params; params != "size=0 utf8=false priority=0" {
+		t.Fatalf("Upstream saw '%s', expected no parameters", params)
+	}
+	for _, test := range []struct {
+		params string
+		code   int
+		status string
+	}{
+		{"SMTPUTF8", 550, "5.6.7 "},
+		{"BY=3600;R", 555, "5.5.4 "},
+	} {
+		if err := client.Reset(); err != nil {
+			t.Fatalf("Cannot execute 'RSET': %v", err)
+		}
+		if code, msg, err := client.Cmd(250, "MAIL FROM:<a@b> %s", test.params); err == nil || code != test.code || !strings.HasPrefix(msg, test.status) {
+			t.Fatalf("Expected %d %sfor MAIL with '%s', got %d %s: %v", test.code, test.status, test.params, code, msg, err)
+		}
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Cannot send QUIT: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package smtpd
+
+import (
+	"context"
+	"sync"
+)
+
+// mailResult holds the result of processing a message
+type mailResult struct {
+	r   *ICResponse
+	err error
+}
+
+// mailJob is a message awaiting processing by a mailQueue worker
+type mailJob struct {
+	ctx    context.Context    // the session context
+	c      *InboundConnection // the connection that received the message
+	data   []byte             // the message
+	result chan mailResult    // the result of processing the message
+}
+
+// mailQueue is a bounded queue of messages awaiting processing by a pool of workers, which
+// call ProcessMail on each connection's ITP. This limits the number of concurrent calls to
+// ProcessMail; when the queue is full new messages are refused with a 452 rather than the
+// connection blocking
+//
+// A connection always waits for its message to be processed, so the ITP's response is sent
+// to the client and the message data remains valid until ProcessMail returns
+type mailQueue struct {
+	jobs    chan *mailJob  // the queue
+	workers int            // number of workers
+	wg      sync.WaitGroup // running workers
+}
+
+// newMailQueue returns a new mailQueue
+func newMailQueue(depth int, workers int) *mailQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &mailQueue{
+		jobs:    make(chan *mailJob, depth),
+		workers: workers,
+	}
+}
+
+// start starts the workers
+func (q *mailQueue) start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// stop stops the workers once the queue is drained. Nothing may be submitted after this is called
+func (q *mailQueue) stop() {
+	close(q.jobs)
+	q.wg.Wait()
+}
+
+// work processes jobs until the queue is closed
+func (q *mailQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		// do not process messages whose session has gone away whilst queued
+		if err := job.ctx.Err(); err != nil {
+			job.result <- mailResult{err: err}
+			continue
+		}
+		r, err := job.c.ITP.ProcessMail(job.ctx, job.c, job.data)
+		job.result <- mailResult{r: r, err: err}
+	}
+}
+
+// process queues a message, and waits for it to be processed. If the queue is full a 452
+// response is returned immediately
+func (q *mailQueue) process(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	job := &mailJob{
+		ctx:    ctx,
+		c:      c,
+		data:   data,
+		result: make(chan mailResult, 1),
+	}
+	select {
+	case q.jobs <- job:
+	default:
+		c.logger.Printf("[WARN] Queue full; deferring message from %s", c.name)
+		// RFC3463 3.4
+		return NewResponse(452, c.message("4.3.1", "queuefull")), nil
+	}
+	// we must wait even if ctx is cancelled, as the worker may be using data
+	result := <-job.result
+	return result.r, result.err
+}
@@ -0,0 +1,127 @@
+package smtpd
+
+import (
+	"context"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BlockingITP is an InboundTransactionProcessor whose ProcessMail blocks until released
+type BlockingITP struct {
+	DummyITP
+	started chan struct{} // receives a value when ProcessMail is entered
+	release chan struct{} // closed to release ProcessMail
+	mutex   sync.Mutex    // protects processed
+	count   int           // number of messages processed
+}
+
+// ProcessMail waits to be released, then counts the message
+func (i *BlockingITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.started <- struct{}{}
+	<-i.release
+	i.mutex.Lock()
+	i.count++
+	i.mutex.Unlock()
+	return nil, nil
+}
+
+// newQueueTestListener returns a listener with a running queue
+func newQueueTestListener(t *testing.T, depth int, workers int) *Listener {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:     "tcp",
+		Address:      "127.0.0.1:30025",
+		QueueDepth:   depth,
+		QueueWorkers: workers,
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.queue.start()
+	return l
+}
+
+// sendQueuedMessage sends a message over a new connection, returning the error from the end of DATA
+func sendQueuedMessage(t *testing.T, l *Listener, itp InboundTransactionProcessor) error {
+	tc := newTestConnectionWithListener(t, l, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Errorf("Cannot connect to server: %v", err)
+		return err
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Errorf("Cannot execute 'MAIL FROM': %v", err)
+		return err
+	}
+	if err := tc.client.Rcpt("a@b"); err != nil {
+		t.Errorf("Cannot execute 'RCPT TO': %v", err)
+		return err
+	}
+	writer, err := tc.client.Data()
+	if err != nil {
+		t.Errorf("Cannot execute 'DATA': %v", err)
+		return err
+	}
+	if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Errorf("Write failed: %v", err)
+		return err
+	}
+	return writer.Close()
+}
+
+func TestQueueSaturation(t *testing.T) {
+	l := newQueueTestListener(t, 1, 1)
+	defer l.queue.stop()
+
+	itp := &BlockingITP{
+		started: make(chan struct{}, 2),
+		release: make(chan struct{}),
+	}
+
+	results := make(chan error, 2)
+	// the first message occupies the only worker
+	go func() { results <- sendQueuedMessage(t, l, itp) }()
+	<-itp.started
+
+	// the second message fills the queue
+	go func() { results <- sendQueuedMessage(t, l, itp) }()
+	for i := 0; len(l.queue.jobs) == 0; i++ {
+		if i > 100 {
+			t.Fatalf("Second message was not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the third message should be refused
+	err := sendQueuedMessage(t, l, itp)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 452 {
+		t.Fatalf("Expected 452 with queue full, got %v", err)
+	}
+
+	close(itp.release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("Queued message failed: %v", err)
+		}
+	}
+	if itp.count != 2 {
+		t.Fatalf("Expected 2 messages processed, got %d", itp.count)
+	}
+}
+
+func TestQueueNormal(t *testing.T) {
+	l := newQueueTestListener(t, 10, 2)
+	defer l.queue.stop()
+
+	itp := &TestITP{}
+	for i := 0; i < 5; i++ {
+		if err := sendQueuedMessage(t, l, itp); err != nil {
+			t.Fatalf("Could not send message %d: %v", i, err)
+		}
+		if string(itp.data) != "Subject: test\r\n\r\nbody\r\n" {
+			t.Fatalf("Message %d not processed correctly: %q", i, itp.data)
+		}
+	}
+}
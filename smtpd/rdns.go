@@ -0,0 +1,132 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Resolver performs the DNS lookups used to check the client's reverse DNS. It is satisfied
+// by *net.Resolver, and may be replaced (e.g. for testing) using Listener.SetResolver
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// rdnsResult holds the result of a reverse DNS lookup
+type rdnsResult struct {
+	name     string // the first PTR name (or the verified name), without the trailing dot
+	verified bool   // true if the name resolves back to the client's address
+}
+
+// temporaryDNSError returns true if err is a DNS failure that may succeed later (e.g. a timeout
+// or SERVFAIL), as opposed to the name not existing
+func temporaryDNSError(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return false
+	}
+	return true
+}
+
+// forwardConfirmedName looks up the PTR names for ip, and then looks up each name in turn
+// to find one which resolves back to ip (FCrDNS)
+func forwardConfirmedName(ctx context.Context, resolver Resolver, ip net.IP) (rdnsResult, error) {
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return rdnsResult{}, err
+	}
+	if len(names) == 0 {
+		return rdnsResult{}, nil
+	}
+	var forwardErr error
+	for _, name := range names {
+		if addrs, err := resolver.LookupIPAddr(ctx, name); err != nil {
+			if temporaryDNSError(err) {
+				forwardErr = err
+			}
+		} else {
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					return rdnsResult{name: strings.TrimSuffix(name, "."), verified: true}, nil
+				}
+			}
+		}
+	}
+	// we could not confirm the name, but it may be confirmed once DNS recovers
+	return rdnsResult{name: strings.TrimSuffix(names[0], ".")}, forwardErr
+}
+
+// lookupRemoteHostname performs a forward-confirmed reverse DNS lookup of the client address
+// ip, storing the result on the connection. The lookup is abandoned after the configured
+// timeout even if the resolver does not honour its context, so DNS cannot stall the connection.
+// Timeouts and other temporary DNS failures are recorded so they are not treated as permanent
+func (c *InboundConnection) lookupRemoteHostname(ctx context.Context, ip net.IP) {
+	resolver := c.params.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancelFunc := context.WithTimeout(ctx, c.params.ReverseDNSTimeout)
+	defer cancelFunc()
+
+	type lookup struct {
+		result rdnsResult
+		err    error
+	}
+	done := make(chan lookup, 1)
+	go func() {
+		result, err := forwardConfirmedName(ctx, resolver, ip)
+		done <- lookup{result: result, err: err}
+	}()
+
+	select {
+	case l := <-done:
+		if l.err != nil {
+			c.logger.Printf("[DEBUG] Reverse DNS lookup for %s failed: %v", ip, l.err)
+			c.remoteHostnameTempFail = temporaryDNSError(l.err)
+		}
+		c.remoteHostname = l.result.name
+		c.remoteHostnameVerified = l.result.verified
+	case <-ctx.Done():
+		c.logger.Printf("[WARN] Reverse DNS lookup for %s timed out", ip)
+		c.remoteHostnameTempFail = true
+	}
+}
+
+// RemoteHostname returns the client's hostname from reverse DNS, and whether it has been
+// verified by resolving it back to the client's address. If reverse DNS is disabled, or
+// the client has no PTR record, the name is empty. Policies should only trust verified names
+func (c *InboundConnection) RemoteHostname() (string, bool) {
+	return c.remoteHostname, c.remoteHostnameVerified
+}
+
+// checkReverseDNS returns a response rejecting the client if strict reverse DNS checking is
+// enabled and it lacks forward-confirmed reverse DNS, or nil if it is acceptable. DNS failures
+// give a temporary rejection so a resolver problem does not bounce legitimate mail
+func (c *InboundConnection) checkReverseDNS() *ICResponse {
+	if c.remoteHostnameVerified {
+		return nil
+	}
+	if c.remoteHostnameTempFail {
+		return NewResponse(451, c.message("4.7.25", "reversedns")).Final()
+	}
+	// RFC7372 3.3
+	return NewResponse(550, c.message("5.7.25", "reversedns")).Final()
+}
+
+// reverseDNSExempt returns true if ip is exempt from strict reverse DNS checking
+func (c *InboundConnection) reverseDNSExempt(ip net.IP) bool {
+	for _, n := range c.params.ReverseDNSExempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the client's IP address, or nil if it does not have one (e.g. on a unix socket)
+func (c *InboundConnection) remoteIP() net.IP {
+	if addr, ok := c.plainConn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// stubResolver is a Resolver answering from fixed tables. If block is set, lookups wait
+// for the context to be done
+type stubResolver struct {
+	ptr   map[string][]string
+	hosts map[string][]net.IPAddr
+	block bool
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if r.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// newRDNSTestConnection returns a connection (which is not served) using the resolver given
+func newRDNSTestConnection(t *testing.T, resolver Resolver) *InboundConnection {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:          "tcp",
+		Address:           "127.0.0.1:30025",
+		ReverseDNS:        true,
+		ReverseDNSTimeout: "100ms",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	l.SetResolver(resolver)
+	c, _ := newInboundConnection(l, newTestLogger(t), nil)
+	return c
+}
+
+func TestReverseDNSMatch(t *testing.T) {
+	c := newRDNSTestConnection(t, &stubResolver{
+		ptr:   map[string][]string{"2001:db8::1": []string{"mx.example.com."}},
+		hosts: map[string][]net.IPAddr{"mx.example.com.": []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}}},
+	})
+	c.lookupRemoteHostname(context.Background(), net.ParseIP("2001:db8::1"))
+	if name, verified := c.RemoteHostname(); name != "mx.example.com" || !verified {
+		t.Fatalf("Expected verified mx.example.com, got %s %v", name, verified)
+	}
+}
+
+func TestReverseDNSMismatch(t *testing.T) {
+	c := newRDNSTestConnection(t, &stubResolver{
+		ptr:   map[string][]string{"192.0.2.1": []string{"forged.example.com."}},
+		hosts: map[string][]net.IPAddr{"forged.example.com.": []net.IPAddr{{IP: net.ParseIP("192.0.2.99")}}},
+	})
+	c.lookupRemoteHostname(context.Background(), net.ParseIP("192.0.2.1"))
+	if name, verified := c.RemoteHostname(); name != "forged.example.com" || verified {
+		t.Fatalf("Expected unverified forged.example.com, got %s %v", name, verified)
+	}
+}
+
+func TestReverseDNSTimeout(t *testing.T) {
+	c := newRDNSTestConnection(t, &stubResolver{block: true})
+	start := time.Now()
+	c.lookupRemoteHostname(context.Background(), net.ParseIP("192.0.2.1"))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Reverse DNS took %v despite timeout", elapsed)
+	}
+	if name, verified := c.RemoteHostname(); name != "" || verified {
+		t.Fatalf("Expected no name after timeout, got %s %v", name, verified)
+	}
+}
+
+// RDNSITP refuses connections without verified reverse DNS
+type RDNSITP struct {
+	DummyITP
+}
+
+func (i *RDNSITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	if name, verified := c.RemoteHostname(); !verified || name != "localhost.example.com" {
+		return NewResponse(550, "5.7.1 Error: no reverse DNS"), nil
+	}
+	return nil, nil
+}
+
+// dialReverseDNS starts a listener with the config, ITP and resolver given, and returns
+// the result of connecting to it
+func dialReverseDNS(t *testing.T, s ServerConfig, itp InboundTransactionProcessor, resolver Resolver) error {
+	l, err := NewListener(newTestLogger(t), s)
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	if itp != nil {
+		l.SetITP(itp)
+	}
+	l.SetResolver(resolver)
+	defer startListener(l)()
+
+	conn, err := dialWithRetries(s.Address)
+	if err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	// a rejection in the greeting is returned
+	client, err := smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return client.Quit()
+}
+
+// localResolver resolves 127.0.0.1 to a forward-confirmed name
+var localResolver = &stubResolver{
+	ptr:   map[string][]string{"127.0.0.1": []string{"localhost.example.com."}},
+	hosts: map[string][]net.IPAddr{"localhost.example.com.": []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}},
+}
+
+func TestReverseDNSCheckConnection(t *testing.T) {
+	if err := dialReverseDNS(t, ServerConfig{
+		Protocol:   "tcp",
+		Address:    "127.0.0.1:30031",
+		ReverseDNS: true,
+	}, &RDNSITP{}, localResolver); err != nil {
+		t.Fatalf("Connection refused despite verified reverse DNS: %v", err)
+	}
+}
+
+func TestReverseDNSStrict(t *testing.T) {
+	s := ServerConfig{
+		Protocol:         "tcp",
+		Address:          "127.0.0.1:30032",
+		ReverseDNSStrict: true,
+	}
+	if err := dialReverseDNS(t, s, nil, localResolver); err != nil {
+		t.Fatalf("Connection refused despite verified reverse DNS: %v", err)
+	}
+	if err := dialReverseDNS(t, s, nil, &stubResolver{}); err == nil {
+		t.Fatalf("Connection accepted without reverse DNS")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 550 {
+		t.Fatalf("Expected 550 without reverse DNS, got %v", err)
+	}
+
+	s.ReverseDNSTimeout = "100ms"
+	if err := dialReverseDNS(t, s, nil, &stubResolver{block: true}); err == nil {
+		t.Fatalf("Connection accepted despite DNS timeout")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 451 {
+		t.Fatalf("Expected 451 on DNS timeout, got %v", err)
+	}
+}
+
+func TestReverseDNSExempt(t *testing.T) {
+	if err := dialReverseDNS(t, ServerConfig{
+		Protocol:         "tcp",
+		Address:          "127.0.0.1:30033",
+		ReverseDNSStrict: true,
+		ReverseDNSExempt: []string{"10.0.0.0/8", "127.0.0.0/8"},
+	}, nil, &stubResolver{}); err != nil {
+		t.Fatalf("Exempt connection refused: %v", err)
+	}
+
+	if _, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol:         "tcp",
+		Address:          "127.0.0.1:30033",
+		ReverseDNSExempt: []string{"wombat"},
+	}); err == nil {
+		t.Fatalf("Accepted bad reverse DNS exemption")
+	}
+}
@@ -0,0 +1,31 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+)
+
+// errFreeSpaceUnsupported is returned by freeSpace on platforms where it is not implemented
+var errFreeSpaceUnsupported = errors.New("Free space check not supported on this platform")
+
+// SpoolSpaceChecker is a ResourceChecker which refuses messages when the filesystem holding a
+// spool directory is low on space. It may be embedded in an InboundTransactionProcessor. On
+// platforms where free space cannot be determined, all messages are accepted
+type SpoolSpaceChecker struct {
+	Path         string // the spool directory
+	MinFreeBytes uint64 // the free space below which messages are refused
+}
+
+// CheckResources refuses the message with a 452 if the spool is low on space
+func (s *SpoolSpaceChecker) CheckResources(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	if free, err := freeSpace(s.Path); err == errFreeSpaceUnsupported {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if free < s.MinFreeBytes {
+		c.logger.Printf("[WARN] Only %d bytes free in %s; deferring message from %s", free, s.Path, c.name)
+		// RFC3463 3.4
+		return NewResponse(452, c.message("4.3.1", "nostorage")), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,89 @@
+package smtpd
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+// LowResourcesITP refuses all messages as if resources were low
+type LowResourcesITP struct {
+	DummyITP
+}
+
+func (i *LowResourcesITP) CheckResources(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	return NewResponse(452, "4.3.1 Insufficient system storage"), nil
+}
+
+// SpoolITP checks the free space on its spool
+type SpoolITP struct {
+	DummyITP
+	SpoolSpaceChecker
+}
+
+// sendToResourceITP sends a message to an ITP, returning the error from DATA
+func sendToResourceITP(t *testing.T, itp InboundTransactionProcessor) error {
+	tc := newTestConnectionWithITP(t, itp)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Hello("localhost"); err != nil {
+		t.Fatalf("Cannot say hello to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	writer, err := tc.client.Data()
+	if err == nil {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		err = writer.Close()
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+	return err
+}
+
+func TestCheckResources(t *testing.T) {
+	if err := sendToResourceITP(t, &LowResourcesITP{}); err == nil {
+		t.Fatalf("DATA accepted with low resources")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 452 || !strings.HasPrefix(e.Msg, "4.3.1 ") {
+		t.Fatalf("Expected 452 4.3.1 with low resources, got %v", err)
+	}
+}
+
+func TestSpoolSpaceChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := freeSpace(dir); err == errFreeSpaceUnsupported {
+		t.Skip("Free space check not supported")
+	} else if err != nil {
+		t.Fatalf("Could not check free space: %v", err)
+	}
+
+	if err := sendToResourceITP(t, &SpoolITP{SpoolSpaceChecker: SpoolSpaceChecker{Path: dir}}); err != nil {
+		t.Fatalf("Message refused with sufficient space: %v", err)
+	}
+	if err := sendToResourceITP(t, &SpoolITP{SpoolSpaceChecker: SpoolSpaceChecker{Path: dir, MinFreeBytes: math.MaxUint64}}); err == nil {
+		t.Fatalf("Message accepted with insufficient space")
+	} else if e, ok := err.(*textproto.Error); !ok || e.Code != 452 || !strings.HasPrefix(e.Msg, "4.3.1 ") {
+		t.Fatalf("Expected 452 4.3.1 with insufficient space, got %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package smtpd
+
+import (
+	"syscall"
+)
+
+// reusePortControl is nil as SO_REUSEPORT is not supported on this platform
+var reusePortControl func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,54 @@
+package smtpd
+
+import (
+	"sync"
+)
+
+// SharedState holds state shared between the connections using an ITP, such as a greylist, rate
+// limiter or alias table, keyed by string. As an ITP is shared by all of a listener's connections,
+// its methods are called concurrently; SharedState does the locking, and may be embedded in an
+// ITP. Values must not be modified other than within Update. The zero value is ready to use
+type SharedState struct {
+	mutex  sync.Mutex
+	values map[string]interface{}
+}
+
+// Get returns the value stored for key, or nil if there is none
+func (s *SharedState) Get(key string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.values[key]
+}
+
+// Update calls f with the value stored for key (nil if there is none) and stores the value it
+// returns in its place, deleting the key if that is nil, returning the new value. No other access
+// to the state happens whilst f runs, so the read and the write are atomic; f must not itself use
+// the state
+func (s *SharedState) Update(key string, f func(value interface{}) interface{}) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value := f(s.values[key])
+	if value == nil {
+		delete(s.values, key)
+	} else {
+		if s.values == nil {
+			s.values = make(map[string]interface{})
+		}
+		s.values[key] = value
+	}
+	return value
+}
+
+// Delete removes the value stored for key, if any
+func (s *SharedState) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+}
+
+// Len returns the number of keys with values stored
+func (s *SharedState) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.values)
+}
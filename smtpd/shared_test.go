@@ -0,0 +1,112 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSharedState(t *testing.T) {
+	s := &SharedState{}
+	if v := s.Get("a"); v != nil || s.Len() != 0 {
+		t.Fatalf("Empty state has value %v", v)
+	}
+	increment := func(value interface{}) interface{} {
+		if value == nil {
+			return 1
+		}
+		return value.(int) + 1
+	}
+	s.Update("a", increment)
+	if v := s.Update("a", increment); v != 2 || s.Get("a") != 2 || s.Len() != 1 {
+		t.Fatalf("Wrong value after update: %v", v)
+	}
+	if v := s.Update("a", func(value interface{}) interface{} { return nil }); v != nil || s.Get("a") != nil || s.Len() != 0 {
+		t.Fatalf("Value not deleted by update: %v", v)
+	}
+	s.Update("b", increment)
+	s.Delete("b")
+	if s.Get("b") != nil || s.Len() != 0 {
+		t.Fatalf("Value not deleted")
+	}
+}
+
+// GreylistITP temporarily rejects the first attempt to send from each sender to each recipient,
+// accepting later attempts
+type GreylistITP struct {
+	DummyITP
+	SharedState
+	rejected int64 // the number of recipients rejected
+	accepted int64 // the number of recipients accepted
+}
+
+func (i *GreylistITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	seen := i.Update(string(c.Sender())+" "+address.String(), func(value interface{}) interface{} {
+		if value == nil {
+			return false
+		}
+		return true
+	})
+	if !seen.(bool) {
+		atomic.AddInt64(&i.rejected, 1)
+		return NewResponse(450, "4.7.1 Error: greylisted, try again later"), nil
+	}
+	atomic.AddInt64(&i.accepted, 1)
+	return nil, nil
+}
+
+func TestSharedITP(t *testing.T) {
+	const (
+		connections  = 20
+		transactions = 10
+		recipients   = 5
+	)
+	itp := &GreylistITP{}
+	l, err := NewListener(newTestLogger(t), ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30025"})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < connections; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tc := newTestConnectionWithListener(t, l, itp)
+			defer tc.Close()
+			if err := tc.Connect(); err != nil {
+				t.Errorf("Cannot connect to server: %v", err)
+				return
+			}
+			for i := 0; i < transactions; i++ {
+				if err := tc.client.Mail("a@b"); err != nil {
+					t.Errorf("Cannot execute 'MAIL FROM': %v", err)
+					return
+				}
+				if err := tc.client.Rcpt(fmt.Sprintf("r%d@example.com", i%recipients)); err != nil {
+					if e, ok := err.(*textproto.Error); !ok || e.Code != 450 {
+						t.Errorf("Cannot execute 'RCPT TO': %v", err)
+						return
+					}
+				}
+				if err := tc.client.Reset(); err != nil {
+					t.Errorf("Cannot execute 'RSET': %v", err)
+					return
+				}
+			}
+			if err := tc.client.Quit(); err != nil {
+				t.Errorf("Cannot send quit to server: %v", err)
+			}
+			tc.client = nil // don't attempt Close()
+		}()
+	}
+	wg.Wait()
+
+	// exactly one attempt for each recipient was greylisted, however the attempts interleaved
+	if itp.rejected != recipients || itp.accepted != connections*transactions-recipients || itp.Len() != recipients {
+		t.Fatalf("Wrong greylisting: %d rejected, %d accepted, %d entries", itp.rejected, itp.accepted, itp.Len())
+	}
+}
@@ -0,0 +1,57 @@
+package smtpd
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout is the maximum time to wait for sessions to finish on shutdown, unless
+// configured otherwise
+const defaultShutdownTimeout = 30 * time.Second
+
+// sessionSet tracks the sessions in progress across every listener, so any still running when
+// the shutdown timeout expires can be closed. A nil sessionSet tracks nothing
+type sessionSet struct {
+	mu    sync.Mutex
+	conns map[*InboundConnection]struct{}
+}
+
+// newSessionSet returns a new, empty, sessionSet
+func newSessionSet() *sessionSet {
+	return &sessionSet{conns: make(map[*InboundConnection]struct{})}
+}
+
+// add records a session which has started
+func (s *sessionSet) add(c *InboundConnection) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = struct{}{}
+}
+
+// remove records that a session has finished
+func (s *sessionSet) remove(c *InboundConnection) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+// closeAll closes the connection of every session in progress, returning how many there were.
+// A session whose ITP is hung may not finish even so, but its client is released
+func (s *sessionSet) closeAll() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		// TLS runs over the plain connection, so closing it closes both
+		c.plainConn.Close()
+	}
+	return len(s.conns)
+}
@@ -0,0 +1,89 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// sinkPhase is a phase of the SMTP conversation at which a SinkITP responds
+type sinkPhase int
+
+const (
+	sinkPhaseConnect sinkPhase = iota
+	sinkPhaseMail
+	sinkPhaseRcpt
+	sinkPhaseData
+)
+
+// Map of configuration text to sink phases
+var sinkPhaseMap = map[string]sinkPhase{
+	"connect": sinkPhaseConnect,
+	"mail":    sinkPhaseMail,
+	"rcpt":    sinkPhaseRcpt,
+	"data":    sinkPhaseData,
+}
+
+const (
+	sinkDefaultCode    = 554
+	sinkDefaultMessage = "5.7.1 Error: no service here"
+)
+
+// SinkITP is an InboundTransactionProcessor which returns a fixed response at a
+// configured phase of the conversation and accepts everything before it. It
+// discards all mail. This is useful for draining a port, honeypots and load testing
+type SinkITP struct {
+	phase    sinkPhase   // the phase at which we respond
+	response *ICResponse // the response to send
+}
+
+// NewSinkITP returns a new SinkITP from the configuration supplied
+func NewSinkITP(s SinkConfig) (*SinkITP, error) {
+	phase, ok := sinkPhaseMap[strings.ToLower(s.Phase)]
+	if !ok {
+		return nil, fmt.Errorf("Bad sink phase: '%s'", s.Phase)
+	}
+	code := s.Code
+	if code == 0 {
+		code = sinkDefaultCode
+	}
+	if code < 200 || code > 599 {
+		return nil, fmt.Errorf("Bad sink response code: %d", s.Code)
+	}
+	message := s.Message
+	if message == "" {
+		message = sinkDefaultMessage
+	}
+	return &SinkITP{
+		phase:    phase,
+		response: NewResponse(code, message),
+	}, nil
+}
+
+// respond returns the configured response if we are at the configured phase
+func (i *SinkITP) respond(phase sinkPhase) (*ICResponse, error) {
+	if phase != i.phase {
+		return nil, nil
+	}
+	return i.response, nil
+}
+
+// CheckConnection returns the configured response in the connect phase
+func (i *SinkITP) CheckConnection(ctx context.Context, c *InboundConnection) (*ICResponse, error) {
+	return i.respond(sinkPhaseConnect)
+}
+
+// CheckFromAddress returns the configured response in the mail phase
+func (i *SinkITP) CheckFromAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return i.respond(sinkPhaseMail)
+}
+
+// CheckRecipientAddress returns the configured response in the rcpt phase
+func (i *SinkITP) CheckRecipientAddress(ctx context.Context, c *InboundConnection, address *AddressString) (*ICResponse, error) {
+	return i.respond(sinkPhaseRcpt)
+}
+
+// ProcessMail returns the configured response in the data phase, and otherwise discards the mail
+func (i *SinkITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	return i.respond(sinkPhaseData)
+}
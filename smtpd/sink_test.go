@@ -0,0 +1,113 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newSinkTestConnection returns a test connection using a SinkITP parsed from the YAML supplied
+func newSinkTestConnection(t *testing.T, conf string) *TestConnection {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "goms.conf")
+	writeConfig(t, conf, fn)
+
+	c, err := ParseConfig(fn)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	l, err := NewListener(newTestLogger(t), c.Servers[0])
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	return newTestConnectionWithITP(t, l.itp)
+}
+
+// checkSinkCode checks err is an SMTP error with the code given
+func checkSinkCode(t *testing.T, err error, code int, desc string) {
+	if e, ok := err.(*textproto.Error); !ok || e.Code != code {
+		t.Fatalf("Expected %d at %s, got %v", code, desc, err)
+	}
+}
+
+func TestSinkConnect(t *testing.T) {
+	tc := newSinkTestConnection(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  sink:
+    phase: connect
+    code: 554
+    message: "5.7.1 Error: go away"
+`)
+	defer tc.Close()
+
+	checkSinkCode(t, tc.Connect(), 554, "connect")
+}
+
+func TestSinkRcpt(t *testing.T) {
+	tc := newSinkTestConnection(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  sink:
+    phase: rcpt
+    code: 550
+`)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	checkSinkCode(t, tc.client.Rcpt("a@b"), 550, "rcpt")
+}
+
+func TestSinkData(t *testing.T) {
+	tc := newSinkTestConnection(t, `
+servers:
+- protocol: tcp
+  address: 127.0.0.1:30025
+  sink:
+    phase: data
+    code: 451
+    message: "4.3.0 Error: try again later"
+`)
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	if err := tc.client.Rcpt("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		checkSinkCode(t, writer.Close(), 451, "data")
+	}
+}
+
+func TestSinkBadConfig(t *testing.T) {
+	if _, err := NewSinkITP(SinkConfig{Phase: "wombat"}); err == nil {
+		t.Fatalf("Accepted bad sink phase")
+	}
+	if _, err := NewSinkITP(SinkConfig{Phase: "data", Code: 999}); err == nil {
+		t.Fatalf("Accepted bad sink code")
+	}
+}
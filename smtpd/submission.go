@@ -0,0 +1,44 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// addMissingHeaders adds a Message-ID and a Date header to a message which lacks them, as a
+// submission server may (RFC6409 8.2 and 8.3). Headers already present are left alone
+func (c *InboundConnection) addMissingHeaders(body *bytes.Buffer) {
+	headers, _ := readHeaders(body.Bytes())
+	present := headerNames(headers)
+	var added bytes.Buffer
+	if !present["message-id"] {
+		if id, err := newMessageID(c.params.GreetingHostname, c.clock().Now()); err != nil {
+			c.logger.Printf("[ERROR] Could not generate Message-ID: %v", err)
+		} else {
+			fmt.Fprintf(&added, "Message-ID: %s\r\n", id)
+		}
+	}
+	if !present["date"] {
+		// RFC5322 3.3
+		fmt.Fprintf(&added, "Date: %s\r\n", c.clock().Now().Format(time.RFC1123Z))
+	}
+	if added.Len() == 0 {
+		return
+	}
+	added.Write(body.Bytes())
+	body.Reset()
+	body.Write(added.Bytes())
+}
+
+// newMessageID returns a new unique Message-ID in the domain given, generated at the time given
+// (RFC5322 3.6.4)
+func newMessageID(domain string, now time.Time) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%d.%s@%s>", now.Unix(), hex.EncodeToString(b), domain), nil
+}
@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"bytes"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddMissingHeaders(t *testing.T) {
+	c, _ := newInboundConnection(nil, newTestLogger(t), nil)
+	c.params.GreetingHostname = "mail.example.com"
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	c.params.Clock = newFakeClock(now)
+	messageIDRE := regexp.MustCompile(`^<1136214245\.[0-9a-f]+@mail\.example\.com>$`)
+
+	for _, test := range []struct {
+		body      string
+		messageID string // expected Message-ID, or "" if one should be generated
+		date      string // expected Date, or "" if one should be generated
+	}{
+		{"From: a@b\r\nSubject: test\r\n\r\nbody\r\n", "", ""},
+		{"From: a@b\r\nMessage-ID: <1@b>\r\n\r\nbody\r\n", "<1@b>", ""},
+		{"From: a@b\r\nDate: Mon, 02 Jan 2006 15:04:05 -0700\r\n\r\nbody\r\n", "", "Mon, 02 Jan 2006 15:04:05 -0700"},
+		{"message-id: <1@b>\r\ndate: Mon, 02 Jan 2006 15:04:05 -0700\r\nFrom: a@b\r\n\r\nbody\r\n", "<1@b>", "Mon, 02 Jan 2006 15:04:05 -0700"},
+	} {
+		body := bytes.NewBufferString(test.body)
+		c.addMissingHeaders(body)
+		msg, err := mail.ReadMessage(bytes.NewReader(body.Bytes()))
+		if err != nil {
+			t.Fatalf("Could not parse %q: %v", body.String(), err)
+		}
+		if ids := msg.Header["Message-Id"]; len(ids) != 1 {
+			t.Fatalf("Expected one Message-ID in %q", body.String())
+		} else if test.messageID != "" && ids[0] != test.messageID {
+			t.Fatalf("Existing Message-ID replaced in %q", body.String())
+		} else if test.messageID == "" && !messageIDRE.MatchString(ids[0]) {
+			t.Fatalf("Bad Message-ID generated: %s", ids[0])
+		}
+		if dates := msg.Header["Date"]; len(dates) != 1 {
+			t.Fatalf("Expected one Date in %q", body.String())
+		} else if test.date != "" && dates[0] != test.date {
+			t.Fatalf("Existing Date replaced in %q", body.String())
+		}
+		if date, err := msg.Header.Date(); err != nil {
+			t.Fatalf("Bad Date in %q: %v", body.String(), err)
+		} else if test.date == "" && !date.Equal(now) {
+			t.Fatalf("Date generated from the wrong clock: %v", date)
+		}
+		if !strings.HasSuffix(body.String(), "\r\n\r\nbody\r\n") {
+			t.Fatalf("Body altered: %q", body.String())
+		}
+	}
+}
+
+func TestNewMessageIDUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := newMessageID("example.com", time.Now())
+		if err != nil {
+			t.Fatalf("Could not generate Message-ID: %v", err)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicate Message-ID: %s", id)
+		}
+		seen[id] = true
+		if addr, err := mail.ParseAddress(strings.Trim(id, "<>")); err != nil || addr.Address != strings.Trim(id, "<>") {
+			t.Fatalf("Malformed Message-ID: %s", id)
+		}
+	}
+}
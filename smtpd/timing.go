@@ -0,0 +1,21 @@
+package smtpd
+
+import (
+	"fmt"
+	"time"
+)
+
+// TransactionTiming breaks down the time taken by a transaction whose message was received in full,
+// so slowness may be attributed to the client (FirstByte and Transfer) or to the server and ITP
+// (Processing). Times are taken from the connection's clock
+type TransactionTiming struct {
+	FirstByte  time.Duration // from the 354 response to DATA to the first line of the message
+	Transfer   time.Duration // from the first line of the message to its end
+	Processing time.Duration // from the end of the message to the response, including the content filter and ProcessMail
+	Total      time.Duration // from MAIL being accepted to the response to DATA
+}
+
+// String formats the timing as it is logged
+func (t *TransactionTiming) String() string {
+	return fmt.Sprintf("first-byte=%v transfer=%v processing=%v total=%v", t.FirstByte, t.Transfer, t.Processing, t.Total)
+}
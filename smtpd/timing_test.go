@@ -0,0 +1,83 @@
+package smtpd
+
+import (
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SlowITP advances the clock whilst processing mail, as a slow backend would take time
+type SlowITP struct {
+	DummyITP
+	clock *fakeClock
+	delay time.Duration
+}
+
+func (i *SlowITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.clock.Advance(i.delay)
+	return nil, nil
+}
+
+func TestTransactionTiming(t *testing.T) {
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	clock := newFakeClock(time.Now())
+	l.SetClock(clock)
+	recorder := &EventRecorder{}
+	l.SetEventHandler(recorder)
+	logs := &logBuffer{}
+	tc := newTestConnectionWithLogger(t, l, &SlowITP{clock: clock, delay: 3 * time.Second}, log.New(logs, "", 0))
+	defer tc.Close()
+
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("Cannot connect to server: %v", err)
+	}
+	if err := tc.client.Mail("a@b"); err != nil {
+		t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := tc.client.Rcpt("c@d"); err != nil {
+		t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+	}
+	if writer, err := tc.client.Data(); err != nil {
+		t.Fatalf("Cannot execute 'DATA': %v", err)
+	} else {
+		if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Message not accepted: %v", err)
+		}
+	}
+	if err := tc.client.Quit(); err != nil {
+		t.Fatal("Cannot send quit to server")
+	} else {
+		tc.client = nil // don't attempt Close()
+	}
+	<-tc.done
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	var timing *TransactionTiming
+	for _, e := range recorder.events {
+		if e.Type == EventMessageAccepted {
+			timing = e.Timing
+		}
+	}
+	if timing == nil {
+		t.Fatalf("No timing for the message")
+	}
+	if timing.FirstByte < 0 || timing.Transfer < 0 || timing.Processing != 3*time.Second || timing.Total < 4*time.Second {
+		t.Fatalf("Implausible timing: %v", timing)
+	}
+	if !strings.Contains(logs.String(), "[INFO] Timing of message from pipe (connection ") || !strings.Contains(logs.String(), " processing=3s total=") {
+		t.Fatalf("Timing not logged:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,202 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsDefaultReload is the default interval between checking certificate files for changes
+const tlsDefaultReload = time.Minute
+
+// certificateSource is a certificate and key pair loaded from files, which are reloaded when they change
+type certificateSource struct {
+	certFile  string           // path to the certificate file
+	keyFile   string           // path to the key file
+	hostnames []string         // hostnames configured for the certificate
+	modTime   time.Time        // latest modification time of the files when last loaded
+	cert      *tls.Certificate // the certificate
+}
+
+// certificateSelector chooses the certificate to present by the server name the client
+// requested with SNI, falling back to a default certificate. Certificates are reloaded
+// if their files change, so renewed certificates are used without a restart
+type certificateSelector struct {
+	mutex       sync.RWMutex                // protects the fields below
+	sources     []*certificateSource        // the certificates; the first is the default
+	staple      []byte                      // OCSP staple for the default certificate (nil if none)
+	byName      map[string]*tls.Certificate // certificates by lower case hostname, which may be a wildcard ("*.example.com")
+	defaultCert *tls.Certificate            // certificate used when no name matches
+}
+
+// loadCertificate loads a certificate and key pair, parsing the leaf certificate
+func loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// latestModTime returns the latest modification time of the source's files
+func (s *certificateSource) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, fn := range []string{s.certFile, s.keyFile} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load loads the source's certificate if its files have changed since it was last loaded,
+// returning it and the files' modification time. If they have not changed, the certificate is nil
+func (s *certificateSource) load() (*tls.Certificate, time.Time, error) {
+	modTime, err := s.latestModTime()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if s.cert != nil && !modTime.After(s.modTime) {
+		return nil, s.modTime, nil
+	}
+	cert, err := loadCertificate(s.certFile, s.keyFile)
+	return cert, modTime, err
+}
+
+// add adds a certificate for the hostnames given, or if there are none, for the DNS names
+// in the certificate. The first certificate added is the default
+func (s *certificateSelector) add(certFile string, keyFile string, hostnames []string) error {
+	if certFile == "" {
+		certFile = keyFile
+	}
+	source := &certificateSource{certFile: certFile, keyFile: keyFile, hostnames: hostnames}
+	cert, modTime, err := source.load()
+	if err != nil {
+		return err
+	}
+	source.cert = cert
+	source.modTime = modTime
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sources = append(s.sources, source)
+	s.build()
+	return nil
+}
+
+// build builds the map of hostnames to certificates. The mutex must be held
+func (s *certificateSelector) build() {
+	s.byName = make(map[string]*tls.Certificate)
+	s.defaultCert = nil
+	for i, source := range s.sources {
+		cert := source.cert
+		if i == 0 {
+			if s.staple != nil {
+				// copy rather than modify the certificate, as it may be in use by a handshake
+				stapled := *cert
+				stapled.OCSPStaple = s.staple
+				cert = &stapled
+			}
+			s.defaultCert = cert
+		}
+		hostnames := source.hostnames
+		if len(hostnames) == 0 {
+			hostnames = cert.Leaf.DNSNames
+		}
+		for _, name := range hostnames {
+			name = strings.ToLower(name)
+			if _, ok := s.byName[name]; !ok {
+				s.byName[name] = cert
+			}
+		}
+	}
+}
+
+// reload reloads any certificates whose files have changed, returning whether any certificate,
+// and whether the default certificate, has changed. If a certificate cannot be loaded, the
+// previous one remains in use
+func (s *certificateSelector) reload() (bool, bool, error) {
+	s.mutex.RLock()
+	sources := append([]*certificateSource{}, s.sources...)
+	s.mutex.RUnlock()
+
+	type loaded struct {
+		cert    *tls.Certificate
+		modTime time.Time
+	}
+	changed := make(map[*certificateSource]loaded)
+	var firstErr error
+	for _, source := range sources {
+		if cert, modTime, err := source.load(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if cert != nil {
+			changed[source] = loaded{cert: cert, modTime: modTime}
+		}
+	}
+	if len(changed) == 0 {
+		return false, false, firstErr
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for source, l := range changed {
+		source.cert = l.cert
+		source.modTime = l.modTime
+	}
+	_, defaultChanged := changed[s.sources[0]]
+	if defaultChanged {
+		// the staple is for the previous certificate
+		s.staple = nil
+	}
+	s.build()
+	return true, defaultChanged, firstErr
+}
+
+// defaultCertificate returns the default certificate
+func (s *certificateSelector) defaultCertificate() *tls.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.defaultCert
+}
+
+// setStaple sets the OCSP staple of the default certificate, provided it is still the
+// certificate with the leaf given
+func (s *certificateSelector) setStaple(leaf *x509.Certificate, staple []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sources[0].cert.Leaf != leaf {
+		return
+	}
+	s.staple = staple
+	s.build()
+}
+
+// getCertificate returns the certificate matching the ClientHello's server name. It is used
+// as tls.Config.GetCertificate
+func (s *certificateSelector) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	// a wildcard matches a single label only (RFC6125 6.4.3)
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.defaultCert, nil
+}
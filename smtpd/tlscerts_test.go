@@ -0,0 +1,157 @@
+package smtpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for the names given to dir, returning
+// the path of the file holding both the certificate and key
+func writeTestCertificate(t *testing.T, dir string, names ...string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	fn := filepath.Join(dir, names[0]+".pem")
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+	return fn
+}
+
+// servedCertificate performs a TLS handshake with the config given using the SNI name given, and
+// returns the first DNS name in the certificate served
+func servedCertificate(t *testing.T, config *tls.Config, serverName string) string {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	sc.SetDeadline(time.Now().Add(5 * time.Second))
+	cc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go tls.Server(sc, config).Handshake()
+
+	client := tls.Client(cc, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	return client.ConnectionState().PeerCertificates[0].DNSNames[0]
+}
+
+func TestTlsSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30025",
+		Tls: TlsConfig{
+			KeyFile:    writeTestCertificate(t, dir, "default.example.com"),
+			ServerName: "default.example.com",
+			Certificates: []TlsCertificate{
+				{KeyFile: writeTestCertificate(t, dir, "mail.example.org")},
+				{KeyFile: writeTestCertificate(t, dir, "mail.example.net"), Hostnames: []string{"*.example.net"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+
+	for _, test := range []struct{ sni, served string }{
+		{"mail.example.org", "mail.example.org"},
+		{"MAIL.EXAMPLE.ORG", "mail.example.org"},
+		{"smtp.example.net", "mail.example.net"},
+		{"a.b.example.net", "default.example.com"},
+		{"other.example.com", "default.example.com"},
+		{"", "default.example.com"},
+	} {
+		if served := servedCertificate(t, l.tlsconfig, test.sni); served != test.served {
+			t.Fatalf("Served %s for SNI name '%s', expected %s", served, test.sni, test.served)
+		}
+	}
+}
+
+func TestTlsReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "cert.pem")
+	if err := os.Rename(writeTestCertificate(t, dir, "old.example.com"), fn); err != nil {
+		t.Fatalf("Could not rename certificate: %v", err)
+	}
+
+	l, err := NewListener(newTestLogger(t), ServerConfig{
+		Protocol: "tcp",
+		Address:  "127.0.0.1:30038",
+		Tls:      TlsConfig{KeyFile: fn, ServerName: "mail.example.com", ReloadInterval: "20ms"},
+	})
+	if err != nil {
+		t.Fatalf("Could not create listener: %v", err)
+	}
+	defer startListener(l)()
+
+	if served := servedCertificate(t, l.tlsconfig, "mail.example.com"); served != "old.example.com" {
+		t.Fatalf("Served %s before reload", served)
+	}
+
+	// replace the certificate, ensuring its modification time changes
+	if err := os.Rename(writeTestCertificate(t, dir, "new.example.com"), fn); err != nil {
+		t.Fatalf("Could not rename certificate: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(fn, future, future)
+
+	served := ""
+	for retries := 0; retries < 100 && served != "new.example.com"; retries++ {
+		time.Sleep(20 * time.Millisecond)
+		served = servedCertificate(t, l.tlsconfig, "mail.example.com")
+	}
+	if served != "new.example.com" {
+		t.Fatalf("Served %s after reload", served)
+	}
+
+	// a broken certificate is ignored and the previous one is kept
+	if err := ioutil.WriteFile(fn, []byte("broken"), 0600); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+	future = future.Add(time.Minute)
+	os.Chtimes(fn, future, future)
+	time.Sleep(100 * time.Millisecond)
+	if served := servedCertificate(t, l.tlsconfig, "mail.example.com"); served != "new.example.com" {
+		t.Fatalf("Served %s after failed reload", served)
+	}
+}
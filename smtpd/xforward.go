@@ -0,0 +1,121 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// xforwardAttributes are the attributes an XFORWARD command may give, in the order advertised
+var xforwardAttributes = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE"}
+
+const (
+	maxXForwardValueLength = 255
+	xforwardUnavailable    = "[UNAVAILABLE]"
+	xforwardTempUnavail    = "[TEMPUNAVAIL]"
+)
+
+var (
+	xforwardNameRE  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+	xforwardPortRE  = regexp.MustCompile(`^[0-9]{1,5}$`)
+	xforwardIdentRE = regexp.MustCompile(`^[!-~]+$`)
+)
+
+// xforwardTrusted returns true if the client may use XFORWARD
+func (c *InboundConnection) xforwardTrusted() bool {
+	if ip := c.remoteIP(); ip != nil {
+		for _, n := range c.params.XForwardTrusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validXForward returns true if value is valid for the XFORWARD attribute given
+func validXForward(attribute, value string) bool {
+	known := false
+	for _, a := range xforwardAttributes {
+		known = known || a == attribute
+	}
+	if !known {
+		return false
+	}
+	if value == xforwardUnavailable || value == xforwardTempUnavail {
+		return true
+	}
+	switch attribute {
+	case "NAME":
+		return xforwardNameRE.MatchString(value)
+	case "ADDR":
+		return net.ParseIP(strings.TrimPrefix(strings.ToUpper(value), "IPV6:")) != nil
+	case "PORT":
+		return xforwardPortRE.MatchString(value)
+	case "PROTO":
+		return value == "SMTP" || value == "ESMTP"
+	case "HELO", "IDENT":
+		return xforwardIdentRE.MatchString(value)
+	case "SOURCE":
+		return value == "LOCAL" || value == "REMOTE"
+	}
+	return false
+}
+
+// doXFORWARD implements the XFORWARD command, by which a trusted upstream relay (e.g. Postfix)
+// gives the details of the client from which it received the message. The attributes apply to
+// the next transaction, and are cleared with it
+func (c *InboundConnection) doXFORWARD(ctx context.Context, params []byte) (*ICResponse, error) {
+	if !c.xforwardTrusted() {
+		return NewResponse(550, c.message("5.7.0", "notauthorized")), nil
+	}
+	if c.inTransaction {
+		return NewResponse(503, c.message("5.5.1", "xforwardinmail")), nil
+	}
+	fields := strings.Fields(string(bytes.TrimSpace(params)))
+	if len(fields) == 0 {
+		return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+	}
+	// validate every attribute before changing any
+	attributes := make(map[string]string)
+	for _, field := range fields {
+		i := strings.IndexByte(field, '=')
+		if i < 0 {
+			return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+		}
+		attribute := strings.ToUpper(field[:i])
+		value, ok := decodeXtext(field[i+1:])
+		if !ok || value == "" || len(value) > maxXForwardValueLength || !validXForward(attribute, value) {
+			return NewResponse(501, c.message("5.5.4", "badsyntax")), nil
+		}
+		attributes[attribute] = value
+	}
+	if c.xforward == nil {
+		c.xforward = make(map[string]string)
+	}
+	for attribute, value := range attributes {
+		if value == xforwardUnavailable || value == xforwardTempUnavail {
+			delete(c.xforward, attribute)
+		} else {
+			c.xforward[attribute] = value
+		}
+	}
+	c.logger.Printf("[INFO] XFORWARD from %s: %v", c.name, c.xforward)
+	return NewResponse(250, "2.0.0 OK"), nil
+}
+
+// XForward returns a copy of the attributes of the original client given by a trusted relay with
+// XFORWARD for the current transaction, keyed by attribute name (NAME, ADDR, PORT, PROTO, HELO,
+// IDENT or SOURCE). Attributes given as unavailable are absent. It is nil if there were none
+func (c *InboundConnection) XForward() map[string]string {
+	if c.xforward == nil {
+		return nil
+	}
+	attributes := make(map[string]string, len(c.xforward))
+	for attribute, value := range c.xforward {
+		attributes[attribute] = value
+	}
+	return attributes
+}
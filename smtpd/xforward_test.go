@@ -0,0 +1,162 @@
+package smtpd
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestValidXForward(t *testing.T) {
+	for _, test := range []struct {
+		attribute string
+		value     string
+		valid     bool
+	}{
+		{"NAME", "mail.example.com", true},
+		{"NAME", "[UNAVAILABLE]", true},
+		{"NAME", "bad_name.example.com", false},
+		{"ADDR", "192.0.2.1", true},
+		{"ADDR", "IPv6:2001:db8::1", true},
+		{"ADDR", "[TEMPUNAVAIL]", true},
+		{"ADDR", "192.0.2", false},
+		{"PORT", "25", true},
+		{"PORT", "port", false},
+		{"PROTO", "ESMTP", true},
+		{"PROTO", "LMTP", false},
+		{"HELO", "client.example.com", true},
+		{"IDENT", "abc123", true},
+		{"SOURCE", "REMOTE", true},
+		{"SOURCE", "ELSEWHERE", false},
+		{"OTHER", "value", false},
+		{"OTHER", "[UNAVAILABLE]", false},
+	} {
+		if valid := validXForward(test.attribute, test.value); valid != test.valid {
+			t.Fatalf("validXForward(%s, %s) gave %v, expected %v", test.attribute, test.value, valid, test.valid)
+		}
+	}
+}
+
+// XForwardITP records the XFORWARD attributes seen by ProcessMail
+type XForwardITP struct {
+	DummyITP
+	mutex    sync.Mutex
+	xforward map[string]string
+	envelope map[string]string
+}
+
+func (i *XForwardITP) ProcessMail(ctx context.Context, c *InboundConnection, data []byte) (*ICResponse, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.xforward = c.XForward()
+	i.envelope = c.envelope().XForward
+	return nil, nil
+}
+
+func TestXForward(t *testing.T) {
+	for _, trusted := range []bool{true, false} {
+		s := ServerConfig{Protocol: "tcp", Address: "127.0.0.1:30047", XForwardCIDRs: []string{"192.0.2.0/24"}}
+		if trusted {
+			s.XForwardCIDRs = []string{"127.0.0.0/8", "::1/128"}
+		}
+		l, err := NewListener(newTestLogger(t), s)
+		if err != nil {
+			t.Fatalf("Could not create listener: %v", err)
+		}
+		itp := &XForwardITP{}
+		l.SetITP(itp)
+		stop := startListener(l)
+
+		client := dialTestListener(t, s.Address)
+		if err := client.Hello("relay.example.com"); err != nil {
+			t.Fatalf("Cannot say hello to server: %v", err)
+		}
+		if ok, attributes := client.Extension("XFORWARD"); ok != trusted {
+			t.Fatalf("XFORWARD advertised %v to client trusted %v", ok, trusted)
+		} else if ok && attributes != "NAME ADDR PORT PROTO HELO IDENT SOURCE" {
+			t.Fatalf("Wrong XFORWARD attributes advertised: %s", attributes)
+		}
+
+		if !trusted {
+			if code, _, err := client.Cmd(250, "XFORWARD ADDR=192.0.2.1"); err == nil || code != 550 {
+				t.Fatalf("Expected 550 for XFORWARD from untrusted client, got %d %v", code, err)
+			}
+		} else {
+			for _, garbage := range []string{"", "ADDR", "ADDR=", "ADDR=notanaddress", "OTHER=x", "NAME=a NAME=b_c", "PROTO=+ZZ"} {
+				if code, _, err := client.Cmd(250, "XFORWARD %s", garbage); err == nil || code != 501 {
+					t.Fatalf("Expected 501 for XFORWARD %s, got %d %v", garbage, code, err)
+				}
+			}
+			if _, _, err := client.Cmd(250, "XFORWARD NAME=client.example.net ADDR=192.0.2.1 PROTO=ESMTP"); err != nil {
+				t.Fatalf("Cannot execute XFORWARD: %v", err)
+			}
+			if _, _, err := client.Cmd(250, "XFORWARD HELO=client+2Eexample.net IDENT=[UNAVAILABLE] SOURCE=REMOTE"); err != nil {
+				t.Fatalf("Cannot execute XFORWARD: %v", err)
+			}
+		}
+		if err := client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if trusted {
+			if code, _, err := client.Cmd(250, "XFORWARD NAME=other.example.net"); err == nil || code != 503 {
+				t.Fatalf("Expected 503 for XFORWARD in a transaction, got %d %v", code, err)
+			}
+		}
+		if err := client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if writer, err := client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		} else {
+			if _, err := writer.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Message not accepted: %v", err)
+			}
+		}
+
+		itp.mutex.Lock()
+		if !trusted {
+			if itp.xforward != nil {
+				t.Fatalf("XFORWARD attributes from untrusted client: %v", itp.xforward)
+			}
+		} else {
+			expected := map[string]string{"NAME": "client.example.net", "ADDR": "192.0.2.1", "PROTO": "ESMTP", "HELO": "client.example.net", "SOURCE": "REMOTE"}
+			if len(itp.xforward) != len(expected) || len(itp.envelope) != len(expected) {
+				t.Fatalf("Wrong XFORWARD attributes: %v", itp.xforward)
+			}
+			for attribute, value := range expected {
+				if itp.xforward[attribute] != value || itp.envelope[attribute] != value {
+					t.Fatalf("Wrong XFORWARD attribute %s: %s", attribute, itp.xforward[attribute])
+				}
+			}
+		}
+		itp.mutex.Unlock()
+
+		// the attributes apply only to the one transaction
+		if err := client.Mail("a@b"); err != nil {
+			t.Fatalf("Cannot execute 'MAIL FROM': %v", err)
+		}
+		if err := client.Rcpt("c@d"); err != nil {
+			t.Fatalf("Cannot execute 'RCPT TO': %v", err)
+		}
+		if writer, err := client.Data(); err != nil {
+			t.Fatalf("Cannot execute 'DATA': %v", err)
+		} else {
+			writer.Write([]byte("Subject: test\r\n\r\nbody\r\n"))
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Message not accepted: %v", err)
+			}
+		}
+		itp.mutex.Lock()
+		if itp.xforward != nil {
+			t.Fatalf("XFORWARD attributes kept for the next transaction: %v", itp.xforward)
+		}
+		itp.mutex.Unlock()
+
+		if err := client.Quit(); err != nil {
+			t.Fatalf("Cannot send quit to server: %v", err)
+		}
+		stop()
+	}
+}